@@ -0,0 +1,205 @@
+package main
+
+// チューニング用に、リアクションの書き込みをサーバ内から負荷をかけて計測する
+// デモモードでのみルーティングし、管理者トークンを持つリクエストだけを受け付ける
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	demoModeEnvKey   = "ISUCON13_DEMO_MODE"
+	adminTokenEnvKey = "ISUCON13_ADMIN_TOKEN"
+
+	maxBenchmarkReactionCount       = 10000
+	maxBenchmarkReactionConcurrency = 64
+	benchmarkReactionEmojiName      = ":benchmark:"
+)
+
+type ReactionBenchmarkResult struct {
+	Count       int     `json:"count"`
+	Concurrency int     `json:"concurrency"`
+	Errors      int     `json:"errors"`
+	ElapsedMs   float64 `json:"elapsed_ms"`
+	P50Ms       float64 `json:"p50_ms"`
+	P90Ms       float64 `json:"p90_ms"`
+	P99Ms       float64 `json:"p99_ms"`
+	MaxMs       float64 `json:"max_ms"`
+	// cleanup=true の場合に、計測後に削除したリアクションの件数
+	CleanedUp int64 `json:"cleaned_up"`
+}
+
+// isDemoMode はデモモードで起動しているかを返す
+func isDemoMode() bool {
+	v, _ := strconv.ParseBool(os.Getenv(demoModeEnvKey))
+	return v
+}
+
+// verifyAdmin は Authorization: Bearer <token> が管理者トークンと一致するかを確かめる
+// トークンが設定されていない場合は、誰も管理者として扱わない
+func verifyAdmin(c echo.Context) error {
+	token := os.Getenv(adminTokenEnvKey)
+	given, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if token == "" || !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return echo.NewHTTPError(http.StatusForbidden, "admin token is required")
+	}
+	return nil
+}
+
+// リアクション書き込みのベンチマークAPI (管理者向け)
+// POST /api/admin/benchmark/reactions?livestream_id=&count=&concurrency=&cleanup=
+// 配信者本人のリアクションとして count 件を concurrency 並列で書き込み、1件ごとの所要時間の分布を返す
+func postReactionBenchmarkHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.QueryParam("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id query parameter must be integer")
+	}
+	count, err := strconv.Atoi(c.QueryParam("count"))
+	if err != nil || count <= 0 || count > maxBenchmarkReactionCount {
+		return echo.NewHTTPError(http.StatusBadRequest, "count query parameter must be between 1 and "+strconv.Itoa(maxBenchmarkReactionCount))
+	}
+	concurrency := 1
+	if c.QueryParam("concurrency") != "" {
+		concurrency, err = strconv.Atoi(c.QueryParam("concurrency"))
+		if err != nil || concurrency <= 0 || concurrency > maxBenchmarkReactionConcurrency {
+			return echo.NewHTTPError(http.StatusBadRequest, "concurrency query parameter must be between 1 and "+strconv.Itoa(maxBenchmarkReactionConcurrency))
+		}
+	}
+	cleanup := false
+	if c.QueryParam("cleanup") != "" {
+		cleanup, err = strconv.ParseBool(c.QueryParam("cleanup"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cleanup query parameter must be boolean")
+		}
+	}
+
+	var livestreamModel LivestreamModel
+	if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	var (
+		mu          sync.Mutex
+		latencies   = make([]time.Duration, 0, count)
+		reactionIDs = make([]int64, 0, count)
+		errorCount  int
+	)
+	jobs := make(chan struct{}, count)
+	for i := 0; i < count; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	startedAt := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				// postReactionHandler と同じく、1件ごとにトランザクションを張って書き込む
+				reactionModel := ReactionModel{
+					UserID:       livestreamModel.UserID,
+					LivestreamID: livestreamModel.ID,
+					EmojiName:    benchmarkReactionEmojiName,
+					Intensity:    defaultReactionIntensity,
+					Count:        1,
+					CreatedAt:    time.Now().Unix(),
+				}
+				insertStartedAt := time.Now()
+				err := benchmarkInsertReaction(c, &reactionModel)
+				elapsed := time.Since(insertStartedAt)
+
+				mu.Lock()
+				if err != nil {
+					errorCount++
+				} else {
+					latencies = append(latencies, elapsed)
+					reactionIDs = append(reactionIDs, reactionModel.ID)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := ReactionBenchmarkResult{
+		Count:       count,
+		Concurrency: concurrency,
+		Errors:      errorCount,
+		ElapsedMs:   durationMs(time.Since(startedAt)),
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result.P50Ms = durationMs(latencyPercentile(latencies, 50))
+		result.P90Ms = durationMs(latencyPercentile(latencies, 90))
+		result.P99Ms = durationMs(latencyPercentile(latencies, 99))
+		result.MaxMs = durationMs(latencies[len(latencies)-1])
+	}
+
+	if cleanup && len(reactionIDs) > 0 {
+		query, params, err := sqlx.In("DELETE FROM reactions WHERE id IN (?)", reactionIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct deleting reactions query: "+err.Error())
+		}
+		rs, err := dbConn.ExecContext(ctx, query, params...)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete benchmark reactions: "+err.Error())
+		}
+		result.CleanedUp, err = rs.RowsAffected()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+		}
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+func benchmarkInsertReaction(c echo.Context, reactionModel *ReactionModel) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertReaction(ctx, tx, reactionModel); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// latencyPercentile は昇順に並んだ latencies の p パーセンタイルを返す
+func latencyPercentile(latencies []time.Duration, p int) time.Duration {
+	i := (len(latencies)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return latencies[i]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,62 @@
+package main
+
+// プロセス内キャッシュに古い値を入れないための、リクエストごとの情報
+// ハンドラのトランザクションは REPEATABLE READ なので、始めた後に他でコミットされた更新は見えない
+// キャッシュの世代はトランザクションを始める前 (リクエストの開始時) に取っておき、その後に無効化されていればキャッシュしない
+// レプリカで読んだ値は遅れている可能性があるので、キャッシュには入れない
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type cacheSnapshotKey struct{}
+
+type cacheSnapshot struct {
+	userGeneration             uint64
+	reactionSettingsGeneration uint64
+}
+
+type replicaReadKey struct{}
+
+// withCacheSnapshot は現在のキャッシュの世代を ctx に持たせる
+func withCacheSnapshot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheSnapshotKey{}, &cacheSnapshot{
+		userGeneration:             userCache.currentGeneration(),
+		reactionSettingsGeneration: reactionSettingsStore.currentGeneration(),
+	})
+}
+
+// cacheSnapshotFromContext はリクエストの開始時に取ったキャッシュの世代を返す
+// 取っていない場合 (リクエストの外での呼び出しなど) は false を返すので、キャッシュに入れないこと
+func cacheSnapshotFromContext(ctx context.Context) (*cacheSnapshot, bool) {
+	snapshot, ok := ctx.Value(cacheSnapshotKey{}).(*cacheSnapshot)
+	return snapshot, ok
+}
+
+// cacheSnapshotMiddleware はハンドラがトランザクションを始める前に、キャッシュの世代を取っておく
+func cacheSnapshotMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.SetRequest(c.Request().WithContext(withCacheSnapshot(c.Request().Context())))
+		return next(c)
+	}
+}
+
+// isReplicaRead は ctx が beginReadTxx でレプリカのトランザクションを始めたものかを返す
+func isReplicaRead(ctx context.Context) bool {
+	replica, _ := ctx.Value(replicaReadKey{}).(bool)
+	return replica
+}
+
+// beginReadTxx は読み取りだけのAPIのトランザクションを dbReadConn で始める
+// レプリカを使う場合は、そのトランザクションで読んだ値をキャッシュしないよう、印を付けた ctx を返す
+func beginReadTxx(ctx context.Context, opts *sql.TxOptions) (context.Context, *sqlx.Tx, error) {
+	if dbReadConn != dbConn {
+		ctx = context.WithValue(ctx, replicaReadKey{}, true)
+	}
+	tx, err := dbReadConn.BeginTxx(ctx, opts)
+	return ctx, tx, err
+}
@@ -0,0 +1,181 @@
+package main
+
+// リクエストごとに発行したSQLの数を数えるための仕組み
+// N+1 の検出用に、database/sql のドライバをラップしてクエリ発行を数える
+// 負荷試験の調査用に、X-Debug: 1 を付けたリクエストではDBにかかった時間も測る
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	dbQueriesHeader = "X-DB-Queries"
+	dbTimeHeader    = "X-DB-Time-Ms"
+	debugHeader     = "X-Debug"
+
+	appEnvEnvKey = "ISUCON13_ENV"
+)
+
+type queryCounterKey struct{}
+
+type queryCounter struct {
+	count atomic.Int64
+	// timed が false の場合は時間を測らない
+	timed   bool
+	elapsed atomic.Int64
+}
+
+func withQueryCounter(ctx context.Context, timed bool) (context.Context, *queryCounter) {
+	counter := &queryCounter{timed: timed}
+	return context.WithValue(ctx, queryCounterKey{}, counter), counter
+}
+
+// queryStartedAt はクエリの開始時刻を返す。時間を測らないリクエストではゼロ値を返す
+func queryStartedAt(ctx context.Context) time.Time {
+	if counter, ok := ctx.Value(queryCounterKey{}).(*queryCounter); ok && counter.timed {
+		return time.Now()
+	}
+	return time.Time{}
+}
+
+// countQuery はクエリを1つ数え、startedAt がゼロ値でなければ経過時間を足す
+func countQuery(ctx context.Context, startedAt time.Time) {
+	if counter, ok := ctx.Value(queryCounterKey{}).(*queryCounter); ok {
+		counter.count.Add(1)
+		if !startedAt.IsZero() {
+			counter.elapsed.Add(int64(time.Since(startedAt)))
+		}
+	}
+}
+
+// 本番環境では、リクエストヘッダだけでDBの情報を外に出さない
+var debugHeadersEnabled = os.Getenv(appEnvEnvKey) != "production"
+
+// dbQueryCountMiddleware はリクエストのcontextにカウンタを仕込む
+// 本番環境以外で X-Debug: 1 が付いている場合だけ、発行されたクエリ数とクエリにかかった時間の合計 (ミリ秒) をレスポンスヘッダに載せる
+func dbQueryCountMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		timed := debugHeadersEnabled && c.Request().Header.Get(debugHeader) == "1"
+		ctx, counter := withQueryCounter(c.Request().Context(), timed)
+		c.SetRequest(c.Request().WithContext(ctx))
+		c.Response().Before(func() {
+			if timed {
+				c.Response().Header().Set(dbQueriesHeader, strconv.FormatInt(counter.count.Load(), 10))
+				elapsed := time.Duration(counter.elapsed.Load())
+				c.Response().Header().Set(dbTimeHeader, strconv.FormatFloat(float64(elapsed)/float64(time.Millisecond), 'f', 3, 64))
+			}
+		})
+		return next(c)
+	}
+}
+
+type queryCountingConnector struct {
+	driver.Connector
+}
+
+func (c *queryCountingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &queryCountingConn{conn}, nil
+}
+
+// queryCountingConn はMySQLドライバのコネクションをラップする
+// go-sql-driver/mysql のコネクションは以下のインターフェースをすべて実装している
+type queryCountingConn struct {
+	driver.Conn
+}
+
+var (
+	_ driver.ConnBeginTx        = (*queryCountingConn)(nil)
+	_ driver.ConnPrepareContext = (*queryCountingConn)(nil)
+	_ driver.ExecerContext      = (*queryCountingConn)(nil)
+	_ driver.QueryerContext     = (*queryCountingConn)(nil)
+	_ driver.Pinger             = (*queryCountingConn)(nil)
+	_ driver.SessionResetter    = (*queryCountingConn)(nil)
+	_ driver.Validator          = (*queryCountingConn)(nil)
+	_ driver.NamedValueChecker  = (*queryCountingConn)(nil)
+)
+
+func (c *queryCountingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *queryCountingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &queryCountingStmt{stmt}, nil
+}
+
+func (c *queryCountingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	startedAt := queryStartedAt(ctx)
+	result, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	// ErrSkip の場合はプリペアドステートメント経由で再実行されるので、そちらで数える
+	if !errors.Is(err, driver.ErrSkip) {
+		countQuery(ctx, startedAt)
+	}
+	return result, err
+}
+
+// 時間は結果が返り始めるまでを測り、行の読み出しにかかった時間は含めない
+func (c *queryCountingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	startedAt := queryStartedAt(ctx)
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if !errors.Is(err, driver.ErrSkip) {
+		countQuery(ctx, startedAt)
+	}
+	return rows, err
+}
+
+func (c *queryCountingConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *queryCountingConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *queryCountingConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+func (c *queryCountingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+type queryCountingStmt struct {
+	driver.Stmt
+}
+
+var (
+	_ driver.StmtExecContext   = (*queryCountingStmt)(nil)
+	_ driver.StmtQueryContext  = (*queryCountingStmt)(nil)
+	_ driver.NamedValueChecker = (*queryCountingStmt)(nil)
+)
+
+func (s *queryCountingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	startedAt := queryStartedAt(ctx)
+	defer countQuery(ctx, startedAt)
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s *queryCountingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	startedAt := queryStartedAt(ctx)
+	defer countQuery(ctx, startedAt)
+	return s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+}
+
+func (s *queryCountingStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	return s.Stmt.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
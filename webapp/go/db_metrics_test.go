@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestDBQueryCountMiddlewareHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		debug      string
+		wantHeader bool
+	}{
+		{name: "without X-Debug", enabled: true, debug: "", wantHeader: false},
+		{name: "with X-Debug", enabled: true, debug: "1", wantHeader: true},
+		{name: "production", enabled: false, debug: "1", wantHeader: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := debugHeadersEnabled
+			debugHeadersEnabled = tt.enabled
+			t.Cleanup(func() { debugHeadersEnabled = orig })
+
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.debug != "" {
+				req.Header.Set(debugHeader, tt.debug)
+			}
+			rec := httptest.NewRecorder()
+			handler := dbQueryCountMiddleware(func(c echo.Context) error {
+				countQuery(c.Request().Context(), queryStartedAt(c.Request().Context()))
+				return c.NoContent(http.StatusOK)
+			})
+			if err := handler(e.NewContext(req, rec)); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, header := range []string{dbQueriesHeader, dbTimeHeader} {
+				if got := rec.Header().Get(header) != ""; got != tt.wantHeader {
+					t.Errorf("%s present = %v, want %v", header, got, tt.wantHeader)
+				}
+			}
+			if tt.wantHeader && rec.Header().Get(dbQueriesHeader) != "1" {
+				t.Errorf("%s = %q, want 1", dbQueriesHeader, rec.Header().Get(dbQueriesHeader))
+			}
+		})
+	}
+}
+
+func TestGetReactionsDebugHeaders(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	seedTestReactions(t, owner.ID, livestreamID, 3)
+	path := fmt.Sprintf("/api/livestream/%d/reaction", livestreamID)
+
+	rec := doTestRequest(t, http.MethodGet, path, owner.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusOK, nil)
+	for _, header := range []string{dbQueriesHeader, dbTimeHeader} {
+		if got := rec.Header().Get(header); got != "" {
+			t.Errorf("without X-Debug: %s = %q, want no header", header, got)
+		}
+	}
+
+	rec = doTestRequest(t, http.MethodGet, path, owner.Cookie, nil, debugHeader+": 1")
+	decodeTestResponse(t, rec, http.StatusOK, nil)
+	// リアクションとユーザ、配信をまとめて引くので、リアクションの数によらず数回で済む
+	queries, err := strconv.Atoi(rec.Header().Get(dbQueriesHeader))
+	if err != nil || queries < 1 || queries > 10 {
+		t.Errorf("%s = %q, want between 1 and 10", dbQueriesHeader, rec.Header().Get(dbQueriesHeader))
+	}
+	if ms, err := strconv.ParseFloat(rec.Header().Get(dbTimeHeader), 64); err != nil || ms < 0 {
+		t.Errorf("%s = %q, want a non-negative number", dbTimeHeader, rec.Header().Get(dbTimeHeader))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+// リアクションとして投稿できる絵文字の許可リスト
+// ファイルには1行に1つ絵文字名を書く。空行と # で始まる行は無視する
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	emojiAllowlistPathEnvKey = "ISUCON13_EMOJI_ALLOWLIST_PATH"
+	// true の場合、許可リストと emoji_catalog が食い違っていたら起動を止める
+	emojiCatalogStrictEnvKey = "ISUCON13_EMOJI_CATALOG_STRICT"
+)
+
+// nilの場合は許可リストを使わず、すべての絵文字を許可する
+var emojiAllowlist map[string]struct{}
+
+var normalizedEmojiNameRegexp = regexp.MustCompile(`^[a-z0-9_+-]+$`)
+
+// リアクションとして投稿できる絵文字名の形式。:tada: のようなショートコード
+var emojiShortcodeRegexp = regexp.MustCompile(`^:[a-zA-Z0-9_+-]+:$`)
+
+// normalizeEmojiName は :Tada: のような表記を tada にそろえる
+func normalizeEmojiName(name string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(name)), ":")
+}
+
+func isAllowedEmoji(name string) bool {
+	if emojiAllowlist == nil {
+		return true
+	}
+	_, ok := emojiAllowlist[normalizeEmojiName(name)]
+	return ok
+}
+
+// parseEmojiAllowlist は許可リストを読み込み、採用しなかった行を理由付きで返す
+func parseEmojiAllowlist(r io.Reader) (map[string]struct{}, []string, error) {
+	allowlist := make(map[string]struct{})
+	var ignored []string
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name := normalizeEmojiName(line)
+		if !normalizedEmojiNameRegexp.MatchString(name) {
+			ignored = append(ignored, fmt.Sprintf("line %d: malformed %q", lineNo, line))
+			continue
+		}
+		if _, ok := allowlist[name]; ok {
+			ignored = append(ignored, fmt.Sprintf("line %d: duplicate %q", lineNo, line))
+			continue
+		}
+		allowlist[name] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return allowlist, ignored, nil
+}
+
+// loadEmojiAllowlist は許可リストのファイルを読み込む
+// 不正な行は警告を出して読み飛ばし、有効な絵文字がひとつもない場合のみエラーにする
+func loadEmojiAllowlist(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	allowlist, ignored, err := parseEmojiAllowlist(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read emoji allowlist %s: %w", path, err)
+	}
+	if len(ignored) > 0 {
+		log.Printf("ignored %d lines in emoji allowlist %s: %s", len(ignored), path, strings.Join(ignored, ", "))
+	}
+	if len(allowlist) == 0 {
+		return nil, fmt.Errorf("emoji allowlist %s has no valid entries", path)
+	}
+
+	return allowlist, nil
+}
+
+// diffEmojiCatalog は許可リストと絵文字カタログを突き合わせ、片方にしかない絵文字をそれぞれ名前順で返す
+func diffEmojiCatalog(allowlist map[string]struct{}, catalog []string) (notInCatalog []string, notInAllowlist []string) {
+	inCatalog := make(map[string]struct{}, len(catalog))
+	for _, name := range catalog {
+		name = normalizeEmojiName(name)
+		inCatalog[name] = struct{}{}
+		if _, ok := allowlist[name]; !ok {
+			notInAllowlist = append(notInAllowlist, name)
+		}
+	}
+	for name := range allowlist {
+		if _, ok := inCatalog[name]; !ok {
+			notInCatalog = append(notInCatalog, name)
+		}
+	}
+	sort.Strings(notInCatalog)
+	sort.Strings(notInAllowlist)
+	return notInCatalog, notInAllowlist
+}
+
+// verifyEmojiCatalog は許可リストの絵文字が emoji_catalog にすべて登録されているかを確かめる
+// カタログにない絵文字は表示に使う画像がないので、食い違いはログに残す。strict の場合はエラーにする
+// カタログにしかない絵文字は、許可リストで絞っているだけなのでログに残すだけにする
+func verifyEmojiCatalog(ctx context.Context, db *sqlx.DB, allowlist map[string]struct{}, strict bool) error {
+	var catalog []string
+	if err := db.SelectContext(ctx, &catalog, "SELECT name FROM emoji_catalog"); err != nil {
+		if !strict {
+			log.Printf("skipped emoji catalog check: failed to get emoji catalog: %+v", err)
+			return nil
+		}
+		return fmt.Errorf("failed to get emoji catalog: %w", err)
+	}
+
+	notInCatalog, notInAllowlist := diffEmojiCatalog(allowlist, catalog)
+	if len(notInAllowlist) > 0 {
+		log.Printf("%d emoji in the catalog are not in the allowlist: %s", len(notInAllowlist), strings.Join(notInAllowlist, ", "))
+	}
+	if len(notInCatalog) > 0 {
+		msg := fmt.Sprintf("%d emoji in the allowlist have no catalog entry: %s", len(notInCatalog), strings.Join(notInCatalog, ", "))
+		if strict {
+			return errors.New(msg)
+		}
+		log.Print(msg)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeTestEmojiAllowlist(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "emoji.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEmojiAllowlist(t *testing.T) {
+	path := writeTestEmojiAllowlist(t, strings.Join([]string{
+		"# よく使う絵文字",
+		"tada",
+		"",
+		"  :Tada:  ",
+		"THUMBSUP",
+		"+1",
+		"not an emoji",
+		"thumbsup",
+	}, "\n"))
+
+	allowlist, err := loadEmojiAllowlist(path)
+	if err != nil {
+		t.Fatalf("loadEmojiAllowlist: %v", err)
+	}
+	var names []string
+	for name := range allowlist {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if got, want := strings.Join(names, ","), "+1,tada,thumbsup"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestParseEmojiAllowlistReportsIgnoredLines(t *testing.T) {
+	_, ignored, err := parseEmojiAllowlist(strings.NewReader("tada\n:tada:\n# comment\n\nnot an emoji\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// コメントと空行は無視するだけで、採用しなかった行には含めない
+	want := []string{`line 2: duplicate ":tada:"`, `line 5: malformed "not an emoji"`}
+	if strings.Join(ignored, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q, want %q", ignored, want)
+	}
+}
+
+func TestLoadEmojiAllowlistWithoutValidEntries(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":         "",
+		"comments only": "# comment\n\n# another\n",
+		"all invalid":   "not an emoji\n:::\nこんにちは\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadEmojiAllowlist(writeTestEmojiAllowlist(t, content)); err == nil {
+				t.Fatalf("got nil error, want an error for no valid entries")
+			}
+		})
+	}
+}
+
+func TestVerifyEmojiCatalog(t *testing.T) {
+	resetTestDB(t)
+	ctx := context.Background()
+	if _, err := dbConn.Exec("INSERT INTO emoji_catalog (name, image_path) VALUES ('tada', '/emoji/tada.png'), ('heart', '/emoji/heart.png')"); err != nil {
+		t.Fatal(err)
+	}
+
+	matching := map[string]struct{}{"tada": {}, "heart": {}}
+	for _, strict := range []bool{false, true} {
+		if err := verifyEmojiCatalog(ctx, dbConn, matching, strict); err != nil {
+			t.Fatalf("matching allowlist, strict=%v: %v", strict, err)
+		}
+	}
+
+	// カタログにない絵文字を許可している
+	mismatched := map[string]struct{}{"tada": {}, "ghost": {}}
+	if err := verifyEmojiCatalog(ctx, dbConn, mismatched, false); err != nil {
+		t.Fatalf("mismatch, not strict: got %v, want only a warning", err)
+	}
+	err := verifyEmojiCatalog(ctx, dbConn, mismatched, true)
+	if err == nil || !strings.Contains(err.Error(), "ghost") {
+		t.Fatalf("mismatch, strict: got %v, want an error naming ghost", err)
+	}
+
+	// カタログにしかない絵文字は、許可リストで絞っているだけなので strict でも通す
+	if err := verifyEmojiCatalog(ctx, dbConn, map[string]struct{}{"tada": {}}, true); err != nil {
+		t.Fatalf("subset of the catalog, strict: %v", err)
+	}
+
+	notInCatalog, notInAllowlist := diffEmojiCatalog(mismatched, []string{":Heart:", "tada"})
+	if fmt.Sprint(notInCatalog) != "[ghost]" || fmt.Sprint(notInAllowlist) != "[heart]" {
+		t.Fatalf("diff: got %v, %v, want [ghost], [heart]", notInCatalog, notInAllowlist)
+	}
+}
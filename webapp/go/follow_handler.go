@@ -0,0 +1,106 @@
+package main
+
+// ユーザのフォロー
+// フォロワー数は include=follower_count を指定すると、ユーザ情報に含まれる
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// フォローAPI
+// POST /api/user/:username/follow
+// フォロー済みのユーザをもう一度フォローしても何もしない
+func postFollowHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followeeID, err := getUserIDByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+	if followeeID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot follow yourself")
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)", userID, followeeID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// フォロー解除API
+// DELETE /api/user/:username/follow
+// フォローしていないユーザのフォローを解除しても何もしない
+func deleteFollowHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followeeID, err := getUserIDByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userID, followeeID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// getUserIDByName はユーザ名からユーザIDを引く。存在しない場合は 404 を返す
+func getUserIDByName(ctx context.Context, tx *sqlx.Tx, username string) (int64, error) {
+	var followeeID int64
+	if err := tx.GetContext(ctx, &followeeID, "SELECT id FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	return followeeID, nil
+}
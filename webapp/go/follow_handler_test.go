@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFollow(t *testing.T) {
+	resetTestDB(t)
+	streamer := newTestUser(t, "streamer")
+	fan := newTestUser(t, "fan")
+	now := time.Now().Unix()
+	livestreamID := newTestLivestream(t, streamer.ID, "stream", now-3600, now+3600)
+	newTestReaction(t, ReactionModel{UserID: streamer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+
+	// リアクションに埋め込まれた配信者のフォロワー数
+	followerCount := func() int64 {
+		t.Helper()
+		reactions := getTestReactions(t, fan, livestreamID, "include=follower_count")
+		if len(reactions) != 1 || reactions[0].User.FollowerCount == nil {
+			t.Fatalf("got reactions %+v, want one with follower_count", reactions)
+		}
+		return *reactions[0].User.FollowerCount
+	}
+	follow := func(method string, user testUser, username string) int {
+		t.Helper()
+		return doTestRequest(t, method, "/api/user/"+username+"/follow", user.Cookie, nil).Code
+	}
+
+	if got := followerCount(); got != 0 {
+		t.Fatalf("before follow: follower_count = %d, want 0", got)
+	}
+
+	// 2回フォローしても1人として数える
+	for i := 0; i < 2; i++ {
+		if code := follow(http.MethodPost, fan, "streamer"); code != http.StatusOK {
+			t.Fatalf("follow %d: status = %d, want %d", i, code, http.StatusOK)
+		}
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM follows WHERE follower_id = ? AND followee_id = ?", fan.ID, streamer.ID); got != 1 {
+		t.Fatalf("got %d follows rows after following twice, want 1", got)
+	}
+	if got := followerCount(); got != 1 {
+		t.Fatalf("after follow: follower_count = %d, want 1", got)
+	}
+
+	if code := follow(http.MethodPost, streamer, "streamer"); code != http.StatusBadRequest {
+		t.Fatalf("follow yourself: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := follow(http.MethodPost, fan, "nobody"); code != http.StatusNotFound {
+		t.Fatalf("follow unknown user: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// フォローしていない状態で解除しても成功する
+	for i := 0; i < 2; i++ {
+		if code := follow(http.MethodDelete, fan, "streamer"); code != http.StatusOK {
+			t.Fatalf("unfollow %d: status = %d, want %d", i, code, http.StatusOK)
+		}
+	}
+	if got := followerCount(); got != 0 {
+		t.Fatalf("after unfollow: follower_count = %d, want 0", got)
+	}
+}
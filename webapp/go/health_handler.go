@@ -0,0 +1,33 @@
+package main
+
+// ロードバランサ向けのヘルスチェック
+// プロセスが動いているだけでなく、DBに接続できることまで確かめる
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DBの応答をこれ以上待たずに、異常として返す
+const healthCheckTimeout = time.Second
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// ヘルスチェックAPI
+// GET /healthz
+// セッションは不要。DBに接続できなければ 503 を返す
+func getHealthzHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthCheckTimeout)
+	defer cancel()
+
+	if err := dbConn.PingContext(ctx); err != nil {
+		c.Logger().Warnf("health check failed to ping db: %+v", err)
+		return c.JSON(http.StatusServiceUnavailable, &HealthResponse{Status: "db_unavailable"})
+	}
+	return c.JSON(http.StatusOK, &HealthResponse{Status: "ok"})
+}
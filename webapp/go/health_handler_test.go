@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestHealthz(t *testing.T) {
+	var res HealthResponse
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/healthz", "", nil), http.StatusOK, &res)
+	if res.Status != "ok" {
+		t.Fatalf("healthy: status = %q, want ok", res.Status)
+	}
+
+	// 閉じた接続に差し替えて、ping が失敗する状態にする
+	failing, err := sqlx.Open("mysql", testDBConfig.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing.Close()
+	orig := dbConn
+	dbConn = failing
+	t.Cleanup(func() { dbConn = orig })
+
+	rec := doTestRequest(t, http.MethodGet, "/healthz", "", nil)
+	decodeTestResponse(t, rec, http.StatusServiceUnavailable, &res)
+	if res.Status != "db_unavailable" {
+		t.Fatalf("failing db: status = %q, want db_unavailable", res.Status)
+	}
+}
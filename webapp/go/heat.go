@@ -0,0 +1,138 @@
+package main
+
+// 配信ごとの盛り上がり度 (heat) をメモリ上で管理する
+//
+// リアクション1件ごとに heatReactionWeight、投げ銭ごとに tip * heatTipWeight を加算し、
+// heatDecayInterval ごとに全配信の heat を次の式で減衰させる
+//
+//	heat = heat * 0.5^(heatDecayInterval / heatHalfLife)
+//
+// つまり、何も起きなければ heatHalfLife ごとに heat は半分になる
+// 各パラメータは環境変数で変更できる
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	heatHalfLifeEnvKey       = "ISUCON13_HEAT_HALF_LIFE_SECONDS"
+	heatReactionWeightEnvKey = "ISUCON13_HEAT_REACTION_WEIGHT"
+	heatTipWeightEnvKey      = "ISUCON13_HEAT_TIP_WEIGHT"
+
+	heatDecayInterval = time.Second
+	// これを下回った配信は追跡をやめる
+	minTrackedHeat = 0.01
+)
+
+var (
+	heatHalfLife       = 60 * time.Second
+	heatReactionWeight = 1.0
+	heatTipWeight      = 0.01
+)
+
+var livestreamHeat = newHeatTracker()
+
+type heatTracker struct {
+	mu   sync.Mutex
+	heat map[int64]float64
+}
+
+func newHeatTracker() *heatTracker {
+	return &heatTracker{
+		heat: make(map[int64]float64),
+	}
+}
+
+// loadHeatConfig は環境変数から heat の計算パラメータを読み込む
+func loadHeatConfig() error {
+	if v, ok := os.LookupEnv(heatHalfLifeEnvKey); ok {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("environment variable '%s' must be positive number", heatHalfLifeEnvKey)
+		}
+		heatHalfLife = time.Duration(seconds * float64(time.Second))
+	}
+	if v, ok := os.LookupEnv(heatReactionWeightEnvKey); ok {
+		weight, err := strconv.ParseFloat(v, 64)
+		if err != nil || weight < 0 {
+			return fmt.Errorf("environment variable '%s' must be non-negative number", heatReactionWeightEnvKey)
+		}
+		heatReactionWeight = weight
+	}
+	if v, ok := os.LookupEnv(heatTipWeightEnvKey); ok {
+		weight, err := strconv.ParseFloat(v, 64)
+		if err != nil || weight < 0 {
+			return fmt.Errorf("environment variable '%s' must be non-negative number", heatTipWeightEnvKey)
+		}
+		heatTipWeight = weight
+	}
+	return nil
+}
+
+func (t *heatTracker) add(livestreamID int64, delta float64) {
+	if delta <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.heat[livestreamID] += delta
+}
+
+func (t *heatTracker) recordReaction(livestreamID int64) {
+	t.add(livestreamID, heatReactionWeight)
+}
+
+func (t *heatTracker) recordTip(livestreamID int64, tip int64) {
+	t.add(livestreamID, float64(tip)*heatTipWeight)
+}
+
+func (t *heatTracker) get(livestreamID int64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.heat[livestreamID]
+}
+
+func (t *heatTracker) snapshot() map[int64]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	heat := make(map[int64]float64, len(t.heat))
+	for id, v := range t.heat {
+		heat[id] = v
+	}
+	return heat
+}
+
+func (t *heatTracker) decay(factor float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, heat := range t.heat {
+		heat *= factor
+		if heat < minTrackedHeat {
+			delete(t.heat, id)
+			continue
+		}
+		t.heat[id] = heat
+	}
+}
+
+func (t *heatTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.heat = make(map[int64]float64)
+}
+
+// runDecay は heatDecayInterval ごとに heat を減衰させ続ける
+func (t *heatTracker) runDecay() {
+	factor := math.Pow(0.5, float64(heatDecayInterval)/float64(heatHalfLife))
+	ticker := time.NewTicker(heatDecayInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.decay(factor)
+	}
+}
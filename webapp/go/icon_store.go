@@ -0,0 +1,430 @@
+package main
+
+// アイコン画像の保存先を差し替えられるようにするための仕組み
+// 既定ではこれまで通りMySQLに保存し、設定でファイルシステムやメモリに切り替えられる
+// 呼び出し側のトランザクションを受け取り、MySQLに保存する場合はそのトランザクションで読み書きする
+// (1リクエストで接続を2本使うと、接続プールが埋まったときに互いを待って止まってしまう)
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	iconStoreEnvKey = "ISUCON13_ICON_STORE"
+	iconDirEnvKey   = "ISUCON13_ICON_DIR"
+
+	defaultIconDir = "../icons"
+)
+
+var errIconNotFound = errors.New("icon not found")
+
+// IconStore はユーザのアイコン画像の保存先
+// q, db には呼び出し側のトランザクション (初期化では dbConn) を渡す
+type IconStore interface {
+	// Get はユーザのアイコン画像を返す。設定されていなければ errIconNotFound を返す
+	Get(ctx context.Context, q sqlx.QueryerContext, userID int64) ([]byte, error)
+	// GetThumbnail はユーザのアイコン画像のサムネイルを返す。保存されていなければ errIconNotFound を返す
+	GetThumbnail(ctx context.Context, q sqlx.QueryerContext, userID int64) ([]byte, error)
+	// Put はユーザのアイコン画像とそのサムネイルを置き換え、新しいアイコンのIDを返す
+	Put(ctx context.Context, db sqlx.ExtContext, userID int64, image []byte, thumbnail []byte) (int64, error)
+	// Hash はユーザのアイコン画像のハッシュ値を返す。設定されていなければ errIconNotFound を返す
+	Hash(ctx context.Context, q sqlx.QueryerContext, userID int64) (string, error)
+	// Hashes は複数ユーザのアイコン画像のハッシュ値をまとめて返す。アイコンのないユーザは含まれない
+	Hashes(ctx context.Context, q sqlx.QueryerContext, userIDs []int64) (map[int64]string, error)
+	// Reset は保存した画像を初期状態に戻す
+	Reset(ctx context.Context, db sqlx.ExtContext) error
+}
+
+var iconStore IconStore = &dbIconStore{}
+
+func loadIconStoreConfig() error {
+	switch v := os.Getenv(iconStoreEnvKey); v {
+	case "", "db":
+		iconStore = &dbIconStore{}
+	case "fs":
+		dir := defaultIconDir
+		if d, ok := os.LookupEnv(iconDirEnvKey); ok {
+			dir = d
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create icon directory '%s': %w", dir, err)
+		}
+		iconStore = newFSIconStore(dir)
+	case "memory":
+		iconStore = newMemoryIconStore()
+	default:
+		return fmt.Errorf("environment variable '%s' must be one of db, fs, memory: %s", iconStoreEnvKey, v)
+	}
+	return nil
+}
+
+func hashIcon(image []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(image))
+}
+
+// dbIconStore は icons テーブルに保存する
+// ハッシュ値はアップロード時に image_hash カラムへ保存しておき、読み出し時には計算しない
+type dbIconStore struct{}
+
+func (s *dbIconStore) Get(ctx context.Context, q sqlx.QueryerContext, userID int64) ([]byte, error) {
+	var image []byte
+	if err := sqlx.GetContext(ctx, q, &image, "SELECT image FROM icons WHERE user_id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errIconNotFound
+		}
+		return nil, err
+	}
+	return image, nil
+}
+
+// GetThumbnail は、サムネイルを作る前に保存された初期データのアイコンでは errIconNotFound を返す
+func (s *dbIconStore) GetThumbnail(ctx context.Context, q sqlx.QueryerContext, userID int64) ([]byte, error) {
+	var thumbnail []byte
+	if err := sqlx.GetContext(ctx, q, &thumbnail, "SELECT thumbnail FROM icons WHERE user_id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errIconNotFound
+		}
+		return nil, err
+	}
+	if thumbnail == nil {
+		return nil, errIconNotFound
+	}
+	return thumbnail, nil
+}
+
+// Put は呼び出し側のトランザクションで置き換えるので、コミットは呼び出し側で行う
+func (s *dbIconStore) Put(ctx context.Context, db sqlx.ExtContext, userID int64, image []byte, thumbnail []byte) (int64, error) {
+	if _, err := db.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
+		return 0, fmt.Errorf("failed to delete old user icon: %w", err)
+	}
+
+	rs, err := db.ExecContext(ctx, "INSERT INTO icons (user_id, image, image_hash, thumbnail) VALUES (?, ?, ?, ?)", userID, image, hashIcon(image), thumbnail)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert new user icon: %w", err)
+	}
+
+	iconID, err := rs.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last inserted icon id: %w", err)
+	}
+	return iconID, nil
+}
+
+func (s *dbIconStore) Hash(ctx context.Context, q sqlx.QueryerContext, userID int64) (string, error) {
+	var hash string
+	if err := sqlx.GetContext(ctx, q, &hash, "SELECT image_hash FROM icons WHERE user_id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errIconNotFound
+		}
+		return "", err
+	}
+	return hash, nil
+}
+
+func (s *dbIconStore) Hashes(ctx context.Context, q sqlx.QueryerContext, userIDs []int64) (map[int64]string, error) {
+	if len(userIDs) == 0 {
+		return map[int64]string{}, nil
+	}
+
+	var iconHashes []struct {
+		ID     int64  `db:"id"`
+		UserID int64  `db:"user_id"`
+		Hash   string `db:"image_hash"`
+	}
+	query, params, err := sqlx.In("SELECT id, user_id, image_hash FROM icons WHERE user_id IN (?)", userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct getting icon hashes query: %w", err)
+	}
+	if err := sqlx.SelectContext(ctx, q, &iconHashes, query, params...); err != nil {
+		return nil, err
+	}
+	hashMap := make(map[int64]string, len(iconHashes))
+	for _, iconHash := range iconHashes {
+		hashMap[iconHash.UserID] = iconHash.Hash
+	}
+	return hashMap, nil
+}
+
+// Reset は初期データの icons のうち、ハッシュ値が入っていないものに image_hash を入れる
+// テーブル自体は init.sh で初期化されている前提
+func (s *dbIconStore) Reset(ctx context.Context, db sqlx.ExtContext) error {
+	var icons []struct {
+		ID    int64  `db:"id"`
+		Image []byte `db:"image"`
+	}
+
+	if err := sqlx.SelectContext(ctx, db, &icons, "SELECT id, image FROM icons WHERE image_hash = ''"); err != nil {
+		return fmt.Errorf("failed to select icons: %w", err)
+	}
+	for _, icon := range icons {
+		if _, err := db.ExecContext(ctx, "UPDATE icons SET image_hash = ? WHERE id = ?", hashIcon(icon.Image), icon.ID); err != nil {
+			return fmt.Errorf("failed to update icon hash: %w", err)
+		}
+	}
+	return nil
+}
+
+// fsIconStore はユーザごとに1ファイルとしてディレクトリに保存する
+// ハッシュ値は読み出すたびに計算しないよう、メモリ上に覚えておく
+type fsIconStore struct {
+	dir string
+
+	mu     sync.Mutex
+	hashes map[int64]string
+	lastID int64
+}
+
+func newFSIconStore(dir string) *fsIconStore {
+	return &fsIconStore{
+		dir:    dir,
+		hashes: make(map[int64]string),
+	}
+}
+
+func (s *fsIconStore) path(userID int64) string {
+	return filepath.Join(s.dir, strconv.FormatInt(userID, 10)+".jpg")
+}
+
+func (s *fsIconStore) thumbnailPath(userID int64) string {
+	return filepath.Join(s.dir, strconv.FormatInt(userID, 10)+".thumb.png")
+}
+
+func (s *fsIconStore) Get(ctx context.Context, q sqlx.QueryerContext, userID int64) ([]byte, error) {
+	image, err := os.ReadFile(s.path(userID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errIconNotFound
+		}
+		return nil, err
+	}
+	return image, nil
+}
+
+func (s *fsIconStore) GetThumbnail(ctx context.Context, q sqlx.QueryerContext, userID int64) ([]byte, error) {
+	thumbnail, err := os.ReadFile(s.thumbnailPath(userID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errIconNotFound
+		}
+		return nil, err
+	}
+	return thumbnail, nil
+}
+
+func (s *fsIconStore) Put(ctx context.Context, db sqlx.ExtContext, userID int64, image []byte, thumbnail []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 元の画像より先にサムネイルを置き換え、古い画像に新しいサムネイルが組み合わさる時間だけにする
+	if err := s.replaceFile(s.thumbnailPath(userID), thumbnail); err != nil {
+		return 0, err
+	}
+	if err := s.replaceFile(s.path(userID), image); err != nil {
+		return 0, err
+	}
+
+	s.hashes[userID] = hashIcon(image)
+	s.lastID++
+	return s.lastID, nil
+}
+
+// replaceFile は、読み出し中のリクエストに書きかけのファイルが見えないよう、別名で書いてから置き換える
+func (s *fsIconStore) replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(s.dir, "icon-*")
+	if err != nil {
+		return fmt.Errorf("failed to create icon file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write icon file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write icon file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace icon file: %w", err)
+	}
+	return nil
+}
+
+func (s *fsIconStore) Hash(ctx context.Context, q sqlx.QueryerContext, userID int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hashLocked(userID)
+}
+
+func (s *fsIconStore) hashLocked(userID int64) (string, error) {
+	if hash, ok := s.hashes[userID]; ok {
+		return hash, nil
+	}
+	image, err := os.ReadFile(s.path(userID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", errIconNotFound
+		}
+		return "", err
+	}
+	hash := hashIcon(image)
+	s.hashes[userID] = hash
+	return hash, nil
+}
+
+func (s *fsIconStore) Hashes(ctx context.Context, q sqlx.QueryerContext, userIDs []int64) (map[int64]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashMap := make(map[int64]string, len(userIDs))
+	for _, userID := range userIDs {
+		hash, err := s.hashLocked(userID)
+		if err != nil {
+			if errors.Is(err, errIconNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		hashMap[userID] = hash
+	}
+	return hashMap, nil
+}
+
+// Reset はディレクトリ内のアイコンをすべて削除し、初期データの icons をファイルに書き出す
+func (s *fsIconStore) Reset(ctx context.Context, db sqlx.ExtContext) error {
+	icons, err := selectInitialIcons(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read icon directory: %w", err)
+	}
+	for _, entry := range entries {
+		if err := os.Remove(filepath.Join(s.dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove icon file: %w", err)
+		}
+	}
+	s.hashes = make(map[int64]string)
+	for _, icon := range icons {
+		if err := os.WriteFile(s.path(icon.UserID), icon.Image, 0o644); err != nil {
+			return fmt.Errorf("failed to write icon file: %w", err)
+		}
+		s.hashes[icon.UserID] = hashIcon(icon.Image)
+	}
+	s.lastID = int64(len(icons))
+	return nil
+}
+
+type initialIcon struct {
+	UserID int64  `db:"user_id"`
+	Image  []byte `db:"image"`
+}
+
+// selectInitialIcons は init.sh が icons に入れた初期データのアイコンを読む
+func selectInitialIcons(ctx context.Context, q sqlx.QueryerContext) ([]initialIcon, error) {
+	var icons []initialIcon
+	if err := sqlx.SelectContext(ctx, q, &icons, "SELECT user_id, image FROM icons ORDER BY id ASC"); err != nil {
+		return nil, fmt.Errorf("failed to select icons: %w", err)
+	}
+	return icons, nil
+}
+
+// memoryIconStore はプロセスのメモリに保存する
+// 再起動すると消えるので、1台で動かす開発環境やテストで使う
+type memoryIconStore struct {
+	mu     sync.Mutex
+	icons  map[int64]memoryIcon
+	lastID int64
+}
+
+type memoryIcon struct {
+	image     []byte
+	thumbnail []byte
+	hash      string
+}
+
+func newMemoryIconStore() *memoryIconStore {
+	return &memoryIconStore{
+		icons: make(map[int64]memoryIcon),
+	}
+}
+
+func (s *memoryIconStore) Get(ctx context.Context, q sqlx.QueryerContext, userID int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	icon, ok := s.icons[userID]
+	if !ok {
+		return nil, errIconNotFound
+	}
+	return icon.image, nil
+}
+
+func (s *memoryIconStore) GetThumbnail(ctx context.Context, q sqlx.QueryerContext, userID int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	icon, ok := s.icons[userID]
+	if !ok || icon.thumbnail == nil {
+		return nil, errIconNotFound
+	}
+	return icon.thumbnail, nil
+}
+
+func (s *memoryIconStore) Put(ctx context.Context, db sqlx.ExtContext, userID int64, image []byte, thumbnail []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.icons[userID] = memoryIcon{image: image, thumbnail: thumbnail, hash: hashIcon(image)}
+	s.lastID++
+	return s.lastID, nil
+}
+
+func (s *memoryIconStore) Hash(ctx context.Context, q sqlx.QueryerContext, userID int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	icon, ok := s.icons[userID]
+	if !ok {
+		return "", errIconNotFound
+	}
+	return icon.hash, nil
+}
+
+func (s *memoryIconStore) Hashes(ctx context.Context, q sqlx.QueryerContext, userIDs []int64) (map[int64]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashMap := make(map[int64]string, len(userIDs))
+	for _, userID := range userIDs {
+		if icon, ok := s.icons[userID]; ok {
+			hashMap[userID] = icon.hash
+		}
+	}
+	return hashMap, nil
+}
+
+// Reset は保存したアイコンを捨て、初期データの icons を読み込む
+func (s *memoryIconStore) Reset(ctx context.Context, db sqlx.ExtContext) error {
+	icons, err := selectInitialIcons(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.icons = make(map[int64]memoryIcon, len(icons))
+	for _, icon := range icons {
+		s.icons[icon.UserID] = memoryIcon{image: icon.Image, hash: hashIcon(icon.Image)}
+	}
+	s.lastID = int64(len(icons))
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func TestIconStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) IconStore{
+		"memory": func(t *testing.T) IconStore { return newMemoryIconStore() },
+		"fs":     func(t *testing.T) IconStore { return newFSIconStore(t.TempDir()) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			if _, err := store.Get(ctx, nil, 1); !errors.Is(err, errIconNotFound) {
+				t.Fatalf("Get before Put: got %v, want errIconNotFound", err)
+			}
+			if _, err := store.Hash(ctx, nil, 1); !errors.Is(err, errIconNotFound) {
+				t.Fatalf("Hash before Put: got %v, want errIconNotFound", err)
+			}
+
+			image := []byte("image of user 1")
+			thumbnail := []byte("thumbnail of user 1")
+			firstID, err := store.Put(ctx, nil, 1, image, thumbnail)
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			got, err := store.Get(ctx, nil, 1)
+			if err != nil || !bytes.Equal(got, image) {
+				t.Fatalf("Get: got %q, %v, want %q", got, err, image)
+			}
+			got, err = store.GetThumbnail(ctx, nil, 1)
+			if err != nil || !bytes.Equal(got, thumbnail) {
+				t.Fatalf("GetThumbnail: got %q, %v, want %q", got, err, thumbnail)
+			}
+			hash, err := store.Hash(ctx, nil, 1)
+			if err != nil || hash != hashIcon(image) {
+				t.Fatalf("Hash: got %q, %v, want %q", hash, err, hashIcon(image))
+			}
+
+			// 置き換えると新しいIDが振られ、ハッシュ値も変わる
+			replaced := []byte("new image of user 1")
+			secondID, err := store.Put(ctx, nil, 1, replaced, thumbnail)
+			if err != nil {
+				t.Fatalf("Put again: %v", err)
+			}
+			if secondID == firstID {
+				t.Fatalf("Put again returned the same id %d", secondID)
+			}
+			hashes, err := store.Hashes(ctx, nil, []int64{1, 2})
+			if err != nil {
+				t.Fatalf("Hashes: %v", err)
+			}
+			if len(hashes) != 1 || hashes[1] != hashIcon(replaced) {
+				t.Fatalf("Hashes: got %v, want only user 1 with %q", hashes, hashIcon(replaced))
+			}
+		})
+	}
+}
+
+// newTestPNG は w x h の単色の PNG を作る
+func newTestPNG(t testing.TB, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.RGBA{R: 0xff, A: 0xff}}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestIconHashMatchesStoredImage(t *testing.T) {
+	resetTestDB(t)
+	ctx := context.Background()
+	uploader := newTestUser(t, "uploader")
+	seeded := newTestUser(t, "seeded")
+
+	rec := doTestRequest(t, http.MethodPost, "/api/icon", uploader.Cookie, &PostIconRequest{Image: newTestPNG(t, 8, 8)})
+	var posted PostIconResponse
+	decodeTestResponse(t, rec, http.StatusCreated, &posted)
+
+	// 初期データのアイコンはハッシュ値が空のまま入っていて、Reset で埋める
+	if _, err := dbConn.Exec("INSERT INTO icons (user_id, image) VALUES (?, ?)", seeded.ID, []byte("seeded image")); err != nil {
+		t.Fatal(err)
+	}
+	if err := iconStore.Reset(ctx, dbConn); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+
+	for _, u := range []testUser{uploader, seeded} {
+		var stored []byte
+		if err := dbConn.Get(&stored, "SELECT image FROM icons WHERE user_id = ?", u.ID); err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf("%x", sha256.Sum256(stored))
+
+		var user User
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/"+u.Name, uploader.Cookie, nil), http.StatusOK, &user)
+		if user.IconHash != want {
+			t.Errorf("%s: icon_hash = %q, want sha256 of the stored image %q", u.Name, user.IconHash, want)
+		}
+	}
+}
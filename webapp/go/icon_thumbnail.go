@@ -0,0 +1,57 @@
+package main
+
+// 一覧に埋め込む小さいアイコン画像
+// アップロード時に作って元の画像と一緒に保存し、?size=thumb で返す
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// サムネイルの幅と高さ (ピクセル)
+const iconThumbnailSize = 64
+
+// iconThumbnail は画像の中央を正方形に切り抜き、iconThumbnailSize 四方に縮小した PNG を返す
+// 元の画像より大きくはしないので、小さい画像はそのままの大きさで切り抜くだけになる
+func iconThumbnail(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2))
+
+	size := min(side, iconThumbnailSize)
+	thumb := image.NewNRGBA(image.Rect(0, 0, size, size))
+	// 縮小後の1ピクセルに対応する元の画像の範囲を平均する
+	for y := 0; y < size; y++ {
+		y0 := crop.Min.Y + y*side/size
+		y1 := crop.Min.Y + (y+1)*side/size
+		for x := 0; x < size; x++ {
+			x0 := crop.Min.X + x*side/size
+			x1 := crop.Min.X + (x+1)*side/size
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			thumb.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, thumb); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func TestIconThumbnail(t *testing.T) {
+	resetTestDB(t)
+	user := newTestUser(t, "uploader")
+	small := newTestUser(t, "small")
+
+	original := newTestPNG(t, 200, 100)
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, "/api/icon", user.Cookie, &PostIconRequest{Image: original}), http.StatusCreated, &PostIconResponse{})
+	// iconThumbnailSize より小さい画像は拡大しない
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, "/api/icon", small.Cookie, &PostIconRequest{Image: newTestPNG(t, 32, 32)}), http.StatusCreated, &PostIconResponse{})
+
+	rec := doTestRequest(t, http.MethodGet, "/api/user/uploader/icon", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("original: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), original) {
+		t.Fatalf("original: got %d bytes that differ from the uploaded %d bytes", rec.Body.Len(), len(original))
+	}
+	originalETag := rec.Header().Get("ETag")
+
+	for _, tc := range []struct {
+		username string
+		want     int
+	}{
+		{username: "uploader", want: iconThumbnailSize},
+		{username: "small", want: 32},
+	} {
+		rec := doTestRequest(t, http.MethodGet, "/api/user/"+tc.username+"/icon?size=thumb", "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", tc.username, rec.Code, http.StatusOK)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "image/png" {
+			t.Errorf("%s: Content-Type = %q, want image/png", tc.username, got)
+		}
+		config, err := png.DecodeConfig(rec.Body)
+		if err != nil {
+			t.Fatalf("%s: thumbnail is not a png: %v", tc.username, err)
+		}
+		if config.Width != tc.want || config.Height != tc.want {
+			t.Errorf("%s: thumbnail is %dx%d, want %dx%d", tc.username, config.Width, config.Height, tc.want, tc.want)
+		}
+		if tc.username == "uploader" && rec.Header().Get("ETag") == originalETag {
+			t.Errorf("thumbnail has the same ETag %s as the original", originalETag)
+		}
+	}
+
+	// サムネイルを作っても元の画像は変わらない
+	rec = doTestRequest(t, http.MethodGet, "/api/user/uploader/icon", "", nil)
+	if !bytes.Equal(rec.Body.Bytes(), original) {
+		t.Fatalf("original changed after serving the thumbnail")
+	}
+
+	if rec := doTestRequest(t, http.MethodGet, "/api/user/uploader/icon?size=large", "", nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown size: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+// アップロードされたアイコン画像の検証
+// 画像として読めないものや、大きすぎる画像は保存しない
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	iconMaxBytesEnvKey     = "ISUCON13_ICON_MAX_BYTES"
+	iconMaxDimensionEnvKey = "ISUCON13_ICON_MAX_DIMENSION"
+)
+
+var (
+	// アイコン画像の大きさの上限 (バイト)
+	iconMaxBytes = 10 * 1024 * 1024
+	// アイコン画像の幅と高さの上限 (ピクセル)
+	iconMaxDimension = 4096
+)
+
+// loadIconValidationConfig は環境変数からアイコン画像の上限を読み込む
+func loadIconValidationConfig() error {
+	if v, ok := os.LookupEnv(iconMaxBytesEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("environment variable '%s' must be positive integer", iconMaxBytesEnvKey)
+		}
+		iconMaxBytes = n
+	}
+	if v, ok := os.LookupEnv(iconMaxDimensionEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("environment variable '%s' must be positive integer", iconMaxDimensionEnvKey)
+		}
+		iconMaxDimension = n
+	}
+	return nil
+}
+
+// validateIcon はアイコン画像が PNG か JPEG で、上限を超えていないことを確かめ、読み込んだ画像を返す
+func validateIcon(data []byte) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "image must not be empty")
+	}
+	if len(data) > iconMaxBytes {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("image must be at most %d bytes", iconMaxBytes))
+	}
+
+	// 展開すると巨大になる画像を読み込まないよう、先にヘッダだけで大きさを調べる
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "image must be png or jpeg")
+	}
+	if format != "png" && format != "jpeg" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "image must be png or jpeg")
+	}
+	if config.Width > iconMaxDimension || config.Height > iconMaxDimension {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("image must be at most %dx%d pixels", iconMaxDimension, iconMaxDimension))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to decode the image: "+err.Error())
+	}
+	return img, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"testing"
+)
+
+func TestPostIconValidation(t *testing.T) {
+	resetTestDB(t)
+	user := newTestUser(t, "uploader")
+
+	origBytes, origDimension := iconMaxBytes, iconMaxDimension
+	iconMaxDimension = 16
+	t.Cleanup(func() { iconMaxBytes, iconMaxDimension = origBytes, origDimension })
+
+	valid := newTestPNG(t, 16, 16)
+	rec := doTestRequest(t, http.MethodPost, "/api/icon", user.Cookie, &PostIconRequest{Image: valid})
+	decodeTestResponse(t, rec, http.StatusCreated, &PostIconResponse{})
+
+	var gifImage bytes.Buffer
+	if err := gif.Encode(&gifImage, image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.Black}), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		image    []byte
+		maxBytes int
+	}{
+		{name: "too many pixels", image: newTestPNG(t, 17, 16), maxBytes: origBytes},
+		{name: "too many bytes", image: newTestPNG(t, 16, 16), maxBytes: len(valid) - 1},
+		{name: "not an image", image: []byte("this is not an image"), maxBytes: origBytes},
+		{name: "gif", image: gifImage.Bytes(), maxBytes: origBytes},
+		{name: "empty", image: nil, maxBytes: origBytes},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			iconMaxBytes = tc.maxBytes
+			rec := doTestRequest(t, http.MethodPost, "/api/icon", user.Cookie, &PostIconRequest{Image: tc.image})
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+			}
+
+			// 弾いた画像は保存せず、ハッシュ値も前のアイコンのまま
+			var got User
+			decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/"+user.Name, user.Cookie, nil), http.StatusOK, &got)
+			if got.IconHash != hashIcon(valid) {
+				t.Fatalf("icon_hash = %q, want the hash of the valid icon %q", got.IconHash, hashIcon(valid))
+			}
+		})
+	}
+}
@@ -7,15 +7,51 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	livecommentReportThresholdEnvKey = "ISUCON13_LIVECOMMENT_REPORT_THRESHOLD"
+	livecommentDuplicateWindowEnvKey = "ISUCON13_LIVECOMMENT_DUPLICATE_WINDOW_SECONDS"
+)
+
+var (
+	// この人数から報告されたライブコメントは、一覧に表示しない。0 の場合は表示し続ける
+	livecommentReportThreshold int64 = 5
+	// 同じユーザが同じ配信に、直前と同じ文面のコメントをこの秒数以内に投稿したら断る。0 の場合は断らない
+	livecommentDuplicateWindowSeconds int64 = 10
+)
+
+// loadLivecommentReportConfig は環境変数から非表示にする報告数を読み込む
+func loadLivecommentReportConfig() error {
+	if v, ok := os.LookupEnv(livecommentReportThresholdEnvKey); ok {
+		threshold, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || threshold < 0 {
+			return fmt.Errorf("environment variable '%s' must be non-negative integer", livecommentReportThresholdEnvKey)
+		}
+		livecommentReportThreshold = threshold
+	}
+	return nil
+}
+
+// loadLivecommentDuplicateConfig は環境変数から同じ文面の連投を断る秒数を読み込む
+func loadLivecommentDuplicateConfig() error {
+	if v, ok := os.LookupEnv(livecommentDuplicateWindowEnvKey); ok {
+		window, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || window < 0 {
+			return fmt.Errorf("environment variable '%s' must be non-negative integer", livecommentDuplicateWindowEnvKey)
+		}
+		livecommentDuplicateWindowSeconds = window
+	}
+	return nil
+}
+
 type PostLivecommentRequest struct {
 	Comment string `json:"comment"`
 	Tip     int64  `json:"tip"`
@@ -28,6 +64,7 @@ type LivecommentModel struct {
 	Comment      string `db:"comment"`
 	Tip          int64  `db:"tip"`
 	CreatedAt    int64  `db:"created_at"`
+	ReportCount  int64  `db:"report_count"`
 }
 
 type Livecomment struct {
@@ -79,13 +116,18 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	ctx, tx, err := beginReadTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
+	// 多くの視聴者から報告されたライブコメントは表示しない
+	query := "SELECT * FROM livecomments WHERE livestream_id = ?"
+	if livecommentReportThreshold > 0 {
+		query += fmt.Sprintf(" AND report_count < %d", livecommentReportThreshold)
+	}
+	query += " ORDER BY created_at DESC"
 	if c.QueryParam("limit") != "" {
 		limit, err := strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
@@ -122,10 +164,10 @@ func getNgwords(c echo.Context) error {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
@@ -167,10 +209,10 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	var req *PostLivecommentRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
@@ -205,6 +247,10 @@ func postLivecommentHandler(c echo.Context) error {
 	}
 
 	now := time.Now().Unix()
+	if err := verifyLivecommentNotDuplicated(ctx, tx, userID, livestreamModel.ID, req.Comment, now); err != nil {
+		return err
+	}
+
 	livecommentModel := LivecommentModel{
 		UserID:       userID,
 		LivestreamID: int64(livestreamID),
@@ -224,6 +270,10 @@ func postLivecommentHandler(c echo.Context) error {
 	}
 	livecommentModel.ID = livecommentID
 
+	if err := addUserTipTotal(ctx, tx, userID, livecommentModel.Tip); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
 	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
@@ -233,9 +283,36 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	livestreamHeat.recordTip(livecommentModel.LivestreamID, livecommentModel.Tip)
+	livecommentsPostedTotal.Inc()
+	tipsReceivedTotal.Add(float64(livecommentModel.Tip))
+	if err := announceLivecomment(livecomment); err != nil {
+		c.Logger().Warnf("failed to marshal livecomment for broadcast: %+v", err)
+	}
+
 	return c.JSON(http.StatusCreated, livecomment)
 }
 
+// verifyLivecommentNotDuplicated は、ユーザがその配信に直前に投稿したコメントと同じ文面を
+// livecommentDuplicateWindowSeconds 以内に投稿しようとしていれば 429 を返す
+func verifyLivecommentNotDuplicated(ctx context.Context, tx *sqlx.Tx, userID int64, livestreamID int64, comment string, now int64) error {
+	if livecommentDuplicateWindowSeconds == 0 {
+		return nil
+	}
+
+	var previous string
+	if err := tx.GetContext(ctx, &previous, "SELECT comment FROM livecomments WHERE user_id = ? AND livestream_id = ? AND created_at > ? ORDER BY id DESC LIMIT 1", userID, livestreamID, now-livecommentDuplicateWindowSeconds); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get previous livecomment: "+err.Error())
+	}
+	if previous == comment {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "同じコメントを続けて投稿することはできません")
+	}
+	return nil
+}
+
 func reportLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -253,10 +330,10 @@ func reportLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -282,6 +359,17 @@ func reportLivecommentHandler(c echo.Context) error {
 		}
 	}
 
+	// 報告数は報告したユーザの人数なので、同じユーザが何度報告しても1人と数える
+	var reported int64
+	if err := tx.GetContext(ctx, &reported, "SELECT COUNT(*) FROM livecomment_reports WHERE user_id = ? AND livecomment_id = ?", userID, livecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomment reports: "+err.Error())
+	}
+	if reported == 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE livecomments SET report_count = report_count + 1 WHERE id = ?", livecommentID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livecomment report count: "+err.Error())
+		}
+	}
+
 	now := time.Now().Unix()
 	reportModel := LivecommentReportModel{
 		UserID:        int64(userID),
@@ -324,10 +412,10 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	var req *ModerateRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
@@ -376,10 +464,13 @@ func moderateHandler(c echo.Context) error {
 	}
 
 	var matchedCommentIDs []int64
+	// 削除するライブコメントのチップを、送ったユーザの合計から引く
+	deletedTips := make(map[int64]int64)
 	for _, livecomment := range livecomments {
 		for _, ngword := range ngwords {
 			if strings.Contains(livecomment.Comment, ngword.Word) {
 				matchedCommentIDs = append(matchedCommentIDs, livecomment.ID)
+				deletedTips[livecomment.UserID] += livecomment.Tip
 				break
 			}
 		}
@@ -395,6 +486,16 @@ func moderateHandler(c echo.Context) error {
 		if _, err := tx.ExecContext(ctx, query, param...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
 		}
+		for tipperID, tip := range deletedTips {
+			if err := addUserTipTotal(ctx, tx, tipperID, -tip); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+		}
+	}
+
+	// 絵文字名に NG ワードを含むリアクションも同じトランザクションで削除する
+	if err := purgeNGWordReactions(ctx, tx, int64(livestreamID), int64(userID), req.NGWord); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -475,21 +576,10 @@ func fillLivecommentResponses(ctx context.Context, tx *sqlx.Tx, livecommentModel
 		themeMap[themeModel.UserID] = themeModel
 	}
 
-	var livestreamIconHashes []struct {
-		UserID int64  `db:"user_id"`
-		Hash   string `db:"hash"`
-	}
-	query, params, err = sqlx.In("SELECT i.user_id, ih.hash FROM icon_hashes AS ih JOIN icons AS i ON i.id = ih.icon_id WHERE i.user_id IN (?)", commentOwnerIDs)
+	hashMap, err := iconStore.Hashes(ctx, tx, commentOwnerIDs)
 	if err != nil {
 		return nil, err
 	}
-	if err := tx.SelectContext(ctx, &livestreamIconHashes, query, params...); err != nil {
-		return nil, err
-	}
-	hashMap := make(map[int64]string, len(livestreamIconHashes))
-	for _, livestreamIconHash := range livestreamIconHashes {
-		hashMap[livestreamIconHash.UserID] = livestreamIconHash.Hash
-	}
 
 	livestreamIDs := make([]int64, len(livecommentModels))
 	for i := range livestreamIDs {
@@ -543,6 +633,58 @@ func fillLivecommentResponses(ctx context.Context, tx *sqlx.Tx, livecommentModel
 	return livecomments, nil
 }
 
+// fillLivecommentReportResponses は報告をまとめて組み立てる
+// 報告したユーザはキャッシュを使う fillUserResponses で、報告されたライブコメントは fillLivecommentResponses でまとめて組み立てる
+// NGワードで削除されたライブコメントへの報告は含めない
+func fillLivecommentReportResponses(ctx context.Context, tx *sqlx.Tx, reportModels []*LivecommentReportModel) ([]LivecommentReport, error) {
+	if len(reportModels) == 0 {
+		return []LivecommentReport{}, nil
+	}
+
+	reporterIDs := make([]int64, len(reportModels))
+	livecommentIDs := make([]int64, len(reportModels))
+	for i := range reportModels {
+		reporterIDs[i] = reportModels[i].UserID
+		livecommentIDs[i] = reportModels[i].LivecommentID
+	}
+	reporters, err := fillUserResponses(ctx, tx, reporterIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	livecommentModels := []LivecommentModel{}
+	query, params, err := sqlx.In("SELECT * FROM livecomments WHERE id IN (?)", livecommentIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &livecommentModels, query, params...); err != nil {
+		return nil, err
+	}
+	livecomments, err := fillLivecommentResponses(ctx, tx, livecommentModels)
+	if err != nil {
+		return nil, err
+	}
+	livecommentMap := make(map[int64]Livecomment, len(livecomments))
+	for _, livecomment := range livecomments {
+		livecommentMap[livecomment.ID] = livecomment
+	}
+
+	reports := make([]LivecommentReport, 0, len(reportModels))
+	for _, reportModel := range reportModels {
+		livecomment, ok := livecommentMap[reportModel.LivecommentID]
+		if !ok {
+			continue
+		}
+		reports = append(reports, LivecommentReport{
+			ID:          reportModel.ID,
+			Reporter:    reporters[reportModel.UserID],
+			Livecomment: livecomment,
+			CreatedAt:   reportModel.CreatedAt,
+		})
+	}
+	return reports, nil
+}
+
 func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel LivecommentReportModel) (LivecommentReport, error) {
 	reporterModel := UserModel{}
 	if err := tx.GetContext(ctx, &reporterModel, "SELECT * FROM users WHERE id = ?", reportModel.UserID); err != nil {
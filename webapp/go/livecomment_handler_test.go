@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReportLivecomment(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	now := time.Now().Unix()
+	livestreamID := newTestLivestream(t, owner.ID, "stream", now-3600, now+3600)
+	abusiveID := newTestLivecomment(t, alice.ID, livestreamID, "abusive", 0)
+	normalID := newTestLivecomment(t, alice.ID, livestreamID, "normal", 0)
+
+	orig := livecommentReportThreshold
+	livecommentReportThreshold = 2
+	t.Cleanup(func() { livecommentReportThreshold = orig })
+
+	report := func(user testUser, livecommentID int64) int {
+		t.Helper()
+		return doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/livecomment/%d/report", livestreamID, livecommentID), user.Cookie, nil).Code
+	}
+	listedIDs := func() []int64 {
+		t.Helper()
+		var livecomments []Livecomment
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/livecomment", livestreamID), owner.Cookie, nil), http.StatusOK, &livecomments)
+		ids := make([]int64, len(livecomments))
+		for i, livecomment := range livecomments {
+			ids[i] = livecomment.ID
+		}
+		return ids
+	}
+
+	// 同じユーザが何度報告しても1人と数えるので、まだ表示される
+	for i := 0; i < 2; i++ {
+		if code := report(owner, abusiveID); code != http.StatusCreated {
+			t.Fatalf("report %d: status = %d, want %d", i, code, http.StatusCreated)
+		}
+	}
+	if got := countTestRows(t, "SELECT report_count FROM livecomments WHERE id = ?", abusiveID); got != 1 {
+		t.Fatalf("report_count = %d after one user reported twice, want 1", got)
+	}
+	if got := listedIDs(); len(got) != 2 {
+		t.Fatalf("listed %v below the threshold, want both livecomments", got)
+	}
+
+	// しきい値の人数に達すると一覧から消える
+	if code := report(bob, abusiveID); code != http.StatusCreated {
+		t.Fatalf("report by bob: status = %d, want %d", code, http.StatusCreated)
+	}
+	if got := listedIDs(); len(got) != 1 || got[0] != normalID {
+		t.Fatalf("listed %v at the threshold, want only %d", got, normalID)
+	}
+
+	if code := report(bob, 9999); code != http.StatusNotFound {
+		t.Fatalf("report unknown livecomment: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// 報告一覧は配信者だけが見られ、報告したユーザも含まれる
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/report", livestreamID), owner.Cookie, nil)
+	var reports []LivecommentReport
+	decodeTestResponse(t, rec, http.StatusOK, &reports)
+	if len(reports) != 3 {
+		t.Fatalf("got %d reports, want 3", len(reports))
+	}
+	reporters := map[string]int{}
+	for _, r := range reports {
+		if r.Livecomment.ID != abusiveID {
+			t.Errorf("report %d is for livecomment %d, want %d", r.ID, r.Livecomment.ID, abusiveID)
+		}
+		reporters[r.Reporter.Name]++
+	}
+	if reporters["owner"] != 2 || reporters["bob"] != 1 {
+		t.Fatalf("got reporters %v, want owner twice and bob once", reporters)
+	}
+
+	if rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/report", livestreamID), alice.Cookie, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("reports by a viewer: status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestPostLivecommentDuplicate(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	now := time.Now().Unix()
+	livestreamID := newTestLivestream(t, owner.ID, "stream", now-3600, now+3600)
+	otherLivestreamID := newTestLivestream(t, owner.ID, "other stream", now-3600, now+3600)
+
+	post := func(user testUser, livestreamID int64, comment string) int {
+		t.Helper()
+		return doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/livecomment", livestreamID), user.Cookie, &PostLivecommentRequest{Comment: comment}).Code
+	}
+
+	for _, tc := range []struct {
+		name         string
+		user         testUser
+		livestreamID int64
+		comment      string
+		status       int
+	}{
+		{name: "first", user: viewer, livestreamID: livestreamID, comment: "hello", status: http.StatusCreated},
+		{name: "duplicate within the window", user: viewer, livestreamID: livestreamID, comment: "hello", status: http.StatusTooManyRequests},
+		{name: "other user", user: owner, livestreamID: livestreamID, comment: "hello", status: http.StatusCreated},
+		{name: "other livestream", user: viewer, livestreamID: otherLivestreamID, comment: "hello", status: http.StatusCreated},
+		{name: "different text", user: viewer, livestreamID: livestreamID, comment: "bye", status: http.StatusCreated},
+		// 比べるのは直前のコメントだけ
+		{name: "same as the one before the previous", user: viewer, livestreamID: livestreamID, comment: "hello", status: http.StatusCreated},
+	} {
+		if code := post(tc.user, tc.livestreamID, tc.comment); code != tc.status {
+			t.Fatalf("%s: status = %d, want %d", tc.name, code, tc.status)
+		}
+	}
+
+	// 期間が過ぎた後は同じ文面でも投稿できる
+	if _, err := dbConn.Exec("UPDATE livecomments SET created_at = created_at - ? WHERE user_id = ?", livecommentDuplicateWindowSeconds, viewer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if code := post(viewer, livestreamID, "hello"); code != http.StatusCreated {
+		t.Fatalf("after the window: status = %d, want %d", code, http.StatusCreated)
+	}
+
+	// 0 を設定すると連投を断らない
+	orig := livecommentDuplicateWindowSeconds
+	livecommentDuplicateWindowSeconds = 0
+	t.Cleanup(func() { livecommentDuplicateWindowSeconds = orig })
+	if code := post(viewer, livestreamID, "hello"); code != http.StatusCreated {
+		t.Fatalf("window disabled: status = %d, want %d", code, http.StatusCreated)
+	}
+}
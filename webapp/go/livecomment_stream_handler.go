@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 投稿されたライブコメントの配信にも、リアクションと同じハブを使う
+// IDの重複排除はハブごとに行うので、リアクションとは別のインスタンスにする
+var livecommentBroadcaster = newReactionHub()
+
+// announceLivecomment はコミット済みのライブコメントを購読者へ配信する
+func announceLivecomment(livecomment Livecomment) error {
+	msg, err := json.Marshal(livecomment)
+	if err != nil {
+		return err
+	}
+	livecommentBroadcaster.publishAsync(livecomment.Livestream.ID, livecomment.ID, msg)
+	return nil
+}
+
+// ライブコメントのリアルタイム配信API (Server-Sent Events)
+// GET /api/livestream/:livestream_id/livecomments/sse?overflow=
+// WebSocketを使えないクライアント向け。overflow の意味はリアクションの配信と同じ
+func getLivecommentsSSEHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	policy, err := parseReactionOverflowPolicy(c.QueryParam("overflow"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "overflow query parameter must be one of drop-newest, drop-oldest, disconnect")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 上限に達していることをHTTPのステータスで返せるよう、ヘッダを書く前に購読する
+	sub, err := livecommentBroadcaster.subscribe(int64(livestreamID), policy)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "failed to subscribe livecomments: "+err.Error())
+	}
+	defer livecommentBroadcaster.unsubscribe(int64(livestreamID), sub)
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+	c.Response().Header().Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	for {
+		select {
+		case msg := <-sub.ch:
+			// JSONは改行を含まないので、1行の data フィールドにそのまま入れられる
+			if _, err := fmt.Fprintf(c.Response(), "event: livecomment\ndata: %s\n\n", msg); err != nil {
+				return nil
+			}
+			c.Response().Flush()
+		case <-sub.kicked:
+			return nil
+		case <-ctx.Done():
+			// クライアントが切断した
+			return nil
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLivecommentsSSE(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	now := time.Now().Unix()
+	livestreamID := newTestLivestream(t, owner.ID, "stream", now-3600, now+3600)
+
+	server := httptest.NewServer(testEcho)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/livestream/%d/livecomments/sse", server.URL, livestreamID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Cookie", viewer.Cookie)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if got := res.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", got)
+	}
+
+	// ヘッダが返った時点で購読しているので、この後に投稿したライブコメントは届く
+	rec := doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/livecomment", livestreamID), owner.Cookie, &PostLivecommentRequest{Comment: "hello"})
+	decodeTestResponse(t, rec, http.StatusCreated, nil)
+
+	// 空行までを1つのイベントとして読む
+	lines := make(chan []string, 1)
+	go func() {
+		var event []string
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if scanner.Text() == "" {
+				break
+			}
+			event = append(event, scanner.Text())
+		}
+		lines <- event
+	}()
+	var event []string
+	select {
+	case event = <-lines:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event received")
+	}
+	if len(event) != 2 || event[0] != "event: livecomment" || !strings.HasPrefix(event[1], "data: ") {
+		t.Fatalf("got event %q, want a livecomment event with data", event)
+	}
+	var livecomment Livecomment
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(event[1], "data: ")), &livecomment); err != nil {
+		t.Fatalf("data is not a livecomment: %v", err)
+	}
+	if livecomment.Comment != "hello" || livecomment.User.ID != owner.ID {
+		t.Fatalf("got livecomment %+v, want hello by owner", livecomment)
+	}
+
+	// クライアントが切断すると購読をやめる
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		livecommentBroadcaster.mu.Lock()
+		subscribers := len(livecommentBroadcaster.subscribers[livestreamID])
+		livecommentBroadcaster.mu.Unlock()
+		if subscribers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still %d subscribers after the client disconnected", subscribers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -7,11 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -52,6 +52,12 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	// 表示されるリアクションの件数
+	ReactionCount int64 `json:"reaction_count"`
+	// 現在視聴しているユーザ数
+	ViewerCount int64 `json:"viewer_count"`
+	// include=heat を指定した場合のみ含める
+	Heat *float64 `json:"heat,omitempty"`
 }
 
 type LivestreamTagModel struct {
@@ -76,10 +82,10 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	var req *ReserveLivestreamRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
@@ -121,6 +127,17 @@ func reserveLivestreamHandler(c echo.Context) error {
 		}
 	}
 
+	// 同じユーザの予約と時間が重なる場合は予約できない
+	// 終了時刻ちょうどに始まる予約は重ならないものとして扱う
+	// NOTE: 並列な予約で重複を見逃さないよう、最新の値を読むためにFOR UPDATEが必要
+	var overlappingIDs []int64
+	if err := tx.SelectContext(ctx, &overlappingIDs, "SELECT id FROM livestreams WHERE user_id = ? AND start_at < ? AND end_at > ? FOR UPDATE", userID, req.EndAt, req.StartAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get overlapping livestreams: "+err.Error())
+	}
+	if len(overlappingIDs) > 0 {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("予約区間 %d ~ %dは予約済みのライブ配信 (id = %d) と重なっています", req.StartAt, req.EndAt, overlappingIDs[0]))
+	}
+
 	var (
 		livestreamModel = &LivestreamModel{
 			UserID:       int64(userID),
@@ -172,34 +189,65 @@ func reserveLivestreamHandler(c echo.Context) error {
 
 func searchLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
+	// tag は複数指定でき、すべてのタグが付いた配信に絞り込む
+	keyTagNames := make([]string, 0, len(c.QueryParams()["tag"]))
+	for _, name := range c.QueryParams()["tag"] {
+		if name != "" && !slices.Contains(keyTagNames, name) {
+			keyTagNames = append(keyTagNames, name)
+		}
+	}
+	statusWhere, statusArgs, err := livestreamStatusWhere(c.QueryParam("status"), "l", time.Now().Unix())
+	if err != nil {
+		return err
+	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	ctx, tx, err := beginReadTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
+	livestreamModels := []*LivestreamModel{}
+	if len(keyTagNames) > 0 {
 		// タグによる取得
 		var tagIDList []int
-		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
+		query, params, err := sqlx.In("SELECT id FROM tags WHERE name IN (?)", keyTagNames)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct getting tags query: "+err.Error())
+		}
+		if err := tx.SelectContext(ctx, &tagIDList, query, params...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
 		}
 
-		q := "SELECT `l`.* FROM livestreams AS l INNER JOIN `livestream_tags` AS `lt` ON `l`.`id` = `lt`.`livestream_id` WHERE `lt`.`tag_id` IN (?) ORDER BY `l`.`id` DESC"
+		// 存在しないタグが含まれていれば、すべてのタグが付いた配信はない
+		if len(tagIDList) == len(keyTagNames) {
+			q := "SELECT `l`.* FROM livestreams AS l INNER JOIN `livestream_tags` AS `lt` ON `l`.`id` = `lt`.`livestream_id` WHERE `lt`.`tag_id` IN (?)"
+			args := []interface{}{tagIDList}
+			if statusWhere != "" {
+				q += " AND " + statusWhere
+				args = append(args, statusArgs...)
+			}
+			if len(tagIDList) > 1 {
+				q += " GROUP BY `l`.`id` HAVING COUNT(DISTINCT `lt`.`tag_id`) = ?"
+				args = append(args, len(tagIDList))
+			}
+			q += " ORDER BY `l`.`id` DESC"
 
-		query, params, err := sqlx.In(q, tagIDList)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct getting livestreams query: "+err.Error())
-		}
-		if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+			query, params, err := sqlx.In(q, args...)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct getting livestreams query: "+err.Error())
+			}
+			if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+			}
 		}
 	} else {
 		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
+		query := "SELECT * FROM livestreams AS l"
+		if statusWhere != "" {
+			query += " WHERE " + statusWhere
+		}
+		query += " ORDER BY id DESC"
 		if c.QueryParam("limit") != "" {
 			limit, err := strconv.Atoi(c.QueryParam("limit"))
 			if err != nil {
@@ -208,12 +256,15 @@ func searchLivestreamsHandler(c echo.Context) error {
 			query += fmt.Sprintf(" LIMIT %d", limit)
 		}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
+		if err := tx.SelectContext(ctx, &livestreamModels, query, statusArgs...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
 	}
 
-	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	include := parseIncludeParam(c)
+	livestreams, err := fillLivestreamResponsesWithOptions(ctx, tx, livestreamModels, livestreamFillOptions{
+		Heat: include["heat"],
+	})
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
@@ -225,6 +276,23 @@ func searchLivestreamsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, livestreams)
 }
 
+// livestreamStatusWhere は status で配信を絞り込む条件を返す。status が空の場合は絞り込まない
+// live は配信中、upcoming は開始前、ended は終了後の配信
+func livestreamStatusWhere(status string, alias string, now int64) (string, []interface{}, error) {
+	switch status {
+	case "":
+		return "", nil, nil
+	case "live":
+		return alias + ".start_at <= ? AND " + alias + ".end_at > ?", []interface{}{now, now}, nil
+	case "upcoming":
+		return alias + ".start_at > ?", []interface{}{now}, nil
+	case "ended":
+		return alias + ".end_at <= ?", []interface{}{now}, nil
+	default:
+		return "", nil, echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be one of live, upcoming or ended")
+	}
+}
+
 func getMyLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	if err := verifyUserSession(c); err != nil {
@@ -237,17 +305,20 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	var livestreamModels []*LivestreamModel
 	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
-	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	include := parseIncludeParam(c)
+	livestreams, err := fillLivestreamResponsesWithOptions(ctx, tx, livestreamModels, livestreamFillOptions{
+		Heat: include["heat"],
+	})
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
 	}
@@ -287,7 +358,10 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
-	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	include := parseIncludeParam(c)
+	livestreams, err := fillLivestreamResponsesWithOptions(ctx, tx, livestreamModels, livestreamFillOptions{
+		Heat: include["heat"],
+	})
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
 	}
@@ -307,10 +381,10 @@ func enterLivestreamHandler(c echo.Context) error {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
@@ -332,6 +406,10 @@ func enterLivestreamHandler(c echo.Context) error {
 	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
+	// 視聴履歴とは別に、視聴中のユーザを1人1行で記録する。入室し直しても数が増えないよう、既にあれば何もしない
+	if _, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO livestream_viewers (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_viewer: "+err.Error())
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
@@ -347,10 +425,10 @@ func exitLivestreamHandler(c echo.Context) error {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
@@ -366,6 +444,9 @@ func exitLivestreamHandler(c echo.Context) error {
 	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
 	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_viewer: "+err.Error())
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
@@ -374,6 +455,47 @@ func exitLivestreamHandler(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+type LivestreamViewerCount struct {
+	ViewerCount int64 `json:"viewer_count"`
+}
+
+// 視聴者数取得API
+// GET /api/livestream/:livestream_id/viewers/count
+func getLivestreamViewerCountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	var viewerCount int64
+	if err := tx.GetContext(ctx, &viewerCount, "SELECT COUNT(*) FROM livestream_viewers WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count viewers: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &LivestreamViewerCount{ViewerCount: viewerCount})
+}
+
 func getLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -436,10 +558,10 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
-	// error already check
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already check
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	if livestreamModel.UserID != userID {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
@@ -450,13 +572,9 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
 	}
 
-	reports := make([]LivecommentReport, len(reportModels))
-	for i := range reportModels {
-		report, err := fillLivecommentReportResponse(ctx, tx, *reportModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
-		}
-		reports[i] = report
+	reports, err := fillLivecommentReportResponses(ctx, tx, reportModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment reports: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -494,21 +612,43 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		}
 	}
 
+	// まとめて投稿されたリアクションは1行に件数を持つので、行数ではなく count の合計を数える
+	var reactionCount int64
+	if err := tx.GetContext(ctx, &reactionCount, "SELECT IFNULL(SUM(count), 0) FROM reactions WHERE livestream_id = ? AND "+visibleReactionsWhere(""), livestreamModel.ID); err != nil {
+		return Livestream{}, err
+	}
+
+	var viewerCount int64
+	if err := tx.GetContext(ctx, &viewerCount, "SELECT COUNT(*) FROM livestream_viewers WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return Livestream{}, err
+	}
+
 	livestream := Livestream{
-		ID:           livestreamModel.ID,
-		Owner:        owner,
-		Title:        livestreamModel.Title,
-		Tags:         tags,
-		Description:  livestreamModel.Description,
-		PlaylistUrl:  livestreamModel.PlaylistUrl,
-		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-		StartAt:      livestreamModel.StartAt,
-		EndAt:        livestreamModel.EndAt,
+		ID:            livestreamModel.ID,
+		Owner:         owner,
+		Title:         livestreamModel.Title,
+		Tags:          tags,
+		Description:   livestreamModel.Description,
+		PlaylistUrl:   livestreamModel.PlaylistUrl,
+		ThumbnailUrl:  livestreamModel.ThumbnailUrl,
+		StartAt:       livestreamModel.StartAt,
+		EndAt:         livestreamModel.EndAt,
+		ReactionCount: reactionCount,
+		ViewerCount:   viewerCount,
 	}
 	return livestream, nil
 }
 
+// livestreamFillOptions は、配信一覧に追加で含める情報を指定する
+type livestreamFillOptions struct {
+	Heat bool
+}
+
 func fillLivestreamResponses(ctx context.Context, tx *sqlx.Tx, livestreamModels []*LivestreamModel) ([]Livestream, error) {
+	return fillLivestreamResponsesWithOptions(ctx, tx, livestreamModels, livestreamFillOptions{})
+}
+
+func fillLivestreamResponsesWithOptions(ctx context.Context, tx *sqlx.Tx, livestreamModels []*LivestreamModel, opts livestreamFillOptions) ([]Livestream, error) {
 	if len(livestreamModels) == 0 {
 		return []Livestream{}, nil
 	}
@@ -520,40 +660,18 @@ func fillLivestreamResponses(ctx context.Context, tx *sqlx.Tx, livestreamModels
 		livestreamIDs[i] = ls.ID
 	}
 
-	ownerModels := []UserModel{}
-	query, params, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", livestreamUserIDs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to construct getting users query: %w", err)
-	}
-	if err := tx.SelectContext(ctx, &ownerModels, query, params...); err != nil {
-		return nil, err
-	}
-
-	ownerMap := make(map[int64]UserModel, len(ownerModels))
-	for _, ownerModel := range ownerModels {
-		ownerMap[ownerModel.ID] = ownerModel
-	}
-
-	themeModels := []ThemeModel{}
-	query, params, err = sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", livestreamUserIDs)
+	// 配信者は一覧の中で重複しやすいので、ユーザ情報はキャッシュを使う fillUserResponses でまとめて組み立てる
+	owners, err := fillUserResponses(ctx, tx, livestreamUserIDs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to construct getting themes query: %w", err)
-	}
-	if err := tx.SelectContext(ctx, &themeModels, query, params...); err != nil {
 		return nil, err
 	}
 
-	themeMap := make(map[int64]ThemeModel, len(themeModels))
-	for _, themeModel := range themeModels {
-		themeMap[themeModel.UserID] = themeModel
-	}
-
 	var livestreamTags []struct {
 		LivestreamID int64  `db:"livestream_id"`
 		TagID        int64  `db:"id"`
 		TagName      string `db:"name"`
 	}
-	query, params, err = sqlx.In("SELECT lt.livestream_id, t.* FROM tags AS t INNER JOIN `livestream_tags` AS `lt` ON `t`.`id` = `lt`.`tag_id` WHERE `lt`.`livestream_id` IN (?)", livestreamIDs)
+	query, params, err := sqlx.In("SELECT lt.livestream_id, t.* FROM tags AS t INNER JOIN `livestream_tags` AS `lt` ON `t`.`id` = `lt`.`tag_id` WHERE `lt`.`livestream_id` IN (?)", livestreamIDs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct getting tags query: %w", err)
 	}
@@ -568,57 +686,60 @@ func fillLivestreamResponses(ctx context.Context, tx *sqlx.Tx, livestreamModels
 		})
 	}
 
-	var livestreamIconHashes []struct {
-		UserID int64  `db:"user_id"`
-		Hash   string `db:"hash"`
+	var reactionCounts []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"cnt"`
 	}
-	query, params, err = sqlx.In("SELECT i.user_id, ih.hash FROM icon_hashes AS ih JOIN icons AS i ON i.id = ih.icon_id WHERE i.user_id IN (?)", livestreamUserIDs)
+	query, params, err = sqlx.In("SELECT livestream_id, SUM(count) AS cnt FROM reactions WHERE livestream_id IN (?) AND "+visibleReactionsWhere("")+" GROUP BY livestream_id", livestreamIDs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to construct getting icon hashes query: %w", err)
+		return nil, fmt.Errorf("failed to construct counting reactions query: %w", err)
 	}
-	if err := tx.SelectContext(ctx, &livestreamIconHashes, query, params...); err != nil {
+	if err := tx.SelectContext(ctx, &reactionCounts, query, params...); err != nil {
 		return nil, err
 	}
-	hashMap := make(map[int64]string, len(livestreamIconHashes))
-	for _, livestreamIconHash := range livestreamIconHashes {
-		hashMap[livestreamIconHash.UserID] = livestreamIconHash.Hash
+	reactionCountMap := make(map[int64]int64, len(reactionCounts))
+	for _, reactionCount := range reactionCounts {
+		reactionCountMap[reactionCount.LivestreamID] = reactionCount.Count
 	}
 
-	for i := range livestreamModels {
-		owner := ownerMap[livestreamModels[i].UserID]
-		themeModel := themeMap[livestreamModels[i].UserID]
-		iconHash, ok := hashMap[livestreamModels[i].UserID]
-		if !ok {
-			iconHash = fallbackImageHash
-		}
-
-		user := User{
-			ID:          owner.ID,
-			Name:        owner.Name,
-			DisplayName: owner.DisplayName,
-			Description: owner.Description,
-			Theme: Theme{
-				ID:       themeModel.ID,
-				DarkMode: themeModel.DarkMode,
-			},
-			IconHash: iconHash,
-		}
+	var viewerCounts []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"cnt"`
+	}
+	query, params, err = sqlx.In("SELECT livestream_id, COUNT(*) AS cnt FROM livestream_viewers WHERE livestream_id IN (?) GROUP BY livestream_id", livestreamIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct counting viewers query: %w", err)
+	}
+	if err := tx.SelectContext(ctx, &viewerCounts, query, params...); err != nil {
+		return nil, err
+	}
+	viewerCountMap := make(map[int64]int64, len(viewerCounts))
+	for _, viewerCount := range viewerCounts {
+		viewerCountMap[viewerCount.LivestreamID] = viewerCount.Count
+	}
 
+	for i := range livestreamModels {
 		tags, ok := tagMap[livestreamModels[i].ID]
 		if !ok {
 			tags = []Tag{}
 		}
 
 		livestream := Livestream{
-			ID:           livestreamModels[i].ID,
-			Owner:        user,
-			Title:        livestreamModels[i].Title,
-			Tags:         tags,
-			Description:  livestreamModels[i].Description,
-			PlaylistUrl:  livestreamModels[i].PlaylistUrl,
-			ThumbnailUrl: livestreamModels[i].ThumbnailUrl,
-			StartAt:      livestreamModels[i].StartAt,
-			EndAt:        livestreamModels[i].EndAt,
+			ID:            livestreamModels[i].ID,
+			Owner:         owners[livestreamModels[i].UserID],
+			Title:         livestreamModels[i].Title,
+			Tags:          tags,
+			Description:   livestreamModels[i].Description,
+			PlaylistUrl:   livestreamModels[i].PlaylistUrl,
+			ThumbnailUrl:  livestreamModels[i].ThumbnailUrl,
+			StartAt:       livestreamModels[i].StartAt,
+			EndAt:         livestreamModels[i].EndAt,
+			ReactionCount: reactionCountMap[livestreamModels[i].ID],
+			ViewerCount:   viewerCountMap[livestreamModels[i].ID],
+		}
+		if opts.Heat {
+			heat := livestreamHeat.get(livestreamModels[i].ID)
+			livestream.Heat = &heat
 		}
 		livestreams[i] = livestream
 	}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLivestreamReactionCount(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	busyID := newTestLivestream(t, owner.ID, "busy", 0, 1)
+	quietID := newTestLivestream(t, owner.ID, "quiet", 0, 1)
+	emptyID := newTestLivestream(t, owner.ID, "empty", 0, 1)
+
+	now := time.Now().Unix()
+	// まとめて投稿された行は count の分だけ数え、取り消されたリアクションは数えない
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: busyID, EmojiName: ":tada:", CreatedAt: now, Count: 3})
+	newTestReaction(t, ReactionModel{UserID: owner.ID, LivestreamID: busyID, EmojiName: ":heart:", CreatedAt: now})
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: busyID, EmojiName: ":heart:", CreatedAt: now, DeletedAt: now})
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: quietID, EmojiName: ":tada:", CreatedAt: now})
+	want := map[int64]int64{busyID: 4, quietID: 1, emptyID: 0}
+
+	for id, count := range want {
+		var livestream Livestream
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d", id), viewer.Cookie, nil), http.StatusOK, &livestream)
+		if livestream.ReactionCount != count {
+			t.Errorf("livestream %d: reaction_count = %d, want %d", id, livestream.ReactionCount, count)
+		}
+	}
+
+	// 一覧は一括取得の経路で数える
+	var livestreams []Livestream
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/owner/livestream", viewer.Cookie, nil), http.StatusOK, &livestreams)
+	if len(livestreams) != len(want) {
+		t.Fatalf("got %d livestreams, want %d", len(livestreams), len(want))
+	}
+	for _, livestream := range livestreams {
+		if livestream.ReactionCount != want[livestream.ID] {
+			t.Errorf("list livestream %d: reaction_count = %d, want %d", livestream.ID, livestream.ReactionCount, want[livestream.ID])
+		}
+	}
+}
+
+// seedTestLivestreams は配信者がそれぞれ違う配信を n 件入れる
+func seedTestLivestreams(t testing.TB, n int) []*LivestreamModel {
+	t.Helper()
+	livestreamModels := make([]*LivestreamModel, n)
+	for i := range livestreamModels {
+		owner := newTestUser(t, fmt.Sprintf("owner%d", i))
+		livestreamModels[i] = &LivestreamModel{}
+		if err := dbConn.Get(livestreamModels[i], "SELECT * FROM livestreams WHERE id = ?", newTestLivestream(t, owner.ID, "stream", 0, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return livestreamModels
+}
+
+// countFillLivestreamQueries は fillLivestreamResponses が発行したクエリ数を返す
+// context にキャッシュの世代を持たせないので、ユーザ情報のキャッシュは使わずに毎回引く
+func countFillLivestreamQueries(t testing.TB, livestreamModels []*LivestreamModel) int64 {
+	t.Helper()
+	ctx, counter := withQueryCounter(context.Background(), false)
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, livestream := range livestreams {
+		if livestream.Owner.ID != livestreamModels[i].UserID {
+			t.Fatalf("livestream %d: got owner %d, want %d", livestream.ID, livestream.Owner.ID, livestreamModels[i].UserID)
+		}
+	}
+	return counter.count.Load()
+}
+
+func TestFillLivestreamResponsesQueryCount(t *testing.T) {
+	resetTestDB(t)
+	livestreamModels := seedTestLivestreams(t, 20)
+
+	// 配信者ごとにユーザ、テーマ、アイコンを引かず、件数によらず同じクエリ数で済む
+	one := countFillLivestreamQueries(t, livestreamModels[:1])
+	if many := countFillLivestreamQueries(t, livestreamModels); many != one {
+		t.Fatalf("got %d queries for %d livestreams, want %d as for 1", many, len(livestreamModels), one)
+	}
+}
+
+func BenchmarkFillLivestreamResponses(b *testing.B) {
+	for _, n := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("livestreams=%d", n), func(b *testing.B) {
+			resetTestDB(b)
+			livestreamModels := seedTestLivestreams(b, n)
+
+			b.ResetTimer()
+			var queries int64
+			for i := 0; i < b.N; i++ {
+				queries += countFillLivestreamQueries(b, livestreamModels)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+		})
+	}
+}
+
+func TestLivestreamViewers(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, owner.ID, "other stream", 0, 1)
+
+	visit := func(user testUser, method, action string) {
+		t.Helper()
+		decodeTestResponse(t, doTestRequest(t, method, fmt.Sprintf("/api/livestream/%d/%s", livestreamID, action), user.Cookie, nil), http.StatusOK, nil)
+	}
+	assertViewers := func(want int64) {
+		t.Helper()
+		var count LivestreamViewerCount
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/viewers/count", livestreamID), owner.Cookie, nil), http.StatusOK, &count)
+		if count.ViewerCount != want {
+			t.Fatalf("viewers/count = %d, want %d", count.ViewerCount, want)
+		}
+		var livestream Livestream
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d", livestreamID), owner.Cookie, nil), http.StatusOK, &livestream)
+		if livestream.ViewerCount != want {
+			t.Fatalf("viewer_count = %d, want %d", livestream.ViewerCount, want)
+		}
+	}
+
+	assertViewers(0)
+	// 同じユーザが何度入室しても1人と数える
+	visit(alice, http.MethodPost, "enter")
+	visit(alice, http.MethodPost, "enter")
+	visit(bob, http.MethodPost, "enter")
+	assertViewers(2)
+
+	visit(alice, http.MethodDelete, "exit")
+	assertViewers(1)
+	// 退室済みでも、もう一度退室できる
+	visit(alice, http.MethodDelete, "exit")
+	assertViewers(1)
+
+	var other LivestreamViewerCount
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/viewers/count", otherLivestreamID), owner.Cookie, nil), http.StatusOK, &other)
+	if other.ViewerCount != 0 {
+		t.Fatalf("other livestream: viewers/count = %d, want 0", other.ViewerCount)
+	}
+}
+
+func TestReserveLivestreamOverlap(t *testing.T) {
+	resetTestDB(t)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	const hour = 60 * 60
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+	reserve := func(user testUser, startAt, endAt int64) int {
+		t.Helper()
+		req := &ReserveLivestreamRequest{Tags: []int64{}, Title: "stream", StartAt: startAt, EndAt: endAt}
+		return doTestRequest(t, http.MethodPost, "/api/livestream/reservation", user.Cookie, req).Code
+	}
+
+	if got := reserve(alice, base, base+hour); got != http.StatusCreated {
+		t.Fatalf("first reservation: got status %d, want 201", got)
+	}
+	for _, tt := range []struct {
+		name           string
+		user           testUser
+		startAt, endAt int64
+		want           int
+	}{
+		{name: "overlapping the end", user: alice, startAt: base + hour/2, endAt: base + hour + hour/2, want: http.StatusConflict},
+		{name: "overlapping the start", user: alice, startAt: base - hour/2, endAt: base + hour/2, want: http.StatusConflict},
+		{name: "enclosing", user: alice, startAt: base - hour, endAt: base + 2*hour, want: http.StatusConflict},
+		{name: "same slot by another user", user: bob, startAt: base, endAt: base + hour, want: http.StatusCreated},
+		// 終了時刻ちょうどに始まる予約、開始時刻ちょうどに終わる予約は重ならない
+		{name: "starting at the end", user: alice, startAt: base + hour, endAt: base + 2*hour, want: http.StatusCreated},
+		{name: "ending at the start", user: alice, startAt: base - hour, endAt: base, want: http.StatusCreated},
+	} {
+		if got := reserve(tt.user, tt.startAt, tt.endAt); got != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM livestreams WHERE user_id = ?", alice.ID); got != 3 {
+		t.Fatalf("alice has %d livestreams, want 3", got)
+	}
+
+	// 重ならなくても、予約枠が残っていなければ予約できない
+	if _, err := dbConn.Exec("INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (0, ?, ?)", base+5*hour, base+6*hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := reserve(bob, base+5*hour, base+6*hour); got != http.StatusBadRequest {
+		t.Fatalf("full slot: got status %d, want 400", got)
+	}
+}
+
+func TestSearchLivestreamsByTags(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	if _, err := dbConn.Exec("INSERT INTO tags (id, name) VALUES (1, 'game'), (2, 'music'), (3, 'talk')"); err != nil {
+		t.Fatal(err)
+	}
+	gameID := newTestLivestream(t, owner.ID, "game", 0, 1)
+	bothID := newTestLivestream(t, owner.ID, "game and music", 0, 1)
+	musicID := newTestLivestream(t, owner.ID, "music and talk", 0, 1)
+	for _, lt := range [][2]int64{{gameID, 1}, {bothID, 1}, {bothID, 2}, {musicID, 2}, {musicID, 3}} {
+		if _, err := dbConn.Exec("INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", lt[0], lt[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for query, want := range map[string][]int64{
+		// 1つだけ指定した場合は、これまで通りそのタグの配信を新しい順に返す
+		"tag=game": {bothID, gameID},
+		// 複数指定した場合は、すべてのタグが付いた配信だけを返す
+		"tag=game&tag=music":          {bothID},
+		"tag=music&tag=talk":          {musicID},
+		"tag=game&tag=game":           {bothID, gameID},
+		"tag=game&tag=music&tag=talk": {},
+		// 存在しないタグはエラーにせず、空の一覧を返す
+		"tag=unknown":          {},
+		"tag=game&tag=unknown": {},
+	} {
+		var livestreams []Livestream
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/livestream/search?"+query, owner.Cookie, nil), http.StatusOK, &livestreams)
+		got := make([]int64, len(livestreams))
+		for i := range livestreams {
+			got[i] = livestreams[i].ID
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestSearchLivestreamsByStatus(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	now := time.Now().Unix()
+	endedID := newTestLivestream(t, owner.ID, "ended", now-2*60*60, now-60*60)
+	liveID := newTestLivestream(t, owner.ID, "live", now-60, now+60*60)
+	upcomingID := newTestLivestream(t, owner.ID, "upcoming", now+60*60, now+2*60*60)
+	if _, err := dbConn.Exec("INSERT INTO tags (id, name) VALUES (1, 'game')"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{endedID, liveID} {
+		if _, err := dbConn.Exec("INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, 1)", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for query, want := range map[string][]int64{
+		"":                         {upcomingID, liveID, endedID},
+		"status=live":              {liveID},
+		"status=upcoming":          {upcomingID},
+		"status=ended":             {endedID},
+		"status=live&tag=game":     {liveID},
+		"status=upcoming&tag=game": {},
+	} {
+		var livestreams []Livestream
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/livestream/search?"+query, owner.Cookie, nil), http.StatusOK, &livestreams)
+		got := make([]int64, len(livestreams))
+		for i := range livestreams {
+			got[i] = livestreams[i].ID
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%q: got %v, want %v", query, got, want)
+		}
+	}
+
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/livestream/search?status=paused", owner.Cookie, nil), http.StatusBadRequest, nil)
+}
@@ -0,0 +1,78 @@
+package main
+
+// メモリ上で集計している配信ごとの値 (秒間リアクション数の最大値、heat) を livestream_stats テーブルに退避する
+// 再起動しても値が途切れないよう、終了時に保存し、起動時に読み戻す
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type LivestreamStatsModel struct {
+	LivestreamID     int64   `db:"livestream_id"`
+	PeakReactionRate float64 `db:"peak_reaction_rate"`
+	Heat             float64 `db:"heat"`
+	UpdatedAt        int64   `db:"updated_at"`
+}
+
+// saveLivestreamStats はメモリ上の値を livestream_stats に書き出す
+func saveLivestreamStats(ctx context.Context, db *sqlx.DB, now time.Time) error {
+	statsMap := make(map[int64]*LivestreamStatsModel)
+	statsOf := func(livestreamID int64) *LivestreamStatsModel {
+		stats, ok := statsMap[livestreamID]
+		if !ok {
+			stats = &LivestreamStatsModel{LivestreamID: livestreamID, UpdatedAt: now.Unix()}
+			statsMap[livestreamID] = stats
+		}
+		return stats
+	}
+	for livestreamID, peak := range reactionRates.peaks() {
+		statsOf(livestreamID).PeakReactionRate = peak
+	}
+	for livestreamID, heat := range livestreamHeat.snapshot() {
+		statsOf(livestreamID).Heat = heat
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 保存時点の値だけを残す
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_stats"); err != nil {
+		return fmt.Errorf("failed to delete livestream stats: %w", err)
+	}
+	for _, stats := range statsMap {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_stats (livestream_id, peak_reaction_rate, heat, updated_at) VALUES (:livestream_id, :peak_reaction_rate, :heat, :updated_at)", stats); err != nil {
+			return fmt.Errorf("failed to insert livestream stats: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// restoreLivestreamStats は livestream_stats からメモリ上の値を復元する
+// 既に存在しない配信の値は読み捨て、heat は保存してからの経過時間の分だけ減衰させる
+func restoreLivestreamStats(ctx context.Context, db *sqlx.DB, now time.Time) error {
+	var statsModels []LivestreamStatsModel
+	query := "SELECT s.* FROM livestream_stats s INNER JOIN livestreams l ON l.id = s.livestream_id"
+	if err := db.SelectContext(ctx, &statsModels, query); err != nil {
+		return fmt.Errorf("failed to get livestream stats: %w", err)
+	}
+
+	for _, stats := range statsModels {
+		reactionRates.restorePeak(stats.LivestreamID, stats.PeakReactionRate)
+
+		elapsed := now.Sub(time.Unix(stats.UpdatedAt, 0))
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		livestreamHeat.add(stats.LivestreamID, stats.Heat*math.Pow(0.5, float64(elapsed)/float64(heatHalfLife)))
+	}
+	return nil
+}
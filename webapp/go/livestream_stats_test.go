@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLivestreamStatsSurviveRestart(t *testing.T) {
+	resetTestDB(t)
+	ctx := context.Background()
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	const deletedLivestreamID = 999999
+
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 5; i++ {
+		reactionRates.record(livestreamID, now)
+	}
+	livestreamHeat.add(livestreamID, 8)
+	livestreamHeat.add(deletedLivestreamID, 8)
+	wantPeak := reactionRates.peaks()[livestreamID]
+	if wantPeak <= 0 {
+		t.Fatalf("peak = %v, want a positive rate", wantPeak)
+	}
+
+	if err := saveLivestreamStats(ctx, dbConn, now); err != nil {
+		t.Fatalf("saveLivestreamStats: %v", err)
+	}
+	// 再起動して、メモリ上の値がなくなった状態から読み戻す
+	resetInMemoryState()
+	restartedAt := now.Add(heatHalfLife)
+	if err := restoreLivestreamStats(ctx, dbConn, restartedAt); err != nil {
+		t.Fatalf("restoreLivestreamStats: %v", err)
+	}
+
+	if _, peak := reactionRates.rate(livestreamID, restartedAt); peak != wantPeak {
+		t.Fatalf("peak = %v, want %v", peak, wantPeak)
+	}
+	// 止まっていた間の分だけ減衰する
+	if heat := livestreamHeat.get(livestreamID); math.Abs(heat-4) > 1e-9 {
+		t.Fatalf("heat = %v, want 4", heat)
+	}
+	// なくなった配信の値は読み捨てる
+	if heat := livestreamHeat.get(deletedLivestreamID); heat != 0 {
+		t.Fatalf("heat of the deleted livestream = %v, want 0", heat)
+	}
+
+	// 再起動前より小さい最大値では上書きしない
+	reactionRates.restorePeak(livestreamID, wantPeak/2)
+	if _, peak := reactionRates.rate(livestreamID, restartedAt); peak != wantPeak {
+		t.Fatalf("peak after restoring a smaller value = %v, want %v", peak, wantPeak)
+	}
+}
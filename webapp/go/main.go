@@ -4,19 +4,26 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"context"
 	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
@@ -25,13 +32,23 @@ import (
 
 const (
 	listenPort                     = 8080
+	shutdownTimeoutEnvKey          = "ISUCON13_SHUTDOWN_TIMEOUT_SECONDS"
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+	iconHashFallbackEnvKey         = "ISUCON13_ICON_HASH_FALLBACK_ON_ERROR"
+	reactionCoalesceWindowEnvKey   = "ISUCON13_REACTION_COALESCE_WINDOW_SECONDS"
+	reactionsMaxLimitEnvKey        = "ISUCON13_REACTIONS_MAX_LIMIT"
 )
 
 var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
-	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	// 読み取りだけのAPIで使う接続。レプリカが設定されていなければ dbConn と同じ
+	dbReadConn *sqlx.DB
+	secret     = []byte("isucon13_session_cookiestore_defaultsecret")
+	// trueの場合、アイコンのハッシュ値が取得できなくてもエラーにせず fallbackImageHash を返す
+	iconHashFallbackOnError = false
+	// 終了時に、処理中のリクエストが終わるのを待つ最大時間
+	shutdownTimeout = 10 * time.Second
 )
 
 func init() {
@@ -39,13 +56,125 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if v, ok := os.LookupEnv(iconHashFallbackEnvKey); ok {
+		fallbackOnError, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as bool: %+v", iconHashFallbackEnvKey, err)
+		}
+		iconHashFallbackOnError = fallbackOnError
+	}
+	if v, ok := os.LookupEnv(reactionCoalesceWindowEnvKey); ok {
+		window, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as int: %+v", reactionCoalesceWindowEnvKey, err)
+		}
+		reactionCoalesceWindowSeconds = window
+	}
+	if v, ok := os.LookupEnv(shutdownTimeoutEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			log.Fatalf("environment variable '%s' must be non-negative integer", shutdownTimeoutEnvKey)
+		}
+		shutdownTimeout = time.Duration(seconds) * time.Second
+	}
+	if v, ok := os.LookupEnv(reactionsMaxLimitEnvKey); ok {
+		maxLimit, err := strconv.Atoi(v)
+		if err != nil || maxLimit <= 0 {
+			log.Fatalf("environment variable '%s' must be positive integer: %s", reactionsMaxLimitEnvKey, v)
+		}
+		reactionsMaxLimit = maxLimit
+	}
 }
 
 type InitializeResponse struct {
 	Language string `json:"language"`
 }
 
+// dbPoolConfig はコネクションプールの設定
+type dbPoolConfig struct {
+	MaxOpenConns int
+	// 0 の場合は database/sql の既定値のまま
+	MaxIdleConns int
+	// 0 の場合はコネクションを使い回し続ける
+	ConnMaxLifetime time.Duration
+}
+
+// loadDBPoolConfig は環境変数からコネクションプールの設定を読み込む
+// 設定されていない項目は、これまでと同じ値になる
+func loadDBPoolConfig() (dbPoolConfig, error) {
+	const (
+		maxOpenConnsEnvKey    = "ISUCON13_MYSQL_MAX_OPEN_CONNS"
+		maxIdleConnsEnvKey    = "ISUCON13_MYSQL_MAX_IDLE_CONNS"
+		connMaxLifetimeEnvKey = "ISUCON13_MYSQL_CONN_MAX_LIFETIME_SECONDS"
+	)
+
+	conf := dbPoolConfig{
+		MaxOpenConns: 10,
+	}
+	if v, ok := os.LookupEnv(maxOpenConnsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return dbPoolConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", maxOpenConnsEnvKey)
+		}
+		conf.MaxOpenConns = n
+	}
+	if v, ok := os.LookupEnv(maxIdleConnsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return dbPoolConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", maxIdleConnsEnvKey)
+		}
+		conf.MaxIdleConns = n
+	}
+	if v, ok := os.LookupEnv(connMaxLifetimeEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return dbPoolConfig{}, fmt.Errorf("environment variable '%s' must be non-negative integer", connMaxLifetimeEnvKey)
+		}
+		conf.ConnMaxLifetime = time.Duration(seconds) * time.Second
+	}
+	return conf, nil
+}
+
+// dbPool は dbPoolConfig を適用する先。*sql.DB が満たす
+type dbPool interface {
+	SetMaxOpenConns(n int)
+	SetMaxIdleConns(n int)
+	SetConnMaxLifetime(d time.Duration)
+}
+
+func (conf dbPoolConfig) apply(db dbPool) {
+	db.SetMaxOpenConns(conf.MaxOpenConns)
+	if conf.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(conf.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(conf.ConnMaxLifetime)
+}
+
 func connectDB(logger echo.Logger) (*sqlx.DB, error) {
+	return openDB(logger, "")
+}
+
+// connectReadReplicaDB は読み取り専用のレプリカに接続する
+// レプリカのアドレスが設定されていない場合は nil を返す。接続先以外の設定はプライマリと同じものを使う
+func connectReadReplicaDB(logger echo.Logger) (*sqlx.DB, error) {
+	const (
+		replicaAddrEnvKey = "ISUCON13_MYSQL_REPLICA_ADDRESS"
+		replicaPortEnvKey = "ISUCON13_MYSQL_REPLICA_PORT"
+	)
+
+	addr, ok := os.LookupEnv(replicaAddrEnvKey)
+	if !ok {
+		return nil, nil
+	}
+	port := "3306"
+	if v, ok := os.LookupEnv(replicaPortEnvKey); ok {
+		port = v
+	}
+	return openDB(logger, net.JoinHostPort(addr, port))
+}
+
+// openDB は環境変数の設定で MySQL に接続する。addr が空でない場合は接続先だけを差し替える
+func openDB(logger echo.Logger, addr string) (*sqlx.DB, error) {
 	const (
 		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
 		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
@@ -56,6 +185,11 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
 	)
 
+	poolConf, err := loadDBPoolConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	conf := mysql.NewConfig()
 
 	// 環境変数がセットされていなかった場合でも一旦動かせるように、デフォルト値を入れておく
@@ -93,12 +227,17 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		}
 		conf.ParseTime = parseTime
 	}
+	if addr != "" {
+		conf.Addr = addr
+	}
 
-	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	connector, err := mysql.NewConnector(conf)
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(10)
+	// リクエストごとのクエリ数を数えるため、ドライバをラップしておく
+	db := sqlx.NewDb(sql.OpenDB(&queryCountingConnector{connector}), "mysql")
+	poolConf.apply(db.DB)
 
 	if err := db.Ping(); err != nil {
 		return nil, err
@@ -107,42 +246,37 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 	return db, nil
 }
 
+// resetInMemoryState はメモリ上に持っているキャッシュや集計値を捨てる
+func resetInMemoryState() {
+	reactionSettingsStore.reset()
+	reactionRates.reset()
+	reactionBroadcaster.resetPublished()
+	livecommentBroadcaster.resetPublished()
+	livestreamHeat.reset()
+	reactionInsertLatency.reset()
+	reactionRateLimiter.reset()
+	reactionBuckets.reset()
+	userCache.reset()
+	userStatisticsCache.reset()
+}
+
 func initializeHandler(c echo.Context) error {
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		c.Logger().Warnf("init.sh failed with err=%s", string(out))
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
-	ctx := c.Request().Context()
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	// DBを初期化したので、メモリ上のキャッシュも捨てる
+	resetInMemoryState()
 
-	var icons []struct {
-		ID    int64  `db:"id"`
-		Image []byte `db:"image"`
+	// 初期データのライブコメントから、ユーザごとのチップの合計を作り直す
+	if err := recomputeUserTipTotals(c.Request().Context(), dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to recompute user tip totals: "+err.Error())
 	}
 
-	if err := tx.SelectContext(ctx, &icons, "SELECT id, image FROM icons"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to select icons: "+err.Error())
-	}
-	stmt, err := tx.PrepareContext(ctx, "INSERT INTO icon_hashes (icon_id, hash) VALUES (?, ?)")
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to prepare statement: "+err.Error())
-	}
-	defer stmt.Close()
-
-	for _, icon := range icons {
-		hash := sha256.Sum256(icon.Image)
-		if _, err := stmt.ExecContext(ctx, icon.ID, fmt.Sprintf("%x", hash)); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert icon hash: "+err.Error())
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	// アイコンの保存先を初期データの状態に戻す
+	if err := iconStore.Reset(c.Request().Context(), dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset icons: "+err.Error())
 	}
 
 	// fallbackImage のハッシュ値を計算
@@ -158,11 +292,15 @@ func initializeHandler(c echo.Context) error {
 	})
 }
 
-func main() {
+// newEcho はミドルウェアとルーティングを設定した echo.Echo を返す
+// DBへの接続や設定の読み込みは main で行う
+func newEcho() *echo.Echo {
 	e := echo.New()
 	e.Debug = false
 	e.Logger.SetLevel(echolog.OFF)
-	e.Use(middleware.Logger())
+	e.Use(requestLogMiddleware)
+	e.Use(dbQueryCountMiddleware)
+	e.Use(cacheSnapshotMiddleware)
 	cookieStore := sessions.NewCookieStore(secret)
 	cookieStore.Options.Domain = "*.u.isucon.dev"
 	e.Use(session.Middleware(cookieStore))
@@ -174,12 +312,14 @@ func main() {
 	// top
 	e.GET("/api/tag", getTagHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
+	e.PUT("/api/user/:username/theme", putStreamerThemeHandler)
 
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/trending", getTrendingLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
@@ -188,14 +328,51 @@ func main() {
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	// ライブコメントのリアルタイム配信
+	e.GET("/api/livestream/:livestream_id/livecomments/sse", getLivecommentsSSEHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	e.DELETE("/api/livestream/:livestream_id/reaction/:reaction_id", deleteReactionHandler)
+	e.POST("/api/livestream/:livestream_id/reactions/batch", postReactionBatchHandler)
+	e.POST("/api/livestream/:livestream_id/reactions/bulk", postReactionsBulkHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/unused", getUnusedEmojisHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/new", getNewReactionsHandler)
+	// リアクションのリアルタイム配信
+	e.GET("/api/livestream/:livestream_id/reactions/ws", getReactionsWebSocketHandler)
+	// リアクションのエクスポート
+	e.GET("/api/livestream/:livestream_id/reactions.vtt", getReactionsWebVTTHandler)
+	e.GET("/api/livestream/:livestream_id/reactions.ndjson", getReactionsNDJSONHandler)
+	// リアクションのリプレイ
+	e.GET("/api/livestream/:livestream_id/reactions/replay", getReactionReplayHandler)
+	// 配信者によるリアクション設定
+	e.GET("/api/livestream/:livestream_id/reaction-settings", getReactionSettingsHandler)
+	e.PUT("/api/livestream/:livestream_id/reaction-settings", putReactionSettingsHandler)
+	e.POST("/api/livestream/:livestream_id/reactions/approve", approveReactionsHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/moderation-log", getReactionModerationLogHandler)
+	e.PUT("/api/livestream/:livestream_id/reactions/:reaction_id/hidden", putReactionHiddenHandler)
+	e.DELETE("/api/livestream/:livestream_id/reactions/:reaction_id", deleteModeratedReactionHandler)
+	e.PUT("/api/livestream/:livestream_id/reactions/shadow-bans/:user_id", putReactionShadowBanHandler)
+	e.DELETE("/api/livestream/:livestream_id/reactions/shadow-bans/:user_id", deleteReactionShadowBanHandler)
+	// リアクション分析
+	e.GET("/api/livestream/:livestream_id/reactions/summary", getReactionSummaryHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/diff", getReactionsDiffHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/rate", getReactionRateHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/cooccurrence", getReactionCooccurrenceHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/by-tenure", getReactionsByTenureHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/active-reactors", getActiveReactorsHandler)
+	e.GET("/api/livestream/:livestream_id/engagement/timeline", getEngagementTimelineHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/timeline", getReactionTimelineHandler)
+	// プロフィール・テーマ変更後のリアクション再取得
+	e.POST("/api/reactions/refresh", refreshReactionsHandler)
+	// (配信者向け)視聴者ごとのリアクション一覧
+	e.GET("/api/livestream/:livestream_id/viewer/:user_id/reactions", getViewerReactionsHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
 	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
 	// ライブコメント報告
 	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/:livecomment_id/reactions", getLivecommentReactionsHandler)
 	// 配信者によるモデレーション (NGワード登録)
 	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
 
@@ -204,6 +381,8 @@ func main() {
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// 視聴中のユーザ数
+	e.GET("/api/livestream/:livestream_id/viewers/count", getLivestreamViewerCountHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
@@ -211,19 +390,52 @@ func main() {
 	e.GET("/api/user/me", getMeHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
+	e.GET("/api/users", getUsersHandler)
+	e.PATCH("/api/user/:username", patchUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
+	e.GET("/api/user/:username/reactions", getUserReactionsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
 	e.POST("/api/icon", postIconHandler)
+	e.POST("/api/user/:username/follow", postFollowHandler)
+	e.DELETE("/api/user/:username/follow", deleteFollowHandler)
 
 	// stats
 	// ライブ配信統計情報
 	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	e.GET("/api/livestream/:livestream_id/me/reaction-stats", getMyReactionStatisticsHandler)
+	e.GET("/api/livestream/:livestream_id/tips/ranking", getTipRankingHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
 
+	// ヘルスチェック
+	e.GET("/healthz", getHealthzHandler)
+
+	// Prometheus のメトリクス。本番環境でも収集するので、常に登録する
+	e.GET("/metrics", getMetricsHandler)
+
+	// デバッグ用のメトリクス
+	registerDebugRoutes(e)
+
+	// チューニング用のベンチマーク (管理者向け)。デモモードでのみ有効
+	if isDemoMode() {
+		e.POST("/api/admin/benchmark/reactions", postReactionBenchmarkHandler)
+	}
+
 	e.HTTPErrorHandler = errorResponseHandler
 
+	// 購読中の接続は自分からは終わらないので、終了時に切断して処理中のリクエストの待ち合わせを妨げないようにする
+	e.Server.RegisterOnShutdown(func() {
+		reactionBroadcaster.closeAll()
+		livecommentBroadcaster.closeAll()
+	})
+
+	return e
+}
+
+func main() {
+	e := newEcho()
+
 	// DB接続
 	conn, err := connectDB(e.Logger)
 	if err != nil {
@@ -233,6 +445,104 @@ func main() {
 	defer conn.Close()
 	dbConn = conn
 
+	// 一覧取得など読み取りだけのAPIはレプリカに向ける。レプリカがなければプライマリを使う
+	readConn, err := connectReadReplicaDB(e.Logger)
+	if err != nil {
+		e.Logger.Errorf("failed to connect read replica db: %v", err)
+		os.Exit(1)
+	}
+	if readConn != nil {
+		defer readConn.Close()
+		dbReadConn = readConn
+	} else {
+		dbReadConn = conn
+	}
+
+	// スキーマのずれを起動時に検出する。ISUCON13_SCHEMA_CHECK=false で無効にできる
+	schemaCheck := true
+	if v, ok := os.LookupEnv(schemaCheckEnvKey); ok {
+		schemaCheck, err = strconv.ParseBool(v)
+		if err != nil {
+			e.Logger.Errorf("failed to parse environment variable '%s' as bool: %v", schemaCheckEnvKey, err)
+			os.Exit(1)
+		}
+	}
+	if schemaCheck {
+		if err := verifyReactionsSchema(context.Background(), dbConn); err != nil {
+			e.Logger.Errorf("schema check failed: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// リアクションの絵文字許可リスト
+	if path, ok := os.LookupEnv(emojiAllowlistPathEnvKey); ok {
+		allowlist, err := loadEmojiAllowlist(path)
+		if err != nil {
+			e.Logger.Errorf("failed to load emoji allowlist: %v", err)
+			os.Exit(1)
+		}
+		emojiAllowlist = allowlist
+
+		// 許可した絵文字に、表示用のカタログが揃っているかを確かめる
+		strict := false
+		if v, ok := os.LookupEnv(emojiCatalogStrictEnvKey); ok {
+			strict, err = strconv.ParseBool(v)
+			if err != nil {
+				e.Logger.Errorf("failed to parse environment variable '%s' as bool: %v", emojiCatalogStrictEnvKey, err)
+				os.Exit(1)
+			}
+		}
+		if err := verifyEmojiCatalog(context.Background(), dbConn, emojiAllowlist, strict); err != nil {
+			e.Logger.Errorf("emoji catalog check failed: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// 配信の盛り上がり度
+	if err := loadHeatConfig(); err != nil {
+		e.Logger.Errorf("failed to load heat config: %v", err)
+		os.Exit(1)
+	}
+	go livestreamHeat.runDecay()
+
+	// DBの書き込み遅延によるリアクションの流量制御
+	if err := loadReactionThrottleConfig(); err != nil {
+		e.Logger.Errorf("failed to load reaction throttle config: %v", err)
+		os.Exit(1)
+	}
+
+	// ユーザごとのリアクション投稿数の制限
+	if err := loadReactionRateLimitConfig(); err != nil {
+		e.Logger.Errorf("failed to load reaction rate limit config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadReactionStreamRateConfig(); err != nil {
+		e.Logger.Errorf("failed to load reaction stream rate config: %v", err)
+		os.Exit(1)
+	}
+
+	// 報告されたライブコメントを非表示にする人数
+	if err := loadLivecommentReportConfig(); err != nil {
+		e.Logger.Errorf("failed to load livecomment report config: %v", err)
+		os.Exit(1)
+	}
+
+	// 同じ文面のライブコメントの連投を断る秒数
+	if err := loadLivecommentDuplicateConfig(); err != nil {
+		e.Logger.Errorf("failed to load livecomment duplicate config: %v", err)
+		os.Exit(1)
+	}
+
+	// アイコンの保存先
+	if err := loadIconStoreConfig(); err != nil {
+		e.Logger.Errorf("failed to load icon store config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadIconValidationConfig(); err != nil {
+		e.Logger.Errorf("failed to load icon validation config: %v", err)
+		os.Exit(1)
+	}
+
 	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
 	if !ok {
 		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
@@ -240,11 +550,37 @@ func main() {
 	}
 	powerDNSSubdomainAddress = subdomainAddr
 
+	// 前回の終了時に保存した集計値を読み戻す
+	if err := restoreLivestreamStats(context.Background(), dbConn, time.Now()); err != nil {
+		e.Logger.Errorf("failed to restore livestream stats: %v", err)
+		os.Exit(1)
+	}
+
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- e.Start(listenAddr)
+	}()
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErr:
 		e.Logger.Errorf("failed to start HTTP server: %v", err)
 		os.Exit(1)
+	case <-sigCtx.Done():
+	}
+
+	// 新しい接続の受け付けをやめ、処理中のリクエスト (開いているトランザクションを含む) を待ってから、
+	// メモリ上の集計値を保存して終了する。DBの接続は main を抜けるときに閉じる
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shutdown HTTP server: %+v", err)
+	}
+	if err := saveLivestreamStats(shutdownCtx, dbConn, time.Now()); err != nil {
+		log.Printf("failed to save livestream stats: %+v", err)
 	}
 }
 
@@ -265,3 +601,56 @@ func errorResponseHandler(err error, c echo.Context) {
 		c.Logger().Errorf("%+v", e)
 	}
 }
+
+const (
+	mysqlErrTooManyConnections = 1040
+	// DBが混んでいて断ったときに、再試行まで待ってもらう秒数
+	dbBusyRetryAfterSeconds = 1
+)
+
+// registerDebugRoutes はデバッグ用のメトリクスのAPIを登録する
+// 内部の状態が外から見えてしまうので、本番環境では登録しない
+func registerDebugRoutes(e *echo.Echo) {
+	if !debugHeadersEnabled {
+		return
+	}
+	e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
+	e.GET("/debug/metrics", getDebugMetricsHandler)
+}
+
+// beginTxError は BeginTxx の失敗をレスポンスにする
+// コネクションが空くのを待ちきれなかった場合は、DBの内部のエラーは返さずに 503 と Retry-After を返す
+func beginTxError(c echo.Context, err error) error {
+	if isDBBusyError(err) {
+		c.Logger().Warnf("failed to begin transaction at %s: %+v", c.Path(), err)
+		c.Response().Header().Set("Retry-After", strconv.Itoa(dbBusyRetryAfterSeconds))
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "the database is busy, please retry later")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+}
+
+// isDBBusyError はコネクションが空くのを待ちきれなかったことによるエラーかを返す
+func isDBBusyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrTooManyConnections)
+}
+
+// parseIncludeParam は include=a,b のようなカンマ区切りのクエリパラメータを集合にする
+func parseIncludeParam(c echo.Context) map[string]bool {
+	return parseSetParam(c, "include")
+}
+
+// parseExpandParam は expand=a,b のようなカンマ区切りのクエリパラメータを集合にする
+func parseExpandParam(c echo.Context) map[string]bool {
+	return parseSetParam(c, "expand")
+}
+
+func parseSetParam(c echo.Context, name string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Split(c.QueryParam(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,678 @@
+package main
+
+// ハンドラのテストで使うDBとリクエストの組み立て
+// MySQL 互換の go-mysql-server をプロセス内で起動し、initdb のスキーマを読み込んで dbConn に使う
+// 行ロックに頼るテストは go-mysql-server では確かめられないので、ISUCON13_TEST_MYSQL_DSN で MySQL を指定したときだけ実行する
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	gmssql "github.com/dolthub/go-mysql-server/sql"
+	vitessmysql "github.com/dolthub/vitess/go/mysql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testUserPassword = "password"
+
+	// 指定すると go-mysql-server ではなく、この MySQL でテストする。例: root:root@tcp(127.0.0.1:3306)/
+	testMySQLDSNEnvKey = "ISUCON13_TEST_MYSQL_DSN"
+	testDBName         = "isupipe_test"
+)
+
+var (
+	testEcho *echo.Echo
+	// テスト用DBへの接続設定。別のデータベースに接続するテストで使う
+	testDBConfig *mysql.Config
+	// 同時に更新された行をロックで直列化するか。go-mysql-server はロックを取らないので false
+	testDBLocksRows bool
+	// ユーザを作るたびに bcrypt を計算しないよう、パスワードのハッシュ値は使い回す
+	testUserHashedPassword string
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetOutput(io.Discard)
+	requestLogOutput = io.Discard
+
+	db, stop, err := startTestDB()
+	if err != nil {
+		log.Fatalf("failed to start test db: %+v", err)
+	}
+	dbConn = db
+	dbReadConn = db
+	testEcho = newEcho()
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(testUserPassword), bcrypt.MinCost)
+	if err != nil {
+		log.Fatalf("failed to hash password: %+v", err)
+	}
+	testUserHashedPassword = string(hashed)
+
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// startTestDB はテスト用のDBを用意し、スキーマを読み込んだDBへの接続を返す
+// ISUCON13_TEST_MYSQL_DSN を指定した場合はそのサーバに isupipe_test を作り直して使い、指定しない場合は go-mysql-server を空いているポートで起動する
+func startTestDB() (*sqlx.DB, func(), error) {
+	conf, stopServer, err := startTestDBServer()
+	if err != nil {
+		return nil, nil, err
+	}
+	conf.ParseTime = true
+	conf.InterpolateParams = true
+	testDBConfig = conf.Clone()
+
+	connector, err := mysql.NewConnector(conf)
+	if err != nil {
+		stopServer()
+		return nil, nil, err
+	}
+	// 本番と同じく、リクエストごとのクエリ数を数えられるようにしておく
+	db := sqlx.NewDb(sql.OpenDB(&queryCountingConnector{connector}), "mysql")
+	db.SetMaxOpenConns(10)
+	stop := func() {
+		db.Close()
+		stopServer()
+	}
+
+	if err := loadTestSchema(db); err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	return db, stop, nil
+}
+
+// loadTestSchema は initdb のスキーマを db の接続先のデータベースに作る
+func loadTestSchema(db *sqlx.DB) error {
+	schema, err := os.ReadFile("../sql/initdb.d/10_schema.sql")
+	if err != nil {
+		return err
+	}
+	for _, stmt := range strings.Split(string(schema), ";\n") {
+		// 接続先のデータベースに作るので、USE isupipe は飛ばす
+		if strings.TrimSpace(stmt) == "" || strings.HasPrefix(strings.TrimSpace(stmt), "USE ") {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to load schema: %w: %s", err, stmt)
+		}
+	}
+	return nil
+}
+
+// startTestDBServer はテスト用のDBサーバを用意し、空の testDBName への接続設定を返す
+func startTestDBServer() (*mysql.Config, func(), error) {
+	if dsn, ok := os.LookupEnv(testMySQLDSNEnvKey); ok {
+		conf, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %s: %w", testMySQLDSNEnvKey, err)
+		}
+		conf.DBName = ""
+		admin, err := sqlx.Open("mysql", conf.FormatDSN())
+		if err != nil {
+			return nil, nil, err
+		}
+		defer admin.Close()
+		for _, stmt := range []string{"DROP DATABASE IF EXISTS `" + testDBName + "`", "CREATE DATABASE `" + testDBName + "`"} {
+			if _, err := admin.Exec(stmt); err != nil {
+				return nil, nil, err
+			}
+		}
+		conf.DBName = testDBName
+		testDBLocksRows = true
+		return conf, func() {}, nil
+	}
+
+	database := memory.NewDatabase(testDBName)
+	database.BaseDatabase.EnablePrimaryKeyIndexes()
+	provider := memory.NewDBProvider(database)
+	engine := sqle.NewDefault(provider)
+	sessionBuilder := func(ctx context.Context, conn *vitessmysql.Conn, addr string) (gmssql.Session, error) {
+		client := gmssql.Client{Address: "localhost", User: "root", Capabilities: conn.Capabilities}
+		return memory.NewSession(gmssql.NewBaseSessionWithClientServer(addr, client, conn.ConnectionID), provider), nil
+	}
+	srv, err := server.NewServer(server.Config{Protocol: "tcp", Address: "127.0.0.1:0"}, engine, sessionBuilder, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	go srv.Start()
+
+	conf := mysql.NewConfig()
+	conf.Net = "tcp"
+	conf.Addr = srv.Listener.Addr().String()
+	conf.User = "root"
+	conf.DBName = testDBName
+	return conf, func() { srv.Close() }, nil
+}
+
+// requireTestDBRowLocks は、同時に更新したときの結果を確かめるテストを、行ロックのあるDBでだけ実行する
+func requireTestDBRowLocks(t *testing.T) {
+	t.Helper()
+	if !testDBLocksRows {
+		t.Skipf("go-mysql-server does not lock rows; set %s to run this test against MySQL", testMySQLDSNEnvKey)
+	}
+}
+
+// resetTestDB はすべてのテーブルを空にし、メモリ上のキャッシュも捨てる
+func resetTestDB(t testing.TB) {
+	t.Helper()
+	var tables []string
+	if err := dbConn.Select(&tables, "SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE()"); err != nil {
+		t.Fatalf("failed to get tables: %v", err)
+	}
+	for _, table := range tables {
+		if _, err := dbConn.Exec("DELETE FROM `" + table + "`"); err != nil {
+			t.Fatalf("failed to delete %s: %v", table, err)
+		}
+	}
+	resetInMemoryState()
+}
+
+type testUser struct {
+	ID     int64
+	Name   string
+	Cookie string
+}
+
+// newTestUser はユーザを作ってログインする
+// 登録APIは DNS のレコードを作るので使わず、users と themes に直接入れる
+func newTestUser(t testing.TB, name string) testUser {
+	t.Helper()
+	return newTestUserCreatedAt(t, name, time.Now().Unix())
+}
+
+func newTestUserCreatedAt(t testing.TB, name string, createdAt int64) testUser {
+	t.Helper()
+	result, err := dbConn.Exec("INSERT INTO users (name, display_name, description, password, created_at) VALUES (?, ?, ?, ?, ?)",
+		name, name, "description of "+name, testUserHashedPassword, createdAt)
+	if err != nil {
+		t.Fatalf("failed to insert user: %v", err)
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbConn.Exec("INSERT INTO themes (user_id, dark_mode) VALUES (?, ?)", userID, false); err != nil {
+		t.Fatalf("failed to insert theme: %v", err)
+	}
+
+	rec := doTestRequest(t, http.MethodPost, "/api/login", "", &LoginRequest{Username: name, Password: testUserPassword})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to login: %d %s", rec.Code, rec.Body.String())
+	}
+	cookie := rec.Result().Cookies()
+	if len(cookie) == 0 {
+		t.Fatalf("login did not set a session cookie")
+	}
+	return testUser{ID: userID, Name: name, Cookie: cookie[0].Name + "=" + cookie[0].Value}
+}
+
+// newTestLivestream は配信を直接入れる。予約枠の確認やタグの付与は行わない
+func newTestLivestream(t testing.TB, ownerID int64, title string, startAt, endAt int64) int64 {
+	t.Helper()
+	result, err := dbConn.Exec("INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		ownerID, title, "description of "+title, "https://example.com/playlist.m3u8", "https://example.com/thumbnail.jpg", startAt, endAt)
+	if err != nil {
+		t.Fatalf("failed to insert livestream: %v", err)
+	}
+	livestreamID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return livestreamID
+}
+
+// newTestReaction はリアクションを直接入れる
+func newTestReaction(t testing.TB, reaction ReactionModel) int64 {
+	t.Helper()
+	if reaction.Intensity == 0 {
+		reaction.Intensity = 1
+	}
+	if reaction.Count == 0 {
+		reaction.Count = 1
+	}
+	result, err := dbConn.NamedExec("INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at, is_bot, intensity, count, pending, hidden, deleted_at, livecomment_id, shadow) VALUES (:user_id, :livestream_id, :emoji_name, :created_at, :is_bot, :intensity, :count, :pending, :hidden, :deleted_at, :livecomment_id, :shadow)", reaction)
+	if err != nil {
+		t.Fatalf("failed to insert reaction: %v", err)
+	}
+	reactionID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reactionID
+}
+
+// newTestLivecomment はライブコメントを直接入れる。チップの集計値は更新しない
+func newTestLivecomment(t testing.TB, userID, livestreamID int64, comment string, tip int64) int64 {
+	t.Helper()
+	result, err := dbConn.Exec("INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, livestreamID, comment, tip, time.Now().Unix())
+	if err != nil {
+		t.Fatalf("failed to insert livecomment: %v", err)
+	}
+	livecommentID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return livecommentID
+}
+
+// doTestRequest は testEcho にリクエストを送る。body が nil でなければ JSON にして送る
+// header には "Name: value" の形でヘッダを追加できる
+func doTestRequest(t testing.TB, method, path, cookie string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	if cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	for _, h := range header {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	rec := httptest.NewRecorder()
+	testEcho.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeTestResponse はステータスコードを確かめてから、レスポンスを JSON として v に読み込む
+func decodeTestResponse(t testing.TB, rec *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, status, rec.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+	}
+}
+
+func countTestRows(t testing.TB, query string, args ...interface{}) int64 {
+	t.Helper()
+	var count int64
+	if err := dbConn.Get(&count, query, args...); err != nil {
+		t.Fatalf("failed to count rows: %v", err)
+	}
+	return count
+}
+
+func TestTagsQueryCount(t *testing.T) {
+	resetTestDB(t)
+	if _, err := dbConn.Exec("INSERT INTO tags (name) VALUES ('tag1'), ('tag2')"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doTestRequest(t, http.MethodGet, "/api/tag", "", nil, "X-Debug: 1")
+	var res TagsResponse
+	decodeTestResponse(t, rec, http.StatusOK, &res)
+	if len(res.Tags) != 2 {
+		t.Fatalf("got %d tags, want 2", len(res.Tags))
+	}
+	// タグの一覧は1回の SELECT で取る
+	if got := rec.Header().Get(dbQueriesHeader); got != "1" {
+		t.Fatalf("%s = %q, want 1", dbQueriesHeader, got)
+	}
+}
+
+// recordingDBPool は適用されたコネクションプールの設定を覚えておく
+type recordingDBPool struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+}
+
+func (p *recordingDBPool) SetMaxOpenConns(n int)              { p.maxOpenConns = n }
+func (p *recordingDBPool) SetMaxIdleConns(n int)              { p.maxIdleConns = n }
+func (p *recordingDBPool) SetConnMaxLifetime(d time.Duration) { p.connMaxLifetime = d }
+
+func TestLoadDBPoolConfig(t *testing.T) {
+	for name, tt := range map[string]struct {
+		env     map[string]string
+		want    recordingDBPool
+		wantErr bool
+	}{
+		"defaults": {
+			// MaxIdleConns は未設定のまま、database/sql の既定値を使う
+			want: recordingDBPool{maxOpenConns: 10},
+		},
+		"all set": {
+			env: map[string]string{
+				"ISUCON13_MYSQL_MAX_OPEN_CONNS":            "64",
+				"ISUCON13_MYSQL_MAX_IDLE_CONNS":            "32",
+				"ISUCON13_MYSQL_CONN_MAX_LIFETIME_SECONDS": "300",
+			},
+			want: recordingDBPool{maxOpenConns: 64, maxIdleConns: 32, connMaxLifetime: 5 * time.Minute},
+		},
+		"zero open conns": {
+			env:     map[string]string{"ISUCON13_MYSQL_MAX_OPEN_CONNS": "0"},
+			wantErr: true,
+		},
+		"non-integer idle conns": {
+			env:     map[string]string{"ISUCON13_MYSQL_MAX_IDLE_CONNS": "many"},
+			wantErr: true,
+		},
+		"negative lifetime": {
+			env:     map[string]string{"ISUCON13_MYSQL_CONN_MAX_LIFETIME_SECONDS": "-1"},
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"ISUCON13_MYSQL_MAX_OPEN_CONNS", "ISUCON13_MYSQL_MAX_IDLE_CONNS", "ISUCON13_MYSQL_CONN_MAX_LIFETIME_SECONDS"} {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			conf, err := loadDBPoolConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", conf)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pool recordingDBPool
+			conf.apply(&pool)
+			if pool != tt.want {
+				t.Fatalf("applied %+v, want %+v", pool, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadReplicaRouting(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+
+	// レプリカはプライマリの複製から始め、レプリカにだけある行で読み先を見分ける
+	replica := openTestStubDB(t, "isupipe_replica")
+	if err := loadTestSchema(replica); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"users", "themes", "livestreams"} {
+		if _, err := replica.Exec("INSERT INTO `" + table + "` SELECT * FROM `" + testDBName + "`.`" + table + "`"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().Unix()
+	for _, stmt := range []string{
+		fmt.Sprintf("INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (%d, %d, ':tada:', %d)", owner.ID, livestreamID, now),
+		fmt.Sprintf("INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (%d, %d, 'on replica', 0, %d)", owner.ID, livestreamID, now),
+		fmt.Sprintf("INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (%d, 'replica stream', '', '', '', 0, 1)", owner.ID),
+	} {
+		if _, err := replica.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dbReadConn = replica
+	t.Cleanup(func() { dbReadConn = dbConn })
+
+	if got := len(getTestReactions(t, owner, livestreamID, "")); got != 1 {
+		t.Fatalf("reactions: got %d, want the 1 reaction on the replica", got)
+	}
+	var livecomments []Livecomment
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/livecomment", livestreamID), owner.Cookie, nil), http.StatusOK, &livecomments)
+	if len(livecomments) != 1 || livecomments[0].Comment != "on replica" {
+		t.Fatalf("livecomments: got %+v, want the livecomment on the replica", livecomments)
+	}
+	var livestreams []Livestream
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/livestream/search", owner.Cookie, nil), http.StatusOK, &livestreams)
+	if len(livestreams) != 2 {
+		t.Fatalf("search: got %d livestreams, want the 2 on the replica", len(livestreams))
+	}
+
+	// 書き込みはプライマリに行く
+	if rec := postTestReaction(t, owner, livestreamID, &PostReactionRequest{EmojiName: ":heart:"}); rec.Code != http.StatusCreated {
+		t.Fatalf("post reaction: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 1 {
+		t.Fatalf("primary: got %d reactions, want the posted 1", got)
+	}
+	var replicaReactions int64
+	if err := replica.Get(&replicaReactions, "SELECT COUNT(*) FROM reactions"); err != nil {
+		t.Fatal(err)
+	}
+	if replicaReactions != 1 {
+		t.Fatalf("replica: got %d reactions, want only the seeded 1", replicaReactions)
+	}
+}
+
+func TestBeginTxErrorWhenPoolIsExhausted(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+
+	// コネクションが1本しかないプールで、その1本を使ったままにする
+	pool, err := sqlx.Open("mysql", testDBConfig.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	pool.SetMaxOpenConns(1)
+	held, err := pool.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { held.Close() })
+	origConn, origReadConn := dbConn, dbReadConn
+	dbConn, dbReadConn = pool, pool
+	t.Cleanup(func() { dbConn, dbReadConn = origConn, origReadConn })
+
+	path := fmt.Sprintf("/api/livestream/%d/reaction", livestreamID)
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		var body io.Reader
+		if method == http.MethodPost {
+			body = strings.NewReader(`{"emoji_name":":tada:"}`)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest(method, path, body).WithContext(ctx)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Cookie", owner.Cookie)
+		rec := httptest.NewRecorder()
+		testEcho.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: got status %d, want 503: %s", method, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Retry-After"); got != strconv.Itoa(dbBusyRetryAfterSeconds) {
+			t.Fatalf("%s: Retry-After = %q, want %d", method, got, dbBusyRetryAfterSeconds)
+		}
+		// ドライバのエラーはクライアントに返さない
+		if strings.Contains(rec.Body.String(), "deadline") {
+			t.Fatalf("%s: the driver error leaked: %s", method, rec.Body.String())
+		}
+	}
+
+	// GET で始まった配信の組み立てはリクエストと切り離されていて、まだコネクションを待っている
+	// 次のテストに持ち越さないよう、コネクションを返して終わるのを待つ
+	held.Close()
+	if _, err := sharedReactionLivestream(context.Background(), livestreamID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBeginTxError(t *testing.T) {
+	for name, tt := range map[string]struct {
+		err  error
+		want int
+	}{
+		"deadline":             {err: fmt.Errorf("begin: %w", context.DeadlineExceeded), want: http.StatusServiceUnavailable},
+		"too many connections": {err: &mysql.MySQLError{Number: mysqlErrTooManyConnections}, want: http.StatusServiceUnavailable},
+		"other":                {err: errors.New("broken pipe"), want: http.StatusInternalServerError},
+	} {
+		c, rec := newTestContext()
+		var he *echo.HTTPError
+		if err := beginTxError(c, tt.err); !errors.As(err, &he) || he.Code != tt.want {
+			t.Errorf("%s: got %v, want %d", name, err, tt.want)
+		}
+		if retryAfter := rec.Header().Get("Retry-After"); (retryAfter != "") != (tt.want == http.StatusServiceUnavailable) {
+			t.Errorf("%s: Retry-After = %q", name, retryAfter)
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+
+	// 終了時に閉じるので、他のテストと共有しているものとは別の購読先を使う
+	origReactions, origLivecomments := reactionBroadcaster, livecommentBroadcaster
+	reactionBroadcaster, livecommentBroadcaster = newReactionHub(), newReactionHub()
+	t.Cleanup(func() { reactionBroadcaster, livecommentBroadcaster = origReactions, origLivecomments })
+
+	e := newEcho()
+	e.HideBanner = true
+	e.HidePort = true
+	started := make(chan struct{})
+	release := make(chan struct{})
+	// 終了を始める前にトランザクションを開き、終了の途中でコミットするハンドラ
+	e.GET("/test/slow", func(c echo.Context) error {
+		tx, err := dbConn.BeginTxx(c.Request().Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		close(started)
+		<-release
+		var count int64
+		if err := tx.Get(&count, "SELECT COUNT(*) FROM users"); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, strconv.FormatInt(count, 10))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Listener = ln
+	serverURL := "http://" + ln.Addr().String()
+	go e.Start("")
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		res, err := http.Get(serverURL + "/test/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		slow <- result{status: res.StatusCode, body: string(body), err: err}
+	}()
+
+	// 購読中の接続は終了時に切断される
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/livestream/%d/livecomments/sse", serverURL, livestreamID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Cookie", owner.Cookie)
+	sse, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sse.Body.Close()
+	if sse.StatusCode != http.StatusOK {
+		t.Fatalf("sse: status = %d, want %d", sse.StatusCode, http.StatusOK)
+	}
+
+	<-started
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- e.Shutdown(ctx)
+	}()
+
+	// 終了を始めた後の新しいリクエストは受け付けない
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: time.Second}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := client.Get(serverURL + "/api/tag")
+		if err != nil {
+			break
+		}
+		res.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("new requests are still accepted after shutdown started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 処理中のリクエストが終わるまで待つ
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned %v before the in-flight request finished", err)
+	default:
+	}
+
+	// 終了を始める前のリクエストは最後まで処理される
+	close(release)
+	select {
+	case r := <-slow:
+		if r.err != nil || r.status != http.StatusOK || r.body != "1" {
+			t.Fatalf("in-flight request: got %d %q, %v, want 200 with the user count", r.status, r.body, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("in-flight request did not finish")
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, sse.Body); err != nil {
+		t.Fatalf("sse: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+// Prometheus 向けのメトリクス
+// 新しいメトリクスを増やすときも、コレクタの定義と登録はこのファイルにまとめる
+
+import (
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	reactionsPostedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "isupipe",
+		Name:      "reactions_posted_total",
+		Help:      "Number of reactions posted.",
+	})
+	livecommentsPostedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "isupipe",
+		Name:      "livecomments_posted_total",
+		Help:      "Number of livecomments posted.",
+	})
+	tipsReceivedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "isupipe",
+		Name:      "tips_received_total",
+		Help:      "Total amount of tips received with livecomments.",
+	})
+	httpRequestDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "isupipe",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	// 購読者のバッファ溢れで捨てたリアクションの配信数
+	reactionHubDropsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isupipe",
+		Name:      "reaction_hub_drops_total",
+		Help:      "Number of reaction messages dropped for slow subscribers by overflow policy.",
+	}, []string{"policy"})
+	// リアクションの投稿を断るかどうかの判断に使う、直近の INSERT の所要時間の平均
+	reactionInsertLatencySeconds = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "isupipe",
+		Name:      "reaction_insert_latency_seconds",
+		Help:      "Average latency of reaction inserts within the throttle window.",
+	}, func() float64 {
+		return reactionInsertLatency.average(time.Now()).Seconds()
+	})
+
+	metricsRegistry = prometheus.NewRegistry()
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		reactionsPostedTotal,
+		livecommentsPostedTotal,
+		tipsReceivedTotal,
+		httpRequestDurationSeconds,
+		reactionInsertLatencySeconds,
+		reactionHubDropsTotal,
+	)
+}
+
+// observeRequestDuration はハンドラの所要時間をルートごとのヒストグラムに記録する
+// ラベルにはパスそのものではなくルートを使い、系列が増えすぎないようにする
+func observeRequestDuration(method string, route string, duration time.Duration) {
+	httpRequestDurationSeconds.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// メトリクス取得API
+// GET /metrics
+var getMetricsHandler = echo.WrapHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeTestMetrics は /metrics を取得し、系列名 (ラベルを含む) ごとの値を返す
+func scrapeTestMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := doTestRequest(t, http.MethodGet, "/metrics", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape: got status %d", rec.Code)
+	}
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("scrape: failed to parse %q: %v", line, err)
+		}
+		metrics[line[:i]] = value
+	}
+	return metrics
+}
+
+func TestMetricsCountPosts(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	postRoute := `isupipe_http_request_duration_seconds_count{method="POST",route="/api/livestream/:livestream_id/reaction"}`
+
+	before := scrapeTestMetrics(t)
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}), http.StatusCreated, nil)
+	// 断られた投稿や検証だけの投稿は数えない
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: ""}), http.StatusBadRequest, nil)
+	rec := doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/reaction?dry_run=true", livestreamID), viewer.Cookie, &PostReactionRequest{EmojiName: ":tada:"})
+	decodeTestResponse(t, rec, http.StatusOK, nil)
+	rec = doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/livecomment", livestreamID), viewer.Cookie, &PostLivecommentRequest{Comment: "nice", Tip: 300})
+	decodeTestResponse(t, rec, http.StatusCreated, nil)
+	after := scrapeTestMetrics(t)
+
+	for name, want := range map[string]float64{
+		"isupipe_reactions_posted_total":    1,
+		"isupipe_livecomments_posted_total": 1,
+		"isupipe_tips_received_total":       300,
+		// ルートごとのレイテンシは、断られたものも含めて記録する
+		postRoute: 3,
+	} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s increased by %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestReactionThrottle(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	t.Cleanup(reactionInsertLatency.reset)
+
+	// 直近の INSERT が閾値より遅ければ、投稿を断る
+	reactionInsertLatency.record(time.Now(), 2*reactionLatencyThreshold)
+
+	rec := postTestReaction(t, owner, livestreamID, &PostReactionRequest{EmojiName: ":tada:"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("post: got status %d, want 503", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != strconv.Itoa(int(reactionLatencyWindow/time.Second)) {
+		t.Fatalf("Retry-After = %q", got)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 0 {
+		t.Fatalf("got %d reactions, want none", got)
+	}
+
+	// 検証だけの投稿は、断られることを結果として返す
+	var res ReactionDryRunResponse
+	rec = doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/reaction?dry_run=true", livestreamID), owner.Cookie, &PostReactionRequest{EmojiName: ":tada:"})
+	decodeTestResponse(t, rec, http.StatusOK, &res)
+	if res.WouldSucceed || res.Status != http.StatusServiceUnavailable {
+		t.Fatalf("dry run: got %+v, want would_succeed=false status=503", res)
+	}
+
+	// 窓から記録が抜ければ、受け付けを再開する
+	reactionInsertLatency.reset()
+	decodeTestResponse(t, postTestReaction(t, owner, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}), http.StatusCreated, nil)
+}
+
+func TestMetricsReactionInsertLatency(t *testing.T) {
+	t.Cleanup(reactionInsertLatency.reset)
+	reactionInsertLatency.reset()
+
+	// 窓の中の記録の平均を秒で出す
+	now := time.Now()
+	reactionInsertLatency.record(now, 100*time.Millisecond)
+	reactionInsertLatency.record(now, 300*time.Millisecond)
+	if got := scrapeTestMetrics(t)["isupipe_reaction_insert_latency_seconds"]; got != 0.2 {
+		t.Fatalf("isupipe_reaction_insert_latency_seconds = %v, want 0.2", got)
+	}
+
+	reactionInsertLatency.reset()
+	if got := scrapeTestMetrics(t)["isupipe_reaction_insert_latency_seconds"]; got != 0 {
+		t.Fatalf("after reset: isupipe_reaction_insert_latency_seconds = %v, want 0", got)
+	}
+}
@@ -19,8 +19,8 @@ func GetPaymentResult(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var totalTip int64
-	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
+	totalTip, err := sumUserTipTotals(ctx, tx)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
 	}
 
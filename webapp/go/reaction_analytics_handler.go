@@ -0,0 +1,752 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type ReactionDiffEntry struct {
+	EmojiName string `json:"emoji"`
+	CountT1   int64  `json:"count_t1"`
+	CountT2   int64  `json:"count_t2"`
+	Delta     int64  `json:"delta"`
+}
+
+type emojiCountModel struct {
+	EmojiName string `db:"emoji_name"`
+	Count     int64  `db:"cnt"`
+}
+
+type ReactionSummaryEntry struct {
+	EmojiName string `json:"emoji_name"`
+	Count     int64  `json:"count"`
+}
+
+type ReactionRate struct {
+	// 直近 reactionRateWindowSeconds 秒間の、1秒あたりのリアクション数
+	Rate     float64 `json:"rate"`
+	PeakRate float64 `json:"peak_rate"`
+}
+
+type EmojiCooccurrence struct {
+	EmojiA string `json:"emoji_a"`
+	EmojiB string `json:"emoji_b"`
+	// 両方の絵文字でリアクションしたユーザ数
+	Count int64 `json:"count"`
+}
+
+type userEmojiModel struct {
+	UserID    int64  `db:"user_id"`
+	EmojiName string `db:"emoji_name"`
+}
+
+type ReactionTenureBucket struct {
+	Bucket         string `json:"bucket"`
+	UserCount      int64  `json:"user_count"`
+	ReactionsCount int64  `json:"reactions_count"`
+}
+
+type tenureCountModel struct {
+	Bucket         string `db:"bucket"`
+	UserCount      int64  `db:"user_count"`
+	ReactionsCount int64  `db:"reactions_count"`
+}
+
+// フォロー期間の区分。フォローしていない、またはフォローして1日未満のユーザは new に入る
+var reactionTenureBuckets = []string{"new", "week", "month", "older"}
+
+type ActiveReactorsBucket struct {
+	BucketStart    int64 `json:"bucket_start"`
+	ActiveReactors int64 `json:"active_reactors"`
+}
+
+type ReactionTimelineBucket struct {
+	BucketStart int64 `json:"bucket_start"`
+	Count       int64 `json:"count"`
+}
+
+type EngagementBucket struct {
+	BucketStart  int64 `json:"bucket_start"`
+	Reactions    int64 `json:"reactions"`
+	Livecomments int64 `json:"livecomments"`
+}
+
+type bucketCountModel struct {
+	BucketStart int64 `db:"bucket_start"`
+	Count       int64 `db:"cnt"`
+}
+
+const (
+	defaultReactionBucketSeconds = 60
+	defaultCooccurrenceTop       = 10
+	// 時系列で返すバケット数の上限。超える場合は新しい方から返す
+	maxTimelineBuckets = 1000
+	// 古いバケットを切り詰めたときに付けるヘッダ
+	timelineTruncatedHeader = "X-Timeline-Truncated"
+)
+
+// 絵文字ごとのリアクション数取得API
+// GET /api/livestream/:livestream_id/reactions/summary
+// 件数の多い順に返す。同数の場合は絵文字名順
+func getReactionSummaryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	// まとめられたリアクションも1件ずつ数えるため、行数ではなく count を合計する
+	query := "SELECT emoji_name, SUM(count) AS cnt FROM reactions WHERE livestream_id = ? AND " + visibleReactionsWhere("") + " GROUP BY emoji_name ORDER BY cnt DESC, emoji_name ASC"
+	var counts []emojiCountModel
+	if err := tx.SelectContext(ctx, &counts, query, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	summary := make([]ReactionSummaryEntry, len(counts))
+	for i := range counts {
+		summary[i] = ReactionSummaryEntry{
+			EmojiName: counts[i].EmojiName,
+			Count:     counts[i].Count,
+		}
+	}
+
+	return c.JSON(http.StatusOK, summary)
+}
+
+// 2時点のリアクション数比較API
+// GET /api/livestream/:livestream_id/reactions/diff?t1=&t2=&bucket=
+// t1, t2 それぞれから bucket 秒間の絵文字ごとのリアクション数と、その差分を返す
+func getReactionsDiffHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	t1, err := strconv.ParseInt(c.QueryParam("t1"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "t1 query parameter must be integer")
+	}
+	t2, err := strconv.ParseInt(c.QueryParam("t2"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "t2 query parameter must be integer")
+	}
+	if t1 >= t2 {
+		return echo.NewHTTPError(http.StatusBadRequest, "t1 must be less than t2")
+	}
+	bucket, err := parseBucketParam(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	query := "SELECT emoji_name, SUM(count) AS cnt FROM reactions WHERE livestream_id = ? AND " + visibleReactionsWhere("") + " AND created_at >= ? AND created_at < ? GROUP BY emoji_name"
+	var countsT1 []emojiCountModel
+	if err := tx.SelectContext(ctx, &countsT1, query, livestreamID, t1, t1+bucket); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions at t1: "+err.Error())
+	}
+	var countsT2 []emojiCountModel
+	if err := tx.SelectContext(ctx, &countsT2, query, livestreamID, t2, t2+bucket); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions at t2: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	entryMap := make(map[string]*ReactionDiffEntry, len(countsT1)+len(countsT2))
+	for _, count := range countsT1 {
+		entryMap[count.EmojiName] = &ReactionDiffEntry{EmojiName: count.EmojiName, CountT1: count.Count}
+	}
+	for _, count := range countsT2 {
+		entry, ok := entryMap[count.EmojiName]
+		if !ok {
+			entry = &ReactionDiffEntry{EmojiName: count.EmojiName}
+			entryMap[count.EmojiName] = entry
+		}
+		entry.CountT2 = count.Count
+	}
+
+	entries := make([]ReactionDiffEntry, 0, len(entryMap))
+	for _, entry := range entryMap {
+		entry.Delta = entry.CountT2 - entry.CountT1
+		entries = append(entries, *entry)
+	}
+	// 増加量の大きい順。同じ場合は絵文字名順
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Delta == entries[j].Delta {
+			return entries[i].EmojiName < entries[j].EmojiName
+		}
+		return entries[i].Delta > entries[j].Delta
+	})
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// 秒間リアクション数取得API
+// GET /api/livestream/:livestream_id/reactions/rate
+func getReactionRateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	rate, peak := reactionRates.rate(int64(livestreamID), time.Now())
+	return c.JSON(http.StatusOK, &ReactionRate{
+		Rate:     rate,
+		PeakRate: peak,
+	})
+}
+
+// 絵文字の共起取得API (配信者向け)
+// GET /api/livestream/:livestream_id/reactions/cooccurrence?top=
+// 同じユーザが使った絵文字の組を、使ったユーザ数の多い順に返す
+func getReactionCooccurrenceHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	top := defaultCooccurrenceTop
+	if c.QueryParam("top") != "" {
+		top, err = strconv.Atoi(c.QueryParam("top"))
+		if err != nil || top <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "top query parameter must be positive integer")
+		}
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	var pairs []userEmojiModel
+	query := "SELECT DISTINCT user_id, emoji_name FROM reactions WHERE livestream_id = ? AND " + visibleReactionsWhere("") + " ORDER BY user_id, emoji_name"
+	if err := tx.SelectContext(ctx, &pairs, query, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// ユーザごとに使った絵文字をまとめ、その中の組をすべて数える
+	// 絵文字名順に取得しているので、同じ組が (A, B) と (B, A) に分かれることはない
+	counts := make(map[[2]string]int64)
+	for start := 0; start < len(pairs); {
+		end := start
+		for end < len(pairs) && pairs[end].UserID == pairs[start].UserID {
+			end++
+		}
+		for i := start; i < end; i++ {
+			for j := i + 1; j < end; j++ {
+				counts[[2]string{pairs[i].EmojiName, pairs[j].EmojiName}]++
+			}
+		}
+		start = end
+	}
+
+	cooccurrences := make([]EmojiCooccurrence, 0, len(counts))
+	for pair, count := range counts {
+		cooccurrences = append(cooccurrences, EmojiCooccurrence{
+			EmojiA: pair[0],
+			EmojiB: pair[1],
+			Count:  count,
+		})
+	}
+	sort.Slice(cooccurrences, func(i, j int) bool {
+		if cooccurrences[i].Count != cooccurrences[j].Count {
+			return cooccurrences[i].Count > cooccurrences[j].Count
+		}
+		if cooccurrences[i].EmojiA != cooccurrences[j].EmojiA {
+			return cooccurrences[i].EmojiA < cooccurrences[j].EmojiA
+		}
+		return cooccurrences[i].EmojiB < cooccurrences[j].EmojiB
+	})
+	if len(cooccurrences) > top {
+		cooccurrences = cooccurrences[:top]
+	}
+
+	return c.JSON(http.StatusOK, cooccurrences)
+}
+
+// フォロー期間別のリアクション数取得API (配信者向け)
+// GET /api/livestream/:livestream_id/reactions/by-tenure
+// リアクションした時点で配信者をどれくらいの期間フォローしていたかで分け、区分ごとのリアクション数を返す
+func getReactionsByTenureHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	const (
+		day   = 24 * 60 * 60
+		week  = 7 * day
+		month = 30 * day
+	)
+	query := fmt.Sprintf(`SELECT
+		CASE
+			WHEN f.created_at IS NULL OR r.created_at - f.created_at < %[1]d THEN 'new'
+			WHEN r.created_at - f.created_at < %[2]d THEN 'week'
+			WHEN r.created_at - f.created_at < %[3]d THEN 'month'
+			ELSE 'older'
+		END AS bucket,
+		COUNT(DISTINCT r.user_id) AS user_count,
+		SUM(r.count) AS reactions_count
+	FROM reactions r
+	INNER JOIN livestreams l ON l.id = r.livestream_id
+	LEFT JOIN follows f ON f.follower_id = r.user_id AND f.followee_id = l.user_id
+	WHERE r.livestream_id = ? AND %[4]s
+	GROUP BY bucket`, day, week, month, visibleReactionsWhere("r"))
+	var counts []tenureCountModel
+	if err := tx.SelectContext(ctx, &counts, query, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	countMap := make(map[string]tenureCountModel, len(counts))
+	for _, count := range counts {
+		countMap[count.Bucket] = count
+	}
+	// リアクションのない区分も 0 件として返す
+	buckets := make([]ReactionTenureBucket, len(reactionTenureBuckets))
+	for i, bucket := range reactionTenureBuckets {
+		buckets[i] = ReactionTenureBucket{
+			Bucket:         bucket,
+			UserCount:      countMap[bucket].UserCount,
+			ReactionsCount: countMap[bucket].ReactionsCount,
+		}
+	}
+
+	return c.JSON(http.StatusOK, buckets)
+}
+
+// 時間帯ごとのリアクションしたユーザ数取得API (配信者向け)
+// GET /api/livestream/:livestream_id/reactions/active-reactors?bucket=
+// 配信の期間と投稿の時刻を含む範囲を bucket 秒ごとに区切り、それぞれでリアクションしたユーザ数を返す
+// バケット数が maxTimelineBuckets を超える場合は新しい方から返し、X-Timeline-Truncated ヘッダを付ける
+func getActiveReactorsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	bucket, err := parseBucketParam(c)
+	if err != nil {
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	reactionsRange, err := selectCreatedAtRange(ctx, tx, "SELECT MIN(created_at) AS min_at, MAX(created_at) AS max_at FROM reactions WHERE livestream_id = ? AND "+visibleReactionsWhere(""), livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get the range of reactions: "+err.Error())
+	}
+	timeline := newTimelineRange(livestreamModel, bucket, reactionsRange)
+
+	query := "SELECT " + bucketStartExpr("created_at") + " AS bucket_start, COUNT(DISTINCT user_id) AS cnt FROM reactions WHERE livestream_id = ? AND " + visibleReactionsWhere("") + " AND created_at >= ? AND created_at < ? GROUP BY bucket_start"
+	counts, err := selectBucketCounts(ctx, tx, query, livestreamModel.ID, timeline)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count active reactors: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	bucketStarts := timeline.starts()
+	buckets := make([]ActiveReactorsBucket, len(bucketStarts))
+	for i, bucketStart := range bucketStarts {
+		buckets[i] = ActiveReactorsBucket{
+			BucketStart:    bucketStart,
+			ActiveReactors: counts[bucketStart],
+		}
+	}
+
+	setTimelineTruncatedHeader(c, timeline)
+	return c.JSON(http.StatusOK, buckets)
+}
+
+// リアクションとライブコメントの時系列取得API (配信者向け)
+// GET /api/livestream/:livestream_id/engagement/timeline?bucket=
+// 配信の期間と投稿の時刻を含む範囲を bucket 秒ごとに区切り、リアクション数とライブコメント数を並べて返す
+// バケット数が maxTimelineBuckets を超える場合は新しい方から返し、X-Timeline-Truncated ヘッダを付ける
+func getEngagementTimelineHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	bucket, err := parseBucketParam(c)
+	if err != nil {
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	reactionsRange, err := selectCreatedAtRange(ctx, tx, "SELECT MIN(created_at) AS min_at, MAX(created_at) AS max_at FROM reactions WHERE livestream_id = ? AND "+visibleReactionsWhere(""), livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get the range of reactions: "+err.Error())
+	}
+	livecommentsRange, err := selectCreatedAtRange(ctx, tx, "SELECT MIN(created_at) AS min_at, MAX(created_at) AS max_at FROM livecomments WHERE livestream_id = ?", livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get the range of livecomments: "+err.Error())
+	}
+	timeline := newTimelineRange(livestreamModel, bucket, reactionsRange, livecommentsRange)
+
+	reactionsQuery := "SELECT " + bucketStartExpr("created_at") + " AS bucket_start, SUM(count) AS cnt FROM reactions WHERE livestream_id = ? AND " + visibleReactionsWhere("") + " AND created_at >= ? AND created_at < ? GROUP BY bucket_start"
+	reactionCounts, err := selectBucketCounts(ctx, tx, reactionsQuery, livestreamModel.ID, timeline)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+	livecommentsQuery := "SELECT " + bucketStartExpr("created_at") + " AS bucket_start, COUNT(*) AS cnt FROM livecomments WHERE livestream_id = ? AND created_at >= ? AND created_at < ? GROUP BY bucket_start"
+	livecommentCounts, err := selectBucketCounts(ctx, tx, livecommentsQuery, livestreamModel.ID, timeline)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomments: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	bucketStarts := timeline.starts()
+	buckets := make([]EngagementBucket, len(bucketStarts))
+	for i, bucketStart := range bucketStarts {
+		buckets[i] = EngagementBucket{
+			BucketStart:  bucketStart,
+			Reactions:    reactionCounts[bucketStart],
+			Livecomments: livecommentCounts[bucketStart],
+		}
+	}
+
+	setTimelineTruncatedHeader(c, timeline)
+	return c.JSON(http.StatusOK, buckets)
+}
+
+// リアクション数の時系列取得API
+// GET /api/livestream/:livestream_id/reactions/timeline?bucket=
+// 配信の期間と投稿の時刻を含む範囲を bucket 秒ごとに区切り、それぞれのリアクション数を古い順に返す
+// バケット数が maxTimelineBuckets を超える場合は新しい方から返し、X-Timeline-Truncated ヘッダを付ける
+func getReactionTimelineHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	bucket, err := parseBucketParam(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	reactionsRange, err := selectCreatedAtRange(ctx, tx, "SELECT MIN(created_at) AS min_at, MAX(created_at) AS max_at FROM reactions WHERE livestream_id = ? AND "+visibleReactionsWhere(""), livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get the range of reactions: "+err.Error())
+	}
+	timeline := newTimelineRange(livestreamModel, bucket, reactionsRange)
+
+	query := "SELECT " + bucketStartExpr("created_at") + " AS bucket_start, SUM(count) AS cnt FROM reactions WHERE livestream_id = ? AND " + visibleReactionsWhere("") + " AND created_at >= ? AND created_at < ? GROUP BY bucket_start"
+	counts, err := selectBucketCounts(ctx, tx, query, livestreamModel.ID, timeline)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	bucketStarts := timeline.starts()
+	buckets := make([]ReactionTimelineBucket, len(bucketStarts))
+	for i, bucketStart := range bucketStarts {
+		buckets[i] = ReactionTimelineBucket{
+			BucketStart: bucketStart,
+			Count:       counts[bucketStart],
+		}
+	}
+
+	setTimelineTruncatedHeader(c, timeline)
+	return c.JSON(http.StatusOK, buckets)
+}
+
+// timelineRange は時系列で返すバケットの区間
+type timelineRange struct {
+	// 最初のバケットの開始時刻
+	origin int64
+	// 最後のバケットの終了時刻 (含まない)
+	end    int64
+	bucket int64
+	// バケット数が上限を超えたため、古いバケットを除いたか
+	truncated bool
+}
+
+// createdAtRangeModel は集計するリアクションやライブコメントの created_at の範囲
+// 1件もない場合はどちらも NULL になる
+type createdAtRangeModel struct {
+	MinAt sql.NullInt64 `db:"min_at"`
+	MaxAt sql.NullInt64 `db:"max_at"`
+}
+
+// selectCreatedAtRange は MIN(created_at) AS min_at, MAX(created_at) AS max_at を返すクエリを、配信IDを渡して実行する
+func selectCreatedAtRange(ctx context.Context, tx *sqlx.Tx, query string, livestreamID int64) (createdAtRangeModel, error) {
+	var rangeModel createdAtRangeModel
+	if err := tx.GetContext(ctx, &rangeModel, query, livestreamID); err != nil {
+		return createdAtRangeModel{}, err
+	}
+	return rangeModel, nil
+}
+
+// newTimelineRange は配信の期間と、集計する行の created_at の範囲をすべて含むように、bucket 秒ごとに区切った区間を返す
+// 配信の期間外に投稿されたものも落とさないよう、バケットの区切りは配信の開始時刻にそろえたまま前後に広げる
+// バケット数が maxTimelineBuckets を超える場合は、新しい方から maxTimelineBuckets 個に切り詰める
+func newTimelineRange(livestreamModel LivestreamModel, bucket int64, createdAtRanges ...createdAtRangeModel) timelineRange {
+	r := timelineRange{origin: livestreamModel.StartAt, end: max(livestreamModel.EndAt, livestreamModel.StartAt), bucket: bucket}
+	for _, rangeModel := range createdAtRanges {
+		if rangeModel.MinAt.Valid && rangeModel.MinAt.Int64 < r.origin {
+			r.origin -= (r.origin - rangeModel.MinAt.Int64 + bucket - 1) / bucket * bucket
+		}
+		if rangeModel.MaxAt.Valid && rangeModel.MaxAt.Int64 >= r.end {
+			r.end = rangeModel.MaxAt.Int64 + 1
+		}
+	}
+	if n := (r.end - r.origin + bucket - 1) / bucket; n > maxTimelineBuckets {
+		r.origin += (n - maxTimelineBuckets) * bucket
+		r.truncated = true
+	}
+	return r
+}
+
+// starts は各バケットの開始時刻を返す
+// 集計結果が疎でもグラフの横軸がそろうよう、空のバケットも含める
+func (r timelineRange) starts() []int64 {
+	starts := []int64{}
+	for start := r.origin; start < r.end; start += r.bucket {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// setTimelineTruncatedHeader は古いバケットを切り詰めたことをヘッダで知らせる
+func setTimelineTruncatedHeader(c echo.Context, r timelineRange) {
+	if r.truncated {
+		c.Response().Header().Set(timelineTruncatedHeader, "true")
+	}
+}
+
+// bucketStartExpr は、時刻のカラムをそれが属するバケットの開始時刻に変換するSQL式を返す
+// プレースホルダとして、最初のバケットの開始時刻、最初のバケットの開始時刻、バケット幅、バケット幅の順に値を渡す
+func bucketStartExpr(column string) string {
+	return fmt.Sprintf("? + ((%s - ?) DIV ?) * ?", column)
+}
+
+// selectBucketCounts は bucketStartExpr を使ったクエリを実行し、バケットの開始時刻ごとの件数を返す
+// query は bucketStartExpr の値に続けて、配信ID、区間の開始、区間の終了を受け取る形にする
+func selectBucketCounts(ctx context.Context, tx *sqlx.Tx, query string, livestreamID int64, r timelineRange) (map[int64]int64, error) {
+	var countModels []bucketCountModel
+	args := []interface{}{
+		r.origin, r.origin, r.bucket, r.bucket,
+		livestreamID, r.origin, r.end,
+	}
+	if err := tx.SelectContext(ctx, &countModels, query, args...); err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int64, len(countModels))
+	for _, countModel := range countModels {
+		counts[countModel.BucketStart] = countModel.Count
+	}
+	return counts, nil
+}
+
+func parseBucketParam(c echo.Context) (int64, error) {
+	if c.QueryParam("bucket") == "" {
+		return defaultReactionBucketSeconds, nil
+	}
+	bucket, err := strconv.ParseInt(c.QueryParam("bucket"), 10, 64)
+	if err != nil || bucket <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "bucket query parameter must be positive integer")
+	}
+	return bucket, nil
+}
+
+// verifyLivestreamExists は配信が存在しない場合に404を返す
+func verifyLivestreamExists(ctx context.Context, tx *sqlx.Tx, livestreamID int64) error {
+	var id int64
+	if err := tx.GetContext(ctx, &id, "SELECT id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestGetReactionSummary(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, owner.ID, "other", 0, 1)
+	for _, emoji := range []string{":heart:", ":tada:", ":heart:", ":smile:", ":heart:", ":tada:", ":clap:"} {
+		decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: emoji}), http.StatusCreated, nil)
+	}
+	// 他の配信のリアクションは数えない
+	decodeTestResponse(t, postTestReaction(t, viewer, otherLivestreamID, &PostReactionRequest{EmojiName: ":clap:"}), http.StatusCreated, nil)
+
+	var summary []ReactionSummaryEntry
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reactions/summary", livestreamID), viewer.Cookie, nil), http.StatusOK, &summary)
+	// 件数の多い順に並び、同じ件数なら絵文字名の順
+	want := []ReactionSummaryEntry{
+		{EmojiName: ":heart:", Count: 3},
+		{EmojiName: ":tada:", Count: 2},
+		{EmojiName: ":clap:", Count: 1},
+		{EmojiName: ":smile:", Count: 1},
+	}
+	if fmt.Sprint(summary) != fmt.Sprint(want) {
+		t.Fatalf("got %+v, want %+v", summary, want)
+	}
+
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/livestream/999999/reactions/summary", viewer.Cookie, nil), http.StatusNotFound, nil)
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reactions/summary", livestreamID), "", nil), http.StatusForbidden, nil)
+}
+
+func TestGetReactionTimeline(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 1000, 1180)
+	for _, reaction := range []ReactionModel{
+		{CreatedAt: 1000},
+		{CreatedAt: 1059, Count: 2},
+		{CreatedAt: 1060},
+		// 配信の期間外のリアクションも、前後にバケットを広げて数える
+		{CreatedAt: 999},
+		{CreatedAt: 1180},
+	} {
+		reaction.UserID, reaction.LivestreamID, reaction.EmojiName = viewer.ID, livestreamID, ":tada:"
+		newTestReaction(t, reaction)
+	}
+
+	path := fmt.Sprintf("/api/livestream/%d/reactions/timeline", livestreamID)
+	var buckets []ReactionTimelineBucket
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path+"?bucket=60", viewer.Cookie, nil), http.StatusOK, &buckets)
+	// 空のバケットも含めて古い順に並ぶ
+	want := []ReactionTimelineBucket{
+		{BucketStart: 940, Count: 1},
+		{BucketStart: 1000, Count: 3},
+		{BucketStart: 1060, Count: 1},
+		{BucketStart: 1120, Count: 0},
+		{BucketStart: 1180, Count: 1},
+	}
+	if fmt.Sprint(buckets) != fmt.Sprint(want) {
+		t.Fatalf("got %+v, want %+v", buckets, want)
+	}
+
+	// bucket を省略すると60秒ごとに区切る
+	var defaultBuckets []ReactionTimelineBucket
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path, viewer.Cookie, nil), http.StatusOK, &defaultBuckets)
+	if fmt.Sprint(defaultBuckets) != fmt.Sprint(want) {
+		t.Fatalf("default bucket: got %+v, want %+v", defaultBuckets, want)
+	}
+
+	for _, bucket := range []string{"0", "-60", "abc"} {
+		rec := doTestRequest(t, http.MethodGet, path+"?bucket="+bucket, viewer.Cookie, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("bucket=%s: got status %d, want 400", bucket, rec.Code)
+		}
+	}
+}
+
+func TestGetReactionTimelineLongStream(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	const start, day = 1_000_000, 24 * 60 * 60
+	livestreamID := newTestLivestream(t, owner.ID, "long stream", start, start+day)
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: start + day - 1})
+
+	// 24時間の配信でも、パラメータなしで新しい方から上限の個数を返す
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reactions/timeline", livestreamID), viewer.Cookie, nil)
+	var buckets []ReactionTimelineBucket
+	decodeTestResponse(t, rec, http.StatusOK, &buckets)
+	if len(buckets) != maxTimelineBuckets || rec.Header().Get(timelineTruncatedHeader) != "true" {
+		t.Fatalf("got %d buckets with %s = %q, want %d truncated", len(buckets), timelineTruncatedHeader, rec.Header().Get(timelineTruncatedHeader), maxTimelineBuckets)
+	}
+	if last := buckets[len(buckets)-1]; last.BucketStart != start+day-60 || last.Count != 1 {
+		t.Fatalf("last bucket = %+v, want one reaction at %d", last, start+day-60)
+	}
+}
+
+func TestGetActiveReactorsTruncated(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	const start, day = 1_000_000, 24 * 60 * 60
+	livestreamID := newTestLivestream(t, owner.ID, "long stream", start, start+day)
+	// 最初のバケットと最後のバケットにリアクションする
+	for _, createdAt := range []int64{start, start + day - 1} {
+		newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: createdAt})
+	}
+
+	path := fmt.Sprintf("/api/livestream/%d/reactions/active-reactors", livestreamID)
+	// 既定の60秒ごとでは1440個になるので、新しい方から上限の個数だけ返す
+	rec := doTestRequest(t, http.MethodGet, path, owner.Cookie, nil)
+	var buckets []ActiveReactorsBucket
+	decodeTestResponse(t, rec, http.StatusOK, &buckets)
+	if len(buckets) != maxTimelineBuckets {
+		t.Fatalf("got %d buckets, want %d", len(buckets), maxTimelineBuckets)
+	}
+	if got := rec.Header().Get(timelineTruncatedHeader); got != "true" {
+		t.Fatalf("%s = %q, want true", timelineTruncatedHeader, got)
+	}
+	if first, want := buckets[0].BucketStart, int64(start+(day/60-maxTimelineBuckets)*60); first != want {
+		t.Fatalf("first bucket starts at %d, want %d", first, want)
+	}
+	if last := buckets[len(buckets)-1]; last.BucketStart != start+day-60 || last.ActiveReactors != 1 {
+		t.Fatalf("last bucket = %+v, want one reactor at %d", last, start+day-60)
+	}
+	for _, bucket := range buckets[:len(buckets)-1] {
+		if bucket.ActiveReactors != 0 {
+			t.Fatalf("bucket %+v counts a reaction outside the returned range", bucket)
+		}
+	}
+
+	// 上限に収まる場合はヘッダを付けない
+	rec = doTestRequest(t, http.MethodGet, path+"?bucket=3600", owner.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusOK, &buckets)
+	if len(buckets) != 24 || rec.Header().Get(timelineTruncatedHeader) != "" {
+		t.Fatalf("bucket=3600: got %d buckets with %s = %q, want 24 without the header", len(buckets), timelineTruncatedHeader, rec.Header().Get(timelineTruncatedHeader))
+	}
+	if buckets[0].ActiveReactors != 1 || buckets[23].ActiveReactors != 1 {
+		t.Fatalf("bucket=3600: got %+v, want a reactor in the first and last buckets", buckets)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+// 複数のリアクションをまとめて投稿するAPI
+// クライアントが同じ batch_id で再送しても二重に保存しないよう、保存済みの項目を reaction_batch_items に記録する
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 一度に投稿できるリアクション数の上限
+	maxReactionBatchSize     = 100
+	maxReactionBatchIDLength = 255
+	// batch_id を覚えておく期間。これを過ぎた batch_id は新しいバッチとして扱う
+	reactionBatchTTLSeconds = 24 * 60 * 60
+
+	mysqlErrDuplicateEntry = 1062
+)
+
+type PostReactionBatchRequest struct {
+	BatchID   string                `json:"batch_id"`
+	Reactions []PostReactionRequest `json:"reactions"`
+}
+
+type ReactionBatchResult struct {
+	Index  int `json:"index"`
+	Status int `json:"status"`
+	// 投稿できた場合に入る。同じバッチの以前の試行で投稿したものも含む
+	Reaction *Reaction `json:"reaction,omitempty"`
+	// 同じバッチの以前の試行で投稿したものなら true
+	Replayed bool `json:"replayed,omitempty"`
+	// 断られた場合に入る。バッチを再送すると、もう一度投稿を試みる
+	Error string `json:"error,omitempty"`
+}
+
+type PostReactionBatchResponse struct {
+	BatchID string                `json:"batch_id"`
+	Results []ReactionBatchResult `json:"results"`
+}
+
+type ReactionBatchItemModel struct {
+	UserID       int64  `db:"user_id"`
+	LivestreamID int64  `db:"livestream_id"`
+	BatchID      string `db:"batch_id"`
+	ItemIndex    int    `db:"item_index"`
+	ReactionID   int64  `db:"reaction_id"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+// リアクション一括投稿API
+// POST /api/livestream/:livestream_id/reactions/batch
+// 項目ごとに保存するので、一部が失敗しても成功した項目は残る。同じ batch_id で再送すると失敗した項目だけを投稿し直す
+// 保存済みの項目より少ない項目で再送した場合は 409 を返す
+func postReactionBatchHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req *PostReactionBatchRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.BatchID == "" || len(req.BatchID) > maxReactionBatchIDLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("batch_id must be 1 to %d characters", maxReactionBatchIDLength))
+	}
+	if len(req.Reactions) == 0 || len(req.Reactions) > maxReactionBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reactions must have 1 to %d items", maxReactionBatchSize))
+	}
+	intensities := make([]int64, len(req.Reactions))
+	for i := range req.Reactions {
+		intensity, err := validatePostReactionRequest(&req.Reactions[i])
+		if err != nil {
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				return echo.NewHTTPError(he.Code, fmt.Sprintf("reactions[%d]: %v", i, he.Message))
+			}
+			return err
+		}
+		intensities[i] = intensity
+	}
+
+	// DBが詰まっている間は、書き込む前に断る
+	if err := checkReactionThrottle(c, time.Now()); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reaction_batch_items WHERE created_at < ?", now-reactionBatchTTLSeconds); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete expired reaction batches: "+err.Error())
+	}
+	var itemModels []ReactionBatchItemModel
+	if err := tx.SelectContext(ctx, &itemModels, "SELECT * FROM reaction_batch_items WHERE user_id = ? AND livestream_id = ? AND batch_id = ?", userID, livestreamID, req.BatchID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction batch: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	results := make([]ReactionBatchResult, len(req.Reactions))
+	postedIDs := make(map[int]int64, len(itemModels))
+	for _, itemModel := range itemModels {
+		// 以前の試行より項目の少ないリトライは、同じバッチとして扱えない
+		if itemModel.ItemIndex >= len(req.Reactions) {
+			return echo.NewHTTPError(http.StatusConflict, "batch_id was already used with more reactions")
+		}
+		postedIDs[itemModel.ItemIndex] = itemModel.ReactionID
+	}
+	for i := range req.Reactions {
+		results[i].Index = i
+		if _, ok := postedIDs[i]; ok {
+			continue
+		}
+
+		reaction, err := postReactionBatchItem(c, livestreamModel, userID, req.BatchID, i, &req.Reactions[i], intensities[i])
+		if err != nil {
+			var he *echo.HTTPError
+			if !errors.As(err, &he) {
+				he = echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			results[i].Status = he.Code
+			results[i].Error = fmt.Sprint(he.Message)
+			continue
+		}
+		results[i].Status = http.StatusCreated
+		results[i].Reaction = &reaction
+
+		// 承認待ちのリアクションは承認されるまで、シャドウバンされたリアクションはずっと配信しない
+		if !reaction.Pending && !reaction.shadow {
+			if _, err := announceReaction(reaction); err != nil {
+				c.Logger().Warnf("failed to marshal reaction for broadcast: %+v", err)
+			}
+		}
+	}
+
+	// 以前の試行で投稿済みの項目は、そのときのリアクションを返す
+	if len(postedIDs) > 0 {
+		if err := fillReplayedReactionBatchResults(ctx, results, postedIDs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill replayed reactions: "+err.Error())
+		}
+	}
+
+	return c.JSON(http.StatusOK, &PostReactionBatchResponse{
+		BatchID: req.BatchID,
+		Results: results,
+	})
+}
+
+// postReactionBatchItem はバッチの1項目を投稿する
+// リアクションと投稿済みの記録は同じトランザクションで保存するので、片方だけが残ることはない
+func postReactionBatchItem(c echo.Context, livestreamModel LivestreamModel, userID int64, batchID string, index int, req *PostReactionRequest, intensity int64) (Reaction, error) {
+	ctx := c.Request().Context()
+
+	// バッチでも1件ずつ単発の投稿と同じ上限で数える
+	postedAt := time.Now()
+	if err := checkReactionRateLimit(c, userID, postedAt); err != nil {
+		return Reaction{}, err
+	}
+	if err := checkReactionStreamRate(c, userID, livestreamModel.ID, postedAt); err != nil {
+		return Reaction{}, err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livecommentID, err := verifyReactionTarget(ctx, tx, livestreamModel.ID, req.LivecommentID)
+	if err != nil {
+		return Reaction{}, err
+	}
+
+	now := time.Now().Unix()
+	pending, err := enforceReactionSettings(c, tx, livestreamModel, userID, req.EmojiName, now)
+	if err != nil {
+		return Reaction{}, err
+	}
+	shadow, err := isReactionShadowBanned(ctx, tx, livestreamModel.ID, userID)
+	if err != nil {
+		return Reaction{}, err
+	}
+
+	reactionModel := ReactionModel{
+		UserID:        userID,
+		LivestreamID:  livestreamModel.ID,
+		EmojiName:     req.EmojiName,
+		Intensity:     intensity,
+		Count:         1,
+		Pending:       pending,
+		CreatedAt:     now,
+		LivecommentID: livecommentID,
+		Shadow:        shadow,
+	}
+	if err := insertReaction(ctx, tx, &reactionModel); err != nil {
+		return Reaction{}, err
+	}
+
+	itemModel := ReactionBatchItemModel{
+		UserID:       userID,
+		LivestreamID: livestreamModel.ID,
+		BatchID:      batchID,
+		ItemIndex:    index,
+		ReactionID:   reactionModel.ID,
+		CreatedAt:    now,
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO reaction_batch_items (user_id, livestream_id, batch_id, item_index, reaction_id, created_at) VALUES (:user_id, :livestream_id, :batch_id, :item_index, :reaction_id, :created_at)", itemModel); err != nil {
+		// 同じバッチが並行して再送され、先に保存された
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+			return Reaction{}, echo.NewHTTPError(http.StatusConflict, "the reaction is being posted by another request of the same batch")
+		}
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction batch item: "+err.Error())
+	}
+
+	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
+	if err != nil {
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	reactionsPostedTotal.Inc()
+
+	return reaction, nil
+}
+
+func fillReplayedReactionBatchResults(ctx context.Context, results []ReactionBatchResult, postedIDs map[int]int64) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	reactionIDs := make([]int64, 0, len(postedIDs))
+	for _, reactionID := range postedIDs {
+		reactionIDs = append(reactionIDs, reactionID)
+	}
+	query, params, err := sqlx.In("SELECT * FROM reactions WHERE id IN (?)", reactionIDs)
+	if err != nil {
+		return err
+	}
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, params...); err != nil {
+		return err
+	}
+	reactions, err := fillReactionResponses(ctx, tx, reactionModels)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	reactionMap := make(map[int64]Reaction, len(reactions))
+	for _, reaction := range reactions {
+		reactionMap[reaction.ID] = reaction
+	}
+	for index, reactionID := range postedIDs {
+		results[index].Status = http.StatusCreated
+		results[index].Replayed = true
+		if reaction, ok := reactionMap[reactionID]; ok {
+			results[index].Reaction = &reaction
+		}
+	}
+	return nil
+}
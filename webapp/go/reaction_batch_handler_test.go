@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func postTestReactionBatch(t *testing.T, user testUser, livestreamID int64, req *PostReactionBatchRequest) PostReactionBatchResponse {
+	t.Helper()
+	rec := doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/reactions/batch", livestreamID), user.Cookie, req)
+	var res PostReactionBatchResponse
+	decodeTestResponse(t, rec, http.StatusOK, &res)
+	if len(res.Results) != len(req.Reactions) {
+		t.Fatalf("got %d results, want %d", len(res.Results), len(req.Reactions))
+	}
+	return res
+}
+
+func TestPostReactionBatchReplay(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+
+	origLimit, origWindow := reactionRateLimit, reactionRateLimitWindow
+	t.Cleanup(func() { reactionRateLimit, reactionRateLimitWindow = origLimit, origWindow })
+	reactionRateLimitWindow = time.Hour
+	// 1件目の試行では、2件目だけが流量制限で失敗する
+	reactionRateLimit = 1
+
+	req := &PostReactionBatchRequest{
+		BatchID:   "batch-1",
+		Reactions: []PostReactionRequest{{EmojiName: ":tada:"}, {EmojiName: ":heart:"}},
+	}
+	first := postTestReactionBatch(t, viewer, livestreamID, req)
+	if first.Results[0].Status != http.StatusCreated || first.Results[1].Status != http.StatusTooManyRequests {
+		t.Fatalf("first attempt: got %+v, want 201 and 429", first.Results)
+	}
+	firstID := first.Results[0].Reaction.ID
+
+	// 再送では失敗した項目だけを投稿し、投稿済みの項目はそのときのリアクションを返す
+	reactionRateLimit = 0
+	second := postTestReactionBatch(t, viewer, livestreamID, req)
+	if r := second.Results[0]; r.Status != http.StatusCreated || !r.Replayed || r.Reaction == nil || r.Reaction.ID != firstID {
+		t.Fatalf("retry of the posted item: got %+v, want replayed reaction %d", r, firstID)
+	}
+	if r := second.Results[1]; r.Status != http.StatusCreated || r.Replayed || r.Reaction == nil || r.Reaction.EmojiName != ":heart:" {
+		t.Fatalf("retry of the failed item: got %+v, want a new reaction", r)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 2 {
+		t.Fatalf("got %d reactions after retry, want 2", got)
+	}
+
+	// すべて投稿済みのバッチを再送しても、増えない
+	third := postTestReactionBatch(t, viewer, livestreamID, req)
+	for i, r := range third.Results {
+		if !r.Replayed || r.Reaction == nil || r.Reaction.ID != second.Results[i].Reaction.ID {
+			t.Fatalf("replay of item %d: got %+v, want the reaction posted before", i, r)
+		}
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 2 {
+		t.Fatalf("got %d reactions after replay, want 2", got)
+	}
+
+	// 別の batch_id は新しいバッチとして投稿する
+	req.BatchID = "batch-2"
+	for _, r := range postTestReactionBatch(t, viewer, livestreamID, req).Results {
+		if r.Status != http.StatusCreated || r.Replayed {
+			t.Fatalf("new batch: got %+v, want a new reaction", r)
+		}
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 4 {
+		t.Fatalf("got %d reactions after a new batch, want 4", got)
+	}
+}
+
+func TestPostReactionBatchShorterRetry(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+
+	req := &PostReactionBatchRequest{
+		BatchID:   "batch-1",
+		Reactions: []PostReactionRequest{{EmojiName: ":tada:"}, {EmojiName: ":heart:"}},
+	}
+	postTestReactionBatch(t, viewer, livestreamID, req)
+
+	// 以前より項目の少ないリトライは、投稿せずに断る
+	req.Reactions = req.Reactions[:1]
+	rec := doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/reactions/batch", livestreamID), viewer.Cookie, req)
+	decodeTestResponse(t, rec, http.StatusConflict, nil)
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 2 {
+		t.Fatalf("got %d reactions after a shorter retry, want 2", got)
+	}
+}
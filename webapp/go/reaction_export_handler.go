@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// WebVTTの各キューを表示しておく秒数
+const reactionCueDurationSeconds = 3
+
+// NDJSONエクスポートで1回のクエリで読み出すリアクションの件数
+const reactionExportBatchSize = 1000
+
+// reactionOffsetSeconds は配信開始からの経過秒数を返す
+// リプレイ時にリアクションを動画のどの位置に重ねるかの計算に使う
+func reactionOffsetSeconds(reactionCreatedAt int64, livestreamStartAt int64) int64 {
+	return reactionCreatedAt - livestreamStartAt
+}
+
+func formatWebVTTTimestamp(seconds int64) string {
+	return fmt.Sprintf("%02d:%02d:%02d.000", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// リアクションのWebVTTエクスポートAPI
+// GET /api/livestream/:livestream_id/reactions.vtt
+func getReactionsWebVTTHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.StartAt <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the livestream has no start time")
+	}
+
+	query := `SELECT r.emoji_name, r.created_at, u.name AS user_name FROM reactions r
+	INNER JOIN users u ON u.id = r.user_id
+	WHERE r.livestream_id = ? AND ` + visibleReactionsWhere("r") + ` AND r.created_at >= ?
+	ORDER BY r.created_at ASC, r.id ASC`
+	rows, err := tx.QueryxContext(ctx, query, livestreamID, livestreamModel.StartAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+	defer rows.Close()
+
+	// 件数が多い配信でもメモリに載せずに済むよう、1行ずつ書き出す
+	c.Response().Header().Set(echo.HeaderContentType, "text/vtt; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	w := bufio.NewWriter(c.Response())
+	fmt.Fprint(w, "WEBVTT\n\n")
+
+	var cue struct {
+		EmojiName string `db:"emoji_name"`
+		CreatedAt int64  `db:"created_at"`
+		UserName  string `db:"user_name"`
+	}
+	for rows.Next() {
+		if err := rows.StructScan(&cue); err != nil {
+			c.Logger().Errorf("failed to scan reaction: %+v", err)
+			break
+		}
+		offset := reactionOffsetSeconds(cue.CreatedAt, livestreamModel.StartAt)
+		fmt.Fprintf(w, "%s --> %s\n<v %s>%s\n\n",
+			formatWebVTTTimestamp(offset),
+			formatWebVTTTimestamp(offset+reactionCueDurationSeconds),
+			html.EscapeString(cue.UserName),
+			html.EscapeString(cue.EmojiName),
+		)
+		if w.Buffered() > 4096 {
+			w.Flush()
+			c.Response().Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		// ステータスコードは送信済みなので、ログに残すだけにする
+		c.Logger().Errorf("failed to read reactions: %+v", err)
+	}
+	w.Flush()
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("failed to commit: %+v", err)
+	}
+	return nil
+}
+
+// リアクションのNDJSONエクスポートAPI
+// GET /api/livestream/:livestream_id/reactions.ndjson?from=&to=
+// from, to には created_at の範囲 (UNIX秒, to は含まない) を指定できる
+func getReactionsNDJSONHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	query := "SELECT * FROM reactions WHERE livestream_id = ? AND " + visibleReactionsWhere("") + " AND id > ?"
+	var boundArgs []interface{}
+	if c.QueryParam("from") != "" {
+		from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+		}
+		query += " AND created_at >= ?"
+		boundArgs = append(boundArgs, from)
+	}
+	if c.QueryParam("to") != "" {
+		to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+		}
+		query += " AND created_at < ?"
+		boundArgs = append(boundArgs, to)
+	}
+	query += " ORDER BY id ASC LIMIT ?"
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	c.Response().WriteHeader(http.StatusOK)
+	w := bufio.NewWriter(c.Response())
+	enc := json.NewEncoder(w)
+
+	// 巨大な配信でもメモリに載せずに済むよう、id をカーソルにして一定件数ずつ読み出しては書き出す
+	var lastID int64
+	for {
+		args := append([]interface{}{livestreamID, lastID}, boundArgs...)
+		args = append(args, reactionExportBatchSize)
+
+		reactionModels := []ReactionModel{}
+		if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
+			// ステータスコードは送信済みなので、ログに残すだけにする
+			c.Logger().Errorf("failed to get reactions: %+v", err)
+			break
+		}
+		if len(reactionModels) == 0 {
+			break
+		}
+
+		reactions, err := fillReactionResponses(ctx, tx, reactionModels)
+		if err != nil {
+			c.Logger().Errorf("failed to fill reactions: %+v", err)
+			break
+		}
+		for i := range reactions {
+			// Encode は末尾に改行を付けるので、そのまま1行1オブジェクトになる
+			if err := enc.Encode(reactions[i]); err != nil {
+				// クライアントが切断した場合などは、これ以上書き出しても仕方がないので打ち切る
+				c.Logger().Errorf("failed to write reaction: %+v", err)
+				return nil
+			}
+		}
+		w.Flush()
+		c.Response().Flush()
+
+		if len(reactionModels) < reactionExportBatchSize {
+			break
+		}
+		lastID = reactionModels[len(reactionModels)-1].ID
+	}
+	w.Flush()
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("failed to commit: %+v", err)
+	}
+	return nil
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/singleflight"
 )
 
 type ReactionModel struct {
@@ -19,6 +23,15 @@ type ReactionModel struct {
 	UserID       int64  `db:"user_id"`
 	LivestreamID int64  `db:"livestream_id"`
 	CreatedAt    int64  `db:"created_at"`
+	IsBot        bool   `db:"is_bot"`
+	Intensity    int64  `db:"intensity"`
+	Count        int64  `db:"count"`
+	Pending      bool   `db:"pending"`
+	Hidden       bool   `db:"hidden"`
+	DeletedAt    int64  `db:"deleted_at"`
+	// リアクション先のライブコメント。配信そのものへのリアクションの場合は NULL
+	LivecommentID sql.NullInt64 `db:"livecomment_id"`
+	Shadow        bool          `db:"shadow"`
 }
 
 type Reaction struct {
@@ -26,14 +39,759 @@ type Reaction struct {
 	EmojiName  string     `json:"emoji_name"`
 	User       User       `json:"user"`
 	Livestream Livestream `json:"livestream"`
+	Intensity  int64      `json:"intensity"`
+	Count      int64      `json:"count"`
+	Pending    bool       `json:"pending,omitempty"`
 	CreatedAt  int64      `json:"created_at"`
+	// 配信で表示される、同じ絵文字のリアクションの件数
+	// include=emoji_total を指定した場合のみ含める
+	EmojiTotal *int64 `json:"emoji_total,omitempty"`
+	// リアクションしたユーザがこの配信で送ったチップの合計
+	// include=reactor_tips を指定した場合のみ含める
+	ReactorTipTotal *int64 `json:"reactor_tip_total,omitempty"`
+	// リアクション先のライブコメント。配信そのものへのリアクションでは省略する
+	LivecommentID *int64 `json:"livecomment_id,omitempty"`
+
+	// シャドウバンされたユーザによる投稿かどうか。本人に気づかれないよう、レスポンスには含めない
+	shadow bool
+}
+
+// LivestreamRef はリアクションが属する配信を、ID とタイトルだけで表す
+type LivestreamRef struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+// CompactReaction は配信を LivestreamRef として埋め込んだ Reaction
+// エンコードするときは、埋め込んだものより外側の Livestream フィールドが優先される
+type CompactReaction struct {
+	Reaction
+	Livestream LivestreamRef `json:"livestream"`
+}
+
+type PostReactionRequest struct {
+	EmojiName string `json:"emoji_name"`
+	// 省略可能。省略した場合は 1 とする
+	Intensity *int64 `json:"intensity,omitempty"`
+	// 省略可能。指定した場合は、同じ配信のライブコメントへのリアクションになる
+	LivecommentID *int64 `json:"livecomment_id,omitempty"`
+}
+
+// リアクションの強さとして受け付ける範囲
+const (
+	minReactionIntensity     = 1
+	maxReactionIntensity     = 5
+	defaultReactionIntensity = 1
+)
+
+type ReactionDryRunResponse struct {
+	WouldSucceed bool `json:"would_succeed"`
+	// 配信者の承認待ちになる場合は true
+	Pending bool `json:"pending,omitempty"`
+	// 断られる場合の、エラーのステータスコードと理由
+	Status int    `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type RefreshReactionsRequest struct {
+	ReactionIDs []int64 `json:"reaction_ids"`
+}
+
+type UnusedEmoji struct {
+	EmojiName string `json:"emoji_name"`
+}
+
+type ApproveReactionsRequest struct {
+	ReactionIDs []int64 `json:"reaction_ids"`
+}
+
+type ApproveReactionsResponse struct {
+	// 承認待ちから表示されるようになったリアクションの件数
+	Approved int64 `json:"approved"`
+}
+
+// visibleReactionsWhere は、一覧や集計に含めてよいリアクションの条件を返す
+// 削除済み・非表示・承認待ち・シャドウバンされたリアクションを除外する。リアクションを読むクエリはすべてこれを使うこと
+func visibleReactionsWhere(alias string) string {
+	prefix := ""
+	if alias != "" {
+		prefix = alias + "."
+	}
+	return fmt.Sprintf("%[1]sdeleted_at = 0 AND NOT %[1]shidden AND NOT %[1]spending AND NOT %[1]sshadow", prefix)
+}
+
+// visibleReactionsWhereFor は visibleReactionsWhere と同じだが、シャドウバンされたリアクションも投稿者本人には見せる
+// 閲覧者ごとに結果が変わる一覧や本人向けの統計で使い、誰にでも同じものを返す集計には使わない
+func visibleReactionsWhereFor(alias string, viewerID int64) string {
+	prefix := ""
+	if alias != "" {
+		prefix = alias + "."
+	}
+	return fmt.Sprintf("%[1]sdeleted_at = 0 AND NOT %[1]shidden AND NOT %[1]spending AND (NOT %[1]sshadow OR %[1]suser_id = %[2]d)", prefix, viewerID)
+}
+
+// 0 より大きい場合、同じユーザがこの秒数以内に投稿した同じリアクションを1行にまとめる
+var reactionCoalesceWindowSeconds int64
+
+// リアクション一覧で limit に指定できる上限。これより大きい値は上限に切り詰める
+var reactionsMaxLimit = 1000
+
+// 一度に再取得できるリアクション数の上限
+const maxRefreshReactionIDs = 100
+
+// 一度に承認できるリアクション数の上限
+const maxApproveReactionIDs = 100
+
+func getReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	// after_id を指定すると、それより新しいリアクションを取得する (ライブフィードの前方ページング)
+	var afterID int64
+	if c.QueryParam("after_id") != "" {
+		if c.QueryParam("before_id") != "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "before_id and after_id query parameters can't be specified at the same time")
+		}
+		afterID, err = strconv.ParseInt(c.QueryParam("after_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "after_id query parameter must be integer")
+		}
+	}
+	// before_id を指定すると、それより古いリアクションを取得する (履歴の後方ページング)
+	var beforeID int64
+	if c.QueryParam("before_id") != "" {
+		beforeID, err = strconv.ParseInt(c.QueryParam("before_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before_id query parameter must be integer")
+		}
+	}
+	// since, until を指定すると、created_at がその範囲 (両端を含む) のリアクションに絞り込む
+	var since, until int64
+	if c.QueryParam("since") != "" {
+		since, err = strconv.ParseInt(c.QueryParam("since"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "since query parameter must be integer")
+		}
+	}
+	if c.QueryParam("until") != "" {
+		until, err = strconv.ParseInt(c.QueryParam("until"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "until query parameter must be integer")
+		}
+		if c.QueryParam("since") != "" && since > until {
+			return echo.NewHTTPError(http.StatusBadRequest, "since query parameter must not be greater than until")
+		}
+	}
+
+	// リプレイ用に古い順でも取得できるようにする。デフォルトは新しい順だが、after_id を指定した場合は古い順
+	order := "DESC"
+	switch c.QueryParam("order") {
+	case "":
+		if c.QueryParam("after_id") != "" {
+			order = "ASC"
+		}
+	case "desc":
+	case "asc":
+		order = "ASC"
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "order query parameter must be asc or desc")
+	}
+
+	// 一覧のリアクションはすべてこの配信のものなので、配信の組み立ては同時に来たリクエストとまとめる
+	sharedLivestreams := map[int64]Livestream{}
+	livestream, err := sharedReactionLivestream(ctx, int64(livestreamID))
+	if err != nil {
+		// 配信の組み立てでもトランザクションを使うので、コネクションを待ちきれなかった場合は同じく 503 を返す
+		if isDBBusyError(err) {
+			return beginTxError(c, err)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestream != nil {
+		sharedLivestreams[livestream.ID] = *livestream
+	}
+
+	ctx, tx, err := beginReadTxx(ctx, nil)
+	if err != nil {
+		return beginTxError(c, err)
+	}
+	defer tx.Rollback()
+
+	// 配信が存在しない場合と、リアクションがまだない場合を区別する
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM reactions WHERE livestream_id = ? AND " + visibleReactionsWhereFor("", userID)
+	if c.QueryParam("exclude_bots") != "" {
+		excludeBots, err := strconv.ParseBool(c.QueryParam("exclude_bots"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "exclude_bots query parameter must be boolean")
+		}
+		// 人間からのリアクションのみに絞り込む
+		if excludeBots {
+			query += " AND NOT is_bot"
+		}
+	}
+	args := []interface{}{livestreamID}
+	// 配信者が設定している場合、登録して間もないアカウントからのリアクションは表示しない
+	settings, err := getReactionSettings(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction settings: "+err.Error())
+	}
+	if settings.MinAccountAgeSeconds > 0 {
+		query += " AND user_id IN (SELECT id FROM users WHERE created_at <= ?)"
+		args = append(args, time.Now().Unix()-settings.MinAccountAgeSeconds)
+	}
+	if c.QueryParam("min_tipper") != "" {
+		minTipper, err := strconv.ParseInt(c.QueryParam("min_tipper"), 10, 64)
+		if err != nil || minTipper < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "min_tipper query parameter must be non-negative integer")
+		}
+		// この配信での投げ銭の合計が min_tipper を超えるユーザのリアクションのみに絞り込む
+		query += " AND user_id IN (SELECT user_id FROM livecomments WHERE livestream_id = ? GROUP BY user_id HAVING SUM(tip) > ?)"
+		args = append(args, livestreamID, minTipper)
+	}
+	// 特定の絵文字のリアクションのみに絞り込む
+	if emojiName := c.QueryParam("emoji_name"); emojiName != "" {
+		query += " AND emoji_name = ?"
+		args = append(args, emojiName)
+	}
+	if c.QueryParam("after_id") != "" {
+		query += " AND id > ?"
+		args = append(args, afterID)
+	}
+	if c.QueryParam("before_id") != "" {
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	if c.QueryParam("since") != "" {
+		query += " AND created_at >= ?"
+		args = append(args, since)
+	}
+	if c.QueryParam("until") != "" {
+		query += " AND created_at <= ?"
+		args = append(args, until)
+	}
+	// created_at が同じリアクションでも、ページングで重複や抜けが出ないよう id でも並べる
+	query += fmt.Sprintf(" ORDER BY created_at %[1]s, id %[1]s", order)
+	// limit を省略した場合は、これまで通りすべて返す
+	// 指定された場合は、巨大な値で全件を読み込ませないよう reactionsMaxLimit に切り詰める
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		if limit > reactionsMaxLimit {
+			limit = reactionsMaxLimit
+		}
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+
+	include := parseIncludeParam(c)
+	reactions, err := fillReactionResponsesWithOptions(ctx, tx, reactionModels, reactionFillOptions{
+		User: userFillOptions{
+			FollowerCount: include["follower_count"],
+		},
+		ReactorTips: include["reactor_tips"],
+		Livestreams: sharedLivestreams,
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 一覧のリアクションはすべて同じ配信のものなので、配信の詳細は expand=livestream の場合だけ返す
+	if parseExpandParam(c)["livestream"] {
+		return c.JSON(http.StatusOK, reactions)
+	}
+	compactReactions := make([]CompactReaction, len(reactions))
+	for i := range reactions {
+		compactReactions[i] = CompactReaction{
+			Reaction: reactions[i],
+			Livestream: LivestreamRef{
+				ID:    reactions[i].Livestream.ID,
+				Title: reactions[i].Livestream.Title,
+			},
+		}
+	}
+	return c.JSON(http.StatusOK, compactReactions)
 }
 
-type PostReactionRequest struct {
-	EmojiName string `json:"emoji_name"`
+func postReactionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	// dry_run=true の場合は、検証だけ行って投稿はしない
+	dryRun := false
+	if c.QueryParam("dry_run") != "" {
+		dryRun, err = strconv.ParseBool(c.QueryParam("dry_run"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "dry_run query parameter must be boolean")
+		}
+	}
+
+	// await_broadcast=true の場合は、購読者への配信が終わってからレスポンスを返す
+	awaitBroadcast := false
+	if c.QueryParam("await_broadcast") != "" {
+		awaitBroadcast, err = strconv.ParseBool(c.QueryParam("await_broadcast"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "await_broadcast query parameter must be boolean")
+		}
+	}
+
+	var req *PostReactionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	intensity, err := validatePostReactionRequest(req)
+	if err != nil {
+		if dryRun {
+			return reactionDryRunResult(c, false, err)
+		}
+		return err
+	}
+
+	idempotencyKey, err := reactionIdempotencyKey(c)
+	if err != nil {
+		return err
+	}
+
+	// DBが詰まっている間は、書き込む前に断る
+	if err := checkReactionThrottle(c, time.Now()); err != nil {
+		if dryRun {
+			return reactionDryRunResult(c, false, err)
+		}
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return beginTxError(c, err)
+	}
+	defer tx.Rollback()
+
+	// 同じ Idempotency-Key で投稿済みであれば、保存せずにそのときのリアクションを返す
+	// 再送は投稿数に数えないので、流量制限より先に、投稿と同じトランザクションでキーを確保する
+	if idempotencyKey != "" && !dryRun {
+		reaction, err := claimReactionIdempotencyKey(ctx, tx, userID, int64(livestreamID), idempotencyKey, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		if reaction != nil {
+			if err := tx.Commit(); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+			}
+			return c.JSON(http.StatusOK, reaction)
+		}
+	}
+	// 検証だけの場合は投稿数に数えず、次の1件が制限されるかどうかだけを調べる
+	limitNow := time.Now()
+	if dryRun {
+		if err := peekReactionRateLimit(c, userID, limitNow); err != nil {
+			return reactionDryRunResult(c, false, err)
+		}
+		if err := peekReactionStreamRate(c, userID, int64(livestreamID), limitNow); err != nil {
+			return reactionDryRunResult(c, false, err)
+		}
+	} else {
+		if err := checkReactionRateLimit(c, userID, limitNow); err != nil {
+			return err
+		}
+		if err := checkReactionStreamRate(c, userID, int64(livestreamID), limitNow); err != nil {
+			return err
+		}
+	}
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	livecommentID, err := verifyReactionTarget(ctx, tx, livestreamModel.ID, req.LivecommentID)
+	if err != nil {
+		if dryRun {
+			return reactionDryRunResult(c, false, err)
+		}
+		return err
+	}
+
+	now := time.Now().Unix()
+	pending, err := enforceReactionSettings(c, tx, livestreamModel, userID, req.EmojiName, now)
+	if dryRun {
+		return reactionDryRunResult(c, pending, err)
+	}
+	if err != nil {
+		return err
+	}
+	shadow, err := isReactionShadowBanned(ctx, tx, livestreamModel.ID, userID)
+	if err != nil {
+		return err
+	}
+
+	reactionModel := ReactionModel{
+		UserID:        int64(userID),
+		LivestreamID:  int64(livestreamID),
+		EmojiName:     req.EmojiName,
+		Intensity:     intensity,
+		Count:         1,
+		Pending:       pending,
+		CreatedAt:     now,
+		LivecommentID: livecommentID,
+		Shadow:        shadow,
+	}
+
+	coalesced, err := coalesceReaction(ctx, tx, &reactionModel)
+	if err != nil {
+		return err
+	}
+	if !coalesced {
+		if err := insertReaction(ctx, tx, &reactionModel); err != nil {
+			return err
+		}
+	}
+	if idempotencyKey != "" {
+		if err := recordReactionIdempotencyKey(ctx, tx, userID, idempotencyKey, reactionModel.ID); err != nil {
+			return err
+		}
+	}
+
+	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+	}
+
+	// 絵文字のバッジをすぐ更新できるよう、投稿後の件数を返す
+	if parseIncludeParam(c)["emoji_total"] {
+		var emojiTotal int64
+		query := "SELECT IFNULL(SUM(count), 0) FROM reactions WHERE livestream_id = ? AND emoji_name = ? AND " + visibleReactionsWhereFor("", userID)
+		if err := tx.GetContext(ctx, &emojiTotal, query, livestreamID, reactionModel.EmojiName); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+		}
+		reaction.EmojiTotal = &emojiTotal
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	reactionsPostedTotal.Inc()
+
+	// 承認待ちのリアクションは、承認されるまで配信しない
+	// シャドウバンされたリアクションは、他の視聴者に見せないので配信も集計もしない
+	// まとめられたリアクションは配信済みなので、集計だけ反映する
+	broadcastStatus := "skipped"
+	if coalesced {
+		reactionRates.record(reaction.Livestream.ID, time.Unix(now, 0))
+		livestreamHeat.recordReaction(reaction.Livestream.ID)
+	} else if !reaction.Pending && !reaction.shadow {
+		done, err := announceReaction(reaction)
+		if err != nil {
+			c.Logger().Warnf("failed to marshal reaction for broadcast: %+v", err)
+			broadcastStatus = "failed"
+		} else if awaitBroadcast {
+			select {
+			case <-done:
+				broadcastStatus = "published"
+			case <-time.After(reactionBroadcastTimeout):
+				// 配信が終わらなくても投稿自体は成功しているので、201を返す
+				broadcastStatus = "timeout"
+			}
+		}
+	}
+	if awaitBroadcast {
+		c.Response().Header().Set("X-Broadcast-Status", broadcastStatus)
+	}
+
+	return c.JSON(http.StatusCreated, reaction)
+}
+
+// insertReaction はリアクションを保存し、採番されたIDを reactionModel に設定する
+func insertReaction(ctx context.Context, tx *sqlx.Tx, reactionModel *ReactionModel) error {
+	insertStartedAt := time.Now()
+	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, intensity, pending, created_at, livecomment_id, shadow) VALUES (:user_id, :livestream_id, :emoji_name, :intensity, :pending, :created_at, :livecomment_id, :shadow)", reactionModel)
+	reactionInsertLatency.record(time.Now(), time.Since(insertStartedAt))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+	}
+
+	reactionID, err := result.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+	}
+	reactionModel.ID = reactionID
+	return nil
+}
+
+// coalesceReaction は、同じユーザが reactionCoalesceWindowSeconds 以内に投稿した同じリアクションがあれば、
+// 新しい行を作らずにその件数を増やす。まとめた場合は reactionModel をまとめた先の行で置き換えて true を返す
+func coalesceReaction(ctx context.Context, tx *sqlx.Tx, reactionModel *ReactionModel) (bool, error) {
+	if reactionCoalesceWindowSeconds <= 0 || reactionModel.Pending || reactionModel.Shadow {
+		return false, nil
+	}
+
+	// リアクション先のライブコメントが違うものはまとめない。NULL 同士も一致させるため <=> で比べる
+	where := "user_id = ? AND livestream_id = ? AND livecomment_id <=> ? AND emoji_name = ? AND intensity = ? AND created_at >= ? AND " + visibleReactionsWhere("") + " ORDER BY created_at DESC, id DESC LIMIT 1"
+	args := []interface{}{reactionModel.UserID, reactionModel.LivestreamID, reactionModel.LivecommentID, reactionModel.EmojiName, reactionModel.Intensity, reactionModel.CreatedAt - reactionCoalesceWindowSeconds}
+	// 件数の加算は UPDATE 一文で行うので、同時に投稿されても数え漏れない
+	rs, err := tx.ExecContext(ctx, "UPDATE reactions SET count = count + 1 WHERE "+where, args...)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to coalesce reaction: "+err.Error())
+	}
+	affected, err := rs.RowsAffected()
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	// 更新した行はこのトランザクションがロックしているので、同じ条件で引き直せる
+	if err := tx.GetContext(ctx, reactionModel, "SELECT * FROM reactions WHERE "+where, args...); err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get coalesced reaction: "+err.Error())
+	}
+	return true, nil
+}
+
+// announceReaction はコミット済みのリアクションを集計に反映し、購読者へ配信する
+// 配信が終わったら閉じるチャネルを返す
+func announceReaction(reaction Reaction) (<-chan struct{}, error) {
+	reactionRates.record(reaction.Livestream.ID, time.Unix(reaction.CreatedAt, 0))
+	livestreamHeat.recordReaction(reaction.Livestream.ID)
+
+	msg, err := json.Marshal(reaction)
+	if err != nil {
+		return nil, err
+	}
+	return reactionBroadcaster.publishAsync(reaction.Livestream.ID, reaction.ID, msg), nil
+}
+
+// リアクション取り消しAPI
+// DELETE /api/livestream/:livestream_id/reaction/:reaction_id
+// 自分が投稿したリアクションのみ取り消せる。行は残し、deleted_at を入れて以降の読み出しから除く
+func deleteReactionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	reactionID, err := strconv.Atoi(c.Param("reaction_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "reaction_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return beginTxError(c, err)
+	}
+	defer tx.Rollback()
+
+	// 別の配信のリアクションや、取り消し済みのリアクションは存在しないものとして扱う
+	var reactionModel ReactionModel
+	if err := tx.GetContext(ctx, &reactionModel, "SELECT * FROM reactions WHERE id = ? AND livestream_id = ? AND deleted_at = 0 FOR UPDATE", reactionID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "reaction not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction: "+err.Error())
+	}
+	if reactionModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't delete other user's reaction")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reactions SET deleted_at = ? WHERE id = ?", time.Now().Unix(), reactionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reaction: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// リアクション再取得API
+// POST /api/reactions/refresh
+// クライアントが保持しているリアクションを、最新のユーザ情報で詰め直して返す
+func refreshReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req *RefreshReactionsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len(req.ReactionIDs) > maxRefreshReactionIDs {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("too many reaction_ids: up to %d ids are allowed", maxRefreshReactionIDs))
+	}
+	if len(req.ReactionIDs) == 0 {
+		return c.JSON(http.StatusOK, []Reaction{})
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	query, params, err := sqlx.In("SELECT * FROM reactions WHERE id IN (?) AND "+visibleReactionsWhereFor("", userID)+" ORDER BY created_at DESC", req.ReactionIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct getting reactions query: "+err.Error())
+	}
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+
+	reactions, err := fillReactionResponses(ctx, tx, reactionModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, reactions)
+}
+
+// 承認待ちリアクションの一括承認API (配信者向け)
+// POST /api/livestream/:livestream_id/reactions/approve
+// 指定されたIDのうち、この配信の承認待ちリアクションだけを承認し、その件数を返す
+func approveReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req *ApproveReactionsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len(req.ReactionIDs) > maxApproveReactionIDs {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("too many reaction_ids: up to %d ids are allowed", maxApproveReactionIDs))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	var approvedIDs []int64
+	if len(req.ReactionIDs) > 0 {
+		// 他の配信のリアクションや承認済みのリアクションは条件で除外し、件数にも含めない
+		// 履歴に対象を残すため、承認するリアクションを確定させてから更新する
+		query, params, err := sqlx.In("SELECT id FROM reactions WHERE livestream_id = ? AND pending AND deleted_at = 0 AND id IN (?) FOR UPDATE", livestreamID, req.ReactionIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct getting reactions query: "+err.Error())
+		}
+		if err := tx.SelectContext(ctx, &approvedIDs, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get pending reactions: "+err.Error())
+		}
+	}
+	if len(approvedIDs) > 0 {
+		query, params, err := sqlx.In("UPDATE reactions SET pending = FALSE WHERE id IN (?)", approvedIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct approving reactions query: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to approve reactions: "+err.Error())
+		}
+		if err := recordModerationActions(ctx, tx, int64(livestreamID), userID, moderationActionApprove, approvedIDs); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &ApproveReactionsResponse{
+		Approved: int64(len(approvedIDs)),
+	})
 }
 
-func getReactionsHandler(c echo.Context) error {
+// 未使用の絵文字取得API
+// GET /api/livestream/:livestream_id/reactions/unused
+// 投稿できる絵文字のうち、ログイン中のユーザがこの配信でまだ使っていないものを返す
+// 配信の設定とサーバの許可リストのどちらも絵文字を限定していない場合は、候補がないので空になる
+func getUnusedEmojisHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	if err := verifyUserSession(c); err != nil {
@@ -46,24 +804,119 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	settings, err := getReactionSettings(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction settings: "+err.Error())
+	}
+
+	var usedEmojiNames []string
+	if err := tx.SelectContext(ctx, &usedEmojiNames, "SELECT DISTINCT emoji_name FROM reactions WHERE livestream_id = ? AND user_id = ? AND deleted_at = 0", livestreamID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get used emojis: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 配信ごとの設定があればそれを、なければサーバの許可リストを候補にする
+	var candidates []string
+	if len(settings.AllowedEmojis) > 0 {
+		for _, emojiName := range settings.AllowedEmojis {
+			if isAllowedEmoji(emojiName) {
+				candidates = append(candidates, emojiName)
+			}
+		}
+	} else {
+		for emojiName := range emojiAllowlist {
+			candidates = append(candidates, emojiName)
+		}
+	}
+	sort.Strings(candidates)
+
+	used := make(map[string]struct{}, len(usedEmojiNames))
+	for _, emojiName := range usedEmojiNames {
+		used[normalizeEmojiName(emojiName)] = struct{}{}
+	}
+	unused := []UnusedEmoji{}
+	for _, emojiName := range candidates {
+		if _, ok := used[normalizeEmojiName(emojiName)]; ok {
+			continue
+		}
+		unused = append(unused, UnusedEmoji{EmojiName: emojiName})
+	}
+
+	return c.JSON(http.StatusOK, unused)
+}
+
+// 視聴者ごとのリアクション一覧取得API (配信者向け)
+// GET /api/livestream/:livestream_id/viewer/:user_id/reactions
+func getViewerReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	viewerID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM reactions WHERE livestream_id = ? AND user_id = ? AND " + visibleReactionsWhere("") + " ORDER BY created_at ASC, id ASC"
 	if c.QueryParam("limit") != "" {
 		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		if err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
 		}
 		query += fmt.Sprintf(" LIMIT %d", limit)
+		if c.QueryParam("offset") != "" {
+			offset, err := strconv.Atoi(c.QueryParam("offset"))
+			if err != nil || offset < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
+			}
+			query += fmt.Sprintf(" OFFSET %d", offset)
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 他人の行動履歴なので、配信者本人にしか見せない
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
 	}
 
 	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
+	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID, viewerID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
 	}
 
 	reactions, err := fillReactionResponses(ctx, tx, reactionModels)
@@ -78,26 +931,41 @@ func getReactionsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, reactions)
 }
 
-func postReactionHandler(c echo.Context) error {
+// ライブコメントへのリアクション取得API
+// GET /api/livestream/:livestream_id/livecomment/:livecomment_id/reactions
+func getLivecommentReactionsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
-	var req *PostReactionRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	query := "SELECT * FROM reactions WHERE livestream_id = ? AND livecomment_id = ? AND " + visibleReactionsWhereFor("", userID) + " ORDER BY created_at DESC, id DESC"
+	// 配信へのリアクション一覧と同じく、巨大な値は reactionsMaxLimit に切り詰める
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		if limit > reactionsMaxLimit {
+			limit = reactionsMaxLimit
+		}
+		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -106,86 +974,186 @@ func postReactionHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	reactionModel := ReactionModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		EmojiName:    req.EmojiName,
-		CreatedAt:    time.Now().Unix(),
-	}
-
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+	target := int64(livecommentID)
+	if _, err := verifyReactionTarget(ctx, tx, int64(livestreamID), &target); err != nil {
+		return err
 	}
 
-	reactionID, err := result.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID, livecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
 	}
-	reactionModel.ID = reactionID
 
-	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
+	reactions, err := fillReactionResponses(ctx, tx, reactionModels)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reactions: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, reaction)
+	return c.JSON(http.StatusOK, reactions)
 }
 
-func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
-	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", reactionModel.UserID); err != nil {
-		return Reaction{}, err
+// verifyReactionTarget はリアクション先のライブコメントが同じ配信のものか確かめる
+// livecommentID が nil の場合は、配信そのものへのリアクションとして NULL を返す
+func verifyReactionTarget(ctx context.Context, tx *sqlx.Tx, livestreamID int64, livecommentID *int64) (sql.NullInt64, error) {
+	if livecommentID == nil {
+		return sql.NullInt64{}, nil
 	}
-	user, err := fillUserResponse(ctx, tx, userModel)
-	if err != nil {
-		return Reaction{}, err
+
+	var targetLivestreamID int64
+	if err := tx.GetContext(ctx, &targetLivestreamID, "SELECT livestream_id FROM livecomments WHERE id = ?", *livecommentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return sql.NullInt64{}, echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		}
+		return sql.NullInt64{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+	}
+	if targetLivestreamID != livestreamID {
+		return sql.NullInt64{}, echo.NewHTTPError(http.StatusBadRequest, "the livecomment does not belong to the livestream")
 	}
+	return sql.NullInt64{Int64: *livecommentID, Valid: true}, nil
+}
 
-	livestreamModel := LivestreamModel{}
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", reactionModel.LivestreamID); err != nil {
-		return Reaction{}, err
+// validatePostReactionRequest はリクエスト内容を検証し、保存するリアクションの強さを返す
+func validatePostReactionRequest(req *PostReactionRequest) (int64, error) {
+	if req.EmojiName == "" {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "emoji_name is required")
 	}
-	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
-	if err != nil {
-		return Reaction{}, err
+	if !emojiShortcodeRegexp.MatchString(req.EmojiName) {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "emoji_name must be a shortcode like :tada:")
+	}
+	if !isAllowedEmoji(req.EmojiName) {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "the emoji is not in the allowlist")
+	}
+
+	intensity := int64(defaultReactionIntensity)
+	if req.Intensity != nil {
+		intensity = *req.Intensity
+	}
+	if intensity < minReactionIntensity || intensity > maxReactionIntensity {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("intensity must be between %d and %d", minReactionIntensity, maxReactionIntensity))
+	}
+
+	return intensity, nil
+}
+
+// reactionDryRunResult は検証結果を、投稿できるかどうかのレスポンスに変換する
+// 投稿を拒否する理由になるクライアントエラーと、混雑による 503 は200で返し、それ以外のサーバエラーはそのまま返す
+// Retry-After などの検証で付けたヘッダは、そのままレスポンスに残る
+func reactionDryRunResult(c echo.Context, pending bool, err error) error {
+	if err == nil {
+		return c.JSON(http.StatusOK, &ReactionDryRunResponse{
+			WouldSucceed: true,
+			Pending:      pending,
+		})
 	}
 
-	reaction := Reaction{
-		ID:         reactionModel.ID,
-		EmojiName:  reactionModel.EmojiName,
-		User:       user,
-		Livestream: livestream,
-		CreatedAt:  reactionModel.CreatedAt,
+	var he *echo.HTTPError
+	if !errors.As(err, &he) || (he.Code >= http.StatusInternalServerError && he.Code != http.StatusServiceUnavailable) {
+		return err
 	}
+	return c.JSON(http.StatusOK, &ReactionDryRunResponse{
+		WouldSucceed: false,
+		Status:       he.Code,
+		Reason:       fmt.Sprint(he.Message),
+	})
+}
 
+func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
+	// 投稿のたびに呼ばれるので、一覧と同じ一括取得の経路を1件で使い、ユーザと配信の取得をまとめる
+	reactions, err := fillReactionResponses(ctx, tx, []ReactionModel{reactionModel})
+	if err != nil {
+		return Reaction{}, err
+	}
+	reaction := reactions[0]
+	// 一括取得では見つからない行は空のまま埋まるので、1件の場合はこれまで通りエラーにする
+	if reaction.User.ID != reactionModel.UserID || reaction.Livestream.ID != reactionModel.LivestreamID {
+		return Reaction{}, sql.ErrNoRows
+	}
 	return reaction, nil
 }
 
-func fillReactionResponses(ctx context.Context, tx *sqlx.Tx, reactionModels []ReactionModel) ([]Reaction, error) {
-	if len(reactionModels) == 0 {
-		return []Reaction{}, nil
+// reactionFillOptions は、リアクション一覧に追加で含める情報を指定する
+type reactionFillOptions struct {
+	User        userFillOptions
+	ReactorTips bool
+	// Livestreams に含まれる配信は組み立て直さず、そのまま使う
+	Livestreams map[int64]Livestream
+}
+
+// リアクションの一覧は1つの配信のものがほとんどで、人気の配信では同じ配信の情報を同時に何度も組み立てることになる
+// 読み取りだけの一覧では、トランザクションを始める前に sharedReactionLivestream で配信を組み立て、同時に来たリクエストで1回にまとめる
+var reactionLivestreamFlight singleflight.Group
+
+// fetchReactionLivestream は配信を1つ組み立てる。見つからなければ nil を返す
+// 呼び出し側のトランザクションとは別に、読み取り用の接続で読む
+var fetchReactionLivestream = func(ctx context.Context, livestreamID int64) (*Livestream, error) {
+	ctx, tx, err := beginReadTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	userIDs := make([]int64, len(reactionModels))
-	for _, reaction := range reactionModels {
-		userIDs = append(userIDs, reaction.UserID)
+	livestreamModels := []*LivestreamModel{}
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return nil, err
 	}
-	userResps, err := fillUserResponses(ctx, tx, userIDs)
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
 	if err != nil {
 		return nil, err
 	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(livestreams) == 0 {
+		return nil, nil
+	}
+	return &livestreams[0], nil
+}
+
+// sharedReactionLivestream は、同時に呼ばれた同じ配信の組み立てを1回にまとめる
+// 接続を持ったまま他のリクエストを待つと接続プールが埋まって止まるので、トランザクションを始める前に呼ぶこと
+// 組み立ては最初の呼び出し元が切断しても続け、待っている側は自分の ctx が終わった時点で諦める
+func sharedReactionLivestream(ctx context.Context, livestreamID int64) (*Livestream, error) {
+	ch := reactionLivestreamFlight.DoChan(strconv.FormatInt(livestreamID, 10), func() (interface{}, error) {
+		return fetchReactionLivestream(context.WithoutCancel(ctx), livestreamID)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*Livestream), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-	livestreamIDs := make([]int64, len(reactionModels))
-	for _, reaction := range reactionModels {
-		livestreamIDs = append(livestreamIDs, reaction.LivestreamID)
+// resolveReactionLivestreams はリアクションの配信を組み立て、配信IDをキーにした map で返す
+// known に含まれる配信はそのまま使い、残りをまとめて引く
+func resolveReactionLivestreams(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64, known map[int64]Livestream) (map[int64]Livestream, error) {
+	livestreamMap := make(map[int64]Livestream, len(known))
+	// ユーザごとの一覧などでは同じ配信が何度も出てくるので、重複を除いてから引く
+	seen := make(map[int64]struct{}, len(livestreamIDs))
+	distinctIDs := make([]int64, 0, len(livestreamIDs))
+	for _, id := range livestreamIDs {
+		if livestream, ok := known[id]; ok {
+			livestreamMap[id] = livestream
+			continue
+		}
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			distinctIDs = append(distinctIDs, id)
+		}
 	}
+	if len(distinctIDs) == 0 {
+		return livestreamMap, nil
+	}
+
 	var livestreamModels []*LivestreamModel
-	query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", distinctIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -196,10 +1164,59 @@ func fillReactionResponses(ctx context.Context, tx *sqlx.Tx, reactionModels []Re
 	if err != nil {
 		return nil, err
 	}
-	livestreamMap := make(map[int64]Livestream, len(livestreamResps))
 	for _, resp := range livestreamResps {
 		livestreamMap[resp.ID] = resp
 	}
+	return livestreamMap, nil
+}
+
+func fillReactionResponses(ctx context.Context, tx *sqlx.Tx, reactionModels []ReactionModel) ([]Reaction, error) {
+	return fillReactionResponsesWithOptions(ctx, tx, reactionModels, reactionFillOptions{})
+}
+
+func fillReactionResponsesWithOptions(ctx context.Context, tx *sqlx.Tx, reactionModels []ReactionModel, opts reactionFillOptions) ([]Reaction, error) {
+	if len(reactionModels) == 0 {
+		return []Reaction{}, nil
+	}
+
+	userIDs := make([]int64, 0, len(reactionModels))
+	for _, reaction := range reactionModels {
+		userIDs = append(userIDs, reaction.UserID)
+	}
+	userResps, err := fillUserResponsesWithOptions(ctx, tx, userIDs, opts.User)
+	if err != nil {
+		return nil, err
+	}
+
+	livestreamIDs := make([]int64, 0, len(reactionModels))
+	for _, reaction := range reactionModels {
+		livestreamIDs = append(livestreamIDs, reaction.LivestreamID)
+	}
+	livestreamMap, err := resolveReactionLivestreams(ctx, tx, livestreamIDs, opts.Livestreams)
+	if err != nil {
+		return nil, err
+	}
+
+	// リアクションしたユーザが、その配信で投げ銭した合計
+	var tipTotalMap map[[2]int64]int64
+	if opts.ReactorTips {
+		var tipTotals []struct {
+			UserID       int64 `db:"user_id"`
+			LivestreamID int64 `db:"livestream_id"`
+			Total        int64 `db:"total"`
+		}
+		query, params, err := sqlx.In("SELECT user_id, livestream_id, IFNULL(SUM(tip), 0) AS total FROM livecomments WHERE user_id IN (?) AND livestream_id IN (?) GROUP BY user_id, livestream_id", userIDs, livestreamIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SelectContext(ctx, &tipTotals, query, params...); err != nil {
+			return nil, err
+		}
+		tipTotalMap = make(map[[2]int64]int64, len(tipTotals))
+		for _, tipTotal := range tipTotals {
+			tipTotalMap[[2]int64{tipTotal.UserID, tipTotal.LivestreamID}] = tipTotal.Total
+		}
+	}
 
 	reactions := make([]Reaction, len(reactionModels))
 	for i := range reactionModels {
@@ -211,7 +1228,18 @@ func fillReactionResponses(ctx context.Context, tx *sqlx.Tx, reactionModels []Re
 			EmojiName:  reactionModels[i].EmojiName,
 			User:       user,
 			Livestream: livestream,
+			Intensity:  reactionModels[i].Intensity,
+			Count:      reactionModels[i].Count,
+			Pending:    reactionModels[i].Pending,
 			CreatedAt:  reactionModels[i].CreatedAt,
+			shadow:     reactionModels[i].Shadow,
+		}
+		if reactionModels[i].LivecommentID.Valid {
+			reaction.LivecommentID = &reactionModels[i].LivecommentID.Int64
+		}
+		if opts.ReactorTips {
+			tipTotal := tipTotalMap[[2]int64{reactionModels[i].UserID, reactionModels[i].LivestreamID}]
+			reaction.ReactorTipTotal = &tipTotal
 		}
 
 		reactions[i] = reaction
@@ -220,67 +1248,146 @@ func fillReactionResponses(ctx context.Context, tx *sqlx.Tx, reactionModels []Re
 	return reactions, nil
 }
 
+// userFillOptions は、ユーザ情報に追加で含める情報を指定する
+// いずれも追加のクエリが必要になるので、必要な場合のみ指定する
+type userFillOptions struct {
+	FollowerCount         bool
+	ReceivedReactionCount bool
+}
+
 func fillUserResponses(ctx context.Context, tx *sqlx.Tx, userIDs []int64) (map[int64]User, error) {
-	userModels := []UserModel{}
-	query, params, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
-	if err != nil {
-		return nil, err
-	}
-	if err := tx.SelectContext(ctx, &userModels, query, params...); err != nil {
-		return nil, err
-	}
-	userMap := make(map[int64]UserModel, len(userModels))
-	for _, ownerModel := range userModels {
-		userMap[ownerModel.ID] = ownerModel
-	}
+	return fillUserResponsesWithOptions(ctx, tx, userIDs, userFillOptions{})
+}
 
-	themeModels := []ThemeModel{}
-	query, params, err = sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", userIDs)
-	if err != nil {
-		return nil, err
-	}
-	if err := tx.SelectContext(ctx, &themeModels, query, params...); err != nil {
-		return nil, err
+func fillUserResponsesWithOptions(ctx context.Context, tx *sqlx.Tx, userIDs []int64, opts userFillOptions) (map[int64]User, error) {
+	// ユーザ名、テーマ、アイコンはキャッシュを使い、キャッシュにないユーザだけDBから読む
+	// 読んだ値をキャッシュに入れるのは、リクエストの開始時に世代を取っていて、プライマリで読んだ場合だけ
+	snapshot, cacheable := cacheSnapshotFromContext(ctx)
+	cacheable = cacheable && !isReplicaRead(ctx)
+	baseUsers := make(map[int64]User, len(userIDs))
+	missIDs := make([]int64, 0, len(userIDs))
+	for _, id := range userIDs {
+		if user, ok := userCache.get(id); ok {
+			baseUsers[id] = user
+			continue
+		}
+		missIDs = append(missIDs, id)
 	}
+	if len(missIDs) > 0 {
+		userModels := []UserModel{}
+		query, params, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", missIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SelectContext(ctx, &userModels, query, params...); err != nil {
+			return nil, err
+		}
+		userMap := make(map[int64]UserModel, len(userModels))
+		for _, ownerModel := range userModels {
+			userMap[ownerModel.ID] = ownerModel
+		}
 
-	themeMap := make(map[int64]ThemeModel, len(themeModels))
-	for _, themeModel := range themeModels {
-		themeMap[themeModel.UserID] = themeModel
-	}
+		themeModels := []ThemeModel{}
+		query, params, err = sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", missIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SelectContext(ctx, &themeModels, query, params...); err != nil {
+			return nil, err
+		}
 
-	var iconHashes []struct {
-		UserID int64  `db:"user_id"`
-		Hash   string `db:"hash"`
-	}
-	query, params, err = sqlx.In("SELECT i.user_id, ih.hash FROM icon_hashes AS ih JOIN icons AS i ON i.id = ih.icon_id WHERE i.user_id IN (?)", userIDs)
-	if err != nil {
-		return nil, err
+		themeMap := make(map[int64]ThemeModel, len(themeModels))
+		for _, themeModel := range themeModels {
+			themeMap[themeModel.UserID] = themeModel
+		}
+
+		iconHashFailed := false
+		hashMap, err := iconStore.Hashes(ctx, tx, missIDs)
+		if err != nil {
+			if !iconHashFallbackOnError {
+				return nil, err
+			}
+			// アイコンが取れなくても一覧は表示できるよう、全員デフォルトのアイコンとして扱う
+			log.Printf("failed to get icon hashes, falling back to the default icon for %d users: %+v", len(missIDs), err)
+			hashMap = map[int64]string{}
+			iconHashFailed = true
+		}
+
+		for _, id := range missIDs {
+			iconHash, ok := hashMap[id]
+			if !ok {
+				iconHash = fallbackImageHash
+			}
+			user := User{
+				ID:          userMap[id].ID,
+				Name:        userMap[id].Name,
+				DisplayName: userMap[id].DisplayName,
+				Description: userMap[id].Description,
+				Theme: Theme{
+					ID:       themeMap[id].ID,
+					DarkMode: themeMap[id].DarkMode,
+				},
+				IconHash: iconHash,
+			}
+			baseUsers[id] = user
+			// 見つからなかったユーザや、アイコンの取得に失敗して代わりの値を入れたユーザはキャッシュしない
+			if _, found := userMap[id]; found && !iconHashFailed && cacheable {
+				userCache.put(user, snapshot.userGeneration)
+			}
+		}
 	}
-	if err := tx.SelectContext(ctx, &iconHashes, query, params...); err != nil {
-		return nil, err
+
+	var followerCountMap map[int64]int64
+	if opts.FollowerCount {
+		var followerCounts []struct {
+			UserID int64 `db:"followee_id"`
+			Count  int64 `db:"cnt"`
+		}
+		query, params, err := sqlx.In("SELECT followee_id, COUNT(*) AS cnt FROM follows WHERE followee_id IN (?) GROUP BY followee_id", userIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SelectContext(ctx, &followerCounts, query, params...); err != nil {
+			return nil, err
+		}
+		followerCountMap = make(map[int64]int64, len(followerCounts))
+		for _, followerCount := range followerCounts {
+			followerCountMap[followerCount.UserID] = followerCount.Count
+		}
 	}
-	hashMap := make(map[int64]string, len(iconHashes))
-	for _, iconHash := range iconHashes {
-		hashMap[iconHash.UserID] = iconHash.Hash
+
+	// ユーザの配信が受け取ったリアクションの合計
+	var receivedReactionCountMap map[int64]int64
+	if opts.ReceivedReactionCount {
+		var receivedReactionCounts []struct {
+			UserID int64 `db:"user_id"`
+			Count  int64 `db:"cnt"`
+		}
+		query, params, err := sqlx.In("SELECT l.user_id, SUM(r.count) AS cnt FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id AND "+visibleReactionsWhere("r")+" WHERE l.user_id IN (?) GROUP BY l.user_id", userIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SelectContext(ctx, &receivedReactionCounts, query, params...); err != nil {
+			return nil, err
+		}
+		receivedReactionCountMap = make(map[int64]int64, len(receivedReactionCounts))
+		for _, receivedReactionCount := range receivedReactionCounts {
+			receivedReactionCountMap[receivedReactionCount.UserID] = receivedReactionCount.Count
+		}
 	}
 
 	userResponseMap := make(map[int64]User, len(userIDs))
 	for _, id := range userIDs {
-		iconHash, ok := hashMap[id]
-		if !ok {
-			iconHash = fallbackImageHash
-		}
-		userResponseMap[id] = User{
-			ID:          userMap[id].ID,
-			Name:        userMap[id].Name,
-			DisplayName: userMap[id].DisplayName,
-			Description: userMap[id].Description,
-			Theme: Theme{
-				ID:       themeMap[id].ID,
-				DarkMode: themeMap[id].DarkMode,
-			},
-			IconHash: iconHash,
+		user := baseUsers[id]
+		if opts.FollowerCount {
+			count := followerCountMap[id]
+			user.FollowerCount = &count
+		}
+		if opts.ReceivedReactionCount {
+			count := receivedReactionCountMap[id]
+			user.ReceivedReactionCount = &count
 		}
+		userResponseMap[id] = user
 	}
 
 	return userResponseMap, nil
@@ -0,0 +1,1059 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// getTestReactions はリアクション一覧APIを呼び、返ったリアクションを返す
+func getTestReactions(t *testing.T, user testUser, livestreamID int64, query string) []CompactReaction {
+	t.Helper()
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?%s", livestreamID, query), user.Cookie, nil)
+	var reactions []CompactReaction
+	decodeTestResponse(t, rec, http.StatusOK, &reactions)
+	return reactions
+}
+
+func reactionIDs(reactions []CompactReaction) []int64 {
+	ids := make([]int64, len(reactions))
+	for i := range reactions {
+		ids[i] = reactions[i].ID
+	}
+	return ids
+}
+
+func TestGetReactionsExcludeBots(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	now := time.Now().Unix()
+	humanID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now})
+	botID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "robot", CreatedAt: now + 1, IsBot: true})
+
+	if got := reactionIDs(getTestReactions(t, viewer, livestreamID, "")); fmt.Sprint(got) != fmt.Sprint([]int64{botID, humanID}) {
+		t.Fatalf("without filter: got %v, want both reactions", got)
+	}
+	if got := reactionIDs(getTestReactions(t, viewer, livestreamID, "exclude_bots=true")); fmt.Sprint(got) != fmt.Sprint([]int64{humanID}) {
+		t.Fatalf("exclude_bots=true: got %v, want only the human reaction %d", got, humanID)
+	}
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?exclude_bots=maybe", livestreamID), viewer.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestSharedReactionLivestreamCoalescesConcurrentCalls(t *testing.T) {
+	var fetches atomic.Int64
+	release := make(chan struct{})
+	orig := fetchReactionLivestream
+	fetchReactionLivestream = func(ctx context.Context, livestreamID int64) (*Livestream, error) {
+		fetches.Add(1)
+		<-release
+		return &Livestream{ID: livestreamID, Title: "shared"}, nil
+	}
+	t.Cleanup(func() { fetchReactionLivestream = orig })
+
+	const callers = 100
+	var wg sync.WaitGroup
+	results := make([]*Livestream, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = sharedReactionLivestream(context.Background(), 42)
+		}(i)
+	}
+	// 全員が組み立ての完了を待つようになってから、組み立てを終わらせる
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("fetched %d times, want 1", got)
+	}
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil {
+			t.Fatalf("caller %d: %v", i, errs[i])
+		}
+		if results[i] == nil || results[i].ID != 42 {
+			t.Fatalf("caller %d: got %+v, want livestream 42", i, results[i])
+		}
+	}
+}
+
+func TestSharedReactionLivestreamSurvivesLeaderCancel(t *testing.T) {
+	release := make(chan struct{})
+	orig := fetchReactionLivestream
+	fetchReactionLivestream = func(ctx context.Context, livestreamID int64) (*Livestream, error) {
+		<-release
+		// 最初の呼び出し元が切断しても、組み立ては止めない
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return &Livestream{ID: livestreamID}, nil
+	}
+	t.Cleanup(func() { fetchReactionLivestream = orig })
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := sharedReactionLivestream(leaderCtx, 7)
+		leaderErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	waiterResult := make(chan *Livestream, 1)
+	go func() {
+		livestream, err := sharedReactionLivestream(context.Background(), 7)
+		if err != nil {
+			t.Errorf("waiter: %v", err)
+		}
+		waiterResult <- livestream
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	if err := <-leaderErr; err == nil {
+		t.Fatalf("leader: got nil error after cancel")
+	}
+	close(release)
+	if livestream := <-waiterResult; livestream == nil || livestream.ID != 7 {
+		t.Fatalf("waiter: got %+v, want livestream 7", livestream)
+	}
+}
+
+// failingHashIconStore はアイコンのハッシュ値の一括取得だけが失敗する
+type failingHashIconStore struct {
+	IconStore
+}
+
+func (s failingHashIconStore) Hashes(ctx context.Context, q sqlx.QueryerContext, userIDs []int64) (map[int64]string, error) {
+	return nil, errors.New("injected icon hash failure")
+}
+
+func TestGetReactionsIconHashFallback(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: time.Now().Unix()})
+
+	origStore, origFallback, origHash := iconStore, iconHashFallbackOnError, fallbackImageHash
+	iconStore = failingHashIconStore{origStore}
+	// テストでは初期化APIを呼ばないので、既定のアイコンのハッシュ値を決めておく
+	fallbackImageHash = hashIcon([]byte("fallback image"))
+	t.Cleanup(func() { iconStore, iconHashFallbackOnError, fallbackImageHash = origStore, origFallback, origHash })
+	path := fmt.Sprintf("/api/livestream/%d/reaction", livestreamID)
+
+	iconHashFallbackOnError = false
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path, viewer.Cookie, nil), http.StatusInternalServerError, nil)
+
+	iconHashFallbackOnError = true
+	var reactions []CompactReaction
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path, viewer.Cookie, nil), http.StatusOK, &reactions)
+	if len(reactions) != 1 || reactions[0].User.IconHash != fallbackImageHash {
+		t.Fatalf("got %+v, want one reaction with the fallback icon hash", reactions)
+	}
+	// 代わりの値はキャッシュしないので、失敗が直れば本来の値を返す
+	if _, ok := userCache.get(viewer.ID); ok {
+		t.Fatalf("the fallback icon hash was cached")
+	}
+}
+
+func TestPostReactionDryRun(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+
+	origLimit, origWindow := reactionRateLimit, reactionRateLimitWindow
+	reactionRateLimit = 1
+	// 窓の切り替わりをまたがないよう、窓を長くしておく
+	reactionRateLimitWindow = time.Hour
+	t.Cleanup(func() { reactionRateLimit, reactionRateLimitWindow = origLimit, origWindow })
+
+	req := &PostReactionRequest{EmojiName: ":tada:"}
+	dryRunPath := fmt.Sprintf("/api/livestream/%d/reaction?dry_run=true", livestreamID)
+
+	// 投稿できる場合は would_succeed を返し、保存も投稿数の計上もしない
+	for i := 0; i < 2; i++ {
+		var res ReactionDryRunResponse
+		decodeTestResponse(t, doTestRequest(t, http.MethodPost, dryRunPath, viewer.Cookie, req), http.StatusOK, &res)
+		if !res.WouldSucceed {
+			t.Fatalf("dry run %d: got %+v, want would_succeed", i, res)
+		}
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 0 {
+		t.Fatalf("dry run inserted %d reactions", got)
+	}
+
+	// 上限まで投稿した後は、429 になることと Retry-After を返す
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, req), http.StatusCreated, nil)
+	rec := doTestRequest(t, http.MethodPost, dryRunPath, viewer.Cookie, req)
+	var res ReactionDryRunResponse
+	decodeTestResponse(t, rec, http.StatusOK, &res)
+	if res.WouldSucceed || res.Status != http.StatusTooManyRequests {
+		t.Fatalf("after limit: got %+v, want would be rate limited", res)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("Retry-After not set")
+	}
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, req), http.StatusTooManyRequests, nil)
+
+	// 検証で弾かれる内容も、書き込まずに理由を返す
+	rec = doTestRequest(t, http.MethodPost, dryRunPath, owner.Cookie, &PostReactionRequest{EmojiName: "not an emoji"})
+	res = ReactionDryRunResponse{}
+	decodeTestResponse(t, rec, http.StatusOK, &res)
+	if res.WouldSucceed || res.Status != http.StatusBadRequest {
+		t.Fatalf("invalid emoji: got %+v, want 400", res)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 1 {
+		t.Fatalf("got %d reactions, want 1", got)
+	}
+}
+
+func TestGetReactionsFollowerCount(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	popular := newTestUser(t, "popular")
+	lonely := newTestUser(t, "lonely")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	now := time.Now().Unix()
+	newTestReaction(t, ReactionModel{UserID: popular.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now})
+	newTestReaction(t, ReactionModel{UserID: lonely.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now + 1})
+	for _, followerID := range []int64{owner.ID, lonely.ID} {
+		if _, err := dbConn.Exec("INSERT INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)", followerID, popular.ID, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 指定しなければ含めない
+	for _, reaction := range getTestReactions(t, owner, livestreamID, "") {
+		if reaction.User.FollowerCount != nil {
+			t.Fatalf("follower_count included without include: %+v", reaction.User)
+		}
+	}
+
+	want := map[int64]int64{popular.ID: 2, lonely.ID: 0}
+	reactions := getTestReactions(t, owner, livestreamID, "include=follower_count")
+	if len(reactions) != 2 {
+		t.Fatalf("got %d reactions, want 2", len(reactions))
+	}
+	for _, reaction := range reactions {
+		if reaction.User.FollowerCount == nil || *reaction.User.FollowerCount != want[reaction.User.ID] {
+			t.Fatalf("user %d: got follower_count %v, want %d", reaction.User.ID, reaction.User.FollowerCount, want[reaction.User.ID])
+		}
+	}
+}
+
+func TestReactionAggregationsExcludeInvisibleReactions(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	const startAt, endAt = 1700000000, 1700000120
+	livestreamID := newTestLivestream(t, owner.ID, "stream", startAt, endAt)
+
+	visibleID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: startAt + 1, Count: 2})
+	for _, invisible := range []ReactionModel{
+		{DeletedAt: startAt + 10},
+		{Hidden: true},
+		{Pending: true},
+		{Shadow: true},
+	} {
+		invisible.UserID = viewer.ID
+		invisible.LivestreamID = livestreamID
+		invisible.EmojiName = "tada"
+		invisible.CreatedAt = startAt + 2
+		invisible.Count = 10
+		newTestReaction(t, invisible)
+	}
+	path := fmt.Sprintf("/api/livestream/%d", livestreamID)
+
+	// どの一覧・集計も、表示できる1行 (count 2) だけを数える
+	if got := reactionIDs(getTestReactions(t, owner, livestreamID, "")); fmt.Sprint(got) != fmt.Sprint([]int64{visibleID}) {
+		t.Errorf("reactions: got %v, want only %d", got, visibleID)
+	}
+
+	var summary []ReactionSummaryEntry
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path+"/reactions/summary", owner.Cookie, nil), http.StatusOK, &summary)
+	if len(summary) != 1 || summary[0].Count != 2 {
+		t.Errorf("summary: got %+v, want tada 2", summary)
+	}
+
+	var timeline []ReactionTimelineBucket
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path+"/reactions/timeline", owner.Cookie, nil), http.StatusOK, &timeline)
+	var timelineTotal int64
+	for _, bucket := range timeline {
+		timelineTotal += bucket.Count
+	}
+	if timelineTotal != 2 {
+		t.Errorf("timeline: got %+v, want 2 in total", timeline)
+	}
+
+	var livestream Livestream
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path, owner.Cookie, nil), http.StatusOK, &livestream)
+	if livestream.ReactionCount != 2 {
+		t.Errorf("livestream: got reaction_count %d, want 2", livestream.ReactionCount)
+	}
+
+	var livestreamStats LivestreamStatistics
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path+"/statistics", owner.Cookie, nil), http.StatusOK, &livestreamStats)
+	if livestreamStats.TotalReactions != 2 {
+		t.Errorf("livestream statistics: got total_reactions %d, want 2", livestreamStats.TotalReactions)
+	}
+
+	var userStats UserStatistics
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/owner/statistics", owner.Cookie, nil), http.StatusOK, &userStats)
+	if userStats.TotalReactions != 2 {
+		t.Errorf("user statistics: got total_reactions %d, want 2", userStats.TotalReactions)
+	}
+}
+
+func TestGetMyReactionStatisticsShadowBanned(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	troll := newTestUser(t, "troll")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		newTestReaction(t, ReactionModel{UserID: troll.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now, Shadow: true})
+	}
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+
+	getStats := func(user testUser) MyReactionStatistics {
+		t.Helper()
+		var stats MyReactionStatistics
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/me/reaction-stats", livestreamID), user.Cookie, nil), http.StatusOK, &stats)
+		return stats
+	}
+
+	// シャドウバンされたユーザには、自分の件数を含めた分布と比べて見せる
+	want := MyReactionStatistics{ReactionCount: 3, AverageReactions: 2, MedianReactions: 2, Percentile: 50}
+	if got := getStats(troll); got != want {
+		t.Errorf("troll: got %+v, want %+v", got, want)
+	}
+	// 他のユーザの分布には含めない
+	want = MyReactionStatistics{ReactionCount: 1, AverageReactions: 1, MedianReactions: 1, Percentile: 0}
+	if got := getStats(viewer); got != want {
+		t.Errorf("viewer: got %+v, want %+v", got, want)
+	}
+}
+
+func TestApproveReactions(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, viewer.ID, "other", 0, 1)
+	now := time.Now().Unix()
+	pendingID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now, Pending: true})
+	approvedID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now})
+	otherStreamID := newTestReaction(t, ReactionModel{UserID: owner.ID, LivestreamID: otherLivestreamID, EmojiName: "tada", CreatedAt: now, Pending: true})
+	path := fmt.Sprintf("/api/livestream/%d/reactions/approve", livestreamID)
+	req := &ApproveReactionsRequest{ReactionIDs: []int64{pendingID, approvedID, otherStreamID, 999999}}
+
+	// 配信者以外は承認できない
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, path, viewer.Cookie, req), http.StatusForbidden, nil)
+
+	// 承認待ちでこの配信のリアクションだけを承認し、その件数を返す
+	var res ApproveReactionsResponse
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, path, owner.Cookie, req), http.StatusOK, &res)
+	if res.Approved != 1 {
+		t.Fatalf("got approved %d, want 1", res.Approved)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions WHERE id = ? AND NOT pending", pendingID); got != 1 {
+		t.Fatalf("reaction %d is still pending", pendingID)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions WHERE id = ? AND pending", otherStreamID); got != 1 {
+		t.Fatalf("reaction %d on another livestream was approved", otherStreamID)
+	}
+
+	// 同じ一覧をもう一度送っても、承認済みのものは数えない
+	res = ApproveReactionsResponse{}
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, path, owner.Cookie, req), http.StatusOK, &res)
+	if res.Approved != 0 {
+		t.Fatalf("second approve: got approved %d, want 0", res.Approved)
+	}
+}
+
+func TestGetReactionsMissingLivestream(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+
+	// リアクションがまだない配信は、空の配列を返す
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction", livestreamID), owner.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusOK, nil)
+	if got := strings.TrimSpace(rec.Body.String()); got != "[]" {
+		t.Fatalf("empty livestream: got %s, want []", got)
+	}
+
+	// 存在しない配信だけが404になる
+	rec = doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction", livestreamID+1), owner.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusNotFound, nil)
+	if !strings.Contains(rec.Body.String(), "livestream not found") {
+		t.Fatalf("missing livestream: got %s, want livestream not found", rec.Body.String())
+	}
+}
+
+// setTestReactionCoalesceWindow は同じリアクションをまとめる窓を設定し、テストの終わりに戻す
+func setTestReactionCoalesceWindow(t *testing.T, seconds int64) {
+	t.Helper()
+	orig := reactionCoalesceWindowSeconds
+	reactionCoalesceWindowSeconds = seconds
+	t.Cleanup(func() { reactionCoalesceWindowSeconds = orig })
+}
+
+func TestPostReactionCoalesce(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	setTestReactionCoalesceWindow(t, 60)
+
+	req := &PostReactionRequest{EmojiName: ":tada:"}
+	var reactions [3]Reaction
+	for i := range reactions {
+		decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, req), http.StatusCreated, &reactions[i])
+	}
+	// まとめた投稿は、まとめた先の行とその件数を返す
+	if reactions[2].ID != reactions[0].ID || reactions[2].Count != 3 {
+		t.Fatalf("got %+v, want reaction %d with count 3", reactions[2], reactions[0].ID)
+	}
+	// 別の絵文字はまとめない
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: ":heart:"}), http.StatusCreated, nil)
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 2 {
+		t.Fatalf("got %d rows, want 2", got)
+	}
+
+	// 集計は行数ではなく件数を合計する
+	var summary []ReactionSummaryEntry
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reactions/summary", livestreamID), owner.Cookie, nil), http.StatusOK, &summary)
+	if fmt.Sprint(summary) != fmt.Sprint([]ReactionSummaryEntry{{EmojiName: ":tada:", Count: 3}, {EmojiName: ":heart:", Count: 1}}) {
+		t.Fatalf("summary: got %+v, want tada 3 and heart 1", summary)
+	}
+}
+
+func TestPostReactionCoalesceConcurrently(t *testing.T) {
+	requireTestDBRowLocks(t)
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	setTestReactionCoalesceWindow(t, 60)
+
+	req := &PostReactionRequest{EmojiName: ":tada:"}
+	var first Reaction
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, req), http.StatusCreated, &first)
+
+	const posts = 20
+	var wg sync.WaitGroup
+	codes := make([]int, posts)
+	for i := 0; i < posts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = postTestReaction(t, viewer, livestreamID, req).Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusCreated {
+			t.Fatalf("post %d: got status %d, want 201", i, code)
+		}
+	}
+
+	// 同時に投稿しても、まとめた件数は数え漏れない
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 1 {
+		t.Fatalf("got %d rows, want them coalesced into 1", got)
+	}
+	if got := countTestRows(t, "SELECT count FROM reactions WHERE id = ?", first.ID); got != posts+1 {
+		t.Fatalf("count = %d, want %d", got, posts+1)
+	}
+}
+
+func TestFillReactionResponseParity(t *testing.T) {
+	resetTestDB(t)
+	ctx := context.Background()
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	viewer := newTestUser(t, "viewer")
+	aliceStreamID := newTestLivestream(t, alice.ID, "alice stream", 0, 1)
+	bobStreamID := newTestLivestream(t, bob.ID, "bob stream", 0, 1)
+	now := time.Now().Unix()
+	var reactionModels []ReactionModel
+	for i, livestreamID := range []int64{aliceStreamID, bobStreamID, aliceStreamID} {
+		model := ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now + int64(i), Intensity: 1, Count: 1}
+		model.ID = newTestReaction(t, model)
+		reactionModels = append(reactionModels, model)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	batched, err := fillReactionResponses(ctx, tx, reactionModels)
+	if err != nil {
+		t.Fatalf("fillReactionResponses: %v", err)
+	}
+	// 一覧で使う、先に組み立てておいた配信を渡す経路
+	shared, err := sharedReactionLivestream(ctx, aliceStreamID)
+	if err != nil {
+		t.Fatalf("sharedReactionLivestream: %v", err)
+	}
+	withShared, err := fillReactionResponsesWithOptions(ctx, tx, reactionModels, reactionFillOptions{
+		Livestreams: map[int64]Livestream{shared.ID: *shared},
+	})
+	if err != nil {
+		t.Fatalf("fillReactionResponsesWithOptions: %v", err)
+	}
+
+	owners := map[int64]testUser{aliceStreamID: alice, bobStreamID: bob}
+	for i, model := range reactionModels {
+		single, err := fillReactionResponse(ctx, tx, model)
+		if err != nil {
+			t.Fatalf("fillReactionResponse: %v", err)
+		}
+		owner := single.Livestream.Owner
+		if want := owners[model.LivestreamID]; owner.ID != want.ID || owner.Name != want.Name {
+			t.Fatalf("reaction %d: got owner %+v, want %s", model.ID, owner, want.Name)
+		}
+		if !reflect.DeepEqual(single, batched[i]) {
+			t.Fatalf("reaction %d: single and batched differ:\n%+v\n%+v", model.ID, single, batched[i])
+		}
+		if !reflect.DeepEqual(single, withShared[i]) {
+			t.Fatalf("reaction %d: single and shared livestream differ:\n%+v\n%+v", model.ID, single, withShared[i])
+		}
+	}
+}
+
+// seedTestReactions は1秒ずつずらしたリアクションを n 件入れ、古い順のIDを返す
+func seedTestReactions(t *testing.T, userID, livestreamID int64, n int) []int64 {
+	t.Helper()
+	base := time.Now().Unix()
+	ids := make([]int64, n)
+	for i := range ids {
+		ids[i] = newTestReaction(t, ReactionModel{UserID: userID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: base + int64(i)})
+	}
+	return ids
+}
+
+func reversedIDs(ids []int64) []int64 {
+	reversed := make([]int64, len(ids))
+	for i := range ids {
+		reversed[len(ids)-1-i] = ids[i]
+	}
+	return reversed
+}
+
+func TestGetReactionsOrder(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	ids := seedTestReactions(t, owner.ID, livestreamID, 5)
+
+	for _, tt := range []struct {
+		query string
+		want  []int64
+	}{
+		{query: "", want: reversedIDs(ids)},
+		{query: "order=desc", want: reversedIDs(ids)},
+		{query: "order=asc", want: ids},
+		// limit は並べた後に先頭から切り出す
+		{query: "order=asc&limit=2", want: ids[:2]},
+		{query: "order=desc&limit=2", want: []int64{ids[4], ids[3]}},
+		// before_id と組み合わせても、指定した順に並ぶ
+		{query: fmt.Sprintf("order=asc&before_id=%d", ids[3]), want: ids[:3]},
+		{query: fmt.Sprintf("order=desc&before_id=%d&limit=2", ids[3]), want: []int64{ids[2], ids[1]}},
+		{query: fmt.Sprintf("order=desc&after_id=%d", ids[1]), want: []int64{ids[4], ids[3], ids[2]}},
+	} {
+		if got := reactionIDs(getTestReactions(t, owner, livestreamID, tt.query)); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?order=random", livestreamID), owner.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestGetReactionsAfterID(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	ids := seedTestReactions(t, owner.ID, livestreamID, 7)
+
+	// 最初のリアクションより後ろを、3件ずつ古い順にたどる
+	var paged []int64
+	afterID := ids[0]
+	for page := 0; ; page++ {
+		if page > len(ids) {
+			t.Fatalf("paging did not finish")
+		}
+		got := reactionIDs(getTestReactions(t, owner, livestreamID, fmt.Sprintf("after_id=%d&limit=3", afterID)))
+		if len(got) == 0 {
+			break
+		}
+		paged = append(paged, got...)
+		afterID = got[len(got)-1]
+	}
+	if fmt.Sprint(paged) != fmt.Sprint(ids[1:]) {
+		t.Fatalf("got %v, want %v", paged, ids[1:])
+	}
+
+	for _, query := range []string{
+		"after_id=abc",
+		fmt.Sprintf("after_id=%d&before_id=%d", ids[0], ids[6]),
+	} {
+		rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?%s", livestreamID, query), owner.Cookie, nil)
+		decodeTestResponse(t, rec, http.StatusBadRequest, nil)
+	}
+}
+
+func TestGetReactionsReactorTips(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, owner.ID, "other", 0, 1)
+	newTestLivecomment(t, alice.ID, livestreamID, "nice", 100)
+	newTestLivecomment(t, alice.ID, livestreamID, "great", 50)
+	// 他の配信へのチップは数えない
+	newTestLivecomment(t, alice.ID, otherLivestreamID, "hello", 1000)
+	newTestLivecomment(t, bob.ID, livestreamID, "no tip", 0)
+	now := time.Now().Unix()
+	newTestReaction(t, ReactionModel{UserID: alice.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now})
+	newTestReaction(t, ReactionModel{UserID: bob.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now + 1})
+	newTestReaction(t, ReactionModel{UserID: alice.ID, LivestreamID: livestreamID, EmojiName: "heart", CreatedAt: now + 2})
+
+	for _, reaction := range getTestReactions(t, owner, livestreamID, "") {
+		if reaction.ReactorTipTotal != nil {
+			t.Fatalf("reactor_tip_total included without include: %+v", reaction)
+		}
+	}
+
+	want := map[int64]int64{alice.ID: 150, bob.ID: 0}
+	reactions := getTestReactions(t, owner, livestreamID, "include=reactor_tips")
+	if len(reactions) != 3 {
+		t.Fatalf("got %d reactions, want 3", len(reactions))
+	}
+	for _, reaction := range reactions {
+		if reaction.ReactorTipTotal == nil || *reaction.ReactorTipTotal != want[reaction.User.ID] {
+			t.Fatalf("reaction %d by %s: got reactor_tip_total %v, want %d", reaction.ID, reaction.User.Name, reaction.ReactorTipTotal, want[reaction.User.ID])
+		}
+	}
+}
+
+// recordingHashIconStore はアイコンのハッシュ値を一括取得したユーザIDを記録する
+type recordingHashIconStore struct {
+	IconStore
+	mu      sync.Mutex
+	userIDs [][]int64
+}
+
+func (s *recordingHashIconStore) Hashes(ctx context.Context, q sqlx.QueryerContext, userIDs []int64) (map[int64]string, error) {
+	s.mu.Lock()
+	s.userIDs = append(s.userIDs, append([]int64(nil), userIDs...))
+	s.mu.Unlock()
+	return s.IconStore.Hashes(ctx, q, userIDs)
+}
+
+func TestFillReactionResponsesLooksUpOnlyRealUsers(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	users := []testUser{newTestUser(t, "alice"), newTestUser(t, "bob"), newTestUser(t, "carol")}
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	posted := map[int64]int64{}
+	for _, user := range users {
+		var reaction Reaction
+		decodeTestResponse(t, postTestReaction(t, user, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}), http.StatusCreated, &reaction)
+		if reaction.User.ID != user.ID || reaction.User.Name != user.Name {
+			t.Fatalf("posted by %s: got user %+v", user.Name, reaction.User)
+		}
+		posted[reaction.ID] = user.ID
+	}
+
+	origStore := iconStore
+	recorder := &recordingHashIconStore{IconStore: origStore}
+	iconStore = recorder
+	t.Cleanup(func() { iconStore = origStore })
+	userCache.reset()
+
+	reactions := getTestReactions(t, owner, livestreamID, "")
+	if len(reactions) != len(users) {
+		t.Fatalf("got %d reactions, want %d", len(reactions), len(users))
+	}
+	for _, reaction := range reactions {
+		if reaction.User.ID != posted[reaction.ID] {
+			t.Fatalf("reaction %d: got user %d, want %d", reaction.ID, reaction.User.ID, posted[reaction.ID])
+		}
+	}
+	// ID 0 のユーザを引いていない
+	var lookedUp []int64
+	for _, ids := range recorder.userIDs {
+		lookedUp = append(lookedUp, ids...)
+	}
+	if len(lookedUp) == 0 {
+		t.Fatalf("icon hashes were not looked up")
+	}
+	for _, id := range lookedUp {
+		if id == 0 {
+			t.Fatalf("looked up user id 0: %v", recorder.userIDs)
+		}
+	}
+}
+
+func TestGetReactionsBeforeID(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	ids := seedTestReactions(t, owner.ID, livestreamID, 5)
+
+	// 新しい順に2件ずつ、最後のページまでさかのぼる
+	var paged []int64
+	query := "limit=2"
+	for page := 0; ; page++ {
+		if page > len(ids) {
+			t.Fatalf("paging did not finish")
+		}
+		got := reactionIDs(getTestReactions(t, owner, livestreamID, query))
+		if len(got) == 0 {
+			break
+		}
+		paged = append(paged, got...)
+		query = fmt.Sprintf("limit=2&before_id=%d", got[len(got)-1])
+	}
+	if fmt.Sprint(paged) != fmt.Sprint(reversedIDs(ids)) {
+		t.Fatalf("got %v, want %v", paged, reversedIDs(ids))
+	}
+
+	// 続きがないページは404ではなく空の配列を返す
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?before_id=%d", livestreamID, ids[0]), owner.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusOK, nil)
+	if got := strings.TrimSpace(rec.Body.String()); got != "[]" {
+		t.Fatalf("last page: got %s, want []", got)
+	}
+	rec = doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?before_id=abc", livestreamID), owner.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestGetReactionsExpandLivestream(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	// 投稿のレスポンスは、これまで通り配信の詳細を含む
+	var posted Reaction
+	decodeTestResponse(t, postTestReaction(t, owner, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}), http.StatusCreated, &posted)
+	if posted.Livestream.Owner.ID != owner.ID || posted.Livestream.Description == "" {
+		t.Fatalf("posted: got livestream %+v, want the full livestream", posted.Livestream)
+	}
+
+	livestreamKeys := func(query string) []string {
+		rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?%s", livestreamID, query), owner.Cookie, nil)
+		var reactions []struct {
+			Livestream map[string]json.RawMessage `json:"livestream"`
+		}
+		decodeTestResponse(t, rec, http.StatusOK, &reactions)
+		if len(reactions) != 1 {
+			t.Fatalf("%q: got %d reactions, want 1", query, len(reactions))
+		}
+		var keys []string
+		for key := range reactions[0].Livestream {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	// 既定では配信のIDとタイトルだけを返す
+	if got := livestreamKeys(""); fmt.Sprint(got) != "[id title]" {
+		t.Fatalf("default: got livestream keys %v, want [id title]", got)
+	}
+	got := livestreamKeys("expand=livestream")
+	for _, key := range []string{"id", "title", "owner", "description", "tags", "start_at", "end_at"} {
+		if i := sort.SearchStrings(got, key); i == len(got) || got[i] != key {
+			t.Fatalf("expand=livestream: got livestream keys %v, want %s", got, key)
+		}
+	}
+}
+
+func TestPostReactionEmojiValidation(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+
+	for _, tt := range []struct {
+		emoji string
+		want  int
+	}{
+		{emoji: ":tada:", want: http.StatusCreated},
+		{emoji: ":+1:", want: http.StatusCreated},
+		{emoji: "", want: http.StatusBadRequest},
+		{emoji: ":thumbs up:", want: http.StatusBadRequest},
+		{emoji: "tada", want: http.StatusBadRequest},
+		{emoji: "<b>:tada:</b>", want: http.StatusBadRequest},
+	} {
+		rec := postTestReaction(t, owner, livestreamID, &PostReactionRequest{EmojiName: tt.emoji})
+		if rec.Code != tt.want {
+			t.Errorf("%q: got status %d, want %d: %s", tt.emoji, rec.Code, tt.want, rec.Body.String())
+		}
+	}
+	// 断ったリアクションは保存しない
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 2 {
+		t.Fatalf("got %d reactions, want 2", got)
+	}
+}
+
+// fillReactionResponsePerRow は一括取得に寄せる前の fillReactionResponse で、ベンチマークの比較に使う
+func fillReactionResponsePerRow(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", reactionModel.UserID); err != nil {
+		return Reaction{}, err
+	}
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return Reaction{}, err
+	}
+
+	livestreamModel := LivestreamModel{}
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", reactionModel.LivestreamID); err != nil {
+		return Reaction{}, err
+	}
+	livestreams, err := fillLivestreamResponses(ctx, tx, []*LivestreamModel{&livestreamModel})
+	if err != nil {
+		return Reaction{}, err
+	}
+
+	reaction := Reaction{
+		ID:         reactionModel.ID,
+		EmojiName:  reactionModel.EmojiName,
+		User:       user,
+		Livestream: livestreams[0],
+		Intensity:  reactionModel.Intensity,
+		Count:      reactionModel.Count,
+		Pending:    reactionModel.Pending,
+		CreatedAt:  reactionModel.CreatedAt,
+		shadow:     reactionModel.Shadow,
+	}
+	if reactionModel.LivecommentID.Valid {
+		reaction.LivecommentID = &reactionModel.LivecommentID.Int64
+	}
+	return reaction, nil
+}
+
+func BenchmarkFillReactionResponse(b *testing.B) {
+	resetTestDB(b)
+	owner := newTestUser(b, "owner")
+	viewer := newTestUser(b, "viewer")
+	livestreamID := newTestLivestream(b, owner.ID, "stream", 0, 1)
+	model := ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: time.Now().Unix(), Intensity: 1, Count: 1}
+	model.ID = newTestReaction(b, model)
+
+	for _, bm := range []struct {
+		name string
+		fill func(context.Context, *sqlx.Tx, ReactionModel) (Reaction, error)
+	}{
+		{name: "per-row", fill: fillReactionResponsePerRow},
+		{name: "batched", fill: fillReactionResponse},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			ctx, counter := withQueryCounter(context.Background(), false)
+			tx, err := dbConn.BeginTxx(ctx, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.fill(ctx, tx, model); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(counter.count.Load())/float64(b.N), "queries/op")
+		})
+	}
+}
+
+func TestGetReactionsLimit(t *testing.T) {
+	resetTestDB(t)
+	orig := reactionsMaxLimit
+	reactionsMaxLimit = 3
+	t.Cleanup(func() { reactionsMaxLimit = orig })
+
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	seedTestReactions(t, owner.ID, livestreamID, 5)
+
+	for query, want := range map[string]int{
+		"":                5,
+		"limit=2":         2,
+		"limit=100000000": 3,
+	} {
+		if got := len(getTestReactions(t, owner, livestreamID, query)); got != want {
+			t.Errorf("%q: got %d reactions, want %d", query, got, want)
+		}
+	}
+
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?limit=-1", livestreamID), owner.Cookie, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("negative limit: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestGetLivecommentReactionsLimit(t *testing.T) {
+	resetTestDB(t)
+	orig := reactionsMaxLimit
+	reactionsMaxLimit = 3
+	t.Cleanup(func() { reactionsMaxLimit = orig })
+
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	livecommentID := newTestLivecomment(t, owner.ID, livestreamID, "hello", 0)
+	for i := 0; i < 5; i++ {
+		newTestReaction(t, ReactionModel{UserID: owner.ID, LivestreamID: livestreamID, LivecommentID: sql.NullInt64{Int64: livecommentID, Valid: true}, EmojiName: ":tada:", CreatedAt: int64(i)})
+	}
+
+	path := fmt.Sprintf("/api/livestream/%d/livecomment/%d/reactions", livestreamID, livecommentID)
+	for query, want := range map[string]int{
+		"":                5,
+		"limit=2":         2,
+		"limit=100000000": 3,
+	} {
+		var reactions []Reaction
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, path+"?"+query, owner.Cookie, nil), http.StatusOK, &reactions)
+		if len(reactions) != want {
+			t.Errorf("%q: got %d reactions, want %d", query, len(reactions), want)
+		}
+	}
+
+	for _, limit := range []string{"0", "-1", "abc"} {
+		if rec := doTestRequest(t, http.MethodGet, path+"?limit="+limit, owner.Cookie, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("limit=%s: got status %d, want 400", limit, rec.Code)
+		}
+	}
+}
+
+func TestDeleteReaction(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, owner.ID, "other stream", 0, 1)
+	reactionID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: time.Now().Unix()})
+
+	deleteReaction := func(user testUser, livestreamID, reactionID int64) int {
+		t.Helper()
+		return doTestRequest(t, http.MethodDelete, fmt.Sprintf("/api/livestream/%d/reaction/%d", livestreamID, reactionID), user.Cookie, nil).Code
+	}
+
+	if got := deleteReaction(owner, livestreamID, reactionID); got != http.StatusForbidden {
+		t.Fatalf("other user's reaction: got status %d, want 403", got)
+	}
+	if got := deleteReaction(viewer, livestreamID, reactionID+1); got != http.StatusNotFound {
+		t.Fatalf("missing reaction: got status %d, want 404", got)
+	}
+	if got := deleteReaction(viewer, otherLivestreamID, reactionID); got != http.StatusNotFound {
+		t.Fatalf("reaction on another livestream: got status %d, want 404", got)
+	}
+	if got := len(getTestReactions(t, viewer, livestreamID, "")); got != 1 {
+		t.Fatalf("got %d reactions before deleting, want 1", got)
+	}
+
+	if got := deleteReaction(viewer, livestreamID, reactionID); got != http.StatusNoContent {
+		t.Fatalf("own reaction: got status %d, want 204", got)
+	}
+	if got := len(getTestReactions(t, viewer, livestreamID, "")); got != 0 {
+		t.Fatalf("got %d reactions after deleting, want 0", got)
+	}
+	// 取り消し済みのリアクションは、もう一度取り消せない
+	if got := deleteReaction(viewer, livestreamID, reactionID); got != http.StatusNotFound {
+		t.Fatalf("deleted reaction: got status %d, want 404", got)
+	}
+}
+
+func TestGetReactionsEmojiFilter(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	base := time.Now().Unix()
+	var tadaIDs []int64
+	for i, emoji := range []string{":tada:", ":heart:", ":tada:", ":heart:", ":tada:", ":tada:"} {
+		id := newTestReaction(t, ReactionModel{UserID: owner.ID, LivestreamID: livestreamID, EmojiName: emoji, CreatedAt: base + int64(i)})
+		if emoji == ":tada:" {
+			tadaIDs = append(tadaIDs, id)
+		}
+	}
+
+	if got := reactionIDs(getTestReactions(t, owner, livestreamID, "emoji_name=:tada:")); fmt.Sprint(got) != fmt.Sprint(reversedIDs(tadaIDs)) {
+		t.Fatalf("emoji_name=:tada:: got %v, want %v", got, reversedIDs(tadaIDs))
+	}
+	// カーソルと limit は絞り込んだ後のリアクションに対して効く
+	query := fmt.Sprintf("emoji_name=:tada:&after_id=%d&limit=2", tadaIDs[0])
+	if got := reactionIDs(getTestReactions(t, owner, livestreamID, query)); fmt.Sprint(got) != fmt.Sprint(tadaIDs[1:3]) {
+		t.Fatalf("%s: got %v, want %v", query, got, tadaIDs[1:3])
+	}
+
+	// 一致するリアクションがなければ空の配列を返す
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?emoji_name=:smile:", livestreamID), owner.Cookie, nil)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("emoji_name=:smile:: got status %d with %s, want 200 with []", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGetReactionsCreatedAtRange(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	ids := seedTestReactions(t, owner.ID, livestreamID, 5)
+	var base int64
+	if err := dbConn.Get(&base, "SELECT created_at FROM reactions WHERE id = ?", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  []int64
+	}{
+		// 両端を含む
+		{query: fmt.Sprintf("since=%d&until=%d", base+1, base+3), want: []int64{ids[3], ids[2], ids[1]}},
+		{query: fmt.Sprintf("since=%d", base+3), want: []int64{ids[4], ids[3]}},
+		{query: fmt.Sprintf("until=%d", base+1), want: []int64{ids[1], ids[0]}},
+		{query: fmt.Sprintf("since=%d&until=%d", base+2, base+2), want: []int64{ids[2]}},
+		// limit や order と組み合わせられる
+		{query: fmt.Sprintf("since=%d&until=%d&order=asc&limit=2", base+1, base+4), want: []int64{ids[1], ids[2]}},
+		{query: fmt.Sprintf("since=%d", base+10), want: []int64{}},
+	} {
+		if got := reactionIDs(getTestReactions(t, owner, livestreamID, tt.query)); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{
+		fmt.Sprintf("since=%d&until=%d", base+3, base+1),
+		"since=abc",
+		"until=abc",
+	} {
+		rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?%s", livestreamID, query), owner.Cookie, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+// 投稿されたリアクションを、同じ配信を購読しているクライアントへ配信するためのハブ
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// 購読者ごとに溜めておけるメッセージ数。溢れた分は捨てる
+	reactionSubscriberBufferSize = 64
+	// await_broadcast=true の投稿で、配信完了を待つ最大時間
+	reactionBroadcastTimeout = 500 * time.Millisecond
+	// 二重配信を防ぐために覚えておく、直近に配信したリアクションの数
+	recentlyPublishedReactionsSize = 1024
+	// 1配信あたりの購読者数の上限。接続ごとに goroutine を使うので、1つの配信で使い切られないようにする
+	maxReactionSubscribersPerLivestream = 1000
+)
+
+var (
+	errTooManyReactionSubscribers = errors.New("too many subscribers for the livestream")
+	errReactionHubClosed          = errors.New("hub is closed")
+)
+
+// reactionOverflowPolicy は購読者のバッファが埋まっているときの振る舞い
+type reactionOverflowPolicy string
+
+const (
+	// 新しいメッセージを捨てる
+	overflowDropNewest reactionOverflowPolicy = "drop-newest"
+	// 最も古いメッセージを捨てて、新しいメッセージを入れる
+	overflowDropOldest reactionOverflowPolicy = "drop-oldest"
+	// 追いつけない購読者を切断する
+	overflowDisconnect reactionOverflowPolicy = "disconnect"
+
+	defaultReactionOverflowPolicy = overflowDropNewest
+)
+
+func parseReactionOverflowPolicy(v string) (reactionOverflowPolicy, error) {
+	switch policy := reactionOverflowPolicy(v); policy {
+	case "":
+		return defaultReactionOverflowPolicy, nil
+	case overflowDropNewest, overflowDropOldest, overflowDisconnect:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", v)
+	}
+}
+
+// 購読者のバッファ溢れで捨てたメッセージ数。キーはポリシー名
+// /debug/vars から参照できる。/metrics には reactionHubDropsTotal として出す
+var reactionHubDrops = expvar.NewMap("reaction_hub_drops")
+
+type reactionSubscriber struct {
+	ch     chan []byte
+	policy reactionOverflowPolicy
+	// disconnect ポリシーで切断されたときに閉じられる
+	kicked chan struct{}
+}
+
+type reactionHub struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[*reactionSubscriber]struct{}
+
+	// 直近に配信したリアクションIDのリングバッファと、その検索用のセット
+	recentIDs   [recentlyPublishedReactionsSize]int64
+	recentNext  int
+	recentIDSet map[int64]struct{}
+
+	// closeAll の後は購読を受け付けない
+	closed bool
+}
+
+var reactionBroadcaster = newReactionHub()
+
+func newReactionHub() *reactionHub {
+	return &reactionHub{
+		subscribers: make(map[int64]map[*reactionSubscriber]struct{}),
+		recentIDSet: make(map[int64]struct{}, recentlyPublishedReactionsSize),
+	}
+}
+
+// subscribe は配信の購読者を追加する。購読者数が上限に達している場合は errTooManyReactionSubscribers を返す
+// closeAll の後は errReactionHubClosed を返す
+func (h *reactionHub) subscribe(livestreamID int64, policy reactionOverflowPolicy) (*reactionSubscriber, error) {
+	sub := &reactionSubscriber{
+		ch:     make(chan []byte, reactionSubscriberBufferSize),
+		policy: policy,
+		kicked: make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, errReactionHubClosed
+	}
+	if _, ok := h.subscribers[livestreamID]; !ok {
+		h.subscribers[livestreamID] = make(map[*reactionSubscriber]struct{})
+	}
+	if len(h.subscribers[livestreamID]) >= maxReactionSubscribersPerLivestream {
+		return nil, errTooManyReactionSubscribers
+	}
+	h.subscribers[livestreamID][sub] = struct{}{}
+	return sub, nil
+}
+
+func (h *reactionHub) unsubscribe(livestreamID int64, sub *reactionSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs, ok := h.subscribers[livestreamID]
+	if !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, livestreamID)
+	}
+}
+
+// publish は配信の購読者全員にメッセージを送る
+// 遅いクライアントに引きずられないよう、送信はブロックせず、バッファが埋まっている購読者は各自のポリシーに従って扱う
+// 同じリアクションが再度 publish された場合 (投稿処理のリトライなど) は何もしない
+func (h *reactionHub) publish(livestreamID int64, reactionID int64, msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.markPublishedLocked(reactionID) {
+		return
+	}
+	for sub := range h.subscribers[livestreamID] {
+		select {
+		case sub.ch <- msg:
+			continue
+		default:
+		}
+
+		reactionHubDrops.Add(string(sub.policy), 1)
+		reactionHubDropsTotal.WithLabelValues(string(sub.policy)).Inc()
+		switch sub.policy {
+		case overflowDropOldest:
+			// 受信側と競合しても送信がブロックしないよう、どちらも select で行う
+			select {
+			case <-sub.ch:
+			default:
+			}
+			select {
+			case sub.ch <- msg:
+			default:
+			}
+		case overflowDisconnect:
+			close(sub.kicked)
+			delete(h.subscribers[livestreamID], sub)
+		}
+	}
+	if len(h.subscribers[livestreamID]) == 0 {
+		delete(h.subscribers, livestreamID)
+	}
+}
+
+// publishAsync は別のgoroutineで publish し、全購読者への送信が終わったら閉じるチャネルを返す
+func (h *reactionHub) publishAsync(livestreamID int64, reactionID int64, msg []byte) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.publish(livestreamID, reactionID, msg)
+	}()
+	return done
+}
+
+// markPublishedLocked はリアクションIDを配信済みとして記録する。既に配信済みの場合は false を返す
+func (h *reactionHub) markPublishedLocked(reactionID int64) bool {
+	if _, ok := h.recentIDSet[reactionID]; ok {
+		return false
+	}
+	if len(h.recentIDSet) >= recentlyPublishedReactionsSize {
+		delete(h.recentIDSet, h.recentIDs[h.recentNext])
+	}
+	h.recentIDs[h.recentNext] = reactionID
+	h.recentIDSet[reactionID] = struct{}{}
+	h.recentNext = (h.recentNext + 1) % recentlyPublishedReactionsSize
+	return true
+}
+
+// closeAll は全購読者を切断し、以降の購読を断る
+// サーバの終了時に、購読中の接続を終わらせるために呼ぶ
+func (h *reactionHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			close(sub.kicked)
+		}
+	}
+	h.subscribers = make(map[int64]map[*reactionSubscriber]struct{})
+}
+
+// resetPublished は配信済みのリアクションIDを忘れる
+// 初期化でリアクションIDが振り直されるため、initializeHandler から呼ぶ
+func (h *reactionHub) resetPublished() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recentNext = 0
+	h.recentIDSet = make(map[int64]struct{}, recentlyPublishedReactionsSize)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// receivedMessages は購読者のバッファに溜まっているメッセージを取り出す
+func receivedMessages(sub *reactionSubscriber) []string {
+	var msgs []string
+	for {
+		select {
+		case msg := <-sub.ch:
+			msgs = append(msgs, string(msg))
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestReactionHubPublishIsIdempotent(t *testing.T) {
+	hub := newReactionHub()
+	// WebSocket と SSE で同時に購読していても、それぞれに1回ずつ届く
+	ws, err := hub.subscribe(1, overflowDropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sse, err := hub.subscribe(1, overflowDropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.publish(1, 100, []byte("reaction 100"))
+	// 投稿処理のリトライで同じリアクションをもう一度配信しても、届くのは1回だけ
+	hub.publish(1, 100, []byte("reaction 100"))
+	<-hub.publishAsync(1, 100, []byte("reaction 100"))
+
+	for name, sub := range map[string]*reactionSubscriber{"ws": ws, "sse": sse} {
+		if got := receivedMessages(sub); len(got) != 1 || got[0] != "reaction 100" {
+			t.Fatalf("%s: got %q, want one delivery", name, got)
+		}
+	}
+}
+
+func TestReactionHubForgetsOldPublishedIDs(t *testing.T) {
+	hub := newReactionHub()
+	// 覚えておく数を超えたら古いIDから忘れる
+	for id := int64(1); id <= recentlyPublishedReactionsSize+1; id++ {
+		hub.publish(1, id, nil)
+	}
+	if len(hub.recentIDSet) != recentlyPublishedReactionsSize {
+		t.Fatalf("remembered %d ids, want %d", len(hub.recentIDSet), recentlyPublishedReactionsSize)
+	}
+
+	sub, err := hub.subscribe(1, overflowDropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.publish(1, recentlyPublishedReactionsSize+1, []byte("remembered"))
+	hub.publish(1, 1, []byte("forgotten"))
+	if got := receivedMessages(sub); len(got) != 1 || got[0] != "forgotten" {
+		t.Fatalf("got %q, want only the forgotten id to be published again", got)
+	}
+
+	// 初期化の後はIDが振り直されるので、すべて忘れる
+	hub.resetPublished()
+	hub.publish(1, 2, []byte("after reset"))
+	if got := receivedMessages(sub); len(got) != 1 || got[0] != "after reset" {
+		t.Fatalf("after reset: got %q, want one delivery", got)
+	}
+}
+
+func TestReactionHubSlowSubscriber(t *testing.T) {
+	for _, tt := range []struct {
+		policy     reactionOverflowPolicy
+		wantFirst  int
+		wantKicked bool
+	}{
+		{policy: overflowDropNewest, wantFirst: 0},
+		{policy: overflowDropOldest, wantFirst: 1},
+		{policy: overflowDisconnect, wantFirst: 0, wantKicked: true},
+	} {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			hub := newReactionHub()
+			// 一度も読まない購読者
+			slow, err := hub.subscribe(1, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			drops := func() int64 {
+				if v, ok := reactionHubDrops.Get(string(tt.policy)).(interface{ Value() int64 }); ok {
+					return v.Value()
+				}
+				return 0
+			}
+			series := fmt.Sprintf(`isupipe_reaction_hub_drops_total{policy="%s"}`, tt.policy)
+			before := drops()
+			beforeScraped := scrapeTestMetrics(t)[series]
+
+			// バッファを1件超えて配信しても publish はブロックしない
+			for id := int64(0); id <= reactionSubscriberBufferSize; id++ {
+				hub.publish(1, id, []byte{byte(id)})
+			}
+
+			if got := drops() - before; got != 1 {
+				t.Fatalf("drops = %d, want 1", got)
+			}
+			if got := scrapeTestMetrics(t)[series] - beforeScraped; got != 1 {
+				t.Fatalf("%s increased by %v, want 1", series, got)
+			}
+			select {
+			case <-slow.kicked:
+				if !tt.wantKicked {
+					t.Fatalf("subscriber was disconnected")
+				}
+				if _, ok := hub.subscribers[1]; ok {
+					t.Fatalf("disconnected subscriber was not removed")
+				}
+			default:
+				if tt.wantKicked {
+					t.Fatalf("subscriber was not disconnected")
+				}
+			}
+			msgs := receivedMessages(slow)
+			if len(msgs) != reactionSubscriberBufferSize || msgs[0][0] != byte(tt.wantFirst) {
+				t.Fatalf("got %d messages starting with %d, want %d starting with %d", len(msgs), msgs[0][0], reactionSubscriberBufferSize, tt.wantFirst)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+// リアクション投稿の Idempotency-Key
+// 通信が不安定なクライアントが同じ投稿を再送しても、リアクションを二重に保存しないよう、キーと保存したリアクションを reaction_idempotency_keys に記録する
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+	// キーを覚えておく期間。これを過ぎたキーは新しい投稿として扱う
+	reactionIdempotencyTTLSeconds = 24 * 60 * 60
+)
+
+type ReactionIdempotencyKeyModel struct {
+	UserID         int64  `db:"user_id"`
+	IdempotencyKey string `db:"idempotency_key"`
+	ReactionID     int64  `db:"reaction_id"`
+	CreatedAt      int64  `db:"created_at"`
+}
+
+// reactionIdempotencyKey はリクエストの Idempotency-Key を返す。指定されていない場合は空文字列を返す
+func reactionIdempotencyKey(c echo.Context) (string, error) {
+	key := c.Request().Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s header must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+	}
+	return key, nil
+}
+
+// claimReactionIdempotencyKey は投稿のトランザクションでキーを確保する
+// 同じキーで投稿済みであればそのリアクションを返し、まだであれば nil を返す。確保したキーには recordReactionIdempotencyKey で投稿を記録する
+// 同じキーのリクエストが並行して送られた場合、後のリクエストは先のトランザクションが終わるまで INSERT で待ち、
+// 先がコミットすれば保存されたリアクションを返し、ロールバックすれば改めてキーを確保する
+func claimReactionIdempotencyKey(ctx context.Context, tx *sqlx.Tx, userID int64, livestreamID int64, key string, now int64) (*Reaction, error) {
+	// 期限切れのキーが残っていると、同じキーを新しい投稿に使えないので先に消す
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reaction_idempotency_keys WHERE user_id = ? AND created_at < ?", userID, now-reactionIdempotencyTTLSeconds); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to delete expired idempotency keys: "+err.Error())
+	}
+
+	// 投稿するリアクションのIDはまだ決まっていないので、0 で確保しておく
+	keyModel := ReactionIdempotencyKeyModel{
+		UserID:         userID,
+		IdempotencyKey: key,
+		ReactionID:     0,
+		CreatedAt:      now,
+	}
+	_, err := tx.NamedExecContext(ctx, "INSERT INTO reaction_idempotency_keys (user_id, idempotency_key, reaction_id, created_at) VALUES (:user_id, :idempotency_key, :reaction_id, :created_at)", keyModel)
+	if err == nil {
+		return nil, nil
+	}
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != mysqlErrDuplicateEntry {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert idempotency key: "+err.Error())
+	}
+
+	// すでに投稿済み。コミット済みの最新の行を読むため、ロックして読む
+	if err := tx.GetContext(ctx, &keyModel, "SELECT * FROM reaction_idempotency_keys WHERE user_id = ? AND idempotency_key = ? FOR UPDATE", userID, key); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get idempotency key: "+err.Error())
+	}
+
+	var reactionModel ReactionModel
+	if err := tx.GetContext(ctx, &reactionModel, "SELECT * FROM reactions WHERE id = ?", keyModel.ReactionID); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction: "+err.Error())
+	}
+	// 別の配信への投稿に使ったキーを使い回している
+	if reactionModel.LivestreamID != livestreamID {
+		return nil, echo.NewHTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("the %s has already been used for another livestream", idempotencyKeyHeader))
+	}
+
+	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+	}
+	return &reaction, nil
+}
+
+// recordReactionIdempotencyKey は claimReactionIdempotencyKey で確保したキーに、保存したリアクションを記録する
+// リアクションと同じトランザクションで記録するので、片方だけが残ることはない
+func recordReactionIdempotencyKey(ctx context.Context, tx *sqlx.Tx, userID int64, key string, reactionID int64) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE reaction_idempotency_keys SET reaction_id = ? WHERE user_id = ? AND idempotency_key = ?", reactionID, userID, key); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update idempotency key: "+err.Error())
+	}
+	return nil
+}
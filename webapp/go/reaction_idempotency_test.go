@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReactionIdempotencyKey(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, owner.ID, "other stream", 0, 1)
+	req := &PostReactionRequest{EmojiName: ":tada:"}
+	keyHeader := idempotencyKeyHeader + ": retry-1"
+
+	var first Reaction
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, req, keyHeader), http.StatusCreated, &first)
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 1 {
+		t.Fatalf("after first post: got %d reactions, want 1", got)
+	}
+
+	// 再送は保存せず、最初のリアクションを返す
+	var retried Reaction
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, req, keyHeader), http.StatusOK, &retried)
+	if retried.ID != first.ID {
+		t.Fatalf("retry: got reaction %d, want %d", retried.ID, first.ID)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 1 {
+		t.Fatalf("after retry: got %d reactions, want 1", got)
+	}
+
+	// キーはユーザごとに別
+	var others Reaction
+	decodeTestResponse(t, postTestReaction(t, owner, livestreamID, req, keyHeader), http.StatusCreated, &others)
+	if others.ID == first.ID {
+		t.Fatalf("another user's post with the same key returned reaction %d", first.ID)
+	}
+
+	// 別の配信への投稿に使ったキーは使い回せない
+	decodeTestResponse(t, postTestReaction(t, viewer, otherLivestreamID, req, keyHeader), http.StatusUnprocessableEntity, nil)
+
+	// キーを付けない投稿は、毎回保存する
+	for i := 0; i < 2; i++ {
+		decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, req), http.StatusCreated, nil)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 4 {
+		t.Fatalf("after posts without a key: got %d reactions, want 4", got)
+	}
+
+	longKey := idempotencyKeyHeader + ": " + strings.Repeat("k", maxIdempotencyKeyLength+1)
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, req, longKey), http.StatusBadRequest, nil)
+}
+
+func TestReactionIdempotencyKeyConcurrentRetries(t *testing.T) {
+	requireTestDBRowLocks(t)
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+
+	// 同じキーで同時に送っても保存するのは1件で、どのリクエストも同じリアクションを返す
+	const retries = 10
+	var wg sync.WaitGroup
+	codes := make([]int, retries)
+	ids := make([]int64, retries)
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := postTestReaction(t, owner, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}, idempotencyKeyHeader+": same")
+			codes[i] = rec.Code
+			if rec.Code == http.StatusCreated || rec.Code == http.StatusOK {
+				var reaction Reaction
+				if err := json.Unmarshal(rec.Body.Bytes(), &reaction); err == nil {
+					ids[i] = reaction.ID
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for i := range codes {
+		switch codes[i] {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+		default:
+			t.Fatalf("retry %d: got status %d, want 201 or 200", i, codes[i])
+		}
+		if ids[i] != ids[0] {
+			t.Fatalf("retry %d: got reaction %d, want %d", i, ids[i], ids[0])
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d requests created a reaction, want 1", created)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 1 {
+		t.Fatalf("got %d reactions, want 1", got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+// アーカイブした配信のリアクションを取り込むAPI
+// 過去のリアクションをそのまま保存するので、投稿時の流量制限や配信のリアクション設定は適用しない
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 一度に取り込めるリアクション数の上限
+// 1行あたりのプレースホルダ数との積が、MySQLのプレースホルダ数の上限 (65535) を超えないようにする
+const maxReactionImportSize = 5000
+
+type ImportReactionRequest struct {
+	EmojiName string `json:"emoji_name"`
+	UserID    int64  `json:"user_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type ImportReactionsResponse struct {
+	Imported int64 `json:"imported"`
+}
+
+// リアクション取り込みAPI (配信者向け)
+// POST /api/livestream/:livestream_id/reactions/bulk
+// すべての項目を1つの INSERT で保存する。不正な項目が1つでもあれば何も保存しない
+func postReactionsBulkHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req []ImportReactionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len(req) == 0 || len(req) > maxReactionImportSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reactions must have 1 to %d items", maxReactionImportSize))
+	}
+
+	// 投稿と同じ規則で絵文字を検証する
+	reactorIDs := make([]int64, 0, len(req))
+	for i, item := range req {
+		if !emojiShortcodeRegexp.MatchString(item.EmojiName) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reactions[%d]: emoji_name must be a shortcode like :tada:", i))
+		}
+		if !isAllowedEmoji(item.EmojiName) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reactions[%d]: the emoji is not in the allowlist", i))
+		}
+		if item.CreatedAt <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reactions[%d]: created_at must be positive", i))
+		}
+		reactorIDs = append(reactorIDs, item.UserID)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	// 存在しないユーザのリアクションは取り込まない
+	var existingIDs []int64
+	query, params, err := sqlx.In("SELECT id FROM users WHERE id IN (?)", reactorIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct getting users query: "+err.Error())
+	}
+	if err := tx.SelectContext(ctx, &existingIDs, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	existing := make(map[int64]struct{}, len(existingIDs))
+	for _, id := range existingIDs {
+		existing[id] = struct{}{}
+	}
+	for i, item := range req {
+		if _, ok := existing[item.UserID]; !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reactions[%d]: user not found", i))
+		}
+	}
+
+	reactionModels := make([]ReactionModel, len(req))
+	for i, item := range req {
+		reactionModels[i] = ReactionModel{
+			UserID:       item.UserID,
+			LivestreamID: int64(livestreamID),
+			EmojiName:    item.EmojiName,
+			Intensity:    defaultReactionIntensity,
+			CreatedAt:    item.CreatedAt,
+		}
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, intensity, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :intensity, :created_at)", reactionModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reactions: "+err.Error())
+	}
+	imported, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, &ImportReactionsResponse{Imported: imported})
+}
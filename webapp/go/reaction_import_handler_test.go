@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestPostReactionsBulk(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	path := fmt.Sprintf("/api/livestream/%d/reactions/bulk", livestreamID)
+
+	const n = 500
+	req := make([]ImportReactionRequest, n)
+	emojis := []string{":tada:", ":heart:", ":clap:"}
+	for i := range req {
+		userID := owner.ID
+		if i%2 == 1 {
+			userID = viewer.ID
+		}
+		req[i] = ImportReactionRequest{EmojiName: emojis[i%len(emojis)], UserID: userID, CreatedAt: 1700000000 + int64(i)}
+	}
+
+	// 配信者以外は取り込めない
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, path, viewer.Cookie, req), http.StatusForbidden, nil)
+
+	// 不正な項目が1つでもあれば、何も保存しない
+	for name, mutate := range map[string]func(item *ImportReactionRequest){
+		"invalid emoji":  func(item *ImportReactionRequest) { item.EmojiName = "not an emoji" },
+		"missing user":   func(item *ImportReactionRequest) { item.UserID = viewer.ID + 100 },
+		"zero timestamp": func(item *ImportReactionRequest) { item.CreatedAt = 0 },
+	} {
+		invalid := append([]ImportReactionRequest(nil), req...)
+		mutate(&invalid[n-1])
+		decodeTestResponse(t, doTestRequest(t, http.MethodPost, path, owner.Cookie, invalid), http.StatusBadRequest, nil)
+		if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 0 {
+			t.Fatalf("%s: got %d reactions, want the whole batch rejected", name, got)
+		}
+	}
+
+	var res ImportReactionsResponse
+	rec := doTestRequest(t, http.MethodPost, path, owner.Cookie, req, "X-Debug: 1")
+	decodeTestResponse(t, rec, http.StatusCreated, &res)
+	if res.Imported != n {
+		t.Fatalf("imported = %d, want %d", res.Imported, n)
+	}
+	// 件数によらず、配信者とユーザの確認、1つの INSERT で済む
+	if got := rec.Header().Get(dbQueriesHeader); got != "3" {
+		t.Fatalf("%s = %q, want 3", dbQueriesHeader, got)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?", livestreamID); got != n {
+		t.Fatalf("got %d reactions, want %d", got, n)
+	}
+
+	var stored []ReactionModel
+	if err := dbConn.Select(&stored, "SELECT * FROM reactions ORDER BY created_at"); err != nil {
+		t.Fatal(err)
+	}
+	for i, reaction := range stored {
+		want := req[i]
+		if reaction.EmojiName != want.EmojiName || reaction.UserID != want.UserID || reaction.CreatedAt != want.CreatedAt {
+			t.Fatalf("reaction %d: got %+v, want %+v", i, reaction, want)
+		}
+		if reaction.Count != 1 || reaction.Intensity != defaultReactionIntensity {
+			t.Fatalf("reaction %d: count = %d, intensity = %d, want 1 and %d", i, reaction.Count, reaction.Intensity, defaultReactionIntensity)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+// 配信者によるリアクションのモデレーション操作 (承認、削除、非表示など) の記録
+// 操作と同じトランザクションで書き込むので、操作が取り消された場合は記録も残らない
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	moderationActionApprove = "approve"
+	// 配信者が非表示にした。行と deleted_at はそのままで、hidden を立てる
+	moderationActionHide = "hide"
+	// 配信者が削除した
+	moderationActionDelete = "delete"
+	// NGワードの登録によって削除した
+	moderationActionNGWordDelete = "ng_word_delete"
+)
+
+// モデレーション履歴で limit に指定できる上限。これより大きい値は上限に切り詰める
+var moderationLogMaxLimit = 1000
+
+type ReactionModerationLogModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	ActorID      int64  `db:"actor_id"`
+	Action       string `db:"action"`
+	ReactionID   int64  `db:"reaction_id"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type ReactionModerationLog struct {
+	ID         int64  `json:"id"`
+	Actor      User   `json:"actor"`
+	Action     string `json:"action"`
+	ReactionID int64  `json:"reaction_id"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// recordModerationActions は対象のリアクションごとに1行ずつ操作を記録する
+func recordModerationActions(ctx context.Context, tx *sqlx.Tx, livestreamID int64, actorID int64, action string, reactionIDs []int64) error {
+	now := time.Now().Unix()
+	for _, reactionID := range reactionIDs {
+		logModel := ReactionModerationLogModel{
+			LivestreamID: livestreamID,
+			ActorID:      actorID,
+			Action:       action,
+			ReactionID:   reactionID,
+			CreatedAt:    now,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO reaction_moderation_log (livestream_id, actor_id, action, reaction_id, created_at) VALUES (:livestream_id, :actor_id, :action, :reaction_id, :created_at)", logModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert moderation log: "+err.Error())
+		}
+	}
+	return nil
+}
+
+// モデレーション履歴取得API (配信者向け)
+// GET /api/livestream/:livestream_id/reactions/moderation-log?limit=
+func getReactionModerationLogHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM reaction_moderation_log WHERE livestream_id = ? ORDER BY id DESC"
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		if limit > moderationLogMaxLimit {
+			limit = moderationLogMaxLimit
+		}
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	logModels := []ReactionModerationLogModel{}
+	if err := tx.SelectContext(ctx, &logModels, query, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get moderation log: "+err.Error())
+	}
+
+	actorIDs := make([]int64, 0, len(logModels))
+	for _, logModel := range logModels {
+		actorIDs = append(actorIDs, logModel.ActorID)
+	}
+	actors := map[int64]User{}
+	if len(actorIDs) > 0 {
+		actors, err = fillUserResponses(ctx, tx, actorIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	logs := make([]ReactionModerationLog, len(logModels))
+	for i, logModel := range logModels {
+		logs[i] = ReactionModerationLog{
+			ID:         logModel.ID,
+			Actor:      actors[logModel.ActorID],
+			Action:     logModel.Action,
+			ReactionID: logModel.ReactionID,
+			CreatedAt:  logModel.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, logs)
+}
+
+// moderateReaction は配信者として配信のリアクション1件に update を適用し、その操作を記録する
+// update の最後のプレースホルダにはリアクションのIDが入る
+// 他の配信のリアクションや削除済みのリアクションは 404 を返す。skip を満たすリアクションは更新も記録もしない
+func moderateReaction(c echo.Context, action string, skip func(ReactionModel) bool, update string, args ...interface{}) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	reactionID, err := strconv.Atoi(c.Param("reaction_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "reaction_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	var reactionModel ReactionModel
+	if err := tx.GetContext(ctx, &reactionModel, "SELECT * FROM reactions WHERE id = ? AND livestream_id = ? AND deleted_at = 0 FOR UPDATE", reactionID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "reaction not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction: "+err.Error())
+	}
+	if skip == nil || !skip(reactionModel) {
+		if _, err := tx.ExecContext(ctx, update, append(args, reactionID)...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to moderate reaction: "+err.Error())
+		}
+		if err := recordModerationActions(ctx, tx, int64(livestreamID), userID, action, []int64{int64(reactionID)}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// リアクションの非表示API (配信者向け)
+// PUT /api/livestream/:livestream_id/reactions/:reaction_id/hidden
+// 非表示にしたリアクションは投稿者を含め誰の一覧や集計にも出てこない。非表示済みの場合は何も記録しない
+func putReactionHiddenHandler(c echo.Context) error {
+	return moderateReaction(c, moderationActionHide, func(reactionModel ReactionModel) bool {
+		return reactionModel.Hidden
+	}, "UPDATE reactions SET hidden = TRUE WHERE id = ?")
+}
+
+// リアクションの削除API (配信者向け)
+// DELETE /api/livestream/:livestream_id/reactions/:reaction_id
+// 投稿者による取り消しと同じく行は残し、deleted_at を入れて以降の読み出しから除く
+func deleteModeratedReactionHandler(c echo.Context) error {
+	return moderateReaction(c, moderationActionDelete, nil, "UPDATE reactions SET deleted_at = ? WHERE id = ?", time.Now().Unix())
+}
+
+type ReactionShadowBan struct {
+	UserID    int64 `json:"user_id"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+// purgeNGWordReactions は絵文字名に NG ワードを含む配信のリアクションを削除し、その操作を記録する
+// ライブコメントと違ってリアクションは行を残し、deleted_at を入れて以降の読み出しから除く
+func purgeNGWordReactions(ctx context.Context, tx *sqlx.Tx, livestreamID int64, actorID int64, word string) error {
+	// 空文字列はすべての絵文字名に含まれるので、何も削除しない
+	if word == "" {
+		return nil
+	}
+
+	var reactionIDs []int64
+	if err := tx.SelectContext(ctx, &reactionIDs, "SELECT id FROM reactions WHERE livestream_id = ? AND deleted_at = 0 AND INSTR(emoji_name, ?) > 0 FOR UPDATE", livestreamID, word); err != nil {
+		return fmt.Errorf("failed to get reactions that hit the NG word: %w", err)
+	}
+	if len(reactionIDs) == 0 {
+		return nil
+	}
+
+	query, params, err := sqlx.In("UPDATE reactions SET deleted_at = ? WHERE id IN (?)", time.Now().Unix(), reactionIDs)
+	if err != nil {
+		return fmt.Errorf("failed to construct deleting reactions query: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+		return fmt.Errorf("failed to delete reactions that hit the NG word: %w", err)
+	}
+	return recordModerationActions(ctx, tx, livestreamID, actorID, moderationActionNGWordDelete, reactionIDs)
+}
+
+// verifyReactionNGWords は絵文字名が配信者の登録した NG ワードを含んでいれば 400 を返す
+func verifyReactionNGWords(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, emojiName string) error {
+	var hits int64
+	if err := tx.GetContext(ctx, &hits, "SELECT COUNT(*) FROM ng_words WHERE user_id = ? AND livestream_id = ? AND word <> '' AND INSTR(?, word) > 0", livestreamModel.UserID, livestreamModel.ID, emojiName); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	}
+	if hits > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the emoji contains an NG word of this livestream")
+	}
+	return nil
+}
+
+// isReactionShadowBanned はユーザがこの配信でリアクションをシャドウバンされているかを返す
+func isReactionShadowBanned(ctx context.Context, tx *sqlx.Tx, livestreamID int64, userID int64) (bool, error) {
+	var banned int64
+	if err := tx.GetContext(ctx, &banned, "SELECT COUNT(*) FROM reaction_shadow_bans WHERE livestream_id = ? AND user_id = ?", livestreamID, userID); err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get shadow ban: "+err.Error())
+	}
+	return banned > 0, nil
+}
+
+// リアクションのシャドウバン設定API (配信者向け)
+// PUT /api/livestream/:livestream_id/reactions/shadow-bans/:user_id
+// 以降そのユーザのリアクションは投稿に成功したように見えるが、本人以外には表示されず集計にも含まれない
+func putReactionShadowBanHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	targetUserID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	var targetCount int64
+	if err := tx.GetContext(ctx, &targetCount, "SELECT COUNT(*) FROM users WHERE id = ?", targetUserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if targetCount == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+
+	// 設定済みの場合は、最初に設定した日時のまま残す
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO reaction_shadow_bans (livestream_id, user_id, created_at) VALUES (?, ?, ?)", livestreamID, targetUserID, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert shadow ban: "+err.Error())
+	}
+
+	var ban ReactionShadowBan
+	if err := tx.GetContext(ctx, &ban.CreatedAt, "SELECT created_at FROM reaction_shadow_bans WHERE livestream_id = ? AND user_id = ?", livestreamID, targetUserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get shadow ban: "+err.Error())
+	}
+	ban.UserID = int64(targetUserID)
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, ban)
+}
+
+// リアクションのシャドウバン解除API (配信者向け)
+// DELETE /api/livestream/:livestream_id/reactions/shadow-bans/:user_id
+// 解除前に投稿されたリアクションは、解除後も本人以外には表示されない
+func deleteReactionShadowBanHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	targetUserID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reaction_shadow_bans WHERE livestream_id = ? AND user_id = ?", livestreamID, targetUserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete shadow ban: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
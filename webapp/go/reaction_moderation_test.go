@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+func getTestModerationLog(t *testing.T, user testUser, livestreamID int64) []ReactionModerationLog {
+	t.Helper()
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reactions/moderation-log", livestreamID), user.Cookie, nil)
+	var logs []ReactionModerationLog
+	decodeTestResponse(t, rec, http.StatusOK, &logs)
+	return logs
+}
+
+func TestReactionModerationLog(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	now := time.Now().Unix()
+	pendingIDs := []int64{
+		newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now, Pending: true}),
+		newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "tada", CreatedAt: now, Pending: true}),
+	}
+	ngID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: "badword", CreatedAt: now})
+
+	// 承認したリアクションごとに1行残す
+	approvePath := fmt.Sprintf("/api/livestream/%d/reactions/approve", livestreamID)
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, approvePath, owner.Cookie, &ApproveReactionsRequest{ReactionIDs: pendingIDs}), http.StatusOK, nil)
+	logs := getTestModerationLog(t, owner, livestreamID)
+	if len(logs) != len(pendingIDs) {
+		t.Fatalf("after approve: got %d log rows, want %d", len(logs), len(pendingIDs))
+	}
+	var loggedIDs []int64
+	for _, log := range logs {
+		if log.Action != moderationActionApprove || log.Actor.ID != owner.ID {
+			t.Fatalf("after approve: got %+v, want an approval by the owner", log)
+		}
+		loggedIDs = append(loggedIDs, log.ReactionID)
+	}
+	sort.Slice(loggedIDs, func(i, j int) bool { return loggedIDs[i] < loggedIDs[j] })
+	if fmt.Sprint(loggedIDs) != fmt.Sprint(pendingIDs) {
+		t.Fatalf("after approve: logged %v, want %v", loggedIDs, pendingIDs)
+	}
+
+	// 何も承認しなかった操作は残さない
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, approvePath, owner.Cookie, &ApproveReactionsRequest{ReactionIDs: pendingIDs}), http.StatusOK, nil)
+	if got := len(getTestModerationLog(t, owner, livestreamID)); got != len(pendingIDs) {
+		t.Fatalf("after approving again: got %d log rows, want %d", got, len(pendingIDs))
+	}
+
+	// NGワードで削除したリアクションも1行ずつ残す
+	moderatePath := fmt.Sprintf("/api/livestream/%d/moderate", livestreamID)
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, moderatePath, owner.Cookie, &ModerateRequest{NGWord: "bad"}), http.StatusCreated, nil)
+	logs = getTestModerationLog(t, owner, livestreamID)
+	if len(logs) != len(pendingIDs)+1 {
+		t.Fatalf("after moderate: got %d log rows, want %d", len(logs), len(pendingIDs)+1)
+	}
+	if latest := logs[0]; latest.Action != moderationActionNGWordDelete || latest.ReactionID != ngID {
+		t.Fatalf("after moderate: got %+v, want the NG word deletion of %d", latest, ngID)
+	}
+
+	// 履歴は配信者だけが見られる
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reactions/moderation-log", livestreamID), viewer.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusForbidden, nil)
+}
+
+func TestReactionModerationLogLimit(t *testing.T) {
+	resetTestDB(t)
+	orig := moderationLogMaxLimit
+	moderationLogMaxLimit = 2
+	t.Cleanup(func() { moderationLogMaxLimit = orig })
+
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	now := time.Now().Unix()
+	var pendingIDs []int64
+	for i := 0; i < 3; i++ {
+		pendingIDs = append(pendingIDs, newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now, Pending: true}))
+	}
+	approvePath := fmt.Sprintf("/api/livestream/%d/reactions/approve", livestreamID)
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, approvePath, owner.Cookie, &ApproveReactionsRequest{ReactionIDs: pendingIDs}), http.StatusOK, nil)
+
+	path := fmt.Sprintf("/api/livestream/%d/reactions/moderation-log", livestreamID)
+	for query, want := range map[string]int{
+		"":                3,
+		"limit=1":         1,
+		"limit=100000000": 2,
+	} {
+		var logs []ReactionModerationLog
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, path+"?"+query, owner.Cookie, nil), http.StatusOK, &logs)
+		if len(logs) != want {
+			t.Errorf("%q: got %d log rows, want %d", query, len(logs), want)
+		}
+	}
+
+	for _, limit := range []string{"0", "-1", "abc"} {
+		if rec := doTestRequest(t, http.MethodGet, path+"?limit="+limit, owner.Cookie, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("limit=%s: got status %d, want 400", limit, rec.Code)
+		}
+	}
+}
+
+func TestModerateReaction(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, viewer.ID, "other", 0, 1)
+	now := time.Now().Unix()
+	hiddenID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+	deletedID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+	keptID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+	otherID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: otherLivestreamID, EmojiName: ":tada:", CreatedAt: now})
+	hidePath := func(reactionID int64) string {
+		return fmt.Sprintf("/api/livestream/%d/reactions/%d/hidden", livestreamID, reactionID)
+	}
+	deletePath := func(reactionID int64) string {
+		return fmt.Sprintf("/api/livestream/%d/reactions/%d", livestreamID, reactionID)
+	}
+
+	// 配信者以外は操作できない
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, hidePath(hiddenID), viewer.Cookie, nil), http.StatusForbidden, nil)
+	decodeTestResponse(t, doTestRequest(t, http.MethodDelete, deletePath(deletedID), viewer.Cookie, nil), http.StatusForbidden, nil)
+
+	// 非表示にしたものは投稿者にも見えず、削除したものは deleted_at が入る
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, hidePath(hiddenID), owner.Cookie, nil), http.StatusNoContent, nil)
+	decodeTestResponse(t, doTestRequest(t, http.MethodDelete, deletePath(deletedID), owner.Cookie, nil), http.StatusNoContent, nil)
+	for _, user := range []testUser{owner, viewer} {
+		if got := reactionIDs(getTestReactions(t, user, livestreamID, "")); fmt.Sprint(got) != fmt.Sprint([]int64{keptID}) {
+			t.Fatalf("%s: got reactions %v, want only %d", user.Name, got, keptID)
+		}
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions WHERE id = ? AND hidden AND deleted_at = 0", hiddenID); got != 1 {
+		t.Fatalf("reaction %d was not hidden", hiddenID)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions WHERE id = ? AND deleted_at > 0", deletedID); got != 1 {
+		t.Fatalf("reaction %d was not deleted", deletedID)
+	}
+
+	// 操作ごとに1行残し、非表示済みのものをもう一度非表示にしても残さない
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, hidePath(hiddenID), owner.Cookie, nil), http.StatusNoContent, nil)
+	logs := getTestModerationLog(t, owner, livestreamID)
+	if len(logs) != 2 {
+		t.Fatalf("got %d log rows, want 2: %+v", len(logs), logs)
+	}
+	if logs[0].Action != moderationActionDelete || logs[0].ReactionID != deletedID || logs[1].Action != moderationActionHide || logs[1].ReactionID != hiddenID {
+		t.Fatalf("got log %+v, want the deletion of %d after hiding %d", logs, deletedID, hiddenID)
+	}
+	for _, log := range logs {
+		if log.Actor.ID != owner.ID {
+			t.Fatalf("got actor %d, want the owner %d", log.Actor.ID, owner.ID)
+		}
+	}
+
+	// 削除済みや他の配信のリアクションは存在しないものとして扱う
+	for _, path := range []string{deletePath(deletedID), deletePath(otherID), deletePath(999999)} {
+		decodeTestResponse(t, doTestRequest(t, http.MethodDelete, path, owner.Cookie, nil), http.StatusNotFound, nil)
+	}
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, hidePath(otherID), owner.Cookie, nil), http.StatusNotFound, nil)
+}
+
+func TestReactionShadowBan(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	troll := newTestUser(t, "troll")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	banPath := fmt.Sprintf("/api/livestream/%d/reactions/shadow-bans/%d", livestreamID, troll.ID)
+
+	// 配信者だけが設定できる
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, banPath, viewer.Cookie, nil), http.StatusForbidden, nil)
+	var ban ReactionShadowBan
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, banPath, owner.Cookie, nil), http.StatusOK, &ban)
+	if ban.UserID != troll.ID {
+		t.Fatalf("got %+v, want a ban of user %d", ban, troll.ID)
+	}
+
+	// 投稿は成功したように見える
+	var banned Reaction
+	decodeTestResponse(t, postTestReaction(t, troll, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}), http.StatusCreated, &banned)
+
+	// 本人には見えるが、他の人の一覧や集計には出てこない
+	if got := reactionIDs(getTestReactions(t, troll, livestreamID, "")); fmt.Sprint(got) != fmt.Sprint([]int64{banned.ID}) {
+		t.Fatalf("troll: got %v, want own reaction %d", got, banned.ID)
+	}
+	for _, user := range []testUser{owner, viewer} {
+		if got := getTestReactions(t, user, livestreamID, ""); len(got) != 0 {
+			t.Fatalf("%s: got %v, want no reactions", user.Name, reactionIDs(got))
+		}
+	}
+	var summary []ReactionSummaryEntry
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reactions/summary", livestreamID), owner.Cookie, nil), http.StatusOK, &summary)
+	if len(summary) != 0 {
+		t.Fatalf("summary: got %+v, want empty", summary)
+	}
+
+	// 解除した後のリアクションは全員に見えるが、解除前のものは本人以外には見えないまま
+	decodeTestResponse(t, doTestRequest(t, http.MethodDelete, banPath, owner.Cookie, nil), http.StatusOK, nil)
+	var unbanned Reaction
+	decodeTestResponse(t, postTestReaction(t, troll, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}), http.StatusCreated, &unbanned)
+	if got := reactionIDs(getTestReactions(t, viewer, livestreamID, "")); fmt.Sprint(got) != fmt.Sprint([]int64{unbanned.ID}) {
+		t.Fatalf("viewer after unban: got %v, want only %d", got, unbanned.ID)
+	}
+}
+
+func TestNGWordReactions(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, owner.ID, "other stream", 0, 1)
+	now := time.Now().Unix()
+	hitID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":badword:", CreatedAt: now})
+	keptID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+	otherID := newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: otherLivestreamID, EmojiName: ":badword:", CreatedAt: now})
+
+	moderatePath := fmt.Sprintf("/api/livestream/%d/moderate", livestreamID)
+	decodeTestResponse(t, doTestRequest(t, http.MethodPost, moderatePath, owner.Cookie, &ModerateRequest{NGWord: "bad"}), http.StatusCreated, nil)
+
+	// 登録した配信の、NGワードを含むリアクションだけを取り消す
+	if got := reactionIDs(getTestReactions(t, viewer, livestreamID, "")); fmt.Sprint(got) != fmt.Sprint([]int64{keptID}) {
+		t.Fatalf("after moderate: got reactions %v, want only %d", got, keptID)
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions WHERE id = ? AND deleted_at > 0", hitID); got != 1 {
+		t.Fatalf("reaction %d was not deleted", hitID)
+	}
+	if got := reactionIDs(getTestReactions(t, viewer, otherLivestreamID, "")); fmt.Sprint(got) != fmt.Sprint([]int64{otherID}) {
+		t.Fatalf("other livestream: got reactions %v, want %d", got, otherID)
+	}
+
+	// 以降の投稿は断る
+	if rec := postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: ":notbad:"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("post with the NG word: got status %d, want 400", rec.Code)
+	}
+	if rec := postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: ":heart:"}); rec.Code != http.StatusCreated {
+		t.Fatalf("post without the NG word: got status %d, want 201: %s", rec.Code, rec.Body.String())
+	}
+	if rec := postTestReaction(t, viewer, otherLivestreamID, &PostReactionRequest{EmojiName: ":notbad:"}); rec.Code != http.StatusCreated {
+		t.Fatalf("post to the other livestream: got status %d, want 201: %s", rec.Code, rec.Body.String())
+	}
+}
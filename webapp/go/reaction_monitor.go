@@ -0,0 +1,142 @@
+package main
+
+// 配信ごとの秒間リアクション数をメモリ上で集計する
+// 直近 reactionRateWindowSeconds 秒を1秒ごとのバケットで持ち、古いバケットは自然に捨てられる
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	reactionRateWindowSeconds = 10
+	// これ以上の配信を追跡する場合は、最も古くに更新された配信から捨てる
+	maxMonitoredLivestreams = 10000
+)
+
+type reactionRateBucket struct {
+	second int64
+	count  int64
+}
+
+type reactionRateWindow struct {
+	buckets    [reactionRateWindowSeconds]reactionRateBucket
+	peak       float64
+	lastUpdate int64
+}
+
+func (w *reactionRateWindow) add(now int64) {
+	bucket := &w.buckets[now%reactionRateWindowSeconds]
+	if bucket.second != now {
+		bucket.second = now
+		bucket.count = 0
+	}
+	bucket.count++
+	w.lastUpdate = now
+
+	if rate := w.rate(now); rate > w.peak {
+		w.peak = rate
+	}
+}
+
+func (w *reactionRateWindow) rate(now int64) float64 {
+	var total int64
+	for _, bucket := range w.buckets {
+		if bucket.second > now-reactionRateWindowSeconds && bucket.second <= now {
+			total += bucket.count
+		}
+	}
+	return float64(total) / reactionRateWindowSeconds
+}
+
+type reactionMonitor struct {
+	mu      sync.Mutex
+	windows map[int64]*reactionRateWindow
+}
+
+var reactionRates = newReactionMonitor()
+
+func newReactionMonitor() *reactionMonitor {
+	return &reactionMonitor{
+		windows: make(map[int64]*reactionRateWindow),
+	}
+}
+
+func (m *reactionMonitor) record(livestreamID int64, at time.Time) {
+	now := at.Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.windows[livestreamID]
+	if !ok {
+		if len(m.windows) >= maxMonitoredLivestreams {
+			m.evictOldestLocked()
+		}
+		w = &reactionRateWindow{}
+		m.windows[livestreamID] = w
+	}
+	w.add(now)
+}
+
+// rate は現在の秒間リアクション数と、これまでの最大値を返す
+func (m *reactionMonitor) rate(livestreamID int64, at time.Time) (float64, float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.windows[livestreamID]
+	if !ok {
+		return 0, 0
+	}
+	return w.rate(at.Unix()), w.peak
+}
+
+// peaks は配信ごとの秒間リアクション数の最大値を返す
+func (m *reactionMonitor) peaks() map[int64]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peaks := make(map[int64]float64, len(m.windows))
+	for id, w := range m.windows {
+		peaks[id] = w.peak
+	}
+	return peaks
+}
+
+// restorePeak は保存しておいた最大値を復元する。既に記録されている値の方が大きい場合はそちらを残す
+func (m *reactionMonitor) restorePeak(livestreamID int64, peak float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.windows[livestreamID]
+	if !ok {
+		if len(m.windows) >= maxMonitoredLivestreams {
+			m.evictOldestLocked()
+		}
+		w = &reactionRateWindow{}
+		m.windows[livestreamID] = w
+	}
+	if peak > w.peak {
+		w.peak = peak
+	}
+}
+
+func (m *reactionMonitor) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.windows = make(map[int64]*reactionRateWindow)
+}
+
+func (m *reactionMonitor) evictOldestLocked() {
+	var (
+		oldestID int64
+		oldest   int64 = -1
+	)
+	for id, w := range m.windows {
+		if oldest < 0 || w.lastUpdate < oldest {
+			oldestID = id
+			oldest = w.lastUpdate
+		}
+	}
+	delete(m.windows, oldestID)
+}
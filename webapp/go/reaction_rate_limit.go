@@ -0,0 +1,208 @@
+package main
+
+// ユーザごとのリアクション投稿数の制限
+// 固定長の窓ごとに投稿数を数え、上限を超えたら 429 を返す
+// 既定ではプロセス内で数えるが、複数台で動かす場合は Redis で数えることで全台合計の上限にできる
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	reactionRateLimitEnvKey       = "ISUCON13_REACTION_RATE_LIMIT"
+	reactionRateLimitWindowEnvKey = "ISUCON13_REACTION_RATE_LIMIT_WINDOW_SECONDS"
+	reactionRateLimitRedisEnvKey  = "ISUCON13_REACTION_RATE_LIMIT_REDIS_ADDR"
+
+	// Redis が応答しないときに、投稿を待たせる上限
+	reactionRateLimitRedisTimeout = 100 * time.Millisecond
+)
+
+var (
+	// 窓あたりにユーザが投稿できるリアクション数。0 の場合は制限しない
+	reactionRateLimit       int64
+	reactionRateLimitWindow = 10 * time.Second
+
+	reactionRateLimiter rateLimitStore = newMemoryRateLimitStore()
+)
+
+// rateLimitStore は窓ごとの投稿数を数える
+type rateLimitStore interface {
+	// increment は key の now を含む窓での件数を1増やし、増やした後の件数を返す
+	increment(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error)
+	// peek は key の now を含む窓での件数を、増やさずに返す
+	peek(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error)
+	reset()
+}
+
+// loadReactionRateLimitConfig は環境変数から上限と窓の長さ、カウンタの保存先を読み込む
+func loadReactionRateLimitConfig() error {
+	if v, ok := os.LookupEnv(reactionRateLimitEnvKey); ok {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("environment variable '%s' must be non-negative integer", reactionRateLimitEnvKey)
+		}
+		reactionRateLimit = limit
+	}
+	if v, ok := os.LookupEnv(reactionRateLimitWindowEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("environment variable '%s' must be positive integer", reactionRateLimitWindowEnvKey)
+		}
+		reactionRateLimitWindow = time.Duration(seconds) * time.Second
+	}
+	if addr, ok := os.LookupEnv(reactionRateLimitRedisEnvKey); ok {
+		reactionRateLimiter = &redisRateLimitStore{
+			client: redis.NewClient(&redis.Options{Addr: addr}),
+		}
+	}
+	return nil
+}
+
+// checkReactionRateLimit はユーザが窓あたりの上限を超えていれば 429 を返す
+// カウンタの保存先が使えないときは、リアクションを止めないよう警告を出して通す
+func checkReactionRateLimit(c echo.Context, userID int64, now time.Time) error {
+	if reactionRateLimit <= 0 {
+		return nil
+	}
+
+	count, err := reactionRateLimiter.increment(c.Request().Context(), reactionRateLimitKey(userID), now, reactionRateLimitWindow)
+	if err != nil {
+		log.Printf("failed to count reactions for rate limit, allowing the reaction: %+v", err)
+		return nil
+	}
+	return reactionRateLimitResult(c, count, now)
+}
+
+// peekReactionRateLimit は投稿数を数えずに、次の1件が上限を超えるかどうかを checkReactionRateLimit と同じ形で返す
+// dry_run=true の検証で使う
+func peekReactionRateLimit(c echo.Context, userID int64, now time.Time) error {
+	if reactionRateLimit <= 0 {
+		return nil
+	}
+
+	count, err := reactionRateLimiter.peek(c.Request().Context(), reactionRateLimitKey(userID), now, reactionRateLimitWindow)
+	if err != nil {
+		log.Printf("failed to count reactions for rate limit, allowing the reaction: %+v", err)
+		return nil
+	}
+	return reactionRateLimitResult(c, count+1, now)
+}
+
+func reactionRateLimitKey(userID int64) string {
+	return "reaction_rate_limit:" + strconv.FormatInt(userID, 10)
+}
+
+// reactionRateLimitResult は窓での件数が count になる投稿が上限を超えていれば、Retry-After を付けて 429 を返す
+func reactionRateLimitResult(c echo.Context, count int64, now time.Time) error {
+	if count <= reactionRateLimit {
+		return nil
+	}
+
+	windowSeconds := int64(reactionRateLimitWindow / time.Second)
+	wait := windowSeconds - now.Unix()%windowSeconds
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+	return echo.NewHTTPError(http.StatusTooManyRequests, "too many reactions")
+}
+
+// windowStart は now を含む窓の開始時刻を UNIX 秒で返す
+// 全台で同じ窓を使うよう、起動時刻ではなく UNIX 時刻で区切る
+func windowStart(now time.Time, window time.Duration) int64 {
+	seconds := int64(window / time.Second)
+	return now.Unix() - now.Unix()%seconds
+}
+
+// memoryRateLimitStore はプロセス内で数える。台数分だけ上限が緩くなる
+type memoryRateLimitStore struct {
+	mu     sync.Mutex
+	counts map[string]memoryRateLimitCount
+}
+
+type memoryRateLimitCount struct {
+	windowStart int64
+	count       int64
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		counts: make(map[string]memoryRateLimitCount),
+	}
+}
+
+func (s *memoryRateLimitStore) increment(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error) {
+	start := windowStart(now, window)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 古い窓のカウンタは、次に数えるときに捨てる
+	entry := s.counts[key]
+	if entry.windowStart != start {
+		entry = memoryRateLimitCount{windowStart: start}
+	}
+	entry.count++
+	s.counts[key] = entry
+	return entry.count, nil
+}
+
+func (s *memoryRateLimitStore) peek(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.counts[key]
+	if entry.windowStart != windowStart(now, window) {
+		return 0, nil
+	}
+	return entry.count, nil
+}
+
+func (s *memoryRateLimitStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts = make(map[string]memoryRateLimitCount)
+}
+
+// redisRateLimitStore は Redis の INCR で数える
+// キーに窓の開始時刻を含めるので、窓が変わると新しいキーになり、古いキーは有効期限で消える
+type redisRateLimitStore struct {
+	client *redis.Client
+}
+
+func (s *redisRateLimitStore) increment(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, reactionRateLimitRedisTimeout)
+	defer cancel()
+
+	windowKey := key + ":" + strconv.FormatInt(windowStart(now, window), 10)
+	pipe := s.client.TxPipeline()
+	incr := pipe.Incr(ctx, windowKey)
+	pipe.Expire(ctx, windowKey, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (s *redisRateLimitStore) peek(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, reactionRateLimitRedisTimeout)
+	defer cancel()
+
+	count, err := s.client.Get(ctx, key+":"+strconv.FormatInt(windowStart(now, window), 10)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return count, err
+}
+
+// reset は何もしない。他の台と共有しているカウンタなので、1台の初期化では消さない
+// 窓が変われば自然に数え直しになる
+func (s *redisRateLimitStore) reset() {}
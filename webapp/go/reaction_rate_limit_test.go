@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestContext() (echo.Context, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec), rec
+}
+
+func TestPeekReactionRateLimitDoesNotCount(t *testing.T) {
+	origLimit, origLimiter := reactionRateLimit, reactionRateLimiter
+	reactionRateLimit = 2
+	reactionRateLimiter = newMemoryRateLimitStore()
+	t.Cleanup(func() { reactionRateLimit, reactionRateLimiter = origLimit, origLimiter })
+
+	now := time.Unix(1700000000, 0)
+	// 何度検証しても投稿数は増えない
+	for i := 0; i < 5; i++ {
+		c, _ := newTestContext()
+		if err := peekReactionRateLimit(c, 1, now); err != nil {
+			t.Fatalf("peek %d: %v", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		c, _ := newTestContext()
+		if err := checkReactionRateLimit(c, 1, now); err != nil {
+			t.Fatalf("check %d: %v", i, err)
+		}
+	}
+
+	// 上限に達した後の検証は、投稿と同じく 429 と Retry-After を返す
+	c, rec := newTestContext()
+	var he *echo.HTTPError
+	if err := peekReactionRateLimit(c, 1, now); !errors.As(err, &he) || he.Code != http.StatusTooManyRequests {
+		t.Fatalf("peek after limit: got %v, want 429", err)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("Retry-After not set")
+	}
+	if count, _ := reactionRateLimiter.peek(c.Request().Context(), reactionRateLimitKey(1), now, reactionRateLimitWindow); count != 2 {
+		t.Fatalf("count = %d, want 2", count)
+	}
+}
+
+func TestReactionBucketPeekDoesNotTakeTokens(t *testing.T) {
+	limiter := newReactionBucketLimiter()
+	key := reactionBucketKey{userID: 1, livestreamID: 1}
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 5; i++ {
+		if _, ok := limiter.peek(key, now, 1, 2); !ok {
+			t.Fatalf("peek %d limited", i)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := limiter.take(key, now, 1, 2); !ok {
+			t.Fatalf("take %d limited", i)
+		}
+	}
+	wait, ok := limiter.peek(key, now, 1, 2)
+	if ok || wait <= 0 {
+		t.Fatalf("peek after burst: got %v, %v, want limited with positive wait", wait, ok)
+	}
+}
+
+func TestReactionDryRunResultReportsThrottle(t *testing.T) {
+	c, rec := newTestContext()
+	err := reactionDryRunResult(c, false, echo.NewHTTPError(http.StatusServiceUnavailable, "throttled"))
+	if err != nil {
+		t.Fatalf("got error %v, want a dry run response", err)
+	}
+	var res ReactionDryRunResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.WouldSucceed || res.Status != http.StatusServiceUnavailable {
+		t.Fatalf("got %+v, want would_succeed=false status=503", res)
+	}
+
+	c, _ = newTestContext()
+	if err := reactionDryRunResult(c, false, echo.NewHTTPError(http.StatusInternalServerError, "boom")); err == nil {
+		t.Fatalf("500 was turned into a dry run response")
+	}
+}
+
+func TestRedisRateLimitStoreSharedAcrossInstances(t *testing.T) {
+	server := startFakeRedis(t)
+	// 2台のサーバがそれぞれ Redis に接続している
+	stores := []*redisRateLimitStore{
+		{client: redis.NewClient(&redis.Options{Addr: server.addr()})},
+		{client: redis.NewClient(&redis.Options{Addr: server.addr()})},
+	}
+	ctx := context.Background()
+	now := time.Unix(1700000005, 0)
+	window := 10 * time.Second
+
+	for i, store := range []*redisRateLimitStore{stores[0], stores[1], stores[0]} {
+		count, err := store.increment(ctx, "key", now, window)
+		if err != nil {
+			t.Fatalf("increment %d: %v", i, err)
+		}
+		if count != int64(i+1) {
+			t.Fatalf("increment %d: got %d, want %d", i, count, i+1)
+		}
+	}
+	if count, err := stores[1].peek(ctx, "key", now, window); err != nil || count != 3 {
+		t.Fatalf("peek: got %d, %v, want 3", count, err)
+	}
+	// 窓ごとのキーには、窓の長さの有効期限を付ける
+	if ttl := server.ttl("key:1700000000"); ttl != window {
+		t.Fatalf("ttl = %v, want %v", ttl, window)
+	}
+
+	// 次の窓は数え直す
+	next := now.Add(window)
+	if count, err := stores[0].peek(ctx, "key", next, window); err != nil || count != 0 {
+		t.Fatalf("peek in the next window: got %d, %v, want 0", count, err)
+	}
+	if count, err := stores[1].increment(ctx, "key", next, window); err != nil || count != 1 {
+		t.Fatalf("increment in the next window: got %d, %v, want 1", count, err)
+	}
+}
+
+func TestReactionRateLimitWithRedis(t *testing.T) {
+	server := startFakeRedis(t)
+	origLimit, origLimiter := reactionRateLimit, reactionRateLimiter
+	t.Cleanup(func() { reactionRateLimit, reactionRateLimiter = origLimit, origLimiter })
+	reactionRateLimit = 2
+	reactionRateLimiter = &redisRateLimitStore{client: redis.NewClient(&redis.Options{Addr: server.addr()})}
+
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 2; i++ {
+		c, _ := newTestContext()
+		if err := checkReactionRateLimit(c, 1, now); err != nil {
+			t.Fatalf("check %d: %v", i, err)
+		}
+	}
+	c, rec := newTestContext()
+	var he *echo.HTTPError
+	if err := checkReactionRateLimit(c, 1, now); !errors.As(err, &he) || he.Code != http.StatusTooManyRequests {
+		t.Fatalf("check after limit: got %v, want 429", err)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("Retry-After not set")
+	}
+
+	// Redis が落ちている間は、制限せずに通す
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+	reactionRateLimiter = &redisRateLimitStore{client: redis.NewClient(&redis.Options{Addr: downAddr, MaxRetries: -1})}
+	for i := 0; i < 3; i++ {
+		c, _ := newTestContext()
+		if err := checkReactionRateLimit(c, 1, now); err != nil {
+			t.Fatalf("check while redis is down %d: got %v, want allowed", i, err)
+		}
+		c, _ = newTestContext()
+		if err := peekReactionRateLimit(c, 1, now); err != nil {
+			t.Fatalf("peek while redis is down %d: got %v, want allowed", i, err)
+		}
+	}
+}
+
+func TestReactionStreamRateBurst(t *testing.T) {
+	resetTestDB(t)
+	origRate, origBurst, origBuckets := reactionStreamRate, reactionStreamBurst, reactionBuckets
+	// テスト中にトークンが補充されないよう、補充はごく遅くする
+	reactionStreamRate, reactionStreamBurst, reactionBuckets = 0.001, 3, newReactionBucketLimiter()
+	t.Cleanup(func() { reactionStreamRate, reactionStreamBurst, reactionBuckets = origRate, origBurst, origBuckets })
+
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, owner.ID, "other stream", 0, 1)
+
+	for i := 0; i < 3; i++ {
+		if rec := postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}); rec.Code != http.StatusCreated {
+			t.Fatalf("post %d: got status %d, want 201: %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	rec := postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: ":tada:"})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("post past the burst: got status %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("Retry-After not set")
+	}
+	if got := countTestRows(t, "SELECT COUNT(*) FROM reactions"); got != 3 {
+		t.Fatalf("got %d reactions, want 3", got)
+	}
+
+	// バケットはユーザと配信の組ごとにある
+	if rec := postTestReaction(t, viewer, otherLivestreamID, &PostReactionRequest{EmojiName: ":tada:"}); rec.Code != http.StatusCreated {
+		t.Fatalf("other livestream: got status %d, want 201", rec.Code)
+	}
+	if rec := postTestReaction(t, owner, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}); rec.Code != http.StatusCreated {
+		t.Fatalf("other user: got status %d, want 201", rec.Code)
+	}
+}
+
+func TestReactionBucketSweep(t *testing.T) {
+	limiter := newReactionBucketLimiter()
+	now := time.Unix(1700000000, 0)
+	idle := reactionBucketKey{userID: 1, livestreamID: 1}
+	busy := reactionBucketKey{userID: 2, livestreamID: 1}
+	limiter.take(idle, now, 1, 2)
+	// 掃除の直前に使い切ったバケットは、まだ補充されていない
+	for i := 0; i < 2; i++ {
+		limiter.take(busy, now.Add(reactionBucketSweepInterval-time.Second), 1, 2)
+	}
+
+	// 掃除の間隔が過ぎた後の take で、満タンまで補充されたバケットを捨てる
+	limiter.take(reactionBucketKey{userID: 3, livestreamID: 1}, now.Add(reactionBucketSweepInterval), 1, 2)
+	if _, ok := limiter.buckets[idle]; ok {
+		t.Fatalf("idle bucket was not evicted")
+	}
+	if _, ok := limiter.buckets[busy]; !ok {
+		t.Fatalf("bucket that is still empty was evicted")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultReplayDurationSeconds = 60
+	maxReplayDurationSeconds     = 3600
+)
+
+type ReplayReaction struct {
+	Reaction
+	// 配信の開始からリアクションまでの秒数
+	Offset int64 `json:"offset"`
+}
+
+type ReactionReplayResponse struct {
+	Reactions []ReplayReaction `json:"reactions"`
+	// max_per_second に収めるため、リアクションを間引いたかどうか
+	Sampled bool `json:"sampled"`
+	// 範囲内のリアクションのうち、返したものの割合
+	SamplingRatio float64 `json:"sampling_ratio"`
+}
+
+// リアクションのリプレイAPI
+// GET /api/livestream/:livestream_id/reactions/replay?from=&duration=&speed=&max_per_second=
+// 配信開始から from 秒後の duration 秒間のリアクションを返す
+// speed 倍で再生したときの毎秒の件数が max_per_second を超える場合は間引く
+func getReactionReplayHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var from int64
+	if c.QueryParam("from") != "" {
+		from, err = strconv.ParseInt(c.QueryParam("from"), 10, 64)
+		if err != nil || from < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be non-negative integer")
+		}
+	}
+	var duration int64 = defaultReplayDurationSeconds
+	if c.QueryParam("duration") != "" {
+		duration, err = strconv.ParseInt(c.QueryParam("duration"), 10, 64)
+		if err != nil || duration <= 0 || duration > maxReplayDurationSeconds {
+			return echo.NewHTTPError(http.StatusBadRequest, "duration query parameter must be between 1 and "+strconv.Itoa(maxReplayDurationSeconds))
+		}
+	}
+	speed := 1.0
+	if c.QueryParam("speed") != "" {
+		speed, err = strconv.ParseFloat(c.QueryParam("speed"), 64)
+		if err != nil || speed <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "speed query parameter must be positive number")
+		}
+	}
+	var maxPerSecond int64
+	if c.QueryParam("max_per_second") != "" {
+		maxPerSecond, err = strconv.ParseInt(c.QueryParam("max_per_second"), 10, 64)
+		if err != nil || maxPerSecond <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "max_per_second query parameter must be positive integer")
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.StartAt <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the livestream has no start time")
+	}
+
+	windowStart := livestreamModel.StartAt + from
+	query := "SELECT * FROM reactions WHERE livestream_id = ? AND " + visibleReactionsWhere("") + " AND created_at >= ? AND created_at < ? ORDER BY created_at ASC, id ASC"
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID, windowStart, windowStart+duration); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+
+	resp := ReactionReplayResponse{
+		Reactions:     []ReplayReaction{},
+		SamplingRatio: 1,
+	}
+	if len(reactionModels) == 0 {
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	// speed 倍で再生すると、duration 秒分のリアクションが duration / speed 秒で流れる
+	scaledRate := float64(len(reactionModels)) * speed / float64(duration)
+	if maxPerSecond > 0 && scaledRate > float64(maxPerSecond) {
+		sampled := sampleReactionsByEmoji(reactionModels, float64(maxPerSecond)/scaledRate)
+		resp.Sampled = true
+		resp.SamplingRatio = float64(len(sampled)) / float64(len(reactionModels))
+		reactionModels = sampled
+	}
+
+	reactions, err := fillReactionResponses(ctx, tx, reactionModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	for i := range reactions {
+		resp.Reactions = append(resp.Reactions, ReplayReaction{
+			Reaction: reactions[i],
+			Offset:   reactionOffsetSeconds(reactionModels[i].CreatedAt, livestreamModel.StartAt),
+		})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// sampleReactionsByEmoji はリアクションを絵文字ごとに ratio の割合で等間隔に間引く
+// 絵文字ごとに数えるので、間引いた後も絵文字の比率はほぼ変わらない。並び順は保たれる
+func sampleReactionsByEmoji(reactionModels []ReactionModel, ratio float64) []ReactionModel {
+	// 四捨五入になるよう、絵文字ごとの累積値を0.5から始める
+	acc := make(map[string]float64)
+	sampled := make([]ReactionModel, 0, int(float64(len(reactionModels))*ratio)+1)
+	for _, reactionModel := range reactionModels {
+		v, ok := acc[reactionModel.EmojiName]
+		if !ok {
+			v = 0.5
+		}
+		v += ratio
+		if v >= 1 {
+			sampled = append(sampled, reactionModel)
+			v--
+		}
+		acc[reactionModel.EmojiName] = v
+	}
+	return sampled
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type ReactionSettingsModel struct {
+	LivestreamID         int64  `db:"livestream_id"`
+	CooldownSeconds      int64  `db:"cooldown_seconds"`
+	AllowedEmojis        string `db:"allowed_emojis"`
+	FollowersOnly        bool   `db:"followers_only"`
+	AllowOwnerReactions  bool   `db:"allow_owner_reactions"`
+	ModeratedEmojis      string `db:"moderated_emojis"`
+	MinAccountAgeSeconds int64  `db:"min_account_age_seconds"`
+}
+
+type ReactionSettings struct {
+	// 同じユーザがリアクションできる最短の間隔。0 の場合は制限しない
+	CooldownSeconds int64 `json:"cooldown_seconds"`
+	// 投稿できる絵文字。空の場合はすべての絵文字を許可する
+	AllowedEmojis       []string `json:"allowed_emojis"`
+	FollowersOnly       bool     `json:"followers_only"`
+	AllowOwnerReactions bool     `json:"allow_owner_reactions"`
+	// 配信者が承認するまで、承認待ちとして保存する絵文字
+	ModeratedEmojis []string `json:"moderated_emojis"`
+	// 登録からこの秒数が経っていないアカウントのリアクションは断る。0 の場合は制限しない
+	MinAccountAgeSeconds int64 `json:"min_account_age_seconds"`
+}
+
+// 設定が登録されていない配信に適用される設定
+var defaultReactionSettings = ReactionSettings{
+	CooldownSeconds:      0,
+	AllowedEmojis:        []string{},
+	FollowersOnly:        false,
+	AllowOwnerReactions:  true,
+	ModeratedEmojis:      []string{},
+	MinAccountAgeSeconds: 0,
+}
+
+// リアクション投稿のたびに設定を引かなくて済むよう、配信ごとの設定をキャッシュしておく
+// DBから読んだ値は、リクエストの開始時から設定が更新されていない場合だけ入れる (cache_snapshot.go を参照)
+type reactionSettingsCache struct {
+	mu         sync.RWMutex
+	settings   map[int64]reactionSettingsCacheEntry
+	generation uint64
+}
+
+type reactionSettingsCacheEntry struct {
+	settings  ReactionSettings
+	expiresAt time.Time
+}
+
+// キャッシュした設定を使う期間。他のプロセスで更新された設定も、この時間が経てば読み直す
+var reactionSettingsCacheTTL = 30 * time.Second
+
+var reactionSettingsStore = &reactionSettingsCache{
+	settings: make(map[int64]reactionSettingsCacheEntry),
+}
+
+func (c *reactionSettingsCache) get(livestreamID int64) (ReactionSettings, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.settings[livestreamID]
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		return ReactionSettings{}, false
+	}
+	return entry.settings, true
+}
+
+// currentGeneration はトランザクションを始める前に呼び、その値を fill に渡す
+func (c *reactionSettingsCache) currentGeneration() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.generation
+}
+
+// fill はDBから読んだ設定を入れる
+// generation を取得してから設定が更新されていた場合、読んだ値が古い可能性があるので入れない
+func (c *reactionSettingsCache) fill(livestreamID int64, settings ReactionSettings, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.settings[livestreamID] = reactionSettingsCacheEntry{settings: settings, expiresAt: time.Now().Add(reactionSettingsCacheTTL)}
+}
+
+// set は更新をコミットした後に呼び、設定を差し替える
+// 世代を進めるので、更新の前に読み始めた fill は捨てられる
+func (c *reactionSettingsCache) set(livestreamID int64, settings ReactionSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.settings[livestreamID] = reactionSettingsCacheEntry{settings: settings, expiresAt: time.Now().Add(reactionSettingsCacheTTL)}
+}
+
+func (c *reactionSettingsCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.settings = make(map[int64]reactionSettingsCacheEntry)
+}
+
+// allows と moderates は、isAllowedEmoji と同じく :Tada: と tada を同じ絵文字として比べる
+func (s ReactionSettings) allows(emojiName string) bool {
+	if len(s.AllowedEmojis) == 0 {
+		return true
+	}
+	return containsEmoji(s.AllowedEmojis, emojiName)
+}
+
+func (s ReactionSettings) moderates(emojiName string) bool {
+	return containsEmoji(s.ModeratedEmojis, emojiName)
+}
+
+func containsEmoji(emojiNames []string, emojiName string) bool {
+	emojiName = normalizeEmojiName(emojiName)
+	for _, name := range emojiNames {
+		if normalizeEmojiName(name) == emojiName {
+			return true
+		}
+	}
+	return false
+}
+
+// 配信のリアクション設定取得API
+// GET /api/livestream/:livestream_id/reaction-settings
+func getReactionSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	settings, err := getReactionSettings(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction settings: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+// 配信のリアクション設定更新API
+// PUT /api/livestream/:livestream_id/reaction-settings
+func putReactionSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req *ReactionSettings
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.CooldownSeconds < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "cooldown_seconds must not be negative")
+	}
+	if req.MinAccountAgeSeconds < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "min_account_age_seconds must not be negative")
+	}
+	for _, emojiName := range append(append([]string{}, req.AllowedEmojis...), req.ModeratedEmojis...) {
+		if emojiName == "" || strings.Contains(emojiName, ",") {
+			return echo.NewHTTPError(http.StatusBadRequest, "emoji names in reaction settings must be non-empty and must not contain ','")
+		}
+	}
+	if req.AllowedEmojis == nil {
+		req.AllowedEmojis = []string{}
+	}
+	if req.ModeratedEmojis == nil {
+		req.ModeratedEmojis = []string{}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	settingsModel := ReactionSettingsModel{
+		LivestreamID:         int64(livestreamID),
+		CooldownSeconds:      req.CooldownSeconds,
+		AllowedEmojis:        strings.Join(req.AllowedEmojis, ","),
+		FollowersOnly:        req.FollowersOnly,
+		AllowOwnerReactions:  req.AllowOwnerReactions,
+		ModeratedEmojis:      strings.Join(req.ModeratedEmojis, ","),
+		MinAccountAgeSeconds: req.MinAccountAgeSeconds,
+	}
+	query := `INSERT INTO reaction_settings (livestream_id, cooldown_seconds, allowed_emojis, followers_only, allow_owner_reactions, moderated_emojis, min_account_age_seconds)
+	VALUES (:livestream_id, :cooldown_seconds, :allowed_emojis, :followers_only, :allow_owner_reactions, :moderated_emojis, :min_account_age_seconds)
+	ON DUPLICATE KEY UPDATE cooldown_seconds = VALUES(cooldown_seconds), allowed_emojis = VALUES(allowed_emojis), followers_only = VALUES(followers_only),
+	allow_owner_reactions = VALUES(allow_owner_reactions), moderated_emojis = VALUES(moderated_emojis), min_account_age_seconds = VALUES(min_account_age_seconds)`
+	if _, err := tx.NamedExecContext(ctx, query, settingsModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save reaction settings: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// コミット後にキャッシュを差し替える
+	reactionSettingsStore.set(int64(livestreamID), *req)
+
+	return c.JSON(http.StatusOK, req)
+}
+
+// verifyLivestreamOwner は配信が存在し、userIDのユーザの配信であることを検証する
+func verifyLivestreamOwner(ctx context.Context, tx *sqlx.Tx, livestreamID int64, userID int64) error {
+	var ownerID int64
+	if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if ownerID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "only the owner of the livestream can access this resource")
+	}
+	return nil
+}
+
+// getReactionSettings はキャッシュを優先して配信のリアクション設定を返す
+// DBから読んだ値は、プライマリで読んだ場合だけキャッシュに入れる
+func getReactionSettings(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (ReactionSettings, error) {
+	if settings, ok := reactionSettingsStore.get(livestreamID); ok {
+		return settings, nil
+	}
+
+	fill := func(settings ReactionSettings) {
+		if snapshot, ok := cacheSnapshotFromContext(ctx); ok && !isReplicaRead(ctx) {
+			reactionSettingsStore.fill(livestreamID, settings, snapshot.reactionSettingsGeneration)
+		}
+	}
+
+	var settingsModel ReactionSettingsModel
+	if err := tx.GetContext(ctx, &settingsModel, "SELECT * FROM reaction_settings WHERE livestream_id = ?", livestreamID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return ReactionSettings{}, err
+		}
+		fill(defaultReactionSettings)
+		return defaultReactionSettings, nil
+	}
+
+	settings := ReactionSettings{
+		CooldownSeconds:      settingsModel.CooldownSeconds,
+		AllowedEmojis:        splitEmojiList(settingsModel.AllowedEmojis),
+		FollowersOnly:        settingsModel.FollowersOnly,
+		AllowOwnerReactions:  settingsModel.AllowOwnerReactions,
+		ModeratedEmojis:      splitEmojiList(settingsModel.ModeratedEmojis),
+		MinAccountAgeSeconds: settingsModel.MinAccountAgeSeconds,
+	}
+	fill(settings)
+	return settings, nil
+}
+
+func splitEmojiList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// enforceReactionSettings は配信のリアクション設定に従って投稿を検証する
+// 投稿可能な場合は、承認待ちとして保存すべきかどうかを返す
+func enforceReactionSettings(c echo.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64, emojiName string, now int64) (bool, error) {
+	ctx := c.Request().Context()
+
+	settings, err := getReactionSettings(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction settings: "+err.Error())
+	}
+
+	isOwner := livestreamModel.UserID == userID
+	if isOwner && !settings.AllowOwnerReactions {
+		return false, echo.NewHTTPError(http.StatusForbidden, "the owner can't react to this livestream")
+	}
+
+	if !settings.allows(emojiName) {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "the emoji is not allowed on this livestream")
+	}
+
+	if err := verifyReactionNGWords(ctx, tx, livestreamModel, emojiName); err != nil {
+		return false, err
+	}
+
+	if settings.FollowersOnly && !isOwner {
+		var follows int64
+		if err := tx.GetContext(ctx, &follows, "SELECT COUNT(*) FROM follows WHERE follower_id = ? AND followee_id = ?", userID, livestreamModel.UserID); err != nil {
+			return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get follows: "+err.Error())
+		}
+		if follows == 0 {
+			return false, echo.NewHTTPError(http.StatusForbidden, "only followers can react to this livestream")
+		}
+	}
+
+	if settings.MinAccountAgeSeconds > 0 && !isOwner {
+		var registeredAt int64
+		if err := tx.GetContext(ctx, &registeredAt, "SELECT created_at FROM users WHERE id = ?", userID); err != nil {
+			return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		if now-registeredAt < settings.MinAccountAgeSeconds {
+			return false, echo.NewHTTPError(http.StatusForbidden, "the account is too new to react to this livestream")
+		}
+	}
+
+	if settings.CooldownSeconds > 0 {
+		var lastReactedAt int64
+		if err := tx.GetContext(ctx, &lastReactedAt, "SELECT IFNULL(MAX(created_at), 0) FROM reactions WHERE user_id = ? AND livestream_id = ?", userID, livestreamModel.ID); err != nil {
+			return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last reaction: "+err.Error())
+		}
+		if wait := lastReactedAt + settings.CooldownSeconds - now; wait > 0 {
+			c.Response().Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+			return false, echo.NewHTTPError(http.StatusTooManyRequests, "reaction is in cooldown")
+		}
+	}
+
+	return settings.moderates(emojiName), nil
+}
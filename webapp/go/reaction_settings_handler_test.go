@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReactionSettingsCacheRejectsFillAfterUpdate(t *testing.T) {
+	cache := &reactionSettingsCache{settings: make(map[int64]reactionSettingsCacheEntry)}
+
+	// 読み始めた後に設定が更新され、コミットの後に差し替えられた
+	generation := cache.currentGeneration()
+	updated := ReactionSettings{CooldownSeconds: 10}
+	cache.set(1, updated)
+
+	// 更新前に読んだ値で上書きしない
+	cache.fill(1, ReactionSettings{CooldownSeconds: 0}, generation)
+	if settings, ok := cache.get(1); !ok || settings.CooldownSeconds != 10 {
+		t.Fatalf("got %+v, %v, want the updated settings", settings, ok)
+	}
+}
+
+func TestReactionSettingsAllowsNormalizedEmoji(t *testing.T) {
+	settings := ReactionSettings{AllowedEmojis: []string{":Tada:"}, ModeratedEmojis: []string{"heart"}}
+	for _, name := range []string{"tada", ":tada:", " :TADA: "} {
+		if !settings.allows(name) {
+			t.Errorf("allows(%q) = false, want true", name)
+		}
+	}
+	if settings.allows("smile") {
+		t.Errorf("allows(smile) = true, want false")
+	}
+	if !settings.moderates(":Heart:") {
+		t.Errorf("moderates(:Heart:) = false, want true")
+	}
+}
+
+func postTestReaction(t *testing.T, user testUser, livestreamID int64, req *PostReactionRequest, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	return doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/reaction", livestreamID), user.Cookie, req, header...)
+}
+
+func TestReactionSettingsHandlers(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	path := fmt.Sprintf("/api/livestream/%d/reaction-settings", livestreamID)
+
+	// 設定していない配信は既定の設定を返す
+	var settings ReactionSettings
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path, owner.Cookie, nil), http.StatusOK, &settings)
+	if !settings.AllowOwnerReactions || len(settings.AllowedEmojis) != 0 {
+		t.Fatalf("got %+v, want the default settings", settings)
+	}
+
+	// 配信者以外は読み書きできない
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path, viewer.Cookie, nil), http.StatusForbidden, nil)
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, path, viewer.Cookie, &ReactionSettings{}), http.StatusForbidden, nil)
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/livestream/999999/reaction-settings", owner.Cookie, nil), http.StatusNotFound, nil)
+
+	put := &ReactionSettings{AllowedEmojis: []string{":Tada:"}, AllowOwnerReactions: false}
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, path, owner.Cookie, put), http.StatusOK, nil)
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, path, owner.Cookie, &ReactionSettings{CooldownSeconds: -1}), http.StatusBadRequest, nil)
+
+	// キャッシュを捨てても、DBから同じ設定が読める
+	reactionSettingsStore.reset()
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path, owner.Cookie, nil), http.StatusOK, &settings)
+	if fmt.Sprint(settings.AllowedEmojis) != "[:Tada:]" || settings.AllowOwnerReactions {
+		t.Fatalf("got %+v, want the saved settings", settings)
+	}
+
+	// 許可した絵文字は表記が違っても投稿でき、それ以外は断られる
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}), http.StatusCreated, nil)
+	decodeTestResponse(t, postTestReaction(t, viewer, livestreamID, &PostReactionRequest{EmojiName: ":smile:"}), http.StatusBadRequest, nil)
+	decodeTestResponse(t, postTestReaction(t, owner, livestreamID, &PostReactionRequest{EmojiName: ":tada:"}), http.StatusForbidden, nil)
+}
+
+func TestReactionMinAccountAge(t *testing.T) {
+	resetTestDB(t)
+	const minAge = 3600
+	now := time.Now().Unix()
+	owner := newTestUserCreatedAt(t, "owner", now)
+	old := newTestUserCreatedAt(t, "old", now-minAge-100)
+	// ちょうど minAge 秒前に登録したアカウントは許可する
+	boundary := newTestUserCreatedAt(t, "boundary", now-minAge)
+	fresh := newTestUserCreatedAt(t, "fresh", now-minAge+5)
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	path := fmt.Sprintf("/api/livestream/%d/reaction-settings", livestreamID)
+	put := &ReactionSettings{AllowOwnerReactions: true, MinAccountAgeSeconds: minAge}
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, path, owner.Cookie, put), http.StatusOK, nil)
+
+	var wantIDs []int64
+	for _, user := range []testUser{fresh, boundary, old} {
+		id := newTestReaction(t, ReactionModel{UserID: user.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+		if user.ID != fresh.ID {
+			wantIDs = append([]int64{id}, wantIDs...)
+		}
+	}
+	// 一覧からは、登録して間もないアカウントのリアクションを除く
+	if got := reactionIDs(getTestReactions(t, old, livestreamID, "")); fmt.Sprint(got) != fmt.Sprint(wantIDs) {
+		t.Fatalf("reactions: got %v, want %v", got, wantIDs)
+	}
+
+	// 投稿は断る。配信者は登録したばかりでも投稿できる
+	req := &PostReactionRequest{EmojiName: ":tada:"}
+	decodeTestResponse(t, postTestReaction(t, old, livestreamID, req), http.StatusCreated, nil)
+	decodeTestResponse(t, postTestReaction(t, boundary, livestreamID, req), http.StatusCreated, nil)
+	decodeTestResponse(t, postTestReaction(t, fresh, livestreamID, req), http.StatusForbidden, nil)
+	decodeTestResponse(t, postTestReaction(t, owner, livestreamID, req), http.StatusCreated, nil)
+}
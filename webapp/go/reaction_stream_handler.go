@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// リアクションのリアルタイム配信API
+// GET /api/livestream/:livestream_id/reactions/ws?overflow=
+// overflow には受信が追いつかないときの振る舞い (drop-newest, drop-oldest, disconnect) を指定できる
+func getReactionsWebSocketHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	// 認証できないクライアントは、アップグレードする前に弾く
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	policy, err := parseReactionOverflowPolicy(c.QueryParam("overflow"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "overflow query parameter must be one of drop-newest, drop-oldest, disconnect")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+	// 配信者にリアクションを禁止されているユーザには、アップグレードする前に 403 を返す
+	banned, err := isReactionShadowBanned(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "you are banned from reacting to this livestream")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 上限に達していることをHTTPのステータスで返せるよう、アップグレードする前に購読する
+	sub, err := reactionBroadcaster.subscribe(int64(livestreamID), policy)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "failed to subscribe reactions: "+err.Error())
+	}
+	defer reactionBroadcaster.unsubscribe(int64(livestreamID), sub)
+
+	// 他のサイトのページから、ログイン中のユーザのCookieで接続されないよう、Originがこのアプリのものかを検証する
+	server := websocket.Server{
+		Handshake: checkReactionWebSocketOrigin,
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			// クライアントからのメッセージは使わないが、切断を検知するために読み続ける
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				io.Copy(io.Discard, ws)
+			}()
+
+			for {
+				select {
+				case msg := <-sub.ch:
+					if err := websocket.Message.Send(ws, string(msg)); err != nil {
+						return
+					}
+				case <-sub.kicked:
+					return
+				case <-closed:
+					return
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+var errCrossOriginWebSocket = errors.New("websocket origin does not match the host")
+
+// checkReactionWebSocketOrigin は Origin ヘッダのホストがリクエスト先のホストと一致する場合だけ接続を受け付ける
+// エラーを返すと、websocket.Server が 403 を返してアップグレードしない
+func checkReactionWebSocketOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil || !strings.EqualFold(origin.Host, req.Host) {
+		return errCrossOriginWebSocket
+	}
+	config.Origin = origin
+	return nil
+}
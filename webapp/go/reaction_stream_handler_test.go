@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+func TestReactionWebSocketRejectsUnauthenticatedBeforeUpgrade(t *testing.T) {
+	e := echo.New()
+	e.Use(session.Middleware(sessions.NewCookieStore(secret)))
+	e.GET("/api/livestream/:livestream_id/reactions/ws", getReactionsWebSocketHandler)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/livestream/1/reactions/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	// セッションのないリクエストは、他のAPIと同じく verifyUserSession が 401 か 403 で弾く
+	if rec.Code != http.StatusUnauthorized && rec.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, want 401 or 403 before upgrading", rec.Code)
+	}
+	if rec.Header().Get("Upgrade") != "" {
+		t.Fatalf("upgraded without a session")
+	}
+}
+
+func TestCheckReactionWebSocketOrigin(t *testing.T) {
+	tests := []struct {
+		origin  string
+		wantErr bool
+	}{
+		{origin: "https://pipe.u.isucon.dev", wantErr: false},
+		{origin: "https://PIPE.u.isucon.dev", wantErr: false},
+		{origin: "https://evil.example.com", wantErr: true},
+		{origin: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "https://pipe.u.isucon.dev/api/livestream/1/reactions/ws", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		config := &websocket.Config{Version: websocket.ProtocolVersionHybi13}
+		if err := checkReactionWebSocketOrigin(config, req); (err != nil) != tt.wantErr {
+			t.Errorf("origin %q: got error %v, want error %v", tt.origin, err, tt.wantErr)
+		}
+	}
+}
+
+func dialTestReactionWebSocket(t *testing.T, serverURL string, user testUser, livestreamID int64, origin string) (*websocket.Conn, error) {
+	t.Helper()
+	config, err := websocket.NewConfig(fmt.Sprintf("ws%s/api/livestream/%d/reactions/ws", strings.TrimPrefix(serverURL, "http"), livestreamID), origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header.Set("Cookie", user.Cookie)
+	return websocket.DialConfig(config)
+}
+
+func TestReactionWebSocketAccess(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	banned := newTestUser(t, "banned")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	decodeTestResponse(t, doTestRequest(t, http.MethodPut, fmt.Sprintf("/api/livestream/%d/reactions/shadow-bans/%d", livestreamID, banned.ID), owner.Cookie, nil), http.StatusOK, nil)
+
+	server := httptest.NewServer(testEcho)
+	defer server.Close()
+
+	// 同じオリジンからの接続は受け付ける
+	ws, err := dialTestReactionWebSocket(t, server.URL, viewer, livestreamID, server.URL)
+	if err != nil {
+		t.Fatalf("same origin: %v", err)
+	}
+	ws.Close()
+
+	// 他のサイトからの接続は、ログイン中のユーザのCookieが付いていても断る
+	if ws, err := dialTestReactionWebSocket(t, server.URL, viewer, livestreamID, "https://evil.example.com"); err == nil {
+		ws.Close()
+		t.Fatalf("cross origin: upgraded")
+	}
+
+	// リアクションを禁止されたユーザは、アップグレードする前に 403 で断る
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reactions/ws", livestreamID), banned.Cookie, nil,
+		"Connection: Upgrade", "Upgrade: websocket", "Sec-WebSocket-Version: 13", "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==")
+	decodeTestResponse(t, rec, http.StatusForbidden, nil)
+}
@@ -0,0 +1,114 @@
+package main
+
+// DBへの書き込みが遅くなっているときに、リアクションの投稿を一時的に断る
+// 直近 reactionLatencyWindow の間に記録した INSERT の所要時間の平均が閾値を超えていれば 503 を返す
+// 断っている間は新しい記録が増えないので、窓から古い記録が抜けると自然に受け付けを再開する
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	reactionLatencyThresholdEnvKey = "ISUCON13_REACTION_LATENCY_THRESHOLD_MS"
+	reactionLatencyWindowEnvKey    = "ISUCON13_REACTION_LATENCY_WINDOW_SECONDS"
+
+	// 窓の中で保持する記録数の上限。超えた分は古いものから上書きする
+	maxReactionLatencySamples = 256
+)
+
+var (
+	reactionLatencyThreshold = 200 * time.Millisecond
+	reactionLatencyWindow    = 5 * time.Second
+)
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples [maxReactionLatencySamples]latencySample
+	next    int
+}
+
+var reactionInsertLatency = &latencyTracker{}
+
+func init() {
+	// 現在の平均をミリ秒で /debug/vars に出す。/metrics には metrics.go で秒として出す
+	expvar.Publish("reaction_insert_latency_ms", expvar.Func(func() interface{} {
+		return float64(reactionInsertLatency.average(time.Now())) / float64(time.Millisecond)
+	}))
+}
+
+// loadReactionThrottleConfig は環境変数から閾値と窓の長さを読み込む
+func loadReactionThrottleConfig() error {
+	if v, ok := os.LookupEnv(reactionLatencyThresholdEnvKey); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("environment variable '%s' must be positive integer", reactionLatencyThresholdEnvKey)
+		}
+		reactionLatencyThreshold = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv(reactionLatencyWindowEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("environment variable '%s' must be positive integer", reactionLatencyWindowEnvKey)
+		}
+		reactionLatencyWindow = time.Duration(seconds) * time.Second
+	}
+	return nil
+}
+
+func (t *latencyTracker) record(at time.Time, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[t.next] = latencySample{at: at, duration: d}
+	t.next = (t.next + 1) % maxReactionLatencySamples
+}
+
+// average は窓の中の記録の平均を返す。記録がなければ 0 を返す
+func (t *latencyTracker) average(now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var (
+		total time.Duration
+		count int64
+	)
+	for _, sample := range t.samples {
+		if sample.at.IsZero() || now.Sub(sample.at) > reactionLatencyWindow {
+			continue
+		}
+		total += sample.duration
+		count++
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
+
+func (t *latencyTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = [maxReactionLatencySamples]latencySample{}
+	t.next = 0
+}
+
+// checkReactionThrottle はDBの書き込みが遅くなっている場合に 503 を返す
+func checkReactionThrottle(c echo.Context, now time.Time) error {
+	if reactionInsertLatency.average(now) <= reactionLatencyThreshold {
+		return nil
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(reactionLatencyWindow/time.Second)))
+	return echo.NewHTTPError(http.StatusServiceUnavailable, "reactions are temporarily throttled because the database is overloaded")
+}
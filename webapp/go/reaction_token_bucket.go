@@ -0,0 +1,160 @@
+package main
+
+// ユーザごと、配信ごとのリアクション投稿の流量制限
+// reaction_rate_limit.go の窓ごとの上限とは別に、1つの配信に対する連打をトークンバケットで抑える
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	reactionStreamRateEnvKey  = "ISUCON13_REACTION_STREAM_RATE"
+	reactionStreamBurstEnvKey = "ISUCON13_REACTION_STREAM_BURST"
+
+	// 使われていないバケットを掃除する間隔
+	reactionBucketSweepInterval = time.Minute
+)
+
+var (
+	// 1秒あたりに補充するトークン数。0 の場合は制限しない
+	reactionStreamRate float64
+	// バケットに溜められるトークン数。連続して投稿できる数になる
+	reactionStreamBurst float64 = 10
+
+	reactionBuckets = newReactionBucketLimiter()
+)
+
+// loadReactionStreamRateConfig は環境変数から補充の速さとバケットの大きさを読み込む
+func loadReactionStreamRateConfig() error {
+	if v, ok := os.LookupEnv(reactionStreamRateEnvKey); ok {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("environment variable '%s' must be non-negative number", reactionStreamRateEnvKey)
+		}
+		reactionStreamRate = rate
+	}
+	if v, ok := os.LookupEnv(reactionStreamBurstEnvKey); ok {
+		burst, err := strconv.ParseFloat(v, 64)
+		if err != nil || burst < 1 {
+			return fmt.Errorf("environment variable '%s' must be at least 1", reactionStreamBurstEnvKey)
+		}
+		reactionStreamBurst = burst
+	}
+	return nil
+}
+
+// checkReactionStreamRate はユーザがその配信に対して投稿しすぎていれば 429 を返す
+func checkReactionStreamRate(c echo.Context, userID int64, livestreamID int64, now time.Time) error {
+	if reactionStreamRate <= 0 {
+		return nil
+	}
+
+	wait, ok := reactionBuckets.take(reactionBucketKey{userID: userID, livestreamID: livestreamID}, now, reactionStreamRate, reactionStreamBurst)
+	return reactionStreamRateResult(c, wait, ok)
+}
+
+// peekReactionStreamRate はトークンを取り出さずに、次の1件が制限されるかどうかを checkReactionStreamRate と同じ形で返す
+// dry_run=true の検証で使う
+func peekReactionStreamRate(c echo.Context, userID int64, livestreamID int64, now time.Time) error {
+	if reactionStreamRate <= 0 {
+		return nil
+	}
+
+	wait, ok := reactionBuckets.peek(reactionBucketKey{userID: userID, livestreamID: livestreamID}, now, reactionStreamRate, reactionStreamBurst)
+	return reactionStreamRateResult(c, wait, ok)
+}
+
+func reactionStreamRateResult(c echo.Context, wait time.Duration, ok bool) error {
+	if ok {
+		return nil
+	}
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	return echo.NewHTTPError(http.StatusTooManyRequests, "too many reactions to the livestream")
+}
+
+type reactionBucketKey struct {
+	userID       int64
+	livestreamID int64
+}
+
+type reactionBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+type reactionBucketLimiter struct {
+	mu      sync.Mutex
+	buckets map[reactionBucketKey]*reactionBucket
+	sweptAt time.Time
+}
+
+func newReactionBucketLimiter() *reactionBucketLimiter {
+	return &reactionBucketLimiter{
+		buckets: make(map[reactionBucketKey]*reactionBucket),
+	}
+}
+
+// take はバケットからトークンを1つ取り出す
+// 取り出せなかった場合は false と、次のトークンが補充されるまでの時間を返す
+func (l *reactionBucketLimiter) take(key reactionBucketKey, now time.Time, rate float64, burst float64) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.sweptAt) >= reactionBucketSweepInterval {
+		l.sweepLocked(now, rate, burst)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &reactionBucket{tokens: burst, updatedAt: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rate)
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	return 0, true
+}
+
+// peek は take と同じ結果を、バケットを変えずに返す
+func (l *reactionBucketLimiter) peek(key reactionBucketKey, now time.Time, rate float64, burst float64) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tokens := burst
+	if bucket, ok := l.buckets[key]; ok {
+		tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rate)
+	}
+	if tokens < 1 {
+		return time.Duration((1 - tokens) / rate * float64(time.Second)), false
+	}
+	return 0, true
+}
+
+// sweepLocked は満タンまで補充されているバケットを捨てる
+// 満タンのバケットは新しく作った場合と同じなので、捨てても制限の結果は変わらない
+func (l *reactionBucketLimiter) sweepLocked(now time.Time, rate float64, burst float64) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.sweptAt = now
+}
+
+func (l *reactionBucketLimiter) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets = make(map[reactionBucketKey]*reactionBucket)
+}
@@ -0,0 +1,116 @@
+package main
+
+// ユーザが配信のリアクションを最後に見た位置の記録
+// 「見逃したリアクション N 件」のバッジを出すために使う
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const defaultNewReactionsLimit = 50
+
+type ReactionViewCursorModel struct {
+	UserID         int64 `db:"user_id"`
+	LivestreamID   int64 `db:"livestream_id"`
+	LastReactionID int64 `db:"last_reaction_id"`
+	LastViewedAt   int64 `db:"last_viewed_at"`
+}
+
+type NewReactionsResponse struct {
+	// 前回の閲覧以降に、他のユーザが投稿したリアクションの件数
+	Count int64 `json:"count"`
+	// そのうち新しいものから limit 件まで
+	Reactions []Reaction `json:"reactions"`
+	// 前回閲覧した日時。初めての閲覧では 0
+	LastViewedAt int64 `json:"last_viewed_at"`
+}
+
+// 見逃したリアクション取得API
+// GET /api/livestream/:livestream_id/reactions/new?limit=
+// 前回この API を呼んでから他のユーザが投稿したリアクションを返し、見た位置を現在まで進める
+// 初めて呼んだ場合は、配信のすべてのリアクションが対象になる
+func getNewReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	limit := defaultNewReactionsLimit
+	if c.QueryParam("limit") != "" {
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamExists(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	// 同時に呼ばれても同じ範囲を二重に数えたり飛ばしたりしないよう、見た位置の行をロックしてから読む
+	if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO reaction_view_cursors (user_id, livestream_id, last_reaction_id, last_viewed_at) VALUES (?, ?, 0, 0)", userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction view cursor: "+err.Error())
+	}
+	var cursor ReactionViewCursorModel
+	if err := tx.GetContext(ctx, &cursor, "SELECT * FROM reaction_view_cursors WHERE user_id = ? AND livestream_id = ? FOR UPDATE", userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction view cursor: "+err.Error())
+	}
+
+	// 投稿時刻は秒単位で同じ時刻のリアクションが後から増えうるので、見た位置はIDで持つ
+	where := "livestream_id = ? AND id > ? AND user_id <> ? AND " + visibleReactionsWhere("")
+	var summary struct {
+		Count  int64 `db:"cnt"`
+		LastID int64 `db:"last_id"`
+	}
+	if err := tx.GetContext(ctx, &summary, "SELECT IFNULL(SUM(count), 0) AS cnt, IFNULL(MAX(id), ?) AS last_id FROM reactions WHERE "+where, cursor.LastReactionID, livestreamID, cursor.LastReactionID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count new reactions: "+err.Error())
+	}
+
+	reactionModels := []ReactionModel{}
+	query := "SELECT * FROM reactions WHERE " + where + fmt.Sprintf(" AND id <= ? ORDER BY created_at DESC, id DESC LIMIT %d", limit)
+	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID, cursor.LastReactionID, userID, summary.LastID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get new reactions: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reaction_view_cursors SET last_reaction_id = ?, last_viewed_at = ? WHERE user_id = ? AND livestream_id = ?", summary.LastID, time.Now().Unix(), userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reaction view cursor: "+err.Error())
+	}
+
+	reactions, err := fillReactionResponses(ctx, tx, reactionModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &NewReactionsResponse{
+		Count:        summary.Count,
+		Reactions:    reactions,
+		LastViewedAt: cursor.LastViewedAt,
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+// テスト用の最小限の Redis サーバ
+// レート制限で使うコマンド (INCR, EXPIRE, GET と MULTI/EXEC) だけを実装する
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeRedis struct {
+	listener net.Listener
+
+	mu     sync.Mutex
+	values map[string]int64
+	ttls   map[string]time.Duration
+}
+
+// startFakeRedis は空いているポートで fakeRedis を起動する。テストの終わりに止める
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{
+		listener: listener,
+		values:   make(map[string]int64),
+		ttls:     make(map[string]time.Duration),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) ttl(key string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ttls[key]
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "MULTI":
+			inMulti, queued = true, nil
+			reply = "+OK\r\n"
+		case cmd == "EXEC":
+			reply = fmt.Sprintf("*%d\r\n", len(queued))
+			for _, q := range queued {
+				reply += r.exec(q)
+			}
+			inMulti, queued = false, nil
+		case inMulti:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			reply = r.exec(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (r *fakeRedis) exec(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "INCR":
+		r.values[args[1]]++
+		return fmt.Sprintf(":%d\r\n", r.values[args[1]])
+	case "EXPIRE":
+		seconds, _ := strconv.Atoi(args[2])
+		r.ttls[args[1]] = time.Duration(seconds) * time.Second
+		return ":1\r\n"
+	case "GET":
+		v, ok := r.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		s := strconv.FormatInt(v, 10)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	default:
+		// HELLO などは知らないコマンドとして断り、クライアントを RESP2 で動かす
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+// readRESPCommand はクライアントから送られる、バルク文字列の配列を1つ読む
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+// リクエストごとの構造化ログと、ルートごとのレイテンシのヒストグラム
+// 負荷をかけたときにどのハンドラが遅いかを調べるために使う
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ヒストグラムのバケットの上限 (ミリ秒)。最後のバケットはこれらを超えたもの
+var requestLatencyBucketsMs = [...]float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+var (
+	requestLogOutput io.Writer = os.Stdout
+	routeLatencies             = &routeLatencyRegistry{}
+)
+
+type requestLogEntry struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Route      string  `json:"route"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	DBQueries  int64   `json:"db_queries"`
+}
+
+// requestLogMiddleware はリクエストごとに1行のJSONログを出し、ルートごとのヒストグラムに所要時間を記録する
+// dbQueryCountMiddleware より外側に置き、そこで数えたクエリ数をログに含める
+func requestLogMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		// ステータスコードを確定させるため、echo の Logger と同じくここでエラーをレスポンスにする
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+		duration := time.Since(start)
+
+		req := c.Request()
+		route := req.Method + " " + c.Path()
+		routeLatencies.observe(route, duration)
+		observeRequestDuration(req.Method, c.Path(), duration)
+
+		var queries int64
+		if counter, ok := req.Context().Value(queryCounterKey{}).(*queryCounter); ok {
+			queries = counter.count.Load()
+		}
+		line, err := json.Marshal(&requestLogEntry{
+			Time:       start.Format(time.RFC3339Nano),
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			Route:      c.Path(),
+			Status:     c.Response().Status,
+			DurationMs: durationMs(duration),
+			DBQueries:  queries,
+		})
+		if err != nil {
+			return nil
+		}
+		requestLogOutput.Write(append(line, '\n'))
+		return nil
+	}
+}
+
+// routeLatencyRegistry はルートごとのヒストグラムを持つ
+// ルートの種類は起動後すぐに出揃うので、読み出しの多い sync.Map に入れる
+type routeLatencyRegistry struct {
+	histograms sync.Map
+}
+
+type latencyHistogram struct {
+	counts  [len(requestLatencyBucketsMs) + 1]atomic.Int64
+	count   atomic.Int64
+	totalUs atomic.Int64
+}
+
+func (r *routeLatencyRegistry) observe(route string, duration time.Duration) {
+	h, ok := r.histograms.Load(route)
+	if !ok {
+		h, _ = r.histograms.LoadOrStore(route, &latencyHistogram{})
+	}
+	h.(*latencyHistogram).observe(duration)
+}
+
+func (h *latencyHistogram) observe(duration time.Duration) {
+	ms := durationMs(duration)
+	i := sort.SearchFloat64s(requestLatencyBucketsMs[:], ms)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.totalUs.Add(duration.Microseconds())
+}
+
+type LatencyBucket struct {
+	// バケットの上限 (ミリ秒)。上限のない最後のバケットでは省略する
+	Le    *float64 `json:"le,omitempty"`
+	Count int64    `json:"count"`
+}
+
+type RouteLatency struct {
+	Route   string          `json:"route"`
+	Count   int64           `json:"count"`
+	TotalMs float64         `json:"total_ms"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// ルートごとのレイテンシ取得API
+// GET /debug/metrics
+func getDebugMetricsHandler(c echo.Context) error {
+	routes := []RouteLatency{}
+	routeLatencies.histograms.Range(func(key, value any) bool {
+		h := value.(*latencyHistogram)
+		buckets := make([]LatencyBucket, len(h.counts))
+		for i := range h.counts {
+			buckets[i].Count = h.counts[i].Load()
+			if i < len(requestLatencyBucketsMs) {
+				le := requestLatencyBucketsMs[i]
+				buckets[i].Le = &le
+			}
+		}
+		routes = append(routes, RouteLatency{
+			Route:   key.(string),
+			Count:   h.count.Load(),
+			TotalMs: float64(h.totalUs.Load()) / 1000,
+			Buckets: buckets,
+		})
+		return true
+	})
+	// 合計時間の長いルートから並べる
+	sort.Slice(routes, func(i, j int) bool { return routes[i].TotalMs > routes[j].TotalMs })
+
+	return c.JSON(http.StatusOK, routes)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRequestLogMiddlewareRecordsDuration(t *testing.T) {
+	var buf bytes.Buffer
+	orig := requestLogOutput
+	requestLogOutput = &buf
+	t.Cleanup(func() { requestLogOutput = orig })
+
+	e := echo.New()
+	e.Use(requestLogMiddleware)
+	e.GET("/test/request-log", func(c echo.Context) error {
+		time.Sleep(5 * time.Millisecond)
+		return c.NoContent(http.StatusOK)
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test/request-log", nil))
+
+	var entry requestLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to decode the request log %q: %v", buf.String(), err)
+	}
+	if entry.Route != "/test/request-log" || entry.Status != http.StatusOK {
+		t.Fatalf("got route %q status %d, want /test/request-log 200", entry.Route, entry.Status)
+	}
+	if entry.DurationMs <= 0 {
+		t.Fatalf("duration_ms = %v, want positive", entry.DurationMs)
+	}
+
+	h, ok := routeLatencies.histograms.Load("GET /test/request-log")
+	if !ok {
+		t.Fatalf("latency histogram not recorded")
+	}
+	if h.(*latencyHistogram).totalUs.Load() <= 0 {
+		t.Fatalf("latency histogram has no duration")
+	}
+}
+
+func TestRegisterDebugRoutes(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		orig := debugHeadersEnabled
+		debugHeadersEnabled = enabled
+
+		e := echo.New()
+		registerDebugRoutes(e)
+		for _, path := range []string{"/debug/vars", "/debug/metrics"} {
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if found := rec.Code != http.StatusNotFound; found != enabled {
+				t.Errorf("enabled=%v: GET %s returned %d", enabled, path, rec.Code)
+			}
+		}
+
+		debugHeadersEnabled = orig
+	}
+
+	// /metrics は本番環境でも登録する
+	orig := debugHeadersEnabled
+	debugHeadersEnabled = false
+	t.Cleanup(func() { debugHeadersEnabled = orig })
+	rec := httptest.NewRecorder()
+	newEcho().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("production: GET /metrics returned %d", rec.Code)
+	}
+}
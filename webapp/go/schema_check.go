@@ -0,0 +1,58 @@
+package main
+
+// 起動時に、コードが前提としているテーブル定義とDBのスキーマがずれていないかを確かめる
+// SELECT * をモデルに詰めているため、カラムが足りないとリクエストの処理中に初めて失敗してしまう
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const schemaCheckEnvKey = "ISUCON13_SCHEMA_CHECK"
+
+// modelColumns はモデルの db タグから、テーブルに必要なカラム名を返す
+func modelColumns(model interface{}) []string {
+	t := reflect.TypeOf(model)
+	columns := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if column := t.Field(i).Tag.Get("db"); column != "" && column != "-" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// missingColumns は expected のうち actual に含まれないカラム名を返す
+func missingColumns(expected []string, actual []string) []string {
+	exists := make(map[string]struct{}, len(actual))
+	for _, column := range actual {
+		exists[strings.ToLower(column)] = struct{}{}
+	}
+	var missing []string
+	for _, column := range expected {
+		if _, ok := exists[strings.ToLower(column)]; !ok {
+			missing = append(missing, column)
+		}
+	}
+	return missing
+}
+
+// verifyReactionsSchema は reactions テーブルに ReactionModel のカラムがすべてあるかを確かめる
+func verifyReactionsSchema(ctx context.Context, db *sqlx.DB) error {
+	var columns []string
+	query := "SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?"
+	if err := db.SelectContext(ctx, &columns, query, "reactions"); err != nil {
+		return fmt.Errorf("failed to get columns of reactions: %w", err)
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("table reactions does not exist")
+	}
+	if missing := missingColumns(modelColumns(ReactionModel{}), columns); len(missing) > 0 {
+		return fmt.Errorf("table reactions is missing columns: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
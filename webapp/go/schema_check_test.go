@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// openTestStubDB はテスト用のサーバに、ハンドラのテストとは別のデータベースを作って接続する
+func openTestStubDB(t *testing.T, name string) *sqlx.DB {
+	t.Helper()
+	if _, err := dbConn.Exec("CREATE DATABASE IF NOT EXISTS `" + name + "`"); err != nil {
+		t.Fatal(err)
+	}
+	conf := testDBConfig.Clone()
+	conf.DBName = name
+	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		dbConn.Exec("DROP DATABASE IF EXISTS `" + name + "`")
+	})
+	return db
+}
+
+func TestVerifyReactionsSchema(t *testing.T) {
+	ctx := context.Background()
+
+	// initdb のスキーマには必要なカラムがそろっている
+	if err := verifyReactionsSchema(ctx, dbConn); err != nil {
+		t.Fatalf("initdb schema: %v", err)
+	}
+
+	db := openTestStubDB(t, "schema_check_stub")
+	if err := verifyReactionsSchema(ctx, db); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("without reactions: got %v, want the table to be reported missing", err)
+	}
+
+	// 古いスキーマのように、後から足したカラムがない
+	if _, err := db.Exec("CREATE TABLE reactions (id BIGINT PRIMARY KEY, emoji_name VARCHAR(255), user_id BIGINT, livestream_id BIGINT, created_at BIGINT, is_bot BOOLEAN)"); err != nil {
+		t.Fatal(err)
+	}
+	err := verifyReactionsSchema(ctx, db)
+	if err == nil {
+		t.Fatalf("stub schema: got nil error, want missing columns")
+	}
+	for _, column := range []string{"intensity", "count", "pending", "hidden", "deleted_at", "livecomment_id", "shadow"} {
+		if !strings.Contains(err.Error(), column) {
+			t.Errorf("error %q does not mention missing column %s", err, column)
+		}
+	}
+	if strings.Contains(err.Error(), "emoji_name") {
+		t.Errorf("error %q mentions an existing column", err)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -18,6 +20,17 @@ type LivestreamStatistics struct {
 	MaxTip         int64 `json:"max_tip"`
 }
 
+type MyReactionStatistics struct {
+	// ログイン中のユーザがこの配信に投稿したリアクションの件数
+	ReactionCount int64 `json:"reaction_count"`
+	// リアクションの総数を、リアクションしたユーザ数で割ったもの
+	AverageReactions float64 `json:"average_reactions"`
+	// リアクションしたユーザごとの件数の中央値
+	MedianReactions float64 `json:"median_reactions"`
+	// ログイン中のユーザより件数の少ないユーザの割合 (%)
+	Percentile float64 `json:"percentile"`
+}
+
 type LivestreamRankingEntry struct {
 	LivestreamID int64
 	Score        int64
@@ -68,40 +81,50 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 
 	username := c.Param("username")
+	// 集計は重いので、短い間は同じユーザの結果を使い回す
+	stats, err := userStatisticsCache.get(ctx, username, time.Now(), computeUserStatistics)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// computeUserStatistics はユーザの統計情報を集計する
+func computeUserStatistics(ctx context.Context, username string) (UserStatistics, error) {
 	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
 	// また、現在の合計視聴者数もだす
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
 	var user UserModel
 	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
+			return UserStatistics{}, echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
 		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+			return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 		}
 	}
 
 	// ランク算出
 	var users []*UserModel
 	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
 	}
 
 	var ranking UserRanking
 	for _, user := range users {
 		var reactions int64
 		query := `
-		SELECT COUNT(*) FROM users u
+		SELECT IFNULL(SUM(r.count), 0) FROM users u
 		INNER JOIN livestreams l ON l.user_id = u.id
-		INNER JOIN reactions r ON r.livestream_id = l.id
+		INNER JOIN reactions r ON r.livestream_id = l.id AND ` + visibleReactionsWhere("r") + `
 		WHERE u.id = ?`
 		if err := tx.GetContext(ctx, &reactions, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+			return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
 		}
 
 		var tips int64
@@ -111,7 +134,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 		INNER JOIN livecomments l2 ON l2.livestream_id = l.id
 		WHERE u.id = ?`
 		if err := tx.GetContext(ctx, &tips, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
+			return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
 		}
 
 		score := reactions + tips
@@ -133,13 +156,13 @@ func getUserStatisticsHandler(c echo.Context) error {
 
 	// リアクション数
 	var totalReactions int64
-	query := `SELECT COUNT(*) FROM users u
+	query := `SELECT IFNULL(SUM(r.count), 0) FROM users u
     INNER JOIN livestreams l ON l.user_id = u.id
-    INNER JOIN reactions r ON r.livestream_id = l.id
+    INNER JOIN reactions r ON r.livestream_id = l.id AND ` + visibleReactionsWhere("r") + `
     WHERE u.name = ?
 	`
 	if err := tx.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
 
 	// ライブコメント数、チップ合計
@@ -147,13 +170,13 @@ func getUserStatisticsHandler(c echo.Context) error {
 	var totalTip int64
 	var livestreams []*LivestreamModel
 	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	for _, livestream := range livestreams {
 		var livecomments []*LivecommentModel
 		if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+			return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 		}
 
 		for _, livecomment := range livecomments {
@@ -170,7 +193,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 	// 合計視聴者数
 	var viewersCount int64
 	if err := tx.GetContext(ctx, &viewersCount, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
 	}
 
 	// お気に入り絵文字
@@ -179,14 +202,14 @@ func getUserStatisticsHandler(c echo.Context) error {
 	SELECT r.emoji_name
 	FROM users u
 	INNER JOIN livestreams l ON l.user_id = u.id
-	INNER JOIN reactions r ON r.livestream_id = l.id
+	INNER JOIN reactions r ON r.livestream_id = l.id AND ` + visibleReactionsWhere("r") + `
 	WHERE u.name = ?
 	GROUP BY emoji_name
-	ORDER BY COUNT(*) DESC, emoji_name DESC
+	ORDER BY SUM(r.count) DESC, emoji_name DESC
 	LIMIT 1
 	`
 	if err := tx.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
 	}
 
 	stats := UserStatistics{
@@ -197,7 +220,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 		TotalTip:          totalTip,
 		FavoriteEmoji:     favoriteEmoji,
 	}
-	return c.JSON(http.StatusOK, stats)
+	return stats, nil
 }
 
 func getLivestreamStatisticsHandler(c echo.Context) error {
@@ -213,6 +236,16 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 	livestreamID := int64(id)
 
+	// weight=intensity が指定された場合は、リアクションの強さで重み付けした合計を返す
+	reactionsQuery := "SELECT IFNULL(SUM(r.count), 0) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id AND " + visibleReactionsWhere("r") + " WHERE l.id = ?"
+	switch c.QueryParam("weight") {
+	case "":
+	case "intensity":
+		reactionsQuery = "SELECT IFNULL(SUM(r.intensity * r.count), 0) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id AND " + visibleReactionsWhere("r") + " WHERE l.id = ?"
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "weight query parameter must be 'intensity'")
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -237,7 +270,7 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	var ranking LivestreamRanking
 	for _, livestream := range livestreams {
 		var reactions int64
-		if err := tx.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		if err := tx.GetContext(ctx, &reactions, "SELECT IFNULL(SUM(r.count), 0) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id AND "+visibleReactionsWhere("r")+" WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
 		}
 
@@ -277,7 +310,7 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 
 	// リアクション数
 	var totalReactions int64
-	if err := tx.GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := tx.GetContext(ctx, &totalReactions, reactionsQuery, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
 
@@ -299,3 +332,77 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		TotalReports:   totalReports,
 	})
 }
+
+// 自分のリアクション統計API
+// GET /api/livestream/:livestream_id/me/reaction-stats
+// 自分のリアクション数を、配信全体のリアクションしたユーザあたりの平均、中央値と比べる
+func getMyReactionStatisticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livestreamID := int64(id)
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamExists(ctx, tx, livestreamID); err != nil {
+		return err
+	}
+
+	// 自分の件数と比べる分布は同じ条件で数える
+	// シャドウバンされたユーザには、自分のリアクションも分布に含めて見せる
+	visible := visibleReactionsWhereFor("", userID)
+
+	var myCount int64
+	if err := tx.GetContext(ctx, &myCount, "SELECT IFNULL(SUM(count), 0) FROM reactions WHERE livestream_id = ? AND user_id = ? AND "+visible, livestreamID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count my reactions: "+err.Error())
+	}
+
+	// 中央値とパーセンタイルを出すため、リアクションしたユーザごとの件数を昇順で取得する
+	var counts []int64
+	if err := tx.SelectContext(ctx, &counts, "SELECT SUM(count) AS n FROM reactions WHERE livestream_id = ? AND "+visible+" GROUP BY user_id ORDER BY n ASC", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions per user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	stats := MyReactionStatistics{
+		ReactionCount: myCount,
+	}
+	// まだ誰もリアクションしていない場合は0のまま返す
+	if len(counts) > 0 {
+		var total, fewer int64
+		for _, n := range counts {
+			total += n
+			if n < myCount {
+				fewer++
+			}
+		}
+		stats.AverageReactions = float64(total) / float64(len(counts))
+		if len(counts)%2 == 1 {
+			stats.MedianReactions = float64(counts[len(counts)/2])
+		} else {
+			stats.MedianReactions = float64(counts[len(counts)/2-1]+counts[len(counts)/2]) / 2
+		}
+		stats.Percentile = float64(fewer) / float64(len(counts)) * 100
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
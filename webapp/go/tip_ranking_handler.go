@@ -0,0 +1,94 @@
+package main
+
+// 配信ごとの投げ銭のランキング
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultTipRankingLimit = 10
+	maxTipRankingLimit     = 100
+)
+
+type TipRankingEntry struct {
+	User     User  `json:"user"`
+	TotalTip int64 `json:"total_tip"`
+}
+
+// 投げ銭ランキング取得API (配信者向け)
+// GET /api/livestream/:livestream_id/tips/ranking?limit=
+// 配信への投げ銭の合計が多いユーザから順に返す
+func getTipRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	limit := defaultTipRankingLimit
+	if c.QueryParam("limit") != "" {
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 || limit > maxTipRankingLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxTipRankingLimit))
+		}
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	// 合計が同じ場合は先に投げ銭したユーザを上にするため、user_id ではなく最初の投げ銭のIDで並べる
+	var totals []struct {
+		UserID   int64 `db:"user_id"`
+		TotalTip int64 `db:"total_tip"`
+	}
+	query := "SELECT user_id, SUM(tip) AS total_tip FROM livecomments WHERE livestream_id = ? AND tip > 0 GROUP BY user_id ORDER BY SUM(tip) DESC, MIN(id) ASC LIMIT ?"
+	if err := tx.SelectContext(ctx, &totals, query, livestreamID, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tip ranking: "+err.Error())
+	}
+
+	tipperIDs := make([]int64, len(totals))
+	for i := range totals {
+		tipperIDs[i] = totals[i].UserID
+	}
+	users, err := fillUserResponses(ctx, tx, tipperIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	ranking := make([]TipRankingEntry, len(totals))
+	for i := range totals {
+		ranking[i] = TipRankingEntry{
+			User:     users[totals[i].UserID],
+			TotalTip: totals[i].TotalTip,
+		}
+	}
+
+	return c.JSON(http.StatusOK, ranking)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestGetTipRanking(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	carol := newTestUser(t, "carol")
+	dave := newTestUser(t, "dave")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	otherLivestreamID := newTestLivestream(t, owner.ID, "other stream", 0, 1)
+
+	newTestLivecomment(t, alice.ID, livestreamID, "first", 100)
+	newTestLivecomment(t, bob.ID, livestreamID, "big", 500)
+	newTestLivecomment(t, carol.ID, livestreamID, "tie", 300)
+	newTestLivecomment(t, alice.ID, livestreamID, "again", 200)
+	// 投げ銭のないコメントと、他の配信への投げ銭は数えない
+	newTestLivecomment(t, dave.ID, livestreamID, "no tip", 0)
+	newTestLivecomment(t, carol.ID, otherLivestreamID, "elsewhere", 1000)
+
+	path := fmt.Sprintf("/api/livestream/%d/tips/ranking", livestreamID)
+	var ranking []TipRankingEntry
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path, owner.Cookie, nil), http.StatusOK, &ranking)
+	// 合計額の多い順に並び、同じ額なら先に投げ銭したユーザが上になる
+	want := []struct {
+		name     string
+		totalTip int64
+	}{{"bob", 500}, {"alice", 300}, {"carol", 300}}
+	if len(ranking) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(ranking), len(want), ranking)
+	}
+	for i, entry := range ranking {
+		if entry.User.Name != want[i].name || entry.TotalTip != want[i].totalTip {
+			t.Fatalf("rank %d: got %s with %d, want %s with %d", i+1, entry.User.Name, entry.TotalTip, want[i].name, want[i].totalTip)
+		}
+	}
+
+	var top []TipRankingEntry
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path+"?limit=1", owner.Cookie, nil), http.StatusOK, &top)
+	if len(top) != 1 || top[0].User.ID != bob.ID {
+		t.Fatalf("limit=1: got %+v, want only bob", top)
+	}
+
+	// 配信者以外は見られない
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, path, alice.Cookie, nil), http.StatusForbidden, nil)
+}
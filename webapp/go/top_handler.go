@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"net/http"
 
@@ -94,5 +95,84 @@ func getStreamerThemeHandler(c echo.Context) error {
 		DarkMode: themeModel.DarkMode,
 	}
 
+	// テーマ更新APIの If-Match に指定するバージョン
+	c.Response().Header().Set("ETag", versionETag(themeModel.Version))
+	return c.JSON(http.StatusOK, theme)
+}
+
+type PutThemeRequest struct {
+	DarkMode *bool `json:"dark_mode"`
+}
+
+// テーマ更新API
+// PUT /api/user/:username/theme
+// 本人のみ変更できる
+// If-Match にテーマ取得APIの ETag を指定すると、その後に他で更新されていた場合は上書きせず 409 を返す
+func putStreamerThemeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req PutThemeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.DarkMode == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "dark_mode is required")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	err = tx.GetContext(ctx, &userModel, "SELECT id FROM users WHERE name = ?", c.Param("username"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if userModel.ID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "cannot edit other user's theme")
+	}
+
+	themeModel := ThemeModel{}
+	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ? FOR UPDATE", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
+	}
+	if err := verifyIfMatchVersion(c, themeModel.Version); err != nil {
+		return err
+	}
+
+	themeModel.DarkMode = *req.DarkMode
+	themeModel.Version++
+	if _, err := tx.NamedExecContext(ctx, "UPDATE themes SET dark_mode = :dark_mode, version = :version WHERE id = :id", themeModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user theme: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	// 一覧に埋め込むユーザ情報のテーマを更新する
+	userCache.invalidate(userID)
+
+	theme := Theme{
+		ID:       themeModel.ID,
+		DarkMode: themeModel.DarkMode,
+	}
+
+	c.Response().Header().Set("ETag", versionETag(themeModel.Version))
 	return c.JSON(http.StatusOK, theme)
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPutStreamerTheme(t *testing.T) {
+	resetTestDB(t)
+	user := newTestUser(t, "user")
+	other := newTestUser(t, "other")
+	now := time.Now().Unix()
+	livestreamID := newTestLivestream(t, other.ID, "stream", now-3600, now+3600)
+	newTestReaction(t, ReactionModel{UserID: user.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+
+	for _, darkMode := range []bool{true, false} {
+		// 更新前にリアクションを取得して、ユーザ情報をキャッシュに載せておく
+		getTestReactions(t, other, livestreamID, "")
+
+		rec := doTestRequest(t, http.MethodPut, "/api/user/user/theme", user.Cookie, &PutThemeRequest{DarkMode: &darkMode})
+		var theme Theme
+		decodeTestResponse(t, rec, http.StatusOK, &theme)
+		if theme.DarkMode != darkMode {
+			t.Fatalf("got theme %+v, want dark_mode %v", theme, darkMode)
+		}
+
+		// リアクションに埋め込まれたユーザ情報のテーマも変わる
+		reactions := getTestReactions(t, other, livestreamID, "")
+		if len(reactions) != 1 || reactions[0].User.Theme.DarkMode != darkMode {
+			t.Fatalf("got reactions %+v, want the user with dark_mode %v", reactions, darkMode)
+		}
+	}
+
+	darkMode := true
+	for _, tc := range []struct {
+		name   string
+		user   testUser
+		path   string
+		req    *PutThemeRequest
+		status int
+	}{
+		{name: "other user", user: other, path: "/api/user/user/theme", req: &PutThemeRequest{DarkMode: &darkMode}, status: http.StatusForbidden},
+		{name: "missing dark_mode", user: user, path: "/api/user/user/theme", req: &PutThemeRequest{}, status: http.StatusBadRequest},
+		{name: "unknown user", user: user, path: "/api/user/nobody/theme", req: &PutThemeRequest{DarkMode: &darkMode}, status: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doTestRequest(t, http.MethodPut, tc.path, tc.user.Cookie, tc.req)
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+		})
+	}
+
+	var theme Theme
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/user/theme", user.Cookie, nil), http.StatusOK, &theme)
+	if theme.DarkMode {
+		t.Fatalf("dark_mode changed by a rejected update")
+	}
+}
+
+func TestPutStreamerThemeIfMatch(t *testing.T) {
+	resetTestDB(t)
+	user := newTestUser(t, "user")
+
+	rec := doTestRequest(t, http.MethodGet, "/api/user/user/theme", user.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusOK, nil)
+	stale := rec.Header().Get("ETag")
+	if stale == "" {
+		t.Fatalf("no ETag on the theme")
+	}
+
+	darkMode, lightMode := true, false
+	rec = doTestRequest(t, http.MethodPut, "/api/user/user/theme", user.Cookie, &PutThemeRequest{DarkMode: &darkMode}, "If-Match: "+stale)
+	decodeTestResponse(t, rec, http.StatusOK, nil)
+	current := rec.Header().Get("ETag")
+	if current == "" || current == stale {
+		t.Fatalf("ETag after update = %q, want a new version other than %q", current, stale)
+	}
+
+	// 古いバージョンのままの更新は上書きしない
+	rec = doTestRequest(t, http.MethodPut, "/api/user/user/theme", user.Cookie, &PutThemeRequest{DarkMode: &lightMode}, "If-Match: "+stale)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("stale If-Match: status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	var theme Theme
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/user/theme", user.Cookie, nil), http.StatusOK, &theme)
+	if !theme.DarkMode {
+		t.Fatalf("dark_mode changed by a stale update")
+	}
+
+	rec = doTestRequest(t, http.MethodPut, "/api/user/user/theme", user.Cookie, &PutThemeRequest{DarkMode: &lightMode}, "If-Match: "+current)
+	decodeTestResponse(t, rec, http.StatusOK, &theme)
+	if theme.DarkMode {
+		t.Fatalf("dark_mode not updated with the current version")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+// 直近のリアクション数で並べた、いま盛り上がっている配信の一覧
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// リアクションを数える期間 (秒) の既定値と上限
+	defaultTrendingWindowSeconds = 300
+	maxTrendingWindowSeconds     = 24 * 60 * 60
+
+	defaultTrendingLimit = 10
+	maxTrendingLimit     = 100
+)
+
+// 盛り上がっている配信一覧取得API
+// GET /api/livestream/trending?window=&limit=
+// 直近 window 秒に受け取ったリアクションが多い配信から順に返す
+func getTrendingLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	window := int64(defaultTrendingWindowSeconds)
+	if c.QueryParam("window") != "" {
+		var err error
+		window, err = strconv.ParseInt(c.QueryParam("window"), 10, 64)
+		if err != nil || window < 1 || window > maxTrendingWindowSeconds {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("window query parameter must be integer between 1 and %d", maxTrendingWindowSeconds))
+		}
+	}
+	limit := defaultTrendingLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 || limit > maxTrendingLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxTrendingLimit))
+		}
+	}
+
+	ctx, tx, err := beginReadTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// まとめて投稿されたリアクションは1行に件数を持つので、行数ではなく count の合計を数える
+	var counts []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"cnt"`
+	}
+	query := "SELECT livestream_id, SUM(count) AS cnt FROM reactions WHERE created_at >= ? AND " + visibleReactionsWhere("") + " GROUP BY livestream_id ORDER BY cnt DESC, livestream_id DESC LIMIT ?"
+	if err := tx.SelectContext(ctx, &counts, query, time.Now().Unix()-window, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+	if len(counts) == 0 {
+		return c.JSON(http.StatusOK, []Livestream{})
+	}
+
+	livestreamIDs := make([]int64, len(counts))
+	for i := range counts {
+		livestreamIDs[i] = counts[i].LivestreamID
+	}
+	query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct getting livestreams query: "+err.Error())
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	// IN で取得すると順序が保証されないので、リアクション数の順に並べ直す
+	livestreamModelMap := make(map[int64]*LivestreamModel, len(livestreamModels))
+	for _, livestreamModel := range livestreamModels {
+		livestreamModelMap[livestreamModel.ID] = livestreamModel
+	}
+	livestreamModels = livestreamModels[:0]
+	for _, livestreamID := range livestreamIDs {
+		if livestreamModel, ok := livestreamModelMap[livestreamID]; ok {
+			livestreamModels = append(livestreamModels, livestreamModel)
+		}
+	}
+
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
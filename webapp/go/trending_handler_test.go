@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetTrendingLivestreams(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	oldID := newTestLivestream(t, owner.ID, "old", 0, 1)
+	steadyID := newTestLivestream(t, owner.ID, "steady", 0, 1)
+	burstID := newTestLivestream(t, owner.ID, "burst", 0, 1)
+	newTestLivestream(t, owner.ID, "quiet", 0, 1)
+
+	now := time.Now().Unix()
+	// 1時間前にはたくさんのリアクションがあった
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: oldID, EmojiName: ":tada:", CreatedAt: now - 60*60, Count: 10})
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: steadyID, EmojiName: ":tada:", CreatedAt: now - 60, Count: 2})
+	for i := 0; i < 5; i++ {
+		decodeTestResponse(t, postTestReaction(t, viewer, burstID, &PostReactionRequest{EmojiName: ":tada:"}), http.StatusCreated, nil)
+	}
+
+	trending := func(query string) []int64 {
+		t.Helper()
+		var livestreams []Livestream
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/livestream/trending?"+query, "", nil), http.StatusOK, &livestreams)
+		ids := make([]int64, len(livestreams))
+		for i := range livestreams {
+			ids[i] = livestreams[i].ID
+		}
+		return ids
+	}
+
+	// 直近のリアクションが集中した配信が先頭に来る
+	for query, want := range map[string][]int64{
+		"":            {burstID, steadyID},
+		"limit=1":     {burstID},
+		"window=7200": {oldID, burstID, steadyID},
+	} {
+		if got := trending(query); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%q: got %v, want %v", query, got, want)
+		}
+	}
+
+	for _, query := range []string{"window=0", "window=-1", "window=abc", "limit=0"} {
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/livestream/trending?"+query, "", nil), http.StatusBadRequest, nil)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+// リアクションやライブコメントの一覧で毎回組み立てているユーザ情報のキャッシュ
+// ユーザ名、テーマ、アイコンのハッシュ値はほとんど変わらないので、組み立てた User をプロセス内に覚えておく
+// フォロワー数などのオプションの値は変わりやすいので、キャッシュせず毎回数える
+// 古い値を入れないための世代の扱いは cache_snapshot.go を参照
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// キャッシュしておくユーザ数の上限。超えた分は最も長く使われていないものから捨てる
+const userCacheSize = 10000
+
+// キャッシュした User を使う期間。無効化を取りこぼしても、この時間が経てば読み直す
+var userCacheTTL = 30 * time.Second
+
+var userCache = newUserLRUCache(userCacheSize)
+
+type userCacheEntry struct {
+	userID    int64
+	user      User
+	expiresAt time.Time
+}
+
+type userLRUCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[int64]*list.Element
+	// invalidate されるたびに増える。読み込み中に更新されたユーザを古い値でキャッシュしないために使う
+	generation uint64
+}
+
+func newUserLRUCache(size int) *userLRUCache {
+	return &userLRUCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[int64]*list.Element, size),
+	}
+}
+
+// get はキャッシュされている User を返す。期限切れのものは捨てる
+func (c *userLRUCache) get(userID int64) (User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[userID]
+	if !ok {
+		return User{}, false
+	}
+	entry := elem.Value.(*userCacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, userID)
+		return User{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.user, true
+}
+
+// currentGeneration はトランザクションを始める前に呼び、その値を put に渡す
+// トランザクションの途中で取ると、始める前にコミットされた更新の無効化を見逃す
+func (c *userLRUCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put は User をキャッシュする
+// generation を取得してから invalidate が呼ばれていた場合、読み込んだ値が古い可能性があるのでキャッシュしない
+func (c *userLRUCache) put(user User, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	expiresAt := time.Now().Add(userCacheTTL)
+	if elem, ok := c.entries[user.ID]; ok {
+		entry := elem.Value.(*userCacheEntry)
+		entry.user = user
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[user.ID] = c.order.PushFront(&userCacheEntry{userID: user.ID, user: user, expiresAt: expiresAt})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*userCacheEntry).userID)
+	}
+}
+
+// invalidate はユーザのキャッシュを捨てる
+// ユーザ情報、テーマ、アイコンを更新する処理は、コミットした後に必ず呼ぶ
+func (c *userLRUCache) invalidate(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if elem, ok := c.entries[userID]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, userID)
+	}
+}
+
+func (c *userLRUCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.order.Init()
+	c.entries = make(map[int64]*list.Element, c.size)
+}
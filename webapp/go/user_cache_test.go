@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUserCacheNotStaleAfterInvalidation(t *testing.T) {
+	cache := newUserLRUCache(10)
+
+	// リクエストの開始時に世代を取り、トランザクションで古い名前を読んだ
+	snapshot := cache.currentGeneration()
+	stale := User{ID: 1, Name: "old"}
+
+	// その間にプロフィールが更新され、コミットの後に無効化された
+	cache.invalidate(1)
+
+	// 古い値はキャッシュに入らない
+	cache.put(stale, snapshot)
+	if user, ok := cache.get(1); ok {
+		t.Fatalf("got stale user %+v after invalidation", user)
+	}
+
+	// 無効化の後に始めたリクエストが読んだ値は入る
+	cache.put(User{ID: 1, Name: "new"}, cache.currentGeneration())
+	if user, ok := cache.get(1); !ok || user.Name != "new" {
+		t.Fatalf("got %+v, %v, want new user", user, ok)
+	}
+}
+
+func TestUserCacheExpires(t *testing.T) {
+	orig := userCacheTTL
+	userCacheTTL = 10 * time.Millisecond
+	t.Cleanup(func() { userCacheTTL = orig })
+
+	cache := newUserLRUCache(10)
+	cache.put(User{ID: 1, Name: "user"}, cache.currentGeneration())
+	if _, ok := cache.get(1); !ok {
+		t.Fatalf("user not cached")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if user, ok := cache.get(1); ok {
+		t.Fatalf("got expired user %+v", user)
+	}
+}
+
+func TestCacheSnapshotContext(t *testing.T) {
+	if isReplicaRead(context.Background()) {
+		t.Fatalf("background context marked as replica read")
+	}
+	if _, ok := cacheSnapshotFromContext(context.Background()); ok {
+		t.Fatalf("background context has a cache snapshot")
+	}
+	ctx := withCacheSnapshot(context.Background())
+	if _, ok := cacheSnapshotFromContext(ctx); !ok {
+		t.Fatalf("cache snapshot not found")
+	}
+}
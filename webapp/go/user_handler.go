@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
@@ -26,6 +28,13 @@ const (
 	defaultUserIDKey         = "USERID"
 	defaultUsernameKey       = "USERNAME"
 	bcryptDefaultCost        = bcrypt.MinCost
+
+	// プロフィールの文字数の上限
+	maxDisplayNameLength = 255
+	maxDescriptionLength = 1000
+
+	// ユーザ一括取得で1回に指定できるIDの数の上限
+	maxBulkUserIDs = 100
 )
 
 var fallbackImage = "../img/NoImage.jpg"
@@ -37,15 +46,21 @@ type UserModel struct {
 	DisplayName    string `db:"display_name"`
 	Description    string `db:"description"`
 	HashedPassword string `db:"password"`
+	CreatedAt      int64  `db:"created_at"`
+	Version        int64  `db:"version"`
 }
 
 type User struct {
-	ID          int64  `json:"id"`
-	Name        string `json:"name"`
-	DisplayName string `json:"display_name,omitempty"`
-	Description string `json:"description,omitempty"`
-	Theme       Theme  `json:"theme,omitempty"`
-	IconHash    string `json:"icon_hash,omitempty"`
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	DisplayName   string `json:"display_name,omitempty"`
+	Description   string `json:"description,omitempty"`
+	Theme         Theme  `json:"theme,omitempty"`
+	IconHash      string `json:"icon_hash,omitempty"`
+	FollowerCount *int64 `json:"follower_count,omitempty"`
+	// ユーザの配信が受け取ったリアクションの件数
+	// include=received_reaction_count を指定した場合のみ含める
+	ReceivedReactionCount *int64 `json:"received_reaction_count,omitempty"`
 }
 
 type Theme struct {
@@ -57,6 +72,7 @@ type ThemeModel struct {
 	ID       int64 `db:"id"`
 	UserID   int64 `db:"user_id"`
 	DarkMode bool  `db:"dark_mode"`
+	Version  int64 `db:"version"`
 }
 
 type PostUserRequest struct {
@@ -72,6 +88,12 @@ type PostUserRequestTheme struct {
 	DarkMode bool `json:"dark_mode"`
 }
 
+// PatchUserRequest は変更する項目だけを指定する。指定しなかった項目は変更しない
+type PatchUserRequest struct {
+	DisplayName *string `json:"display_name"`
+	Description *string `json:"description"`
+}
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	// Password is non-hashed password.
@@ -91,6 +113,16 @@ func getIconHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
+	// size=thumb の場合は一覧向けのサムネイルを返す
+	thumb := false
+	switch c.QueryParam("size") {
+	case "":
+	case "thumb":
+		thumb = true
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "size query parameter must be 'thumb'")
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -105,34 +137,70 @@ func getIconHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	// アイコンのハッシュ値を取得。ハッシュが存在する場合は304を返す
-	reqHash := c.Request().Header.Get("If-None-Match")
-	if reqHash != "" {
-		reqHash = strings.ReplaceAll(reqHash, "\"", "")
-		var id int64
-		if err := tx.GetContext(ctx, &id, "SELECT id FROM icons AS i JOIN icon_hashes AS ih ON i.id = ih.icon_id WHERE i.user_id = ? AND ih.hash = ?", user.ID, reqHash); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon hash: "+err.Error())
-			}
-			// ハッシュが存在しないので、次の処理に進む
-		} else {
-			// ハッシュが存在した
-			return c.NoContent(http.StatusNotModified)
+	// アイコンのハッシュ値を ETag として返す。If-None-Match と一致する場合は304を返す
+	// アイコンが設定されていないユーザは、ユーザ情報の icon_hash と同じくデフォルト画像のハッシュ値を使う
+	hash, err := iconStore.Hash(ctx, tx, user.ID)
+	if err != nil {
+		if !errors.Is(err, errIconNotFound) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon hash: "+err.Error())
 		}
+		hash = fallbackImageHash
+	}
+	// サムネイルは元の画像から作るので、元の画像のハッシュ値で見分けられる
+	etag := hash
+	if thumb {
+		etag += "-thumb"
+	}
+	c.Response().Header().Set("ETag", "\""+etag+"\"")
+	if ifNoneMatch(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
 	}
 
-	var image []byte
-	if err := tx.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", user.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.File(fallbackImage)
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+	// サムネイルのないアイコン (初期データなど) は、元の画像を返す
+	if thumb {
+		thumbnail, err := iconStore.GetThumbnail(ctx, tx, user.ID)
+		if err == nil {
+			if err := tx.Commit(); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+			}
+			return c.Blob(http.StatusOK, "image/png", thumbnail)
+		}
+		if !errors.Is(err, errIconNotFound) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon thumbnail: "+err.Error())
 		}
 	}
 
+	image, err := iconStore.Get(ctx, tx, user.ID)
+	if err != nil && !errors.Is(err, errIconNotFound) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if image == nil {
+		return c.File(fallbackImage)
+	}
 	return c.Blob(http.StatusOK, "image/jpeg", image)
 }
 
+// ifNoneMatch は If-None-Match ヘッダのいずれかのタグが hash と一致するかを返す
+// 弱いタグ (W/"...") や引用符のないタグも、アイコンの比較では同じものとして扱う
+func ifNoneMatch(header string, hash string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.Trim(strings.TrimPrefix(tag, "W/"), "\"")
+		if tag != "" && tag == hash {
+			return true
+		}
+	}
+	return false
+}
+
 func postIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -141,45 +209,42 @@ func postIconHandler(c echo.Context) error {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	var req *PostIconRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	// 画像として読めることを確かめてから保存する。ハッシュ値は保存するときに計算される
+	img, err := validateIcon(req.Image)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old user icon: "+err.Error())
+		return err
 	}
-
-	rs, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, image) VALUES (?, ?)", userID, req.Image)
+	thumbnail, err := iconThumbnail(img)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate icon thumbnail: "+err.Error())
 	}
 
-	iconID, err := rs.LastInsertId()
+	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
+	defer tx.Rollback()
 
-	// アイコンのハッシュ値を保存
-	iconHash := sha256.Sum256(req.Image)
-	if _, err := tx.ExecContext(ctx, "INSERT INTO `icon_hashes` (`icon_id`, `hash`) VALUES (?, ?)", iconID, fmt.Sprintf("%x", iconHash)); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new icon hash: "+err.Error())
+	iconID, err := iconStore.Put(ctx, tx, userID, req.Image, thumbnail)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save user icon: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	// 一覧に埋め込むユーザ情報のアイコンのハッシュ値を更新する
+	userCache.invalidate(userID)
 
 	return c.JSON(http.StatusCreated, &PostIconResponse{
 		ID: iconID,
@@ -194,10 +259,10 @@ func getMeHandler(c echo.Context) error {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -257,9 +322,10 @@ func registerHandler(c echo.Context) error {
 		DisplayName:    req.DisplayName,
 		Description:    req.Description,
 		HashedPassword: string(hashedPassword),
+		CreatedAt:      time.Now().Unix(),
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
+	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password, created_at) VALUES(:name, :display_name, :description, :password, :created_at)", userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
 	}
@@ -361,7 +427,7 @@ func loginHandler(c echo.Context) error {
 }
 
 // ユーザ詳細API
-// GET /api/user/:username
+// GET /api/user/:username?include=follower_count,received_reaction_count
 func getUserHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	if err := verifyUserSession(c); err != nil {
@@ -385,6 +451,150 @@ func getUserHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
+	include := parseIncludeParam(c)
+	var user User
+	if include["follower_count"] || include["received_reaction_count"] {
+		users, err := fillUserResponsesWithOptions(ctx, tx, []int64{userModel.ID}, userFillOptions{
+			FollowerCount:         include["follower_count"],
+			ReceivedReactionCount: include["received_reaction_count"],
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		user = users[userModel.ID]
+	} else {
+		user, err = fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// プロフィール更新APIの If-Match に指定するバージョン
+	c.Response().Header().Set("ETag", versionETag(userModel.Version))
+	return c.JSON(http.StatusOK, user)
+}
+
+// ユーザ一括取得API
+// GET /api/users?ids=1,2,3
+// 指定した順にユーザを返す。存在しないユーザは結果に含めない
+func getUsersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var userIDs []int64
+	if v := c.QueryParam("ids"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) > maxBulkUserIDs {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("ids query parameter must contain at most %d ids", maxBulkUserIDs))
+		}
+		for _, s := range parts {
+			id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "ids query parameter must be comma-separated integers")
+			}
+			if !slices.Contains(userIDs, id) {
+				userIDs = append(userIDs, id)
+			}
+		}
+	}
+
+	users := []User{}
+	if len(userIDs) == 0 {
+		return c.JSON(http.StatusOK, users)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userMap, err := fillUserResponses(ctx, tx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	for _, id := range userIDs {
+		// 見つからなかったユーザは空の User になっている
+		if user := userMap[id]; user.ID != 0 {
+			users = append(users, user)
+		}
+	}
+
+	return c.JSON(http.StatusOK, users)
+}
+
+// プロフィール更新API
+// PATCH /api/user/:username
+// 本人のみ、表示名と自己紹介を変更できる
+// If-Match にプロフィール取得APIの ETag を指定すると、その後に他で更新されていた場合は上書きせず 409 を返す
+func patchUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req PatchUserRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.DisplayName != nil && utf8.RuneCountInString(*req.DisplayName) > maxDisplayNameLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("display_name must be at most %d characters", maxDisplayNameLength))
+	}
+	if req.Description != nil && utf8.RuneCountInString(*req.Description) > maxDescriptionLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("description must be at most %d characters", maxDescriptionLength))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ? FOR UPDATE", c.Param("username")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if userModel.ID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "cannot edit other user's profile")
+	}
+	if err := verifyIfMatchVersion(c, userModel.Version); err != nil {
+		return err
+	}
+
+	if req.DisplayName != nil {
+		userModel.DisplayName = *req.DisplayName
+	}
+	if req.Description != nil {
+		userModel.Description = *req.Description
+	}
+	userModel.Version++
+	if _, err := tx.NamedExecContext(ctx, "UPDATE users SET display_name = :display_name, description = :description, version = :version WHERE id = :id", userModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user: "+err.Error())
+	}
+
 	user, err := fillUserResponse(ctx, tx, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
@@ -393,17 +603,46 @@ func getUserHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	// 一覧に埋め込むユーザ情報の表示名と自己紹介を更新する
+	userCache.invalidate(userID)
 
+	c.Response().Header().Set("ETag", versionETag(userModel.Version))
 	return c.JSON(http.StatusOK, user)
 }
 
+// versionETag はプロフィールやテーマのバージョンを ETag の形式にする
+func versionETag(version int64) string {
+	return "\"" + strconv.FormatInt(version, 10) + "\""
+}
+
+// verifyIfMatchVersion は If-Match ヘッダのバージョンが現在のバージョンと同じか確かめる
+// ヘッダがない場合や * の場合は、バージョンによらず更新できる
+func verifyIfMatchVersion(c echo.Context, current int64) error {
+	ifMatch := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return nil
+	}
+	// If-Match は強い比較なので、弱いタグはバージョンによらず一致しない
+	if strings.HasPrefix(ifMatch, "W/") {
+		return echo.NewHTTPError(http.StatusConflict, "the resource has been modified by another request")
+	}
+	version, err := strconv.ParseInt(strings.Trim(ifMatch, "\""), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "If-Match header must be an ETag returned by the server")
+	}
+	if version != current {
+		return echo.NewHTTPError(http.StatusConflict, "the resource has been modified by another request")
+	}
+	return nil
+}
+
 func verifyUserSession(c echo.Context) error {
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	sessionExpires, ok := sess.Values[defaultSessionExpiresKey]
+	sessionExpires, ok := sess.Values[defaultSessionExpiresKey].(int64)
 	if !ok {
 		return echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
 	}
@@ -414,22 +653,36 @@ func verifyUserSession(c echo.Context) error {
 	}
 
 	now := time.Now()
-	if now.Unix() > sessionExpires.(int64) {
+	if now.Unix() > sessionExpires {
 		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
 	}
 
 	return nil
 }
 
+// currentUserID はセッションからログイン中のユーザIDを取り出す
+// セッションが取得できない場合や値が壊れている場合は、panicせずに401を返す
+func currentUserID(c echo.Context) (int64, error) {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
+	if !ok {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
+	}
+	return userID, nil
+}
+
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
 	themeModel := ThemeModel{}
 	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
 		return User{}, err
 	}
 
-	var iconHash string
-	if err := tx.GetContext(ctx, &iconHash, "SELECT ih.hash FROM icon_hashes AS ih JOIN icons AS i ON i.id = ih.icon_id WHERE i.user_id = ?", userModel.ID); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
+	iconHash, err := iconStore.Hash(ctx, tx, userModel.ID)
+	if err != nil {
+		if !errors.Is(err, errIconNotFound) {
 			return User{}, err
 		}
 		iconHash = fallbackImageHash
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestSessionCookie はログインを通さずに、values を持つセッションのクッキーを作る
+func newTestSessionCookie(t *testing.T, values map[interface{}]interface{}) string {
+	t.Helper()
+	store := sessions.NewCookieStore(secret)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	sess, err := store.New(req, defaultSessionIDKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Values = values
+	rec := httptest.NewRecorder()
+	if err := store.Save(req, rec, sess); err != nil {
+		t.Fatal(err)
+	}
+	cookie := rec.Result().Cookies()[0]
+	return cookie.Name + "=" + cookie.Value
+}
+
+func TestMalformedSession(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	livestreamID := newTestLivestream(t, owner.ID, "stream", 0, 1)
+	expires := time.Now().Add(time.Hour).Unix()
+
+	for name, values := range map[string]map[interface{}]interface{}{
+		"user id is a string": {defaultSessionExpiresKey: expires, defaultUserIDKey: fmt.Sprint(owner.ID)},
+		"user id is missing":  {defaultSessionExpiresKey: expires},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cookie := newTestSessionCookie(t, values)
+			// panic せずに401を返す
+			rec := doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/reaction", livestreamID), cookie, &PostReactionRequest{EmojiName: ":tada:"})
+			decodeTestResponse(t, rec, http.StatusUnauthorized, nil)
+			rec = doTestRequest(t, http.MethodGet, "/api/user/me", cookie, nil)
+			decodeTestResponse(t, rec, http.StatusUnauthorized, nil)
+		})
+	}
+
+	// セッションを読めない場合も401を返す
+	c, _ := newTestContext()
+	var he *echo.HTTPError
+	if _, err := currentUserID(c); !errors.As(err, &he) || he.Code != http.StatusUnauthorized {
+		t.Fatalf("currentUserID without a session store: got %v, want 401", err)
+	}
+}
+
+func TestReceivedReactionCount(t *testing.T) {
+	resetTestDB(t)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	carol := newTestUser(t, "carol")
+	aliceStream1 := newTestLivestream(t, alice.ID, "alice 1", 0, 1)
+	aliceStream2 := newTestLivestream(t, alice.ID, "alice 2", 0, 1)
+	bobStream := newTestLivestream(t, bob.ID, "bob", 0, 1)
+	now := time.Now().Unix()
+	// まとめられたリアクションは件数で数え、表示しないリアクションは数えない
+	newTestReaction(t, ReactionModel{UserID: carol.ID, LivestreamID: aliceStream1, EmojiName: "tada", CreatedAt: now, Count: 3})
+	newTestReaction(t, ReactionModel{UserID: bob.ID, LivestreamID: aliceStream2, EmojiName: "tada", CreatedAt: now, Count: 2})
+	newTestReaction(t, ReactionModel{UserID: bob.ID, LivestreamID: aliceStream2, EmojiName: "tada", CreatedAt: now, Hidden: true})
+	newTestReaction(t, ReactionModel{UserID: alice.ID, LivestreamID: bobStream, EmojiName: "tada", CreatedAt: now})
+	want := map[int64]int64{alice.ID: 5, bob.ID: 1, carol.ID: 0}
+
+	// 一度の呼び出しで複数のユーザ分をまとめて数える
+	tx, err := dbConn.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	users, err := fillUserResponsesWithOptions(context.Background(), tx, []int64{alice.ID, bob.ID, carol.ID}, userFillOptions{ReceivedReactionCount: true})
+	if err != nil {
+		t.Fatalf("fillUserResponsesWithOptions: %v", err)
+	}
+	for id, count := range want {
+		if got := users[id].ReceivedReactionCount; got == nil || *got != count {
+			t.Fatalf("user %d: got received_reaction_count %v, want %d", id, got, count)
+		}
+	}
+
+	for _, user := range []testUser{alice, bob, carol} {
+		var got User
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/"+user.Name+"?include=received_reaction_count", alice.Cookie, nil), http.StatusOK, &got)
+		if got.ReceivedReactionCount == nil || *got.ReceivedReactionCount != want[user.ID] {
+			t.Fatalf("%s: got received_reaction_count %v, want %d", user.Name, got.ReceivedReactionCount, want[user.ID])
+		}
+	}
+	// 指定しなければ含めない
+	var got User
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/alice", alice.Cookie, nil), http.StatusOK, &got)
+	if got.ReceivedReactionCount != nil {
+		t.Fatalf("received_reaction_count included without include: %v", *got.ReceivedReactionCount)
+	}
+}
+
+func TestIconETag(t *testing.T) {
+	resetTestDB(t)
+	user := newTestUser(t, "user")
+	icon := newTestPNG(t, 8, 8)
+	rec := doTestRequest(t, http.MethodPost, "/api/icon", user.Cookie, &PostIconRequest{Image: icon})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("post icon: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for _, path := range []string{"/api/user/user/icon", "/api/user/user/icon?size=thumb"} {
+		first := doTestRequest(t, http.MethodGet, path, "", nil)
+		if first.Code != http.StatusOK || first.Body.Len() == 0 {
+			t.Fatalf("%s: got status %d with %d bytes, want 200 with the image", path, first.Code, first.Body.Len())
+		}
+		etag := first.Header().Get("ETag")
+		if !strings.Contains(etag, hashIcon(icon)) {
+			t.Fatalf("%s: ETag = %q, want it to contain the icon hash %q", path, etag, hashIcon(icon))
+		}
+
+		cached := doTestRequest(t, http.MethodGet, path, "", nil, "If-None-Match: "+etag)
+		if cached.Code != http.StatusNotModified || cached.Body.Len() != 0 {
+			t.Fatalf("%s: got status %d with %d bytes, want 304 with no body", path, cached.Code, cached.Body.Len())
+		}
+		// 古いアイコンのタグでは、新しい画像を返す
+		stale := doTestRequest(t, http.MethodGet, path, "", nil, `If-None-Match: "`+hashIcon([]byte("old icon"))+`"`)
+		if stale.Code != http.StatusOK {
+			t.Fatalf("%s: stale If-None-Match got status %d, want 200", path, stale.Code)
+		}
+	}
+
+	// 元の画像とサムネイルはタグで見分ける
+	full := doTestRequest(t, http.MethodGet, "/api/user/user/icon", "", nil).Header().Get("ETag")
+	rec = doTestRequest(t, http.MethodGet, "/api/user/user/icon?size=thumb", "", nil, "If-None-Match: "+full)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("thumbnail with the full image ETag: got status %d, want 200", rec.Code)
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	resetTestDB(t)
+	user := newTestUser(t, "user")
+	other := newTestUser(t, "other")
+	now := time.Now().Unix()
+	livestreamID := newTestLivestream(t, other.ID, "stream", now-3600, now+3600)
+	newTestReaction(t, ReactionModel{UserID: user.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+
+	// 更新前にリアクションを取得して、ユーザ情報をキャッシュに載せておく
+	if reactions := getTestReactions(t, other, livestreamID, ""); len(reactions) != 1 || reactions[0].User.DisplayName != "user" {
+		t.Fatalf("got reactions %+v, want one by user", reactions)
+	}
+
+	displayName, description := "new name", "new description"
+	rec := doTestRequest(t, http.MethodPatch, "/api/user/user", user.Cookie, &PatchUserRequest{DisplayName: &displayName, Description: &description})
+	var updated User
+	decodeTestResponse(t, rec, http.StatusOK, &updated)
+	if updated.DisplayName != displayName || updated.Description != description {
+		t.Fatalf("got %+v, want display_name %q and description %q", updated, displayName, description)
+	}
+
+	// キャッシュが捨てられ、リアクションに埋め込まれたユーザ情報も変わる
+	if reactions := getTestReactions(t, other, livestreamID, ""); reactions[0].User.DisplayName != displayName || reactions[0].User.Description != description {
+		t.Fatalf("embedded user = %+v, want the updated profile", reactions[0].User)
+	}
+
+	tooLong := strings.Repeat("あ", maxDescriptionLength+1)
+	for _, tc := range []struct {
+		name   string
+		user   testUser
+		path   string
+		req    *PatchUserRequest
+		status int
+	}{
+		{name: "too long description", user: user, path: "/api/user/user", req: &PatchUserRequest{Description: &tooLong}, status: http.StatusBadRequest},
+		{name: "other user", user: other, path: "/api/user/user", req: &PatchUserRequest{DisplayName: &displayName}, status: http.StatusForbidden},
+		{name: "unknown user", user: user, path: "/api/user/nobody", req: &PatchUserRequest{DisplayName: &displayName}, status: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doTestRequest(t, http.MethodPatch, tc.path, tc.user.Cookie, tc.req)
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+		})
+	}
+
+	// 弾かれた更新はプロフィールを変えない
+	var got User
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/user", other.Cookie, nil), http.StatusOK, &got)
+	if got.DisplayName != displayName || got.Description != description {
+		t.Fatalf("got %+v after rejected updates, want the first update", got)
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	resetTestDB(t)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+
+	// 指定した順に返し、重複と存在しないユーザは除く
+	rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/users?ids=%d,%d,9999,%d", bob.ID, alice.ID, bob.ID), alice.Cookie, nil)
+	var users []User
+	decodeTestResponse(t, rec, http.StatusOK, &users)
+	if len(users) != 2 || users[0].ID != bob.ID || users[1].ID != alice.ID {
+		t.Fatalf("got %+v, want bob then alice", users)
+	}
+	if users[0].Name != "bob" || users[0].DisplayName != "bob" || users[0].Theme.ID == 0 {
+		t.Fatalf("got %+v, want bob with display name and theme", users[0])
+	}
+
+	var empty []User
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/users", alice.Cookie, nil), http.StatusOK, &empty)
+	if len(empty) != 0 {
+		t.Fatalf("got %+v without ids, want no users", empty)
+	}
+
+	overCap := make([]string, maxBulkUserIDs+1)
+	for i := range overCap {
+		overCap[i] = fmt.Sprint(i + 1)
+	}
+	for _, tc := range []struct {
+		name string
+		ids  string
+	}{
+		{name: "over the cap", ids: strings.Join(overCap, ",")},
+		{name: "non-integer id", ids: fmt.Sprintf("%d,abc", alice.ID)},
+		{name: "empty id", ids: fmt.Sprintf("%d,", alice.ID)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doTestRequest(t, http.MethodGet, "/api/users?ids="+tc.ids, alice.Cookie, nil)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestPatchUserIfMatch(t *testing.T) {
+	resetTestDB(t)
+	user := newTestUser(t, "user")
+
+	rec := doTestRequest(t, http.MethodGet, "/api/user/user", user.Cookie, nil)
+	decodeTestResponse(t, rec, http.StatusOK, nil)
+	stale := rec.Header().Get("ETag")
+	if stale == "" {
+		t.Fatalf("no ETag on the profile")
+	}
+
+	// 取得したときのバージョンを指定すれば更新でき、バージョンが上がる
+	first, second := "first", "second"
+	rec = doTestRequest(t, http.MethodPatch, "/api/user/user", user.Cookie, &PatchUserRequest{DisplayName: &first}, "If-Match: "+stale)
+	decodeTestResponse(t, rec, http.StatusOK, nil)
+	current := rec.Header().Get("ETag")
+	if current == "" || current == stale {
+		t.Fatalf("ETag after update = %q, want a new version other than %q", current, stale)
+	}
+
+	// 別のタブが古いバージョンのまま更新しようとすると、上書きしない
+	rec = doTestRequest(t, http.MethodPatch, "/api/user/user", user.Cookie, &PatchUserRequest{DisplayName: &second}, "If-Match: "+stale)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("stale If-Match: status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	var got User
+	decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/user", user.Cookie, nil), http.StatusOK, &got)
+	if got.DisplayName != first {
+		t.Fatalf("display_name = %q after a stale update, want %q", got.DisplayName, first)
+	}
+
+	for _, tc := range []struct {
+		ifMatch string
+		status  int
+	}{
+		// 強い比較なので、弱いタグは同じバージョンでも一致しない
+		{ifMatch: "W/" + current, status: http.StatusConflict},
+		{ifMatch: current, status: http.StatusOK},
+		{ifMatch: "*", status: http.StatusOK},
+		{ifMatch: "", status: http.StatusOK},
+		{ifMatch: `"abc"`, status: http.StatusBadRequest},
+	} {
+		var header []string
+		if tc.ifMatch != "" {
+			header = append(header, "If-Match: "+tc.ifMatch)
+		}
+		if rec := doTestRequest(t, http.MethodPatch, "/api/user/user", user.Cookie, &PatchUserRequest{DisplayName: &second}, header...); rec.Code != tc.status {
+			t.Errorf("If-Match %q: status = %d, want %d", tc.ifMatch, rec.Code, tc.status)
+		}
+	}
+}
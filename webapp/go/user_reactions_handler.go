@@ -0,0 +1,87 @@
+package main
+
+// ユーザがすべての配信に投稿したリアクション
+// プロフィールページで、そのユーザがリアクションした配信を一覧にするために使う
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultUserReactionsLimit = 50
+	maxUserReactionsLimit     = 100
+)
+
+// ユーザのリアクション一覧API
+// GET /api/user/:username/reactions?before_id=&limit=
+// 新しい順に返す。2ページ目以降は、前のページの最後のリアクションIDを before_id に指定する
+func getUserReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	viewerID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var beforeID int64
+	if c.QueryParam("before_id") != "" {
+		beforeID, err = strconv.ParseInt(c.QueryParam("before_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before_id query parameter must be integer")
+		}
+	}
+
+	limit := defaultUserReactionsLimit
+	if c.QueryParam("limit") != "" {
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 || limit > maxUserReactionsLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxUserReactionsLimit))
+		}
+	}
+
+	ctx, tx, err := beginReadTxx(ctx, nil)
+	if err != nil {
+		return beginTxError(c, err)
+	}
+	defer tx.Rollback()
+
+	userID, err := getUserIDByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM reactions WHERE user_id = ? AND " + visibleReactionsWhereFor("", viewerID)
+	args := []interface{}{userID}
+	if c.QueryParam("before_id") != "" {
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+
+	// 配信はリアクションごとに違うので、expand=livestream の指定によらず配信の詳細を含める
+	reactions, err := fillReactionResponses(ctx, tx, reactionModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, reactions)
+}
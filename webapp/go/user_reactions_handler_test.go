@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetUserReactions(t *testing.T) {
+	resetTestDB(t)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	fan := newTestUser(t, "fan")
+	now := time.Now().Unix()
+	livestreamIDs := []int64{
+		newTestLivestream(t, alice.ID, "alice stream", now-3600, now+3600),
+		newTestLivestream(t, bob.ID, "bob stream", now-3600, now+3600),
+	}
+	owners := map[int64]int64{livestreamIDs[0]: alice.ID, livestreamIDs[1]: bob.ID}
+
+	// 2つの配信に交互にリアクションする
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		ids = append(ids, newTestReaction(t, ReactionModel{UserID: fan.ID, LivestreamID: livestreamIDs[i%2], EmojiName: ":tada:", CreatedAt: now + int64(i)}))
+	}
+	// 他のユーザのリアクションは含まない
+	newTestReaction(t, ReactionModel{UserID: alice.ID, LivestreamID: livestreamIDs[1], EmojiName: ":tada:", CreatedAt: now})
+
+	getReactions := func(query string) []Reaction {
+		t.Helper()
+		var reactions []Reaction
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/fan/reactions?"+query, alice.Cookie, nil), http.StatusOK, &reactions)
+		return reactions
+	}
+
+	reactions := getReactions("")
+	if len(reactions) != len(ids) {
+		t.Fatalf("got %d reactions, want %d", len(reactions), len(ids))
+	}
+	for i, reaction := range reactions {
+		// 新しい順
+		want := ids[len(ids)-1-i]
+		wantLivestreamID := livestreamIDs[(len(ids)-1-i)%2]
+		if reaction.ID != want {
+			t.Errorf("reactions[%d].id = %d, want %d", i, reaction.ID, want)
+		}
+		if reaction.User.ID != fan.ID {
+			t.Errorf("reactions[%d].user = %d, want fan %d", i, reaction.User.ID, fan.ID)
+		}
+		if reaction.Livestream.ID != wantLivestreamID || reaction.Livestream.Owner.ID != owners[wantLivestreamID] {
+			t.Errorf("reactions[%d].livestream = %d owned by %d, want %d owned by %d", i, reaction.Livestream.ID, reaction.Livestream.Owner.ID, wantLivestreamID, owners[wantLivestreamID])
+		}
+	}
+
+	// 前のページの最後のIDを before_id に指定して続きを取る
+	page := getReactions("limit=2")
+	if got := []int64{page[0].ID, page[1].ID}; fmt.Sprint(got) != fmt.Sprint([]int64{ids[4], ids[3]}) {
+		t.Fatalf("first page: got %v, want %v", got, []int64{ids[4], ids[3]})
+	}
+	page = getReactions(fmt.Sprintf("limit=2&before_id=%d", page[1].ID))
+	if got := []int64{page[0].ID, page[1].ID}; fmt.Sprint(got) != fmt.Sprint([]int64{ids[2], ids[1]}) {
+		t.Fatalf("second page: got %v, want %v", got, []int64{ids[2], ids[1]})
+	}
+
+	// 配信はまとめて引くので、リアクションや配信の数によらずクエリの回数は変わらない
+	queries := func(limit int) string {
+		t.Helper()
+		rec := doTestRequest(t, http.MethodGet, fmt.Sprintf("/api/user/fan/reactions?limit=%d", limit), alice.Cookie, nil, debugHeader+": 1")
+		decodeTestResponse(t, rec, http.StatusOK, nil)
+		return rec.Header().Get(dbQueriesHeader)
+	}
+	if one, all := queries(1), queries(len(ids)); one != all {
+		t.Errorf("%s = %s for one reaction but %s for %d reactions", dbQueriesHeader, one, all, len(ids))
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{path: "/api/user/fan/reactions?limit=0", status: http.StatusBadRequest},
+		{path: fmt.Sprintf("/api/user/fan/reactions?limit=%d", maxUserReactionsLimit+1), status: http.StatusBadRequest},
+		{path: "/api/user/fan/reactions?before_id=abc", status: http.StatusBadRequest},
+		{path: "/api/user/nobody/reactions", status: http.StatusNotFound},
+	} {
+		if rec := doTestRequest(t, http.MethodGet, tc.path, alice.Cookie, nil); rec.Code != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.path, rec.Code, tc.status)
+		}
+	}
+}
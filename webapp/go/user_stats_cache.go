@@ -0,0 +1,87 @@
+package main
+
+// ユーザ統計情報のキャッシュ
+// 統計情報は全ユーザのリアクションと投げ銭を集計するので、人気のユーザのページが開かれるたびに計算すると重い
+// ランクは他のユーザへの投稿でも変わり、ユーザごとに正しく捨てることができないので、短い期間で期限切れにする
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// 集計した統計情報を使い回す期間。この間に投稿されたリアクションや投げ銭は反映されない
+const userStatisticsCacheTTL = time.Second
+
+var userStatisticsCache = newUserStatisticsTTLCache(userStatisticsCacheTTL)
+
+type userStatisticsCacheEntry struct {
+	stats     UserStatistics
+	expiresAt time.Time
+}
+
+type userStatisticsTTLCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]userStatisticsCacheEntry
+	// reset されるたびに増える。初期化前に始まった集計の結果をキャッシュしないために使う
+	generation uint64
+	// 同じユーザの集計が同時に要求された場合は、1回だけ集計して結果を共有する
+	group singleflight.Group
+}
+
+func newUserStatisticsTTLCache(ttl time.Duration) *userStatisticsTTLCache {
+	return &userStatisticsTTLCache{
+		ttl:     ttl,
+		entries: make(map[string]userStatisticsCacheEntry),
+	}
+}
+
+// get はキャッシュされている統計情報を返す。期限が切れていれば compute で集計し直す
+// 集計は待っているすべてのリクエストで共有するので、最初のリクエストが切断されても止めない
+func (c *userStatisticsTTLCache) get(ctx context.Context, username string, now time.Time, compute func(context.Context, string) (UserStatistics, error)) (UserStatistics, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[username]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.stats, nil
+	}
+
+	v, err, _ := c.group.Do(username, func() (interface{}, error) {
+		stats, err := compute(context.WithoutCancel(ctx), username)
+		if err != nil {
+			return UserStatistics{}, err
+		}
+		c.put(username, stats, generation, time.Now())
+		return stats, nil
+	})
+	if err != nil {
+		return UserStatistics{}, err
+	}
+	return v.(UserStatistics), nil
+}
+
+func (c *userStatisticsTTLCache) put(username string, stats UserStatistics, generation uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	// 期限切れのものはここで捨てて、キャッシュが増え続けないようにする
+	for name, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, name)
+		}
+	}
+	c.entries[username] = userStatisticsCacheEntry{stats: stats, expiresAt: now.Add(c.ttl)}
+}
+
+func (c *userStatisticsTTLCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[string]userStatisticsCacheEntry)
+}
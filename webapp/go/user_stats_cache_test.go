@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUserStatisticsCacheTTL(t *testing.T) {
+	cache := newUserStatisticsTTLCache(time.Minute)
+	var calls atomic.Int64
+	compute := func(ctx context.Context, username string) (UserStatistics, error) {
+		return UserStatistics{TotalReactions: calls.Add(1)}, nil
+	}
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		stats, err := cache.get(context.Background(), "user", now.Add(time.Duration(i)*time.Second), compute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TotalReactions != 1 {
+			t.Fatalf("call %d: total_reactions = %d, want the cached 1", i, stats.TotalReactions)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("computed %d times within the TTL, want 1", got)
+	}
+
+	// 期限が切れたら集計し直す
+	stats, err := cache.get(context.Background(), "user", now.Add(2*time.Minute), compute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalReactions != 2 {
+		t.Fatalf("after the TTL: total_reactions = %d, want 2", stats.TotalReactions)
+	}
+}
+
+func TestUserStatisticsCacheSingleflight(t *testing.T) {
+	cache := newUserStatisticsTTLCache(time.Minute)
+	var calls atomic.Int64
+	release := make(chan struct{})
+	compute := func(ctx context.Context, username string) (UserStatistics, error) {
+		calls.Add(1)
+		<-release
+		return UserStatistics{TotalReactions: 7}, nil
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats, err := cache.get(context.Background(), "user", time.Now(), compute)
+			if err == nil && stats.TotalReactions != 7 {
+				t.Errorf("total_reactions = %d, want 7", stats.TotalReactions)
+			}
+			errs <- err
+		}()
+	}
+	// 全員が集計を待つまで少し待ってから終わらせる
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("computed %d times for concurrent requests, want 1", got)
+	}
+}
+
+func TestUserStatisticsCacheReset(t *testing.T) {
+	cache := newUserStatisticsTTLCache(time.Minute)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.get(context.Background(), "user", time.Now(), func(ctx context.Context, username string) (UserStatistics, error) {
+			close(started)
+			<-release
+			return UserStatistics{TotalReactions: 1}, nil
+		})
+	}()
+
+	// 集計の途中で初期化されたら、その結果はキャッシュしない
+	<-started
+	cache.reset()
+	close(release)
+	<-done
+
+	stats, err := cache.get(context.Background(), "user", time.Now(), func(ctx context.Context, username string) (UserStatistics, error) {
+		return UserStatistics{TotalReactions: 2}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalReactions != 2 {
+		t.Fatalf("total_reactions = %d, want 2 computed after reset", stats.TotalReactions)
+	}
+}
+
+func TestGetUserStatisticsCached(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	viewer := newTestUser(t, "viewer")
+	now := time.Now().Unix()
+	livestreamID := newTestLivestream(t, owner.ID, "stream", now-3600, now+3600)
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+
+	getStats := func() UserStatistics {
+		t.Helper()
+		var stats UserStatistics
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/user/owner/statistics", viewer.Cookie, nil), http.StatusOK, &stats)
+		return stats
+	}
+
+	if stats := getStats(); stats.TotalReactions != 1 {
+		t.Fatalf("total_reactions = %d, want 1", stats.TotalReactions)
+	}
+
+	// TTL の間は集計し直さないので、増えたリアクションは反映されない
+	newTestReaction(t, ReactionModel{UserID: viewer.ID, LivestreamID: livestreamID, EmojiName: ":tada:", CreatedAt: now})
+	if stats := getStats(); stats.TotalReactions != 1 {
+		t.Fatalf("within the TTL: total_reactions = %d, want the cached 1", stats.TotalReactions)
+	}
+
+	userStatisticsCache.reset()
+	if stats := getStats(); stats.TotalReactions != 2 {
+		t.Fatalf("after reset: total_reactions = %d, want 2", stats.TotalReactions)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+// ユーザごとに送ったチップの合計を user_tip_totals に持っておく
+// ライブコメントを投稿・削除するトランザクションの中で増減させ、チップの合計を返すときに livecomments を全件集計しなくて済むようにする
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// addUserTipTotal はユーザが送ったチップの合計に tip を足す。負の値を渡すと引く
+func addUserTipTotal(ctx context.Context, tx *sqlx.Tx, userID int64, tip int64) error {
+	if tip == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_tip_totals (user_id, total_tip) VALUES (?, ?) ON DUPLICATE KEY UPDATE total_tip = total_tip + VALUES(total_tip)", userID, tip); err != nil {
+		return fmt.Errorf("failed to update user tip total: %w", err)
+	}
+	return nil
+}
+
+// sumUserTipTotals は全ユーザが送ったチップの合計を返す
+func sumUserTipTotals(ctx context.Context, tx *sqlx.Tx) (int64, error) {
+	var total int64
+	if err := tx.GetContext(ctx, &total, "SELECT IFNULL(SUM(total_tip), 0) FROM user_tip_totals"); err != nil {
+		return 0, fmt.Errorf("failed to sum user tip totals: %w", err)
+	}
+	return total, nil
+}
+
+// recomputeUserTipTotals は livecomments から user_tip_totals を作り直す
+// 初期データは livecomments に直接入るため、initializeHandler から呼ぶ
+func recomputeUserTipTotals(ctx context.Context, db *sqlx.DB) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_tip_totals"); err != nil {
+		return fmt.Errorf("failed to delete user tip totals: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_tip_totals (user_id, total_tip) SELECT user_id, SUM(tip) FROM livecomments WHERE tip > 0 GROUP BY user_id"); err != nil {
+		return fmt.Errorf("failed to insert user tip totals: %w", err)
+	}
+
+	return tx.Commit()
+}
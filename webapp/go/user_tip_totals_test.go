@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserTipTotals(t *testing.T) {
+	resetTestDB(t)
+	owner := newTestUser(t, "owner")
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	now := time.Now().Unix()
+	livestreamID := newTestLivestream(t, owner.ID, "stream", now-3600, now+3600)
+
+	tipTotal := func(user testUser) int64 {
+		t.Helper()
+		return countTestRows(t, "SELECT IFNULL(SUM(total_tip), 0) FROM user_tip_totals WHERE user_id = ?", user.ID)
+	}
+	payment := func() int64 {
+		t.Helper()
+		var result PaymentResult
+		decodeTestResponse(t, doTestRequest(t, http.MethodGet, "/api/payment", "", nil), http.StatusOK, &result)
+		return result.TotalTip
+	}
+
+	for _, tc := range []struct {
+		user    testUser
+		comment string
+		tip     int64
+	}{
+		{user: alice, comment: "first tip", tip: 100},
+		{user: alice, comment: "second tip", tip: 50},
+		{user: bob, comment: "bad tip", tip: 30},
+		{user: bob, comment: "no tip", tip: 0},
+	} {
+		rec := doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/livecomment", livestreamID), tc.user.Cookie, &PostLivecommentRequest{Comment: tc.comment, Tip: tc.tip})
+		decodeTestResponse(t, rec, http.StatusCreated, nil)
+	}
+	if got := tipTotal(alice); got != 150 {
+		t.Fatalf("alice: total_tip = %d, want 150", got)
+	}
+	if got := tipTotal(bob); got != 30 {
+		t.Fatalf("bob: total_tip = %d, want 30", got)
+	}
+	if got := payment(); got != 180 {
+		t.Fatalf("payment: total_tip = %d, want 180", got)
+	}
+
+	// NGワードで削除したライブコメントのチップは合計から引く
+	rec := doTestRequest(t, http.MethodPost, fmt.Sprintf("/api/livestream/%d/moderate", livestreamID), owner.Cookie, &ModerateRequest{NGWord: "bad"})
+	decodeTestResponse(t, rec, http.StatusCreated, nil)
+	if got := tipTotal(bob); got != 0 {
+		t.Fatalf("bob after moderation: total_tip = %d, want 0", got)
+	}
+	if got := payment(); got != 150 {
+		t.Fatalf("payment after moderation: total_tip = %d, want 150", got)
+	}
+
+	// 直接入れたライブコメントは、作り直すまで合計に入らない
+	newTestLivecomment(t, bob.ID, livestreamID, "seeded tip", 500)
+	if got := payment(); got != 150 {
+		t.Fatalf("payment before recompute: total_tip = %d, want 150", got)
+	}
+	if err := recomputeUserTipTotals(context.Background(), dbConn); err != nil {
+		t.Fatalf("recomputeUserTipTotals: %v", err)
+	}
+	if got := tipTotal(bob); got != 500 {
+		t.Fatalf("bob after recompute: total_tip = %d, want 500", got)
+	}
+	if got := payment(); got != 650 {
+		t.Fatalf("payment after recompute: total_tip = %d, want 650", got)
+	}
+}
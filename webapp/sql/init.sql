@@ -2,6 +2,7 @@ TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
 TRUNCATE TABLE reservation_slots;
 TRUNCATE TABLE livestream_viewers_history;
+TRUNCATE TABLE livestream_viewers;
 TRUNCATE TABLE livecomment_reports;
 TRUNCATE TABLE ng_words;
 TRUNCATE TABLE reactions;
@@ -10,7 +11,15 @@ TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
-TRUNCATE TABLE icon_hashes;
+TRUNCATE TABLE reaction_settings;
+TRUNCATE TABLE follows;
+TRUNCATE TABLE livestream_stats;
+TRUNCATE TABLE reaction_batch_items;
+TRUNCATE TABLE reaction_idempotency_keys;
+TRUNCATE TABLE reaction_moderation_log;
+TRUNCATE TABLE reaction_shadow_bans;
+TRUNCATE TABLE reaction_view_cursors;
+TRUNCATE TABLE user_tip_totals;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
@@ -24,3 +33,5 @@ ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
 ALTER TABLE `users` auto_increment = 1;
+ALTER TABLE `follows` auto_increment = 1;
+ALTER TABLE `reaction_moderation_log` auto_increment = 1;
@@ -7,6 +7,10 @@ CREATE TABLE `users` (
   `display_name` VARCHAR(255) NOT NULL,
   `password` VARCHAR(255) NOT NULL,
   `description` TEXT NOT NULL,
+  -- 登録日時。初期データのユーザは 0
+  `created_at` BIGINT NOT NULL DEFAULT 0,
+  -- プロフィールを更新するたびに増やす。更新の競合の検出に使う
+  `version` BIGINT NOT NULL DEFAULT 0,
   UNIQUE `uniq_user_name` (`name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
@@ -14,14 +18,20 @@ CREATE TABLE `users` (
 CREATE TABLE `icons` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
-  `image` LONGBLOB NOT NULL
+  `image` LONGBLOB NOT NULL,
+  -- image の sha256 (16進数)。アップロード時に計算して保存する
+  `image_hash` VARCHAR(64) NOT NULL DEFAULT '',
+  -- 一覧向けに縮小した PNG。初期データのアイコンでは NULL
+  `thumbnail` MEDIUMBLOB NULL DEFAULT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ユーザごとのカスタムテーマ
 CREATE TABLE `themes` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
-  `dark_mode` BOOLEAN NOT NULL
+  `dark_mode` BOOLEAN NOT NULL,
+  -- テーマを更新するたびに増やす。更新の競合の検出に使う
+  `version` BIGINT NOT NULL DEFAULT 0
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信
@@ -66,6 +76,14 @@ CREATE TABLE `livestream_viewers_history` (
   `created_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- ライブ配信を視聴中のユーザ
+CREATE TABLE `livestream_viewers` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブ配信に対するライブコメント
 CREATE TABLE `livecomments` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -73,7 +91,9 @@ CREATE TABLE `livecomments` (
   `livestream_id` BIGINT NOT NULL,
   `comment` VARCHAR(255) NOT NULL,
   `tip` BIGINT NOT NULL DEFAULT 0,
-  `created_at` BIGINT NOT NULL
+  `created_at` BIGINT NOT NULL,
+  -- スパムとして報告したユーザの人数
+  `report_count` INT NOT NULL DEFAULT 0
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ユーザからのライブコメントのスパム報告
@@ -102,21 +122,134 @@ CREATE TABLE `reactions` (
   `livestream_id` BIGINT NOT NULL,
   -- :innocent:, :tada:, etc...
   `emoji_name` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  -- ボットトークンから投稿されたリアクションかどうか
+  `is_bot` BOOLEAN NOT NULL DEFAULT FALSE,
+  -- 長押しによる強さ (1〜5)
+  `intensity` TINYINT NOT NULL DEFAULT 1,
+  -- 短時間に連打された同じリアクションをまとめた件数
+  `count` INT NOT NULL DEFAULT 1,
+  -- 承認待ち (モデレーション対象の絵文字)
+  `pending` BOOLEAN NOT NULL DEFAULT FALSE,
+  -- 配信者によって非表示にされたかどうか
+  `hidden` BOOLEAN NOT NULL DEFAULT FALSE,
+  -- 削除日時。0 の場合は削除されていない
+  `deleted_at` BIGINT NOT NULL DEFAULT 0,
+  -- リアクション先のライブコメント。配信そのものへのリアクションの場合は NULL
+  `livecomment_id` BIGINT NULL DEFAULT NULL,
+  -- シャドウバンされたユーザによる投稿。本人以外には見せない
+  `shadow` BOOLEAN NOT NULL DEFAULT FALSE
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- リアクションに使える絵文字の表示用の情報
+CREATE TABLE `emoji_catalog` (
+  -- :tada: なら tada
+  `name` VARCHAR(255) NOT NULL PRIMARY KEY,
+  -- 表示に使う画像のパス
+  `image_path` VARCHAR(255) NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信ごとのリアクション設定
+CREATE TABLE `reaction_settings` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `cooldown_seconds` BIGINT NOT NULL DEFAULT 0,
+  -- カンマ区切りの絵文字名。空の場合はすべて許可
+  `allowed_emojis` TEXT NOT NULL,
+  `followers_only` BOOLEAN NOT NULL DEFAULT FALSE,
+  `allow_owner_reactions` BOOLEAN NOT NULL DEFAULT TRUE,
+  -- カンマ区切りの絵文字名。配信者の承認が必要
+  `moderated_emojis` TEXT NOT NULL,
+  -- 登録からこの秒数が経っていないユーザのリアクションを受け付けない。0 の場合は制限しない
+  `min_account_age_seconds` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 一括投稿で保存済みのリアクション。再送されたバッチを二重に保存しないために使う
+CREATE TABLE `reaction_batch_items` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `batch_id` VARCHAR(255) NOT NULL,
+  -- バッチ内での位置
+  `item_index` INT NOT NULL,
+  `reaction_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `livestream_id`, `batch_id`, `item_index`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- Idempotency-Key 付きで投稿されたリアクション。再送された投稿を二重に保存しないために使う
+CREATE TABLE `reaction_idempotency_keys` (
+  `user_id` BIGINT NOT NULL,
+  `idempotency_key` VARCHAR(255) NOT NULL,
+  `reaction_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `idempotency_key`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者によるリアクションのモデレーション操作の履歴
+CREATE TABLE `reaction_moderation_log` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  -- 操作したユーザ
+  `actor_id` BIGINT NOT NULL,
+  -- approve, delete, hide, etc...
+  `action` VARCHAR(32) NOT NULL,
+  `reaction_id` BIGINT NOT NULL,
   `created_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
--- アイコンのハッシュ値を保存するテーブル
-CREATE TABLE `icon_hashes` (
-  `icon_id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
-  `hash` VARCHAR(64) NOT NULL
+-- 配信者にリアクションをシャドウバンされたユーザ
+CREATE TABLE `reaction_shadow_bans` (
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザが配信のリアクションを最後に見た位置
+CREATE TABLE `reaction_view_cursors` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  -- 最後に見たときの、最も新しいリアクションのID
+  `last_reaction_id` BIGINT NOT NULL,
+  `last_viewed_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザ間のフォロー関係
+CREATE TABLE `follows` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `follower_id` BIGINT NOT NULL,
+  `followee_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_follower_id_followee_id` (`follower_id`, `followee_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 再起動をまたいで引き継ぐ、メモリ上で集計している配信ごとの値
+CREATE TABLE `livestream_stats` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `peak_reaction_rate` DOUBLE NOT NULL DEFAULT 0,
+  `heat` DOUBLE NOT NULL DEFAULT 0,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザごとに送ったチップの合計。livecomments の tip を集計した値
+CREATE TABLE `user_tip_totals` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `total_tip` BIGINT NOT NULL DEFAULT 0
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+ALTER TABLE `livestreams` ADD INDEX `user_id_idx` (`user_id`);
 ALTER TABLE `reactions` ADD INDEX `livestream_id_idx` (`livestream_id`);
 ALTER TABLE `livestream_viewers_history` ADD INDEX `livestream_id_idx` (`livestream_id`);
+ALTER TABLE `livestream_viewers` ADD INDEX `livestream_id_idx` (`livestream_id`);
 ALTER TABLE `livecomments` ADD INDEX `livestream_id_idx` (`livestream_id`);
+ALTER TABLE `livecomments` ADD INDEX `user_id_livestream_id_idx` (`user_id`, `livestream_id`);
 ALTER TABLE `livecomment_reports` ADD INDEX `livestream_id_idx` (`livestream_id`);
 ALTER TABLE `icons` ADD INDEX `user_id_idx` (`user_id`);
 ALTER TABLE `ng_words` ADD INDEX `user_id_livestream_id_idx` (`user_id`, `livestream_id`);
 ALTER TABLE `ng_words` ADD INDEX `livestream_id_idx` (`livestream_id`);
-ALTER TABLE `icon_hashes` ADD INDEX `hash_id_idx` (`hash`);
 ALTER TABLE `livestream_tags` ADD INDEX `livestream_id_idx` (`livestream_id`);
+ALTER TABLE `follows` ADD INDEX `followee_id_idx` (`followee_id`);
+ALTER TABLE `reactions` ADD INDEX `user_id_livestream_id_idx` (`user_id`, `livestream_id`);
+ALTER TABLE `reactions` ADD INDEX `livecomment_id_idx` (`livecomment_id`);
+ALTER TABLE `reaction_batch_items` ADD INDEX `created_at_idx` (`created_at`);
+ALTER TABLE `reaction_moderation_log` ADD INDEX `livestream_id_idx` (`livestream_id`);
@@ -0,0 +1,6 @@
+-- 稼働中のDBで、アイコンのハッシュ値を icon_hashes から icons.image_hash に移す
+-- SHA2(image, 256) は Go の sha256 を16進数にしたものと同じ値になる
+
+ALTER TABLE `icons` ADD COLUMN `image_hash` VARCHAR(64) NOT NULL DEFAULT '';
+UPDATE `icons` SET `image_hash` = SHA2(`image`, 256);
+DROP TABLE IF EXISTS `icon_hashes`;
@@ -0,0 +1,4 @@
+-- 稼働中のDBに、アイコンのサムネイルを保存するカラムを追加する
+-- 既存のアイコンは NULL のままで、サムネイルを要求されたときは元の画像を返す
+
+ALTER TABLE `icons` ADD COLUMN `thumbnail` MEDIUMBLOB NULL DEFAULT NULL;
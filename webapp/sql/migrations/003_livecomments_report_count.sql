@@ -0,0 +1,4 @@
+-- 稼働中のDBで、ライブコメントを報告したユーザの人数を livecomments に持たせる
+
+ALTER TABLE `livecomments` ADD COLUMN `report_count` INT NOT NULL DEFAULT 0;
+UPDATE `livecomments` l SET `report_count` = (SELECT COUNT(DISTINCT r.user_id) FROM `livecomment_reports` r WHERE r.livecomment_id = l.id);
@@ -0,0 +1,3 @@
+-- 稼働中のDBに、ユーザが配信に直前に投稿したライブコメントを引くためのインデックスを追加する
+
+ALTER TABLE `livecomments` ADD INDEX `user_id_livestream_id_idx` (`user_id`, `livestream_id`);
@@ -0,0 +1,7 @@
+-- 稼働中のDBに、ユーザごとに送ったチップの合計を持つテーブルを追加する
+
+CREATE TABLE `user_tip_totals` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `total_tip` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+INSERT INTO `user_tip_totals` (`user_id`, `total_tip`) SELECT `user_id`, SUM(`tip`) FROM `livecomments` WHERE `tip` > 0 GROUP BY `user_id`;
@@ -0,0 +1,4 @@
+-- 稼働中のDBに、プロフィールとテーマの更新の競合を検出するためのバージョンを追加する
+
+ALTER TABLE `users` ADD COLUMN `version` BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE `themes` ADD COLUMN `version` BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- 稼働中のDBに、長押しによるリアクションの強さ (1〜5) を追加する
+-- 既存のリアクションは強さ 1 として扱う
+
+ALTER TABLE `reactions` ADD COLUMN `intensity` TINYINT NOT NULL DEFAULT 1;
@@ -0,0 +1,3 @@
+-- 稼働中のDBに、ボットトークンから投稿されたリアクションかどうかを追加する
+
+ALTER TABLE `reactions` ADD COLUMN `is_bot` BOOLEAN NOT NULL DEFAULT FALSE;
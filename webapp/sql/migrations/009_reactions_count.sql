@@ -0,0 +1,4 @@
+-- 稼働中のDBに、短時間に連打された同じリアクションをまとめた件数を追加する
+-- 既存のリアクションは1行で1件
+
+ALTER TABLE `reactions` ADD COLUMN `count` INT NOT NULL DEFAULT 1;
@@ -0,0 +1,13 @@
+-- 稼働中のDBに、配信者によるリアクションのモデレーションのためのカラムと操作の履歴を追加する
+
+ALTER TABLE `reactions` ADD COLUMN `pending` BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE `reactions` ADD COLUMN `hidden` BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE `reaction_moderation_log` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `actor_id` BIGINT NOT NULL,
+  `action` VARCHAR(32) NOT NULL,
+  `reaction_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+ALTER TABLE `reaction_moderation_log` ADD INDEX `livestream_id_idx` (`livestream_id`);
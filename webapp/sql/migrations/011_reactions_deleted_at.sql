@@ -0,0 +1,3 @@
+-- 稼働中のDBに、リアクションを取り消した日時を追加する。0 の場合は取り消されていない
+
+ALTER TABLE `reactions` ADD COLUMN `deleted_at` BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- 稼働中のDBに、リアクション先のライブコメントを追加する
+-- 既存のリアクションは配信そのものへのリアクションなので NULL のまま
+
+ALTER TABLE `reactions` ADD COLUMN `livecomment_id` BIGINT NULL DEFAULT NULL;
+ALTER TABLE `reactions` ADD INDEX `livecomment_id_idx` (`livecomment_id`);
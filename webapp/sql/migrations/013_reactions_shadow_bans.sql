@@ -0,0 +1,9 @@
+-- 稼働中のDBに、リアクションのシャドウバンを追加する
+
+ALTER TABLE `reactions` ADD COLUMN `shadow` BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE `reaction_shadow_bans` (
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
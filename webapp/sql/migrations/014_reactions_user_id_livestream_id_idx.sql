@@ -0,0 +1,3 @@
+-- 稼働中のDBに、ユーザが配信に投稿したリアクションを引くためのインデックスを追加する
+
+ALTER TABLE `reactions` ADD INDEX `user_id_livestream_id_idx` (`user_id`, `livestream_id`);
@@ -0,0 +1,4 @@
+-- 稼働中のDBに、ユーザの登録日時を追加する
+-- 登録日時が分からない既存のユーザは、初期データのユーザと同じく 0 にする
+
+ALTER TABLE `users` ADD COLUMN `created_at` BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,12 @@
+-- 稼働中のDBに、ライブ配信ごとのリアクション設定を追加する
+-- 設定のない配信には既定の設定が適用される
+
+CREATE TABLE `reaction_settings` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `cooldown_seconds` BIGINT NOT NULL DEFAULT 0,
+  `allowed_emojis` TEXT NOT NULL,
+  `followers_only` BOOLEAN NOT NULL DEFAULT FALSE,
+  `allow_owner_reactions` BOOLEAN NOT NULL DEFAULT TRUE,
+  `moderated_emojis` TEXT NOT NULL,
+  `min_account_age_seconds` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,10 @@
+-- 稼働中のDBに、ユーザ間のフォロー関係を追加する
+
+CREATE TABLE `follows` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `follower_id` BIGINT NOT NULL,
+  `followee_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_follower_id_followee_id` (`follower_id`, `followee_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+ALTER TABLE `follows` ADD INDEX `followee_id_idx` (`followee_id`);
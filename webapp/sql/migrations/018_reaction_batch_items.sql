@@ -0,0 +1,12 @@
+-- 稼働中のDBに、一括投稿で保存済みのリアクションを追加する
+
+CREATE TABLE `reaction_batch_items` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `batch_id` VARCHAR(255) NOT NULL,
+  `item_index` INT NOT NULL,
+  `reaction_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `livestream_id`, `batch_id`, `item_index`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+ALTER TABLE `reaction_batch_items` ADD INDEX `created_at_idx` (`created_at`);
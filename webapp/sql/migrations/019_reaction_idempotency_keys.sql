@@ -0,0 +1,9 @@
+-- 稼働中のDBに、Idempotency-Key 付きで投稿されたリアクションを追加する
+
+CREATE TABLE `reaction_idempotency_keys` (
+  `user_id` BIGINT NOT NULL,
+  `idempotency_key` VARCHAR(255) NOT NULL,
+  `reaction_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `idempotency_key`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
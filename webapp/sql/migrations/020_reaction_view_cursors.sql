@@ -0,0 +1,9 @@
+-- 稼働中のDBに、ユーザが配信のリアクションを最後に見た位置を追加する
+
+CREATE TABLE `reaction_view_cursors` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `last_reaction_id` BIGINT NOT NULL,
+  `last_viewed_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,8 @@
+-- 稼働中のDBに、再起動をまたいで引き継ぐ配信ごとの集計値を追加する
+
+CREATE TABLE `livestream_stats` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `peak_reaction_rate` DOUBLE NOT NULL DEFAULT 0,
+  `heat` DOUBLE NOT NULL DEFAULT 0,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,7 @@
+-- 稼働中のDBに、リアクションに使える絵文字の表示用の情報を追加する
+-- 中身は運用で登録する。許可リストとの食い違いは起動時に verifyEmojiCatalog が確かめる
+
+CREATE TABLE `emoji_catalog` (
+  `name` VARCHAR(255) NOT NULL PRIMARY KEY,
+  `image_path` VARCHAR(255) NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,9 @@
+-- 稼働中のDBに、ライブ配信を視聴中のユーザを追加する
+
+CREATE TABLE `livestream_viewers` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+ALTER TABLE `livestream_viewers` ADD INDEX `livestream_id_idx` (`livestream_id`);
@@ -0,0 +1,3 @@
+-- 稼働中のDBに、ユーザの配信を引くためのインデックスを追加する
+
+ALTER TABLE `livestreams` ADD INDEX `user_id_idx` (`user_id`);